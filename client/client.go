@@ -26,16 +26,20 @@ type Client struct {
 // Dial creates a new client for sending IPX frames to the server at the
 // given address.
 func Dial(addr string) (*Client, error) {
-	resolvedAddr, err := net.ResolveUDPAddr("udp4", addr)
-	if err != nil {
-		return nil, err
-	}
-	conn, err := net.DialUDP("udp4", nil, resolvedAddr)
+	return DialContext(context.Background(), addr)
+}
+
+// DialContext is like Dial, but the context bounds the time spent resolving
+// the server's address. Once created, the client is not affected by the
+// context; it remains open until Close is called.
+func DialContext(ctx context.Context, addr string) (*Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp4", addr)
 	if err != nil {
 		return nil, err
 	}
 	c := &Client{
-		conn:   conn,
+		conn:   conn.(*net.UDPConn),
 		rxpipe: pipe.New(),
 	}
 	go c.recvLoop()
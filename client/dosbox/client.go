@@ -7,19 +7,40 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
+	"sync"
 	"time"
 
 	udpclient "github.com/fragglet/ipxbox/client"
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/network/pipe"
+	"github.com/fragglet/ipxbox/server"
 )
 
 const maxConnectAttempts = 5
 
 var (
 	_ = (network.Node)(&client{})
+
+	// connectAttemptInterval is the time to wait for a response before
+	// sending another registration packet.
+	connectAttemptInterval = time.Second
+
+	// ErrDialTimeout is returned by Dial when no response is received
+	// from the server. It also matches os.ErrDeadlineExceeded.
+	ErrDialTimeout = errors.New("timed out waiting for response from server")
+
+	// ErrHandshakeFailed is returned by Dial when an error occurs during
+	// the registration handshake with the server.
+	ErrHandshakeFailed = errors.New("registration handshake failed")
+
+	// ErrServerFull is returned by Dial when the server rejects the
+	// registration because it cannot accept any more clients. A server
+	// indicates this by replying with a registration response that
+	// assigns the null address.
+	ErrServerFull = errors.New("server is full")
 )
 
 type connectFailure struct {
@@ -34,29 +55,107 @@ func (cf *connectFailure) Unwrap() error {
 	return os.ErrDeadlineExceeded
 }
 
+func (cf *connectFailure) Is(target error) bool {
+	return target == ErrDialTimeout
+}
+
+// Config contains optional configuration parameters for a client.
+type Config struct {
+	// If not nil, Filter is invoked for every packet received from the
+	// server. If it returns true, the packet is discarded instead of
+	// being delivered to the application. filter.IsNetBIOS can be used
+	// here to apply the same rules as the server-side filter.
+	Filter func(*ipx.Packet) bool
+
+	// If non-zero, received packets are held in a jitter buffer for up
+	// to this long before being delivered to the application, to smooth
+	// out variation in packet arrival times.
+	JitterDelay time.Duration
+
+	// If not empty, registration packets are authenticated using this
+	// shared secret, as required by servers that have one configured.
+	// See server.SignRegistration.
+	SharedSecret []byte
+
+	// If true, connect over TCP instead of UDP, for servers that accept
+	// TCP connections (see server.TCPServer).
+	TCP bool
+
+	// If non-zero, the client reconnects to the server if the connection
+	// is lost, or if nothing is received from the server for this long.
+	// Servers send keepalive pings to idle clients (every five seconds
+	// for ipxbox), so this should be several times longer than that.
+	// The server may assign a different address on reconnecting; if so,
+	// the client translates between the two so that the application
+	// continues to see the address that was first assigned.
+	ReconnectTimeout time.Duration
+
+	// If not nil, OnStateChange is called when the client loses its
+	// connection to the server (with connected=false) and when it has
+	// reconnected (with connected=true), so that the application can
+	// pause sending packets in between. It is only called if
+	// ReconnectTimeout is set.
+	OnStateChange func(connected bool)
+}
+
 type client struct {
-	inner  ipx.ReadWriteCloser
-	rxpipe ipx.ReadWriteCloser
-	addr   ipx.Addr
+	config     Config
+	serverAddr string
+	rxpipe     ipx.ReadWriteCloser
+	cancel     context.CancelFunc
+
+	mu    sync.Mutex
+	inner ipx.ReadWriteCloser
+	// addr is the address assigned by the server for the current
+	// connection, while appAddr is the address that was assigned when
+	// first connecting, which is the one the application sees. They
+	// only differ after reconnecting.
+	addr, appAddr ipx.Addr
+	closed        bool
 }
 
 func (c *client) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 	return c.rxpipe.ReadPacket(ctx)
 }
 
+// connection returns the current connection to the server, the address
+// assigned for it, and the address seen by the application.
+func (c *client) connection() (inner ipx.ReadWriteCloser, addr, appAddr ipx.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	appAddr = c.appAddr
+	if appAddr == ipx.AddrNull {
+		appAddr = c.addr
+	}
+	return c.inner, c.addr, appAddr
+}
+
 func (c *client) WritePacket(packet *ipx.Packet) error {
-	return c.inner.WritePacket(packet)
+	inner, addr, appAddr := c.connection()
+	if addr != appAddr && packet.Header.Src.Addr == appAddr {
+		packetCopy := *packet
+		packetCopy.Header.Src.Addr = addr
+		packet = &packetCopy
+	}
+	return inner.WritePacket(packet)
 }
 
 func (c *client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	inner := c.inner
+	c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
 	c.rxpipe.Close()
-	return c.inner.Close()
+	return inner.Close()
 }
 
 func (c *client) GetProperty(x interface{}) bool {
 	switch x.(type) {
 	case *ipx.Addr:
-		*x.(*ipx.Addr) = c.addr
+		_, _, *x.(*ipx.Addr) = c.connection()
 		return true
 	default:
 		return false
@@ -64,28 +163,104 @@ func (c *client) GetProperty(x interface{}) bool {
 }
 
 func (c *client) sendPingReply(addr *ipx.Addr) {
-	c.inner.WritePacket(&ipx.Packet{
+	inner, src, _ := c.connection()
+	inner.WritePacket(&ipx.Packet{
 		Header: ipx.Header{
+			Checksum: ipx.NoChecksum,
+			Length:   uint16(ipx.HeaderLength),
 			Dest: ipx.HeaderAddr{
 				Addr:   *addr,
 				Socket: 2,
 			},
 			Src: ipx.HeaderAddr{
-				Addr:   c.addr,
+				Addr:   src,
 				Socket: 0,
 			},
 		},
 	})
 }
 
+// readPacket reads the next packet from the server. If ReconnectTimeout is
+// set, the connection is re-established if it is lost or goes quiet; an
+// error is only returned once the client has been closed.
+func (c *client) readPacket(ctx context.Context) (*ipx.Packet, error) {
+	for {
+		inner, _, _ := c.connection()
+		if c.config.ReconnectTimeout == 0 {
+			return inner.ReadPacket(ctx)
+		}
+		subctx, cancel := context.WithTimeout(ctx, c.config.ReconnectTimeout)
+		packet, err := inner.ReadPacket(subctx)
+		cancel()
+		switch {
+		case err == nil:
+			return packet, nil
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrClosedPipe):
+			if !c.reconnect(ctx) {
+				return nil, io.ErrClosedPipe
+			}
+		default:
+			return nil, err
+		}
+	}
+}
+
+func (c *client) setState(connected bool) {
+	if c.config.OnStateChange != nil {
+		c.config.OnStateChange(connected)
+	}
+}
+
+// reconnect replaces the connection to the server with a new one, retrying
+// until it succeeds. It returns false if the client is closed first.
+func (c *client) reconnect(ctx context.Context) bool {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return false
+	}
+	c.inner.Close()
+	c.mu.Unlock()
+	c.setState(false)
+	for {
+		inner, addr, err := connect(ctx, c.serverAddr, &c.config)
+		if err == nil {
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				inner.Close()
+				return false
+			}
+			c.inner, c.addr = inner, addr
+			c.mu.Unlock()
+			c.setState(true)
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(connectAttemptInterval):
+		}
+	}
+}
+
 func isPing(hdr *ipx.Header) bool {
 	return hdr.Dest.Addr == ipx.AddrBroadcast && hdr.Dest.Socket == 2
 }
 
 func (c *client) recvLoop(ctx context.Context) {
+	var out ipx.Writer = c.rxpipe
+	if c.config.JitterDelay > 0 {
+		jb := newJitterBuffer(c.config.JitterDelay, c.rxpipe)
+		defer jb.Close()
+		go jb.run(ctx)
+		out = jb
+	}
 	for {
-		packet, err := c.inner.ReadPacket(ctx)
-		if errors.Is(err, io.ErrClosedPipe) {
+		packet, err := c.readPacket(ctx)
+		if errors.Is(err, io.ErrClosedPipe) || ctx.Err() != nil {
 			break
 		} else if err != nil {
 			// TODO: Log error?
@@ -101,13 +276,24 @@ func (c *client) recvLoop(ctx context.Context) {
 			continue
 		}
 
-		c.rxpipe.WritePacket(packet)
+		_, addr, appAddr := c.connection()
+		if addr != appAddr && packet.Header.Dest.Addr == addr {
+			packet.Header.Dest.Addr = appAddr
+		}
+
+		if c.config.Filter != nil && c.config.Filter(packet) {
+			continue
+		}
+
+		out.WritePacket(packet)
 	}
 }
 
-func sendRegistrationPacket(c ipx.ReadWriteCloser) {
-	c.WritePacket(&ipx.Packet{
+func sendRegistrationPacket(c ipx.ReadWriteCloser, secret []byte) {
+	packet := &ipx.Packet{
 		Header: ipx.Header{
+			Checksum: ipx.NoChecksum,
+			Length:   uint16(ipx.HeaderLength),
 			Dest: ipx.HeaderAddr{
 				Addr:   ipx.AddrNull,
 				Socket: 2,
@@ -117,14 +303,18 @@ func sendRegistrationPacket(c ipx.ReadWriteCloser) {
 				Socket: 2,
 			},
 		},
-	})
+	}
+	if len(secret) > 0 {
+		server.SignRegistration(packet, secret, time.Now())
+	}
+	c.WritePacket(packet)
 }
 
 func isRegistrationResponse(hdr *ipx.Header) bool {
 	return hdr.Dest.Socket == 2 && hdr.Src.Socket == 2 && hdr.Dest.Addr != ipx.AddrBroadcast
 }
 
-func handshakeConnect(ctx context.Context, c ipx.ReadWriteCloser, addr string) (ipx.Addr, error) {
+func handshakeConnect(ctx context.Context, c ipx.ReadWriteCloser, addr string, secret []byte) (ipx.Addr, error) {
 	nextSendTime := time.Now()
 	connectAttempts := 0
 	for {
@@ -133,37 +323,86 @@ func handshakeConnect(ctx context.Context, c ipx.ReadWriteCloser, addr string) (
 			if connectAttempts >= maxConnectAttempts {
 				return ipx.AddrNull, &connectFailure{addr}
 			}
-			sendRegistrationPacket(c)
+			sendRegistrationPacket(c, secret)
 			connectAttempts++
-			nextSendTime = now.Add(time.Second)
+			nextSendTime = now.Add(connectAttemptInterval)
 		}
-		subctx, _ := context.WithDeadline(ctx, nextSendTime)
+		subctx, cancel := context.WithDeadline(ctx, nextSendTime)
 		packet, err := c.ReadPacket(subctx)
+		cancel()
+		if ctx.Err() != nil {
+			return ipx.AddrNull, fmt.Errorf("failed to connect to server %q: %w", addr, ctx.Err())
+		}
 		if errors.Is(err, context.DeadlineExceeded) {
 			continue
 		}
 		if err != nil {
-			return ipx.AddrNull, err
+			return ipx.AddrNull, fmt.Errorf("%w: %v", ErrHandshakeFailed, err)
 		}
-		if isRegistrationResponse(&packet.Header) {
-			return packet.Header.Dest.Addr, nil
+		if !isRegistrationResponse(&packet.Header) {
+			continue
+		}
+		if packet.Header.Dest.Addr == ipx.AddrNull {
+			return ipx.AddrNull, ErrServerFull
 		}
+		return packet.Header.Dest.Addr, nil
 	}
 }
 
+// Dial connects to the DOSbox server at the given address, returning a
+// network.Node that can be used to send and receive packets. The context
+// bounds the time spent connecting: if it is cancelled or expires before the
+// server responds, Dial returns an error that wraps the context's error. Once
+// connected, the node is not affected by the context; it stays connected
+// until Close is called, which also stops its background goroutine and
+// causes any blocked ReadPacket call to return an error.
 func Dial(ctx context.Context, addr string) (network.Node, error) {
-	udp, err := udpclient.Dial(addr)
+	return DialConfig(ctx, addr, &Config{})
+}
+
+// connect establishes a new connection to the server and performs the
+// registration handshake, returning the connection and assigned address.
+func connect(ctx context.Context, addr string, config *Config) (ipx.ReadWriteCloser, ipx.Addr, error) {
+	var inner ipx.ReadWriteCloser
+	if config.TCP {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, ipx.AddrNull, err
+		}
+		inner = server.NewStreamConn(conn)
+	} else {
+		udp, err := udpclient.DialContext(ctx, addr)
+		if err != nil {
+			return nil, ipx.AddrNull, err
+		}
+		inner = udp
+	}
+	ipxAddr, err := handshakeConnect(ctx, inner, addr, config.SharedSecret)
+	if err != nil {
+		inner.Close()
+		return nil, ipx.AddrNull, err
+	}
+	return inner, ipxAddr, nil
+}
+
+// DialConfig is like Dial but takes a Config to control the client's
+// behavior.
+func DialConfig(ctx context.Context, addr string, config *Config) (network.Node, error) {
+	inner, ipxAddr, err := connect(ctx, addr, config)
 	if err != nil {
 		return nil, err
 	}
 	c := &client{
-		inner:  udp,
-		rxpipe: pipe.New(),
-	}
-	if c.addr, err = handshakeConnect(ctx, udp, addr); err != nil {
-		udp.Close()
-		return nil, err
+		config:     *config,
+		serverAddr: addr,
+		inner:      inner,
+		rxpipe:     pipe.New(),
+		addr:       ipxAddr,
+		appAddr:    ipxAddr,
 	}
-	go c.recvLoop(context.Background())
+	var loopCtx context.Context
+	loopCtx, c.cancel = context.WithCancel(context.Background())
+	go c.recvLoop(loopCtx)
 	return c, nil
 }
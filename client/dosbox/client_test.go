@@ -0,0 +1,363 @@
+package dosbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/filter"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	"github.com/fragglet/ipxbox/network/pipe"
+	"github.com/fragglet/ipxbox/server"
+	serverdosbox "github.com/fragglet/ipxbox/server/dosbox"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func makeTestPacket(socket uint16, payload string) *ipx.Packet {
+	return &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{
+				Addr:   [6]byte{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+				Socket: socket,
+			},
+			Src: ipx.HeaderAddr{
+				Addr:   [6]byte{0x02, 0x66, 0x77, 0x88, 0x99, 0xaa},
+				Socket: socket,
+			},
+		},
+		Payload: []byte(payload),
+	}
+}
+
+func TestClientFilter(t *testing.T) {
+	server, inner := ipxtesting.MakeLoopbackPair("server", "client")
+	c := &client{
+		config: Config{Filter: filter.IsNetBIOS},
+		inner:  inner,
+		rxpipe: pipe.New(),
+		addr:   [6]byte{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go c.recvLoop(ctx)
+
+	server.WritePacket(makeTestPacket(0x455, "netbios"))
+	wantPacket := makeTestPacket(0x869c, "game data")
+	server.WritePacket(wantPacket)
+
+	gotPacket, err := c.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("error reading packet: %v", err)
+	}
+	if gotPacket != wantPacket {
+		t.Errorf("filtered packet reached application: want %+v, got %+v", wantPacket, gotPacket)
+	}
+}
+
+func TestPingReply(t *testing.T) {
+	server, inner := ipxtesting.MakeLoopbackPair("server", "client")
+	clientAddr := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	pingAddr := ipx.Addr{0x02, 0xff, 0xff, 0xff, 0x00, 0x00}
+	c := &client{
+		inner:  inner,
+		rxpipe: pipe.New(),
+		addr:   clientAddr,
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go c.recvLoop(ctx)
+
+	server.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 2},
+			Src:  ipx.HeaderAddr{Addr: pingAddr},
+		},
+	})
+	wantPacket := makeTestPacket(0x869c, "game data")
+	server.WritePacket(wantPacket)
+
+	reply, err := server.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("no ping reply: %v", err)
+	}
+	if reply.Header.Dest.Addr != pingAddr || reply.Header.Dest.Socket != 2 || reply.Header.Src.Addr != clientAddr {
+		t.Errorf("wrong ping reply: %+v", reply.Header)
+	}
+
+	// The ping is not delivered to the application.
+	gotPacket, err := c.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("error reading packet: %v", err)
+	}
+	if gotPacket != wantPacket {
+		t.Errorf("want game packet, got %+v", gotPacket)
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	connectAttemptInterval = 10 * time.Millisecond
+	defer func() {
+		connectAttemptInterval = time.Second
+	}()
+	ctx := context.Background()
+
+	t.Run("timeout", func(t *testing.T) {
+		_, inner := ipxtesting.MakeLoopbackPair("server", "client")
+		_, err := handshakeConnect(ctx, inner, "testing", nil)
+		if !errors.Is(err, ErrDialTimeout) {
+			t.Errorf("want error %v, got %v", ErrDialTimeout, err)
+		}
+	})
+	t.Run("handshake failed", func(t *testing.T) {
+		_, inner := ipxtesting.MakeLoopbackPair("server", "client")
+		inner.Close()
+		_, err := handshakeConnect(ctx, inner, "testing", nil)
+		if !errors.Is(err, ErrHandshakeFailed) {
+			t.Errorf("want error %v, got %v", ErrHandshakeFailed, err)
+		}
+	})
+	t.Run("server full", func(t *testing.T) {
+		server, inner := ipxtesting.MakeLoopbackPair("server", "client")
+		server.WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: ipx.AddrNull, Socket: 2},
+				Src:  ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 2},
+			},
+		})
+		_, err := handshakeConnect(ctx, inner, "testing", nil)
+		if !errors.Is(err, ErrServerFull) {
+			t.Errorf("want error %v, got %v", ErrServerFull, err)
+		}
+	})
+}
+
+func TestHandshakeContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, inner := ipxtesting.MakeLoopbackPair("server", "client")
+	start := time.Now()
+	_, err := handshakeConnect(ctx, inner, "testing", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want error %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > connectAttemptInterval {
+		t.Errorf("handshake took %v after context expired", elapsed)
+	}
+}
+
+// startTCPServer starts a TCP server on the given address for clients of
+// the given network. TCP clients are added to a UDP server, which is also
+// started.
+func startTCPServer(t *testing.T, ctx context.Context, addr string, n network.Network) *server.TCPServer {
+	us, err := server.New("127.0.0.1:0", &server.Config{
+		Protocols:     []server.Protocol{&serverdosbox.Protocol{Network: n}},
+		ClientTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { us.Close() })
+	go us.Run(ctx)
+	s, err := server.NewTCP(addr, us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Run(ctx)
+	return s
+}
+
+func TestDialTCP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := startTCPServer(t, ctx, "127.0.0.1:0", addressable.Wrap(ipxswitch.New()))
+	defer s.Close()
+
+	var nodes []network.Node
+	for i := 0; i < 2; i++ {
+		node, err := DialConfig(ctx, s.Addr().String(), &Config{TCP: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Close()
+		nodes = append(nodes, node)
+	}
+	packet := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: network.NodeAddress(nodes[1]), Socket: 0x869c},
+			Src:  ipx.HeaderAddr{Addr: network.NodeAddress(nodes[0]), Socket: 0x869c},
+		},
+		Payload: []byte("hello"),
+	}
+	if err := nodes[0].WritePacket(packet); err != nil {
+		t.Fatal(err)
+	}
+	got, err := nodes[1].ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("packet not received: %v", err)
+	}
+	if got.Header != packet.Header || string(got.Payload) != "hello" {
+		t.Errorf("wrong packet received: want %+v, got %+v", packet, got)
+	}
+
+	// The nodes are not affected by the dial context, but closing a
+	// node unblocks ReadPacket.
+	cancel()
+	result := make(chan error)
+	go func() {
+		_, err := nodes[0].ReadPacket(context.Background())
+		result <- err
+	}()
+	nodes[0].Close()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Errorf("ReadPacket succeeded after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("ReadPacket still blocked after Close")
+	}
+}
+
+// startFullServer starts a UDP server, and a TCP server in front of it, that
+// accept only one client, and connects that client.
+func startFullServer(t *testing.T, ctx context.Context, secret []byte) (udpAddr, tcpAddr string) {
+	us, err := server.New("127.0.0.1:0", &server.Config{
+		Protocols:     []server.Protocol{&serverdosbox.Protocol{Network: addressable.Wrap(ipxswitch.New())}},
+		ClientTimeout: time.Minute,
+		MaxClients:    1,
+		SharedSecret:  secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { us.Close() })
+	go us.Run(ctx)
+	s, err := server.NewTCP("127.0.0.1:0", us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	go s.Run(ctx)
+
+	node, err := DialConfig(ctx, us.Addr().String(), &Config{SharedSecret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return us.Addr().String(), s.Addr().String()
+}
+
+func TestDialServerFull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	secret := []byte("swordfish")
+	udpAddr, tcpAddr := startFullServer(t, ctx, secret)
+	for _, tc := range []struct {
+		name   string
+		addr   string
+		config Config
+	}{
+		{"udp", udpAddr, Config{SharedSecret: secret}},
+		{"tcp", tcpAddr, Config{TCP: true, SharedSecret: secret}},
+	} {
+		_, err := DialConfig(ctx, tc.addr, &tc.config)
+		if !errors.Is(err, ErrServerFull) {
+			t.Errorf("%s: want error %v, got %v", tc.name, ErrServerFull, err)
+		}
+	}
+}
+
+func TestDialServerFullUnsigned(t *testing.T) {
+	connectAttemptInterval = 10 * time.Millisecond
+	defer func() {
+		connectAttemptInterval = time.Second
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Unsigned registrations might come from stock DOSBox, which would
+	// take the refusal as success, so the server does not reply.
+	udpAddr, _ := startFullServer(t, ctx, nil)
+	_, err := Dial(ctx, udpAddr)
+	if !errors.Is(err, ErrDialTimeout) {
+		t.Errorf("want error %v, got %v", ErrDialTimeout, err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	connectAttemptInterval = 10 * time.Millisecond
+	defer func() {
+		connectAttemptInterval = time.Second
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := startTCPServer(t, ctx, "127.0.0.1:0", addressable.Wrap(ipxswitch.New()))
+	addr := s.Addr().String()
+
+	states := make(chan bool, 10)
+	node, err := DialConfig(ctx, addr, &Config{
+		TCP:              true,
+		ReconnectTimeout: time.Minute,
+		OnStateChange:    func(connected bool) { states <- connected },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	appAddr := network.NodeAddress(node)
+
+	// Restart the server with a new network, so that the client is
+	// assigned a different address when it reconnects.
+	s.Close()
+	n := addressable.Wrap(ipxswitch.New())
+	s = startTCPServer(t, ctx, addr, n)
+	defer s.Close()
+	for _, want := range []bool{false, true} {
+		select {
+		case got := <-states:
+			if got != want {
+				t.Fatalf("wrong state change: want %v, got %v", want, got)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for state change to %v", want)
+		}
+	}
+	if got := network.NodeAddress(node); got != appAddr {
+		t.Errorf("application address changed after reconnect: want %v, got %v", appAddr, got)
+	}
+
+	other, err := n.NewNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	otherAddr := network.NodeAddress(other)
+	node.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: otherAddr, Socket: 0x869c},
+			Src:  ipx.HeaderAddr{Addr: appAddr, Socket: 0x869c},
+		},
+	})
+	got, err := other.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("packet not received after reconnect: %v", err)
+	}
+	other.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: got.Header.Src.Addr, Socket: 0x869c},
+			Src:  ipx.HeaderAddr{Addr: otherAddr, Socket: 0x869c},
+		},
+	})
+	got, err = node.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("reply not received after reconnect: %v", err)
+	}
+	if got.Header.Dest.Addr != appAddr {
+		t.Errorf("reply not addressed to application address: want %v, got %v", appAddr, got.Header.Dest.Addr)
+	}
+}
@@ -0,0 +1,123 @@
+package dosbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// jitterQueueSize is the maximum number of packets that can be held in the
+// jitter buffer; packets are dropped if it is full.
+const jitterQueueSize = 16
+
+// maxJitterSamples is the number of samples over which the average interval
+// between received packets is calculated.
+const maxJitterSamples = 16
+
+type jitterEntry struct {
+	packet  *ipx.Packet
+	playout time.Time
+}
+
+// jitterBuffer holds received packets for up to a configured delay before
+// delivering them, spacing them out at the average interval at which they
+// have been arriving. This smooths out variation in arrival times caused by
+// network jitter, at the cost of added latency.
+type jitterBuffer struct {
+	delay       time.Duration
+	out         ipx.Writer
+	queue       chan *jitterEntry
+	lastArrival time.Time
+	lastPlayout time.Time
+
+	avgInterval  time.Duration
+	numIntervals int
+}
+
+func newJitterBuffer(delay time.Duration, out ipx.Writer) *jitterBuffer {
+	return &jitterBuffer{
+		delay: delay,
+		out:   out,
+		queue: make(chan *jitterEntry, jitterQueueSize),
+	}
+}
+
+// schedule returns the time at which a packet that arrived at the given time
+// should be delivered. Ideally it is delivered one average interval after
+// the previous packet, but it is never held for longer than the configured
+// delay.
+func (jb *jitterBuffer) schedule(arrival time.Time) time.Time {
+	if jb.lastArrival.IsZero() {
+		// We don't know if the first packet arrived early or late,
+		// so start in the middle of the window.
+		jb.lastArrival = arrival
+		jb.lastPlayout = arrival.Add(jb.delay / 2)
+		return jb.lastPlayout
+	}
+	// Average of the inter-arrival time; a cumulative average for the
+	// first few packets, then an exponentially weighted moving average.
+	if jb.numIntervals < maxJitterSamples {
+		jb.numIntervals++
+	}
+	interval := arrival.Sub(jb.lastArrival)
+	jb.avgInterval += (interval - jb.avgInterval) / time.Duration(jb.numIntervals)
+	jb.lastArrival = arrival
+
+	playout := jb.lastPlayout.Add(jb.avgInterval)
+	// Gradually steer back towards the middle of the window so that
+	// errors in the average do not accumulate over time.
+	playout = playout.Add(arrival.Add(jb.delay/2).Sub(playout) / 8)
+	if latest := arrival.Add(jb.delay); playout.After(latest) {
+		playout = latest
+	}
+	if playout.Before(arrival) {
+		playout = arrival
+	}
+	jb.lastPlayout = playout
+	return playout
+}
+
+// WritePacket adds a packet to the buffer. It must only be called from a
+// single goroutine.
+func (jb *jitterBuffer) WritePacket(packet *ipx.Packet) error {
+	entry := &jitterEntry{
+		packet:  packet,
+		playout: jb.schedule(time.Now()),
+	}
+	select {
+	case jb.queue <- entry:
+	default:
+		// Buffer full; drop the packet.
+	}
+	return nil
+}
+
+// Close stops the buffer once all queued packets have been delivered.
+func (jb *jitterBuffer) Close() error {
+	close(jb.queue)
+	return nil
+}
+
+// run delivers packets from the buffer once they are due, until the buffer
+// is closed or the context is cancelled.
+func (jb *jitterBuffer) run(ctx context.Context) {
+	for {
+		var entry *jitterEntry
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-jb.queue:
+			if !ok {
+				return
+			}
+			entry = e
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(entry.playout)):
+		}
+		jb.out.WritePacket(entry.packet)
+	}
+}
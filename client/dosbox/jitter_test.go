@@ -0,0 +1,35 @@
+package dosbox
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestJitterSmoothing(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	const maxJitter = 30 * time.Millisecond
+	jb := newJitterBuffer(60*time.Millisecond, nil)
+	rng := rand.New(rand.NewSource(1234))
+	start := time.Now()
+
+	// Packets are sent at a regular interval, but arrive with jitter.
+	var playouts []time.Time
+	for i := 0; i < 50; i++ {
+		jitter := time.Duration(rng.Int63n(int64(maxJitter)))
+		arrival := start.Add(time.Duration(i)*interval + jitter)
+		playout := jb.schedule(arrival)
+		if playout.Before(arrival) || playout.After(arrival.Add(jb.delay)) {
+			t.Errorf("packet %d: playout %v outside window [%v, %v]", i, playout.Sub(start), arrival.Sub(start), arrival.Add(jb.delay).Sub(start))
+		}
+		playouts = append(playouts, playout)
+	}
+	// Once the buffer has settled, packets should be delivered at close
+	// to the interval at which they were sent.
+	for i := 10; i < len(playouts); i++ {
+		got := playouts[i].Sub(playouts[i-1])
+		if got < interval-maxJitter/3 || got > interval+maxJitter/3 {
+			t.Errorf("packet %d: delivered %v after previous, want ~%v", i, got, interval)
+		}
+	}
+}
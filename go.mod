@@ -6,10 +6,9 @@ require (
 	github.com/google/gopacket v1.1.19
 	github.com/songgao/packets v0.0.0-20160404182456-549a10cd4091
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.23.0
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 )
 
-require (
-	golang.org/x/net v0.23.0 // indirect
-	golang.org/x/sys v0.18.0 // indirect
-)
+require golang.org/x/sys v0.18.0 // indirect
@@ -7,6 +7,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 )
 
 // Addr represents an IPX address (MAC address).
@@ -37,6 +39,8 @@ var (
 	_ = (encoding.BinaryUnmarshaler)(&HeaderAddr{})
 	_ = (encoding.BinaryMarshaler)(&Header{})
 	_ = (encoding.BinaryUnmarshaler)(&Header{})
+	_ = (encoding.TextMarshaler)(AddrNull)
+	_ = (encoding.TextUnmarshaler)(&AddrNull)
 
 	// For our purposes we always use network zero.
 	ZeroNetwork = [4]byte{0, 0, 0, 0}
@@ -48,14 +52,60 @@ var (
 	minHeaderAddressLength = 12
 )
 
+// NoChecksum is the value of Header.Checksum that indicates that a packet
+// has no checksum. It is almost always used.
+const NoChecksum = 0xffff
+
 func (a Addr) Network() string {
 	return "dosbox-ipx"
 }
 
+// String returns the address as colon-separated lower case hex bytes, eg.
+// "02:ab:cd:ef:01:23".
 func (a Addr) String() string {
 	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", a[0], a[1], a[2], a[3], a[4], a[5])
 }
 
+// MarshalText implements encoding.TextMarshaler, using the same format as
+// String, so that addresses appear as strings in JSON.
+func (a Addr) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the same
+// formats as ParseAddr.
+func (a *Addr) UnmarshalText(text []byte) error {
+	addr, err := ParseAddr(string(text))
+	if err != nil {
+		return err
+	}
+	*a = addr
+	return nil
+}
+
+// ParseAddr parses an IPX node address in the format returned by
+// Addr.String, eg. "02:ab:cd:ef:01:23". Hex digits may be in either case,
+// and the bytes may be separated by '-' instead of ':'.
+func ParseAddr(s string) (Addr, error) {
+	var result Addr
+	sep := ":"
+	if strings.Contains(s, "-") {
+		sep = "-"
+	}
+	parts := strings.Split(s, sep)
+	if len(parts) != len(result) {
+		return AddrNull, fmt.Errorf("invalid IPX address %q: want %d bytes separated by ':' or '-', got %d", s, len(result), len(parts))
+	}
+	for i, part := range parts {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || len(part) != 2 {
+			return AddrNull, fmt.Errorf("invalid IPX address %q: byte %d (%q) is not two hex digits", s, i+1, part)
+		}
+		result[i] = byte(b)
+	}
+	return result, nil
+}
+
 // UnmarshalBinary decodes an IPX header address from a slice of bytes.
 func (a *HeaderAddr) UnmarshalBinary(data []byte) error {
 	if len(data) < minHeaderAddressLength {
@@ -115,6 +165,47 @@ func (h *Header) MarshalBinary() ([]byte, error) {
 	return result, nil
 }
 
+// ComputeChecksum returns the IPX checksum of a packet with this header and
+// the given payload. This is the ones' complement of the ones' complement
+// sum of the packet as big-endian 16-bit words, padded with a zero byte if
+// its length is odd. The checksum field itself is excluded, as is the
+// transport control field, since routers change it. The result is never
+// NoChecksum.
+func (h *Header) ComputeChecksum(payload []byte) uint16 {
+	data, _ := h.MarshalBinary()
+	data = append(data, payload...)
+	sum := uint32(binary.BigEndian.Uint16(data[2:4])) + uint32(data[5])
+	for i := 6; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	if sum == 0 {
+		return 0
+	}
+	return ^uint16(sum)
+}
+
+// VerifyChecksum returns true if the checksum field is correct for a packet
+// with this header and the given payload, or if it is NoChecksum.
+func (h *Header) VerifyChecksum(payload []byte) bool {
+	return h.Checksum == NoChecksum || h.Checksum == h.ComputeChecksum(payload)
+}
+
+// CheckLength returns an error if the Length field of the header is not the
+// given length of the whole packet in bytes, including the header. It is
+// used to reject truncated or oversized packets.
+func (h *Header) CheckLength(packetLen int) error {
+	if int(h.Length) != packetLen {
+		return fmt.Errorf("IPX header length %d does not match packet length %d", h.Length, packetLen)
+	}
+	return nil
+}
+
 func (h *Header) IsBroadcast() bool {
 	return h.Dest.Addr == AddrBroadcast
 }
@@ -3,6 +3,7 @@ package ipx
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"io"
 	"reflect"
 	"testing"
@@ -145,6 +146,125 @@ func TestMarshal(t *testing.T) {
 	}
 }
 
+func TestAddrText(t *testing.T) {
+	for _, tt := range []struct {
+		addr Addr
+		want string
+	}{
+		{AddrNull, "00:00:00:00:00:00"},
+		{AddrBroadcast, "ff:ff:ff:ff:ff:ff"},
+		{Addr{0x02, 0xab, 0xcd, 0xef, 0x01, 0x23}, "02:ab:cd:ef:01:23"},
+	} {
+		if got := tt.addr.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+		data, err := json.Marshal(map[string]Addr{"addr": tt.addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded map[string]Addr
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("json.Unmarshal(%s) failed: %v", data, err)
+		}
+		if decoded["addr"] != tt.addr {
+			t.Errorf("JSON round trip of %v via %s gave %v", tt.addr, data, decoded["addr"])
+		}
+	}
+
+	var got Addr
+	if err := got.UnmarshalText([]byte("02-AB-cd-ef-01-23")); err != nil || got.String() != "02:ab:cd:ef:01:23" {
+		t.Errorf("UnmarshalText gave %v, %v", got, err)
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	want := Addr{0x02, 0xab, 0xcd, 0xef, 0x01, 0x23}
+	for _, s := range []string{"02:ab:cd:ef:01:23", "02:AB:cd:EF:01:23", "02-ab-cd-ef-01-23"} {
+		if got, err := ParseAddr(s); err != nil || got != want {
+			t.Errorf("ParseAddr(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	for _, addr := range []Addr{AddrNull, AddrBroadcast, want} {
+		if got, err := ParseAddr(addr.String()); err != nil || got != addr {
+			t.Errorf("ParseAddr(%q) = %v, %v; want %v", addr.String(), got, err, addr)
+		}
+	}
+	for _, s := range []string{"", "02:ab:cd:ef:01", "02:ab:cd:ef:01:23:45", "02:ab:cd:ef:01:2", "02:ab-cd:ef:01:23", "0x:ab:cd:ef:01:23", "+2:ab:cd:ef:01:23"} {
+		if _, err := ParseAddr(s); err == nil {
+			t.Errorf("ParseAddr(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		want   uint16
+	}{
+		// Registration reply sent by the server.
+		{[]byte{
+			0xff, 0xff, 0x00, 0x1e, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01,
+			0x00, 0x02, 0x00, 0x00, 0x00, 0x01, 0xff, 0xff,
+			0xff, 0xff, 0xff, 0xff, 0x00, 0x02,
+		}, 0xfddb},
+		// testPackets[0], which has an odd length and a non-zero
+		// transport control field.
+		{[]byte{
+			0xff, 0xff, 0x00, 0x23, 0x0c, 0x04, 0x01, 0x02,
+			0x03, 0x04, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0x45, 0x67, 0x43, 0x21, 0x87, 0x65, 0x11, 0x22,
+			0x33, 0x44, 0x55, 0x66, 0x45, 0x67, 0x68, 0x65,
+			0x6c, 0x6c, 0x6f,
+		}, 0xc8de},
+		{[]byte{
+			0xff, 0xff, 0x00, 0x24, 0x00, 0x04, 0x00, 0x00,
+			0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0x86, 0x9c, 0x00, 0x00, 0x00, 0x00, 0x02, 0xab,
+			0xcd, 0xef, 0x01, 0x23, 0x86, 0x9c, 0x64, 0x6f,
+			0x6f, 0x6d, 0x00, 0x01,
+		}, 0x4d03},
+	}
+	for i, tt := range tests {
+		var packet Packet
+		if err := packet.UnmarshalBinary(tt.packet); err != nil {
+			t.Fatal(err)
+		}
+		hdr := &packet.Header
+		if got := hdr.ComputeChecksum(packet.Payload); got != tt.want {
+			t.Errorf("test %d: wrong checksum: want %#04x, got %#04x", i, tt.want, got)
+		}
+		if !hdr.VerifyChecksum(packet.Payload) {
+			t.Errorf("test %d: NoChecksum not accepted", i)
+		}
+		hdr.Checksum = tt.want
+		if !hdr.VerifyChecksum(packet.Payload) {
+			t.Errorf("test %d: correct checksum not accepted", i)
+		}
+		hdr.TransControl++
+		if !hdr.VerifyChecksum(packet.Payload) {
+			t.Errorf("test %d: checksum depends on transport control field", i)
+		}
+		packet.Payload = append(packet.Payload, 0x01)
+		if hdr.VerifyChecksum(packet.Payload) {
+			t.Errorf("test %d: corrupted packet accepted", i)
+		}
+	}
+}
+
+func TestCheckLength(t *testing.T) {
+	hdr := &Header{Length: 35}
+	if err := hdr.CheckLength(35); err != nil {
+		t.Errorf("correct length rejected: %v", err)
+	}
+	if err := hdr.CheckLength(34); err == nil {
+		t.Errorf("truncated packet accepted")
+	}
+	if err := hdr.CheckLength(36); err == nil {
+		t.Errorf("oversized packet accepted")
+	}
+}
+
 func TestShortPacket(t *testing.T) {
 	pktBytes := []byte{0x01, 0x02, 0x03, 0x04}
 	var pkt Packet
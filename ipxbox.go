@@ -3,58 +3,324 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/ipxping"
 	"github.com/fragglet/ipxbox/ipxpkt"
+	"github.com/fragglet/ipxbox/kernelipx"
+	"github.com/fragglet/ipxbox/logging"
+	"github.com/fragglet/ipxbox/metrics"
+	"github.com/fragglet/ipxbox/mirror"
 	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/network/addressable"
 	"github.com/fragglet/ipxbox/network/filter"
+	"github.com/fragglet/ipxbox/network/gamefilter"
 	"github.com/fragglet/ipxbox/network/ipxswitch"
+	"github.com/fragglet/ipxbox/network/pipe"
+	"github.com/fragglet/ipxbox/network/rewrite"
 	"github.com/fragglet/ipxbox/network/stats"
 	"github.com/fragglet/ipxbox/network/tappable"
+	"github.com/fragglet/ipxbox/network/type20"
 	"github.com/fragglet/ipxbox/phys"
+	"github.com/fragglet/ipxbox/ppp"
+	"github.com/fragglet/ipxbox/ppp/l2tp"
+	"github.com/fragglet/ipxbox/ppp/mppe"
 	"github.com/fragglet/ipxbox/ppp/pptp"
+	"github.com/fragglet/ipxbox/pseudonym"
 	"github.com/fragglet/ipxbox/qproxy"
+	"github.com/fragglet/ipxbox/selftest"
 	"github.com/fragglet/ipxbox/server"
 	"github.com/fragglet/ipxbox/server/dosbox"
+	servermetrics "github.com/fragglet/ipxbox/server/metrics"
 	"github.com/fragglet/ipxbox/server/uplink"
+	"github.com/fragglet/ipxbox/server/ws"
 	"github.com/fragglet/ipxbox/syslog"
+	"github.com/fragglet/ipxbox/udpproxy"
+	"github.com/fragglet/ipxbox/webhook"
 
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
 )
 
 var (
-	dumpPackets    = flag.String("dump_packets", "", "Write packets to a .pcap file with the given name.")
-	port           = flag.Int("port", 10000, "UDP port to listen on.")
-	clientTimeout  = flag.Duration("client_timeout", 10*time.Minute, "Time of inactivity before disconnecting clients.")
-	allowNetBIOS   = flag.Bool("allow_netbios", false, "If true, allow packets to be forwarded that may contain Windows file sharing (NetBIOS) packets.")
-	enableIpxpkt   = flag.Bool("enable_ipxpkt", false, "If true, route encapsulated packets from the IPXPKT.COM driver to the physical network (requires --enable_tap or --pcap_device)")
-	enableSyslog   = flag.Bool("enable_syslog", false, "If true, client connects/disconnects are logged to syslog")
-	quakeServers   = flag.String("quake_servers", "", "Proxy to the given list of Quake UDP servers in a way that makes them accessible over IPX.")
-	enablePPTP     = flag.Bool("enable_pptp", false, "If true, run PPTP VPN server on TCP port 1723.")
-	uplinkPassword = flag.String("uplink_password", "", "Password to permit uplink clients to connect. If empty, uplink is not supported.")
+	dumpPackets         = flag.String("dump_packets", "", "Write packets to a .pcap file with the given name.")
+	tapBufferSize       = flag.Int("tap_buffer_size", 0, "Number of packets buffered for --dump_packets and --mirror_address before packets are dropped. If zero, a default size is used.")
+	maxTaps             = flag.Int("max_taps", 0, "If non-zero, maximum number of network taps (such as --dump_packets and --mirror_address) that can be open at once. The same limit applies separately to captures opened through the admin server's /spectate endpoint.")
+	port                = flag.Int("port", 10000, "UDP port to listen on.")
+	listenNetwork       = flag.String("listen_network", "udp4", `Network to listen for clients on: "udp4", "udp6", or "udp" to accept both IPv4 and IPv6 clients.`)
+	maxNodes            = flag.Int("max_nodes", 0, "If non-zero, maximum number of nodes that can be attached to the IPX network at once, including PPTP and L2TP sessions, proxies and uplinks as well as clients. This bounds resource usage when exposed to untrusted clients.")
+	maxClients          = flag.Int("max_clients", 0, "If non-zero, maximum number of clients that can be connected at once. Clients listed in --trusted_clients can connect even when the server is full.")
+	maxPacketRate       = flag.Float64("max_packet_rate", 0, "If non-zero, maximum number of packets per second accepted from each client. Excess packets are dropped. Clients listed in --trusted_clients are exempt.")
+	maxByteRate         = flag.Float64("max_byte_rate", 0, "If non-zero, maximum number of bytes per second accepted from each client. Excess packets are dropped. Clients listed in --trusted_clients are exempt.")
+	clientTimeout       = flag.Duration("client_timeout", 10*time.Minute, "Time of inactivity before disconnecting clients.")
+	allowNetBIOS        = flag.Bool("allow_netbios", false, "If true, allow packets to be forwarded that may contain Windows file sharing (NetBIOS) packets.")
+	enableIpxpkt        = flag.Bool("enable_ipxpkt", false, "If true, route encapsulated packets from the IPXPKT.COM driver to the physical network (requires --enable_tap or --pcap_device)")
+	ipxpktWindow        = flag.Int("ipxpkt_reassembly_window", ipxpkt.DefaultReassemblyWindow, "Maximum number of partially received IPXPKT frames to hold for reassembly at once.")
+	ipxpktTranslateMACs = flag.Bool("ipxpkt_translate_macs", false, "If true, replace the MAC addresses of IPXPKT clients with addresses allocated by the server, to prevent conflicts between clients using the same MAC address.")
+	ipxpktProxyARP      = flag.String("ipxpkt_proxy_arp", "", "If set to a network in CIDR notation (eg. 192.168.1.0/24), answer ARP requests from the physical network on behalf of IPXPKT clients with addresses in that network, and forward traffic for them. Addresses already in use on the physical network are never proxied.")
+	ipxpktTimeout       = flag.Duration("ipxpkt_reassembly_timeout", ipxpkt.DefaultReassemblyTimeout, "Time after which a partially received IPXPKT frame is discarded if no more fragments are received.")
+	enableSyslog        = flag.Bool("enable_syslog", false, "If true, client connects/disconnects are logged to syslog")
+	syslogAddress       = flag.String("syslog_address", "", "If set, log to the syslog server at this address (eg. logs.example.com:514) instead of the local syslog service. Implies --enable_syslog.")
+	syslogNetwork       = flag.String("syslog_network", "udp", `Network to use to reach --syslog_address: "udp" or "tcp".`)
+	syslogFormat        = flag.String("syslog_format", "", `Format of syslog messages: "rfc3164" or "rfc5424". RFC 5424 messages include structured data with client addresses. The default is rfc5424 with --syslog_address and the system's own format otherwise.`)
+	quakeServers        = flag.String("quake_servers", "", "Proxy to the given list of Quake UDP servers in a way that makes them accessible over IPX. Quake II and QuakeWorld servers can be given as quake2://host:port or quakeworld://host:port.")
+	udpProxies          = flag.String("udp_proxies", "", "Make the given comma-separated list of UDP servers accessible over IPX, for games that support both. Each is given as socket=host:port, where socket is the IPX socket number the game uses, eg. 0x869c=game.example.com:5000.")
+	enablePPTP          = flag.Bool("enable_pptp", false, "If true, run PPTP VPN server (see --pptp_address).")
+	pptpAddress         = flag.String("pptp_address", pptp.DefaultAddress, "Address to listen on for PPTP control connections when --enable_pptp is set.")
+	pptpMaxSessions     = flag.Int("pptp_max_sessions", 0, "If non-zero, maximum number of PPTP VPN sessions that can be active at once.")
+	pptpIdleTimeout     = flag.Duration("pptp_idle_timeout", 0, "If non-zero, PPTP VPN sessions are disconnected if nothing is received from the client for this long.")
+	pptpGREAddress      = flag.String("pptp_gre_address", "", "IP address to receive PPTP GRE packets on. If empty, the host from --pptp_address is used.")
+	pptpUsersFile       = flag.String("pptp_users_file", "", "If set, PPTP and L2TP VPN clients must authenticate with MS-CHAPv2 (or CHAP-MD5) using a user name and password from this file, which contains one \"user password\" pair per line.")
+	pptpEncryption      = flag.String("pptp_encryption", "", "If set, PPTP and L2TP VPN traffic must be encrypted with MPPE, using one of these comma-separated key strengths (40, 56, 128). Requires --pptp_users_file.")
+	enableL2TP          = flag.Bool("enable_l2tp", false, "If true, run L2TP VPN server (see --l2tp_address).")
+	l2tpAddress         = flag.String("l2tp_address", l2tp.DefaultAddress, "UDP address to listen on for L2TP messages when --enable_l2tp is set.")
+	l2tpMaxTunnels      = flag.Int("l2tp_max_tunnels", l2tp.DefaultMaxTunnels, "Maximum number of L2TP tunnels that can be open at once.")
+	l2tpMaxSessions     = flag.Int("l2tp_max_sessions", l2tp.DefaultMaxSessions, "Maximum number of L2TP sessions in each tunnel.")
+	l2tpIdleTimeout     = flag.Duration("l2tp_idle_timeout", l2tp.DefaultIdleTimeout, "Time after which an L2TP tunnel is closed if nothing is received from the client.")
+	uplinkPassword      = flag.String("uplink_password", "", "Password to permit uplink clients to connect. If empty, uplink is not supported.")
+	allowedGames        = flag.String("allowed_games", "", "If set, only forward packets recognized as belonging to one of the given comma-separated list of games.")
+	kernelSockets       = flag.String("kernel_ipx_sockets", "", "Bridge the given comma-separated list of IPX socket numbers to the Linux kernel IPX stack (requires build with the kernelipx tag).")
+	reflectBcasts       = flag.Bool("reflect_broadcasts", false, "If true, broadcast packets sent by a client are also delivered back to it. Bridges and uplinks never receive their own broadcasts.")
+	reflectSelf         = flag.Bool("reflect_self_addressed", false, "If true, packets that a client sends to its own address are delivered back to it.")
+	memoryLimit         = flag.Int64("memory_limit", 0, "If non-zero, soft limit in bytes on memory used for buffered packets. New clients are refused when the limit is exceeded.")
+	tcpAddress          = flag.String("tcp_address", "", "If set, also accept DOSBox protocol clients over TCP on the given address (eg. :10000), for networks that block UDP. Each packet is sent as a two byte big endian length followed by the packet.")
+	wsAddress           = flag.String("ws_address", "", "If set, also accept DOSBox protocol clients over WebSocket on the given address (eg. :8000), for DOSBox running in a web browser. Each binary message contains one IPX packet.")
+	wsAllowedOrigins    = flag.String("ws_allowed_origins", "", "Comma-separated list of origins (eg. https://games.example.com) of web pages that may connect with --ws_address, or \"*\" to allow any. Pages served from the same host as the server are always allowed.")
+	statsLogInterval    = flag.Duration("stats_log_interval", 0, "If non-zero, log a summary of the traffic from clients at this interval (eg. 10m), to syslog if it is enabled or to stderr otherwise.")
+	statsAddress        = flag.String("stats_address", "", "If set, listen for HTTP requests on the given address (eg. localhost:8081) and serve packet and byte counters as JSON at /stats.json. The same counters are also served by the admin server.")
+	metricsAddr         = flag.String("metrics_addr", "", "If set, listen for HTTP requests on the given address (eg. localhost:9100) and serve metrics in the OpenMetrics (Prometheus) format at /metrics. The same metrics are also served by the admin server.")
+	adminAddress        = flag.String("admin_address", "", "If set, listen for HTTP requests on the given address (eg. localhost:8080) and serve administrative/debugging information. Requires --admin_token.")
+	adminToken          = flag.String("admin_token", "", "Token that must be given to access the admin server, in an \"Authorization: Bearer <token>\" request header.")
+	enableIPXPing       = flag.Bool("enable_ipxping", false, "If true, respond to Novell IPX ping requests (eg. from IPXPING) so that clients can test connectivity.")
+	webhookURL          = flag.String("webhook_url", "", "If set, POST JSON notifications to the given URL when clients join or leave the server.")
+	filterPresets       = flag.String("filter", "", "Comma-separated list of preset filters that drop unwanted broadcasts, even when --allow_netbios is set: sap (socket 0x452), rip (socket 0x453), netbios (socket 0x455).")
+	filterRules         = flag.String("filter_rules", "", `Packet filter rules, separated by semicolons and checked in order after --filter and the NetBIOS filter, so they cannot allow packets that those drop, eg. "drop socket=0x869c; allow broadcast". Each rule is "allow" or "drop" followed by conditions that must all match: socket=N, src=ADDR, dest=ADDR, broadcast, min_size=N, max_size=N. The rules can be replaced at runtime through the admin server's /filter_rules endpoint.`)
+	networkNumber       = flag.String("network_number", "", "IPX network number recorded in type 20 (NetBIOS broadcast) packets to prevent loops between bridged networks, when --allow_netbios is set. If empty, a random number is used.")
+	gameShims           = flag.String("game_shims", "", "Comma-separated list of packet rewriting rules for games with compatibility problems, of the form game/socket/FROM/TO or game/network/NUMBER.")
+	mirrorAddress       = flag.String("mirror_address", "", "If set, mirror all packets to a remote collector at the given UDP address (host:port).")
+	mirrorSampling      = flag.Int("mirror_sample_rate", 1, "When mirroring packets, only send one in every N packets.")
+	mirrorMaxRate       = flag.Int("mirror_max_rate", 1000, "When mirroring packets, maximum number of packets to send per second (0 for no limit).")
+	sourcePolicy        = flag.String("source_address_policy", "strict", `How to handle packets from clients with the wrong source address. Valid values are "strict" (drop), "permissive" (forward anyway) and "correct" (rewrite to the client's address). With "permissive", packets using another client's address are still dropped, but clients can impersonate any other address, including hosts on bridged networks and uplinked servers.`)
+	addressPrefix       = flag.String("address_prefix", "02", "Prefix (eg. 02:a0) for the IPX addresses assigned to clients; the rest of each address is random. Give bridged servers different prefixes to avoid address collisions between them.")
+	reservedAddrs       = flag.String("reserved_addresses", "", "Comma-separated list of IPX addresses (eg. 02:00:00:00:00:01) that will never be assigned to clients.")
+	minKeepaliveTime    = flag.Duration("min_keepalive_time", 0, "If non-zero, the keepalive interval for a client is shortened, down to this minimum, each time a keepalive ping goes unanswered. This helps clients behind NAT gateways that expire mappings quickly.")
+	logLevel            = flag.String("log_level", "info", "Minimum level of messages to write to syslog: one of error, warn, info or debug.")
+	packetLogSampleRate = flag.Int("packet_log_sample_rate", 1, "When debug logging is enabled (--log_level=debug), only log one in this many messages about individual packets.")
+	selfTest            = flag.Bool("selftest", false, "If true, run a self-test that starts a server and two clients locally and checks that packets can be sent between them, then exit.")
+	trustedClients      = flag.String("trusted_clients", "", "Comma-separated list of trusted clients (eg. the machine hosting a game), identified by IP address or CIDR network. Trusted clients are exempt from per-client limits and use --trusted_client_timeout.")
+	trustedTimeout      = flag.Duration("trusted_client_timeout", time.Hour, "Time of inactivity before disconnecting clients listed in --trusted_clients.")
+	verifyChecksums     = flag.Bool("verify_checksums", false, "If true, drop packets from DOSBox clients that have an incorrect IPX checksum. Packets without a checksum are still accepted.")
+	acceptOversizedReg  = flag.Bool("accept_oversized_registration", false, "If true, DOSBox registration packets with data after the IPX header are accepted and the extra data ignored, instead of being rejected.")
+	addressLeaseTime    = flag.Duration("address_lease_time", 0, "If non-zero, a disconnected client's IPX address is held for this long, and reassigned if a client reconnects from the same IP address.")
+	readBufferSize      = flag.Int("udp_read_buffer_size", server.DefaultReadBufferSize, "Maximum size in bytes of UDP packets received from clients, at least the size of an IPX header (30 bytes). Larger packets are dropped.")
+	checkPacketLength   = flag.Bool("check_packet_length", false, "If true, drop UDP packets whose IPX header length does not match the size of the datagram. Clients from ipxbox versions before this flag was added may not set the length correctly.")
+	sharedSecret        = flag.String("shared_secret", "", "If set, new clients must authenticate their registration using this shared secret. Stock DOSBox cannot do this, so only clients that support authenticated registration can connect.")
+	allowedNetworks     = flag.String("allowed_networks", "", "If set, comma-separated list of networks (eg. 192.168.0.0/16) or IP addresses; packets from anywhere else are dropped.")
+	blockedNetworks     = flag.String("blocked_networks", "", "Comma-separated list of networks (eg. 192.168.0.0/16) or IP addresses from which packets are always dropped.")
+	logPseudonyms       = flag.Bool("log_pseudonyms", false, "If true, client addresses are replaced in logs with pseudonyms. Pseudonyms of recently accepted clients can be reversed via the admin server (see --admin_address and --admin_token).")
 )
 
+var (
+	rttHistogram = metrics.NewHistogram("ipxbox_client_rtt_seconds",
+		"Round trip time of keepalive pings sent to clients.")
+	queueTimeHistogram = metrics.NewHistogram("ipxbox_queue_time_seconds",
+		"Time that packets spend queued before being sent to clients.")
+	serverMetrics = servermetrics.New()
+)
+
+// mustNewNode creates a new node on the given network for a server-side
+// component, exiting if it cannot be created.
+func mustNewNode(net network.Network, what string) network.Node {
+	node, err := net.NewNode()
+	if err != nil {
+		log.Fatalf("failed to create node for %s: %v", what, err)
+	}
+	return node
+}
+
 func addQuakeProxies(ctx context.Context, net network.Network) {
 	if *quakeServers == "" {
 		return
 	}
 	for _, addr := range strings.Split(*quakeServers, ",") {
+		game, serverAddr, err := qproxy.ParseServer(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		node, err := net.NewNode()
+		if err != nil {
+			log.Printf("not proxying to Quake server %s: %v", addr, err)
+			continue
+		}
 		p := qproxy.New(&qproxy.Config{
-			Address:     addr,
+			Address:     serverAddr,
+			Game:        game,
 			IdleTimeout: *clientTimeout,
-		}, net.NewNode())
+		}, node)
 		go p.Run(ctx)
 	}
 }
 
+func addUDPProxies(ctx context.Context, net network.Network) {
+	if *udpProxies == "" {
+		return
+	}
+	for _, p := range strings.Split(*udpProxies, ",") {
+		fields := strings.SplitN(p, "=", 2)
+		if len(fields) != 2 {
+			log.Fatalf("invalid UDP proxy %q: want socket=host:port", p)
+		}
+		socket, err := strconv.ParseUint(fields[0], 0, 16)
+		if err != nil {
+			log.Fatalf("invalid IPX socket number %q: %v", fields[0], err)
+		}
+		proxy := udpproxy.New(&udpproxy.Config{
+			Address:     fields[1],
+			Socket:      uint16(socket),
+			IdleTimeout: *clientTimeout,
+		}, mustNewNode(net, "UDP proxy"))
+		go proxy.Run(ctx)
+	}
+}
+
+// logBridgeStopped reports that the bridge to the named network has stopped
+// and will no longer forward packets. It goes to stderr if syslog is not
+// enabled, since connectivity has been lost.
+func logBridgeStopped(logger *logging.Logger, name string, err error) {
+	if logger == nil {
+		log.Printf("bridge to %s stopped: %v", name, err)
+	} else {
+		logger.Errorf("bridge to %s stopped: %v", name, err)
+	}
+}
+
+func addKernelIPXBridges(ctx context.Context, net network.Network) {
+	if *kernelSockets == "" {
+		return
+	}
+	for _, s := range strings.Split(*kernelSockets, ",") {
+		socket, err := strconv.ParseUint(s, 0, 16)
+		if err != nil {
+			log.Fatalf("invalid IPX socket number %q: %v", s, err)
+		}
+		conn, err := kernelipx.Open(uint16(socket))
+		if err != nil {
+			log.Fatalf("failed to open kernel IPX socket %#x: %v", socket, err)
+		}
+		go ipx.DuplexCopyPackets(ctx, conn, mustNewNode(net, "kernel IPX bridge"))
+	}
+}
+
+// type20NetworkNumber returns the network number to use for type 20 packet
+// propagation, either from the command line or randomly chosen.
+func type20NetworkNumber() [4]byte {
+	var result [4]byte
+	if *networkNumber == "" {
+		for result == ipx.ZeroNetwork {
+			if _, err := rand.Read(result[:]); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return result
+	}
+	n, err := strconv.ParseUint(*networkNumber, 16, 32)
+	if err != nil || n == 0 {
+		log.Fatalf("invalid network number %q", *networkNumber)
+	}
+	binary.BigEndian.PutUint32(result[:], uint32(n))
+	return result
+}
+
+func startMirror(ctx context.Context, t *tappable.TappableNetwork) {
+	e, err := mirror.New(&mirror.Config{
+		Address:    *mirrorAddress,
+		SampleRate: *mirrorSampling,
+		MaxRate:    *mirrorMaxRate,
+	})
+	if err != nil {
+		log.Fatalf("failed to start traffic mirror: %v", err)
+	}
+	tap, err := t.NewTap()
+	if err != nil {
+		log.Fatal(err)
+	}
+	go e.Run(ctx, tap)
+}
+
+// reservedAddresses returns the list of IPX addresses that are used by the
+// server itself, and must not be assigned to clients.
+func reservedAddresses() []ipx.Addr {
+	result := []ipx.Addr{dosbox.AddrPingReply, phys.KeepaliveAddr}
+	if *reservedAddrs == "" {
+		return result
+	}
+	for _, s := range strings.Split(*reservedAddrs, ",") {
+		addr, err := ipx.ParseAddr(s)
+		if err != nil {
+			log.Fatalf("invalid reserved address %q", s)
+		}
+		result = append(result, addr)
+	}
+	return result
+}
+
+// splitList splits a comma-separated flag value, returning nil if it is
+// empty.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// proxyARPNetwork returns the network given by the --ipxpkt_proxy_arp flag,
+// or nil if it is not set.
+func proxyARPNetwork() *net.IPNet {
+	if *ipxpktProxyARP == "" {
+		return nil
+	}
+	_, result, err := net.ParseCIDR(*ipxpktProxyARP)
+	if err != nil {
+		log.Fatalf("invalid --ipxpkt_proxy_arp: %v", err)
+	}
+	return result
+}
+
+// vpnPPPConfig returns the PPP session configuration for the PPTP and L2TP
+// servers, based on the --pptp_users_file and --pptp_encryption flags.
+func vpnPPPConfig() ppp.Config {
+	var result ppp.Config
+	if *pptpUsersFile != "" {
+		users, err := ppp.ReadUsersFile(*pptpUsersFile)
+		if err != nil {
+			log.Fatalf("failed to read PPTP users file: %v", err)
+		}
+		result.Authenticator = users
+	}
+	if *pptpEncryption != "" {
+		strengths, err := mppe.ParseStrengths(*pptpEncryption)
+		if err != nil {
+			log.Fatalf("invalid --pptp_encryption: %v", err)
+		}
+		result.Encryption = strengths
+	}
+	return result
+}
+
 func makePcapWriter() *pcapgo.Writer {
 	f, err := os.Create(*dumpPackets)
 	if err != nil {
@@ -65,7 +331,42 @@ func makePcapWriter() *pcapgo.Writer {
 	return w
 }
 
-func makeNetwork(ctx context.Context) (network.Network, network.Network) {
+// filterRuleSet holds the rules of the packet filter. The rules given by
+// --filter_rules can be replaced at runtime through the admin server.
+type filterRuleSet struct {
+	net *filter.Network
+
+	// Rules from --filter and the NetBIOS filter. User rules come after
+	// these, so that an "allow" rule cannot let through packets that
+	// they would drop.
+	fixed filter.Rules
+
+	mu   sync.Mutex
+	user string
+}
+
+// setUserRules parses the given rules, in the format of --filter_rules, and
+// makes them take effect immediately for all clients.
+func (rs *filterRuleSet) setUserRules(s string) error {
+	userRules, err := filter.ParseRules(s)
+	if err != nil {
+		return err
+	}
+	rules := append(append(filter.Rules{}, rs.fixed...), userRules...)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.net.SetRule(rules.Rule())
+	rs.user = s
+	return nil
+}
+
+func (rs *filterRuleSet) userRules() string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.user
+}
+
+func makeNetwork(ctx context.Context, budget *pipe.Budget, logger *logging.Logger) (*stats.Network, *stats.Network, *ipxswitch.Network, *filterRuleSet) {
 	// We build the network up in layers, each layer adding an extra
 	// feature. This approach allows for modularity and separation of
 	// concerns, avoiding the complexity of a big monolithic system.
@@ -73,95 +374,583 @@ func makeNetwork(ctx context.Context) (network.Network, network.Network) {
 	//  1. Packet received from client; WritePacket() by server
 	//  2. Check source address matches client address (addressable)
 	//  3. Increment receive statistics (stats)
-	//  4. Drop packet if a NetBIOS packet (filter)
+	//  4. Drop packet if a NetBIOS packet (filter) or not from an
+	//     allowed game (gamefilter). If NetBIOS is allowed, type 20
+	//     packets that are looping are dropped instead (type20)
 	//  5. Fork incoming traffic to any network taps (tappable)
 	//  6. Forward to receive queue(s) of other clients (ipxswitch)
 	// Then back out the other way (tx):
 	//  1. Read packet from receive queue (ipxswitch)
 	//  2. No-op (tappable)
-	//  3. Filter NetBIOS packets (filter)
+	//  3. Filter NetBIOS and non-game packets (filter, gamefilter)
 	//  4. Increment transmit statistics (stats)
 	//  5. Check dest address matches client address (addressable)
 	//  5. ReadPacket() by server, and transmit to client.
 	var net network.Network
-	net = ipxswitch.New()
-	if *dumpPackets != "" {
+	sw := ipxswitch.New()
+	sw.ReflectSelfAddressed = *reflectSelf
+	sw.Budget = budget
+	sw.MaxNodes = *maxNodes
+	sw.MaxMirrors = *maxTaps
+	sw.UnknownDestinations = serverMetrics.UnknownDestinations
+	if *adminAddress != "" || *metricsAddr != "" {
+		sw.QueueTime = queueTimeHistogram
+	}
+	net = sw
+	if *dumpPackets != "" || *mirrorAddress != "" {
 		tappableLayer := tappable.Wrap(net)
-		w := makePcapWriter()
-		sink := phys.NewPcapgoSink(w, phys.FramerEthernetII)
-		go ipx.CopyPackets(ctx, tappableLayer.NewTap(), sink)
+		tappableLayer.Budget = budget
+		tappableLayer.TapBufferSize = *tapBufferSize
+		tappableLayer.MaxTaps = *maxTaps
+		if *dumpPackets != "" {
+			w := makePcapWriter()
+			sink := phys.NewPcapgoSink(w, phys.FramerEthernetII)
+			tap, err := tappableLayer.NewTap()
+			if err != nil {
+				log.Fatal(err)
+			}
+			go ipx.CopyPackets(ctx, tap, sink)
+		}
+		if *mirrorAddress != "" {
+			startMirror(ctx, tappableLayer)
+		}
 		net = tappableLayer
 	}
+	fixedRules, err := filter.LookupPresets(splitList(*filterPresets))
+	if err != nil {
+		log.Fatal(err)
+	}
 	if !*allowNetBIOS {
-		net = filter.Wrap(net)
+		fixedRules = append(fixedRules, filter.NetBIOSRules()...)
+	} else {
+		net = type20.Wrap(net, type20NetworkNumber())
+	}
+	var rules *filterRuleSet
+	// The filter is always added when the admin server is enabled, so
+	// that rules can be added at runtime.
+	if len(fixedRules) > 0 || *filterRules != "" || *adminAddress != "" {
+		filterNet := filter.WrapWithRules(net, nil)
+		rules = &filterRuleSet{net: filterNet, fixed: fixedRules}
+		if err := rules.setUserRules(*filterRules); err != nil {
+			log.Fatalf("invalid --filter_rules: %v", err)
+		}
+		net = filterNet
+	}
+	if *allowedGames != "" {
+		sigs, err := gamefilter.Lookup(strings.Split(*allowedGames, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		net = gamefilter.Wrap(net, sigs)
 	}
 	uplinkable := net
-	net = addressable.Wrap(net)
-	net = stats.Wrap(net)
-	return net, stats.Wrap(uplinkable)
+	policy, err := addressable.ParseSourcePolicy(*sourcePolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	prefix, err := addressable.ParseAddressPrefix(*addressPrefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	net = addressable.WrapWithConfig(net, &addressable.Config{
+		SourcePolicy:  policy,
+		AddressPrefix: prefix,
+		Reserved:      reservedAddresses(),
+	})
+	if logger == nil {
+		// Summaries are still useful without syslog.
+		logger = logging.New(log.Default(), logging.LevelInfo)
+	}
+	clients := stats.WrapWithConfig(net, &stats.Config{
+		LogInterval: *statsLogInterval,
+		Logger:      logger,
+	})
+	clients.Identify = gamefilter.Identify
+	go clients.Run(ctx)
+	return clients, stats.Wrap(uplinkable), sw, rules
+}
+
+// allocation describes a client in the address allocation table served by
+// the admin server.
+type allocation struct {
+	IPXAddress    string    `json:"ipx_address"`
+	RemoteAddress string    `json:"remote_address"`
+	ConnectTime   time.Time `json:"connect_time"`
+	LastSeen      time.Time `json:"last_seen"`
+	LastSent      time.Time `json:"last_sent"`
+	Trusted       bool      `json:"trusted,omitempty"`
+	Game          string    `json:"game,omitempty"`
+	Dropped       uint64    `json:"rate_limit_dropped"`
+	RxPackets     uint64    `json:"rx_packets"`
+	RxBytes       uint64    `json:"rx_bytes"`
+	TxPackets     uint64    `json:"tx_packets"`
+	TxBytes       uint64    `json:"tx_bytes"`
+}
+
+// pptpSession describes an active PPTP VPN session in the address allocation
+// table served by the admin server.
+type pptpSession struct {
+	IPXAddress    string    `json:"ipx_address"`
+	IPXNetwork    string    `json:"ipx_network,omitempty"`
+	RemoteAddress string    `json:"remote_address"`
+	ConnectTime   time.Time `json:"connect_time"`
+	stats.Counters
+}
+
+// allocationTable returns a description of the IPX addresses in use by
+// clients of the given server and PPTP server (if not nil), and the
+// addresses reserved for the server's own use.
+func allocationTable(s *server.Server, pptps *pptp.Server) interface{} {
+	clients := []allocation{}
+	for _, ci := range s.Snapshot() {
+		clients = append(clients, allocation{
+			IPXAddress:    ci.IPXAddr.String(),
+			RemoteAddress: ci.Addr.String(),
+			ConnectTime:   ci.ConnectTime,
+			LastSeen:      ci.LastReceiveTime,
+			LastSent:      ci.LastSendTime,
+			Trusted:       ci.Trusted,
+			Game:          ci.Game,
+			Dropped:       ci.Dropped,
+			RxPackets:     ci.RxPackets,
+			RxBytes:       ci.RxBytes,
+			TxPackets:     ci.TxPackets,
+			TxBytes:       ci.TxBytes,
+		})
+	}
+	reserved := []string{ipx.AddrNull.String(), ipx.AddrBroadcast.String()}
+	for _, addr := range reservedAddresses() {
+		reserved = append(reserved, addr.String())
+	}
+	result := map[string]interface{}{
+		"clients":  clients,
+		"reserved": reserved,
+	}
+	if pptps != nil {
+		sessions := []pptpSession{}
+		for _, si := range pptps.Sessions() {
+			ps := pptpSession{
+				IPXAddress:    si.IPXAddr.String(),
+				RemoteAddress: si.RemoteAddr.String(),
+				ConnectTime:   si.ConnectTime,
+				Counters:      si.Counters,
+			}
+			if si.IPXCP != nil {
+				ps.IPXNetwork = fmt.Sprintf("%x", si.IPXCP.Network[:])
+			}
+			sessions = append(sessions, ps)
+		}
+		result["pptp_sessions"] = sessions
+	}
+	return result
+}
+
+// handleSpectate serves the /spectate admin endpoint. Without parameters, it
+// returns a JSON list of the addresses of clients currently being mirrored.
+// With a "target" parameter, it streams a pcap capture of every unicast
+// packet sent to or from the target client until the request is cancelled.
+// Spectating is read-only; nothing can be sent into the network this way.
+func handleSpectate(sw *ipxswitch.Network, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.FormValue("target") == "" {
+		targets := []string{}
+		for _, target := range sw.Mirrors() {
+			targets = append(targets, target.String())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(targets)
+		return
+	}
+	target, err := ipx.ParseAddr(r.FormValue("target"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid target address: %v", err), http.StatusBadRequest)
+		return
+	}
+	m, err := sw.NewMirror(target)
+	if err == ipxswitch.TooManyMirrorsError {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer m.Close()
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	pw := pcapgo.NewWriter(flushWriter{w})
+	pw.WriteFileHeader(1500, layers.LinkTypeEthernet)
+	sink := phys.NewPcapgoSink(pw, phys.FramerEthernetII)
+	ipx.CopyPackets(r.Context(), m, sink)
+}
+
+// flushWriter is an io.Writer that flushes an HTTP response after every
+// write, so that streamed data reaches the client promptly.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// handleFilterRules serves the /filter_rules admin endpoint. A GET request
+// returns the current rules, in the format of --filter_rules. A POST request
+// replaces them with the rules in the "rules" parameter; the change takes
+// effect immediately, without disconnecting clients.
+func handleFilterRules(rules *filterRuleSet, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		fmt.Fprintln(w, rules.userRules())
+	case http.MethodPost:
+		if err := rules.setUserRules(r.FormValue("rules")); err != nil {
+			http.Error(w, fmt.Sprintf("invalid rules: %v", err), http.StatusBadRequest)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// metricsCollector returns a handler that serves the server's metrics in
+// the OpenMetrics format.
+func metricsCollector() http.Handler {
+	return servermetrics.NewCollector(serverMetrics, rttHistogram, queueTimeHistogram)
+}
+
+// startMetricsServer starts an HTTP server that only serves /metrics. Unlike
+// the admin server, it exposes nothing that identifies clients.
+func startMetricsServer() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsCollector())
+	go func() {
+		log.Fatal(http.ListenAndServe(*metricsAddr, mux))
+	}()
+}
+
+func statsHandler(net, uplinkable *stats.Network) http.Handler {
+	return stats.Handler(map[string]*stats.Network{
+		"clients": net,
+		"uplinks": uplinkable,
+	})
+}
+
+// startStatsServer starts an HTTP server that only serves /stats.json, with
+// the packet counters gathered by the stats layer.
+func startStatsServer(net, uplinkable *stats.Network) {
+	mux := http.NewServeMux()
+	mux.Handle("/stats.json", statsHandler(net, uplinkable))
+	go func() {
+		log.Fatal(http.ListenAndServe(*statsAddress, mux))
+	}()
+}
+
+// requireAdminToken wraps an admin server handler so that requests are
+// refused unless they include the token given by --admin_token.
+func requireAdminToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func startAdminServer(s *server.Server, pptps *pptp.Server, net, uplinkable *stats.Network, sw *ipxswitch.Network, rules *filterRuleSet, pseudonyms *pseudonym.Map) {
+	mux := http.NewServeMux()
+	mux.Handle("/stats.json", requireAdminToken(statsHandler(net, uplinkable)))
+	mux.Handle("/allocations.json", requireAdminToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(allocationTable(s, pptps))
+	})))
+	mux.Handle("/metrics", requireAdminToken(metricsCollector()))
+	mux.Handle("/spectate", requireAdminToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleSpectate(sw, w, r)
+	})))
+	mux.Handle("/filter_rules", requireAdminToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleFilterRules(rules, w, r)
+	})))
+	mux.Handle("/pseudonym", requireAdminToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, ok := pseudonyms.Lookup(r.URL.Query().Get("name"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, addr)
+	})))
+	go func() {
+		log.Fatal(http.ListenAndServe(*adminAddress, mux))
+	}()
 }
 
 func main() {
 	physFlags := phys.RegisterFlags()
 	flag.Parse()
 
+	if *selfTest {
+		if err := selftest.Run(os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *adminAddress != "" && *adminToken == "" {
+		log.Fatal("--admin_address requires --admin_token to be set")
+	}
+	if *readBufferSize < ipx.HeaderLength {
+		log.Fatalf("--udp_read_buffer_size must be at least %d bytes", ipx.HeaderLength)
+	}
+
 	ctx := context.Background()
 
-	var logger *log.Logger
-	if *enableSyslog {
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var logger *logging.Logger
+	var format syslog.Format
+	if *syslogFormat != "" {
+		format, err = syslog.ParseFormat(*syslogFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// The severity given here is only a default; messages from the
+	// leveled logger have their severity set from their level.
+	if *syslogAddress != "" {
+		if *syslogFormat == "" {
+			format = syslog.RFC5424
+		}
+		syslogger, err := syslog.NewRemoteLoggerWithFormat(*syslogNetwork,
+			*syslogAddress, format, syslog.LOG_NOTICE|syslog.LOG_DAEMON, 0)
+		if err != nil {
+			log.Fatalf("failed to connect to syslog server: %v", err)
+		}
+		logger = logging.New(syslogger, level)
+	} else if *enableSyslog {
+		var syslogger *log.Logger
 		var err error
-		logger, err = syslog.NewLogger(
-			syslog.LOG_NOTICE|syslog.LOG_DAEMON, 0)
+		if *syslogFormat != "" {
+			syslogger, err = syslog.NewLoggerWithFormat(format,
+				syslog.LOG_NOTICE|syslog.LOG_DAEMON, 0)
+		} else {
+			syslogger, err = syslog.NewLogger(
+				syslog.LOG_NOTICE|syslog.LOG_DAEMON, 0)
+		}
 		if err != nil {
 			log.Fatalf("failed to init syslog: %v", err)
 		}
+		logger = logging.New(syslogger, level)
 	}
 
-	net, uplinkable := makeNetwork(ctx)
+	var pseudonyms *pseudonym.Map
+	if *logPseudonyms {
+		var err error
+		pseudonyms, err = pseudonym.New(nil)
+		if err != nil {
+			log.Fatalf("failed to init pseudonyms: %v", err)
+		}
+	}
+
+	var budget *pipe.Budget
+	if *memoryLimit > 0 {
+		budget = pipe.NewBudget(*memoryLimit)
+	}
+	net, uplinkable, sw, rules := makeNetwork(ctx, budget, logger)
 
 	physLink, err := physFlags.MakePhys(*enableIpxpkt)
 	if err != nil {
 		log.Fatalf("failed to set up physical network: %v", err)
 	} else if physLink != nil {
-		port := uplinkable.NewNode()
+		port := mustNewNode(uplinkable, "physical network")
 		go physLink.Run()
-		go ipx.DuplexCopyPackets(ctx, physLink, port)
+		if *physFlags.Keepalive > 0 {
+			go physLink.SendKeepalives(ctx, *physFlags.Keepalive)
+		}
+		var physPort ipx.ReadWriteCloser = physLink
+		if *physFlags.LoopWindow > 0 {
+			physPort = phys.NewLoopGuardWithConfig(physLink, &phys.LoopGuardConfig{
+				Window: *physFlags.LoopWindow,
+				Size:   *physFlags.LoopCacheSize,
+				Logger: logger,
+			})
+		}
+		go func() {
+			err := ipx.DuplexCopyPackets(ctx, physPort, port)
+			logBridgeStopped(logger, "physical network", err)
+		}()
 		if *enableIpxpkt {
-			r := ipxpkt.NewRouter(net.NewNode())
-			go phys.CopyFrames(r, physLink.NonIPX())
+			r := ipxpkt.NewRouterWithConfig(mustNewNode(net, "IPXPKT router"), &ipxpkt.Config{
+				ReassemblyWindow:  *ipxpktWindow,
+				ReassemblyTimeout: *ipxpktTimeout,
+				TranslateMACs:     *ipxpktTranslateMACs,
+				ProxyARPNetwork:   proxyARPNetwork(),
+			})
+			go func() {
+				err := phys.CopyFrames(ctx, r, physLink.NonIPX())
+				logBridgeStopped(logger, "IPXPKT router", err)
+			}()
 		}
 	}
 	addQuakeProxies(ctx, net)
+	addUDPProxies(ctx, net)
+	addKernelIPXBridges(ctx, uplinkable)
+	if *enableIPXPing {
+		go ipxping.New(mustNewNode(net, "IPX ping responder")).Run(ctx)
+	}
+	var pptps *pptp.Server
 	if *enablePPTP {
-		pptps, err := pptp.NewServer(net)
+		pptps, err = pptp.NewServerWithConfig(net, &pptp.Config{
+			Address:     *pptpAddress,
+			GREAddress:  *pptpGREAddress,
+			MaxSessions: *pptpMaxSessions,
+			IdleTimeout: *pptpIdleTimeout,
+			PPP:         vpnPPPConfig(),
+		})
 		if err != nil {
 			log.Fatalf("failed to start PPTP server: %v", err)
 		}
-		go pptps.Run(ctx)
+		go func() {
+			if err := pptps.Run(ctx); err != nil {
+				log.Fatalf("PPTP server failed: %v", err)
+			}
+		}()
+	}
+	if *enableL2TP {
+		l2tps, err := l2tp.NewServerWithConfig(net, &l2tp.Config{
+			Address:     *l2tpAddress,
+			MaxTunnels:  *l2tpMaxTunnels,
+			MaxSessions: *l2tpMaxSessions,
+			IdleTimeout: *l2tpIdleTimeout,
+			PPP:         vpnPPPConfig(),
+		})
+		if err != nil {
+			log.Fatalf("failed to start L2TP server: %v", err)
+		}
+		go func() {
+			if err := l2tps.Run(ctx); err != nil {
+				log.Fatalf("L2TP server failed: %v", err)
+			}
+		}()
+	}
+
+	var notifier *webhook.Notifier
+	if *webhookURL != "" {
+		notifier = webhook.New(&webhook.Config{
+			URL:     *webhookURL,
+			Timeout: 10 * time.Second,
+			Retries: 3,
+			Backoff: time.Second,
+			Logger:  logger,
+		})
+		go notifier.Run(ctx)
+	}
+
+	var clientNet network.Network = net
+	if *gameShims != "" {
+		transforms, err := rewrite.ParseTransforms(*gameShims)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clientNet = rewrite.Wrap(net, &rewrite.Config{
+			Identify:   gamefilter.Identify,
+			Transforms: transforms,
+		})
 	}
 
 	protocols := []server.Protocol{
 		&dosbox.Protocol{
-			Logger:        logger,
-			Network:       net,
-			KeepaliveTime: 5 * time.Second,
+			Logger:           logger,
+			Network:          clientNet,
+			KeepaliveTime:    5 * time.Second,
+			MinKeepaliveTime: *minKeepaliveTime,
+			Pseudonyms:       pseudonyms,
+			Webhook:          notifier,
+			RTT:              rttHistogram,
+
+			AcceptOversizedRegistration: *acceptOversizedReg,
+			AddressLeaseTime:            *addressLeaseTime,
+			VerifyChecksums:             *verifyChecksums,
+			ReflectBroadcasts:           *reflectBcasts,
 		},
 	}
 	if *uplinkPassword != "" {
 		protocols = append(protocols, &uplink.Protocol{
-			Logger:        logger,
-			Network:       uplinkable,
-			Password:      *uplinkPassword,
-			KeepaliveTime: 5 * time.Second,
+			Logger:           logger,
+			Network:          uplinkable,
+			Password:         *uplinkPassword,
+			KeepaliveTime:    5 * time.Second,
+			Pseudonyms:       pseudonyms,
+			ChallengeTimeout: 30 * time.Second,
 		})
 	}
-	s, err := server.New(fmt.Sprintf(":%d", *port), &server.Config{
-		Protocols:     protocols,
-		ClientTimeout: *clientTimeout,
-		Logger:        logger,
-	})
+	trusted, err := server.ParseTrustList(*trustedClients)
 	if err != nil {
 		log.Fatal(err)
 	}
-	s.Run(ctx)
+	config := &server.Config{
+		Network:             *listenNetwork,
+		Protocols:           protocols,
+		ClientTimeout:       *clientTimeout,
+		MaxClients:          *maxClients,
+		MaxPacketRate:       *maxPacketRate,
+		MaxByteRate:         *maxByteRate,
+		Logger:              logger,
+		Budget:              budget,
+		Pseudonyms:          pseudonyms,
+		PacketLogSampleRate: *packetLogSampleRate,
+		SharedSecret:        []byte(*sharedSecret),
+		CheckPacketLength:   *checkPacketLength,
+		ReadBufferSize:      *readBufferSize,
+		Metrics:             serverMetrics,
+		Identify:            gamefilter.Identify,
+		AllowedCIDRs:        splitList(*allowedNetworks),
+		BlockedCIDRs:        splitList(*blockedNetworks),
+
+		TrustedClients:       trusted,
+		TrustedClientTimeout: *trustedTimeout,
+	}
+	s, err := server.New(fmt.Sprintf(":%d", *port), config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *tcpAddress != "" {
+		tcps, err := server.NewTCP(*tcpAddress, s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := tcps.Run(ctx); err != nil {
+				log.Fatalf("TCP server failed: %v", err)
+			}
+		}()
+	}
+	if *wsAddress != "" {
+		wss := ws.NewWithConfig(s, &ws.Config{
+			AllowedOrigins: splitList(*wsAllowedOrigins),
+		})
+		go func() {
+			log.Fatal(http.ListenAndServe(*wsAddress, wss))
+		}()
+	}
+	if *metricsAddr != "" {
+		startMetricsServer()
+	}
+	if *statsAddress != "" {
+		startStatsServer(net, uplinkable)
+	}
+	if *adminAddress != "" {
+		startAdminServer(s, pptps, net, uplinkable, sw, rules, pseudonyms)
+	}
+	if err := s.Run(ctx); err != nil {
+		log.Fatalf("server failed: %v", err)
+	}
 }
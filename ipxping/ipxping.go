@@ -0,0 +1,94 @@
+// Package ipxping implements a responder for the Novell IPX ping protocol,
+// as used by tools like IPXPING. This allows users to verify connectivity
+// to the server using familiar diagnostic tools.
+package ipxping
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+const (
+	// Socket is the well-known IPX socket number used for Novell IPX
+	// ping requests and replies.
+	Socket = 0x9086
+
+	// headerLength is the length of the ping header that precedes any
+	// optional data in the payload:
+	//   4 bytes  "Ping" signature
+	//   1 byte   version
+	//   1 byte   type (0 = request, 1 = reply)
+	//   2 bytes  ping ID
+	//   1 byte   result
+	//   1 byte   reserved
+	headerLength = 10
+
+	typeRequest = 0
+	typeReply   = 1
+)
+
+var signature = []byte("Ping")
+
+// Responder reads packets from a network node and answers any IPX ping
+// requests that it receives.
+type Responder struct {
+	node network.Node
+}
+
+// IsRequest returns true if the given packet is an IPX ping request.
+func IsRequest(packet *ipx.Packet) bool {
+	return packet.Header.Dest.Socket == Socket &&
+		len(packet.Payload) >= headerLength &&
+		bytes.Equal(packet.Payload[0:4], signature) &&
+		packet.Payload[5] == typeRequest
+}
+
+// MakeReply returns the reply packet that should be sent in response to
+// the given IPX ping request, which is sent from the given address.
+func MakeReply(request *ipx.Packet, addr ipx.Addr) *ipx.Packet {
+	payload := append([]byte{}, request.Payload...)
+	payload[5] = typeReply
+	payload[8] = 0 // result
+	return &ipx.Packet{
+		Header: ipx.Header{
+			Checksum: 0xffff,
+			Length:   uint16(ipx.HeaderLength + len(payload)),
+			Dest:     request.Header.Src,
+			Src: ipx.HeaderAddr{
+				Network: request.Header.Dest.Network,
+				Addr:    addr,
+				Socket:  Socket,
+			},
+		},
+		Payload: payload,
+	}
+}
+
+// Run reads packets from the node, responding to ping requests, until the
+// context is cancelled or the node is closed.
+func (r *Responder) Run(ctx context.Context) error {
+	addr := network.NodeAddress(r.node)
+	for {
+		packet, err := r.node.ReadPacket(ctx)
+		switch {
+		case errors.Is(err, io.ErrClosedPipe):
+			return nil
+		case err != nil:
+			return err
+		}
+		if !IsRequest(packet) {
+			continue
+		}
+		r.node.WritePacket(MakeReply(packet, addr))
+	}
+}
+
+// New creates a new Responder that answers pings received by the given node.
+func New(node network.Node) *Responder {
+	return &Responder{node: node}
+}
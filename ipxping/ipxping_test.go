@@ -0,0 +1,79 @@
+package ipxping
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+var (
+	clientAddr = ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	serverAddr = ipx.Addr{0x02, 0x66, 0x77, 0x88, 0x99, 0xaa}
+)
+
+func TestPingReply(t *testing.T) {
+	client, inner := ipxtesting.MakeLoopbackPair("client", "responder")
+	r := New(&ipxtesting.FakeNetwork{
+		Inner:   inner,
+		Address: serverAddr,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go r.Run(ctx)
+
+	request := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{
+				Addr:   ipx.AddrBroadcast,
+				Socket: Socket,
+			},
+			Src: ipx.HeaderAddr{
+				Addr:   clientAddr,
+				Socket: 0x4001,
+			},
+		},
+		Payload: []byte("Ping\x01\x00\x12\x34\x00\x00extra data"),
+	}
+	client.WritePacket(request)
+
+	reply, err := client.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("no reply received: %v", err)
+	}
+	if reply.Header.Dest != request.Header.Src {
+		t.Errorf("reply sent to wrong address: want %+v, got %+v", request.Header.Src, reply.Header.Dest)
+	}
+	if reply.Header.Src.Addr != serverAddr || reply.Header.Src.Socket != Socket {
+		t.Errorf("reply from wrong address: %+v", reply.Header.Src)
+	}
+	want := []byte("Ping\x01\x01\x12\x34\x00\x00extra data")
+	if !bytes.Equal(reply.Payload, want) {
+		t.Errorf("wrong reply payload: want %q, got %q", want, reply.Payload)
+	}
+}
+
+func TestIsRequest(t *testing.T) {
+	packet := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Socket: Socket},
+		},
+	}
+	for _, tc := range []struct {
+		payload string
+		want    bool
+	}{
+		{"Ping\x01\x00\x00\x01\x00\x00", true},
+		{"Ping\x01\x01\x00\x01\x00\x00", false}, // reply
+		{"Pong\x01\x00\x00\x01\x00\x00", false},
+		{"Ping\x01", false},
+	} {
+		packet.Payload = []byte(tc.payload)
+		if got := IsRequest(packet); got != tc.want {
+			t.Errorf("IsRequest(%q) = %v, want %v", tc.payload, got, tc.want)
+		}
+	}
+}
@@ -10,13 +10,14 @@ const (
 	// This should match the maximum used by ipxpkt.com:
 	maxFragmentPayload = 510
 
-	// maxFrames is the maximum number of frames we store for reassembly
-	// at any given time.
-	maxFrames = 16
+	// DefaultReassemblyWindow is the default maximum number of frames
+	// we store for reassembly at any given time.
+	DefaultReassemblyWindow = 16
 
-	// maxAge is the maximum amount of time that we hold a frame for
-	// reassembly before giving up and flushing it.
-	maxAge = 10 * time.Second
+	// DefaultReassemblyTimeout is the default maximum amount of time
+	// that we hold a frame for reassembly without receiving any new
+	// fragments before giving up and flushing it.
+	DefaultReassemblyTimeout = 10 * time.Second
 )
 
 type frameKey struct {
@@ -30,7 +31,9 @@ type frameData struct {
 }
 
 type frameReassembler struct {
-	frames map[frameKey]*frameData
+	frames  map[frameKey]*frameData
+	window  int
+	timeout time.Duration
 }
 
 func (fd *frameData) processFragment(hdr *Header, fragment []byte) ([]byte, bool) {
@@ -38,6 +41,9 @@ func (fd *frameData) processFragment(hdr *Header, fragment []byte) ([]byte, bool
 	if int(hdr.NumFragments) != len(fd.fragments) {
 		return nil, false
 	}
+	if hdr.Fragment < 1 || int(hdr.Fragment) > len(fd.fragments) {
+		return nil, false
+	}
 	fd.lastRX = time.Now()
 	fd.fragments[hdr.Fragment-1] = append([]byte{}, fragment...)
 	for _, f := range fd.fragments {
@@ -52,33 +58,43 @@ func (fd *frameData) processFragment(hdr *Header, fragment []byte) ([]byte, bool
 	return result, true
 }
 
-func (fr *frameReassembler) init() {
+func (fr *frameReassembler) init(window int, timeout time.Duration) {
 	fr.frames = make(map[frameKey]*frameData)
+	fr.window = window
+	if fr.window <= 0 {
+		fr.window = DefaultReassemblyWindow
+	}
+	fr.timeout = timeout
+	if fr.timeout <= 0 {
+		fr.timeout = DefaultReassemblyTimeout
+	}
 }
 
-// flush empties out old frames from the queue that are older than maxAge. If
-// none are older than maxAge then the frame is emptied that has been sitting
-// in the queue for the longest time with no fragment being received.
-func (fr *frameReassembler) flush() {
-	flushKeys := make([]frameKey, 0)
+// expire empties out frames from the queue that have not received a fragment
+// in longer than the reassembly timeout, so that buffers for frames that will
+// never be completed are not held forever.
+func (fr *frameReassembler) expire() {
 	now := time.Now()
+	for key, data := range fr.frames {
+		if now.After(data.lastRX.Add(fr.timeout)) {
+			delete(fr.frames, key)
+		}
+	}
+}
+
+// flush empties the frame from the queue that has been sitting in the queue
+// for the longest time with no fragment being received, to make space for a
+// new frame.
+func (fr *frameReassembler) flush() {
 	var oldest frameKey
 	var oldestTime time.Time
 	for key, data := range fr.frames {
-		if now.After(data.lastRX.Add(maxAge)) {
-			flushKeys = append(flushKeys, key)
-		} else if oldestTime.IsZero() || data.lastRX.Before(oldestTime) {
+		if oldestTime.IsZero() || data.lastRX.Before(oldestTime) {
 			oldest = key
 			oldestTime = data.lastRX
 		}
 	}
-	for _, key := range flushKeys {
-		delete(fr.frames, key)
-	}
-	// We always flush at least one frame from the queue to make space.
-	if len(flushKeys) == 0 {
-		delete(fr.frames, oldest)
-	}
+	delete(fr.frames, oldest)
 }
 
 func (fr *frameReassembler) reassemble(ipxHeader *ipx.Header, hdr *Header, fragment []byte) ([]byte, bool) {
@@ -90,14 +106,17 @@ func (fr *frameReassembler) reassemble(ipxHeader *ipx.Header, hdr *Header, fragm
 		src:      ipxHeader.Src,
 		packetID: hdr.PacketID,
 	}
+	fr.expire()
 	fd, ok := fr.frames[key]
-	// First fragment of frame?
+	// First fragment of frame? Fragments may arrive in any order, so this
+	// is not necessarily fragment #1.
 	if !ok {
-		if len(fr.frames) >= maxFrames {
+		if len(fr.frames) >= fr.window {
 			fr.flush()
 		}
 		fd = &frameData{
 			fragments: make([][]byte, hdr.NumFragments),
+			lastRX:    time.Now(),
 		}
 		fr.frames[key] = fd
 	}
@@ -0,0 +1,133 @@
+package ipxpkt
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+var testSrc = &ipx.Header{
+	Src: ipx.HeaderAddr{Addr: ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}},
+}
+
+func makeTestFrame(length int) []byte {
+	result := make([]byte, length)
+	for i := range result {
+		result[i] = byte(i)
+	}
+	return result
+}
+
+func TestReassembleReordered(t *testing.T) {
+	var fr frameReassembler
+	fr.init(4, time.Minute)
+
+	// Fragments of two frames, interleaved and out of order.
+	frames := [][]byte{makeTestFrame(1500), makeTestFrame(1200)}
+	fragments := [][][]byte{fragmentFrame(frames[0]), fragmentFrame(frames[1])}
+	order := []struct{ frame, fragment int }{
+		{0, 2}, {1, 1}, {0, 0}, {1, 0}, {0, 1}, {1, 2},
+	}
+	var got [][]byte
+	for _, o := range order {
+		hdr := &Header{
+			Fragment:     uint8(o.fragment + 1),
+			NumFragments: uint8(len(fragments[o.frame])),
+			PacketID:     uint16(o.frame),
+		}
+		if frame, ok := fr.reassemble(testSrc, hdr, fragments[o.frame][o.fragment]); ok {
+			got = append(got, frame)
+		}
+	}
+	if len(got) != 2 || !bytes.Equal(got[0], frames[0]) || !bytes.Equal(got[1], frames[1]) {
+		t.Errorf("frames not reassembled correctly, got %d frames", len(got))
+	}
+	if len(fr.frames) != 0 {
+		t.Errorf("reassembly buffers not released: %d remaining", len(fr.frames))
+	}
+}
+
+func TestReassembleTimeout(t *testing.T) {
+	var fr frameReassembler
+	fr.init(4, time.Minute)
+
+	fragments := fragmentFrame(makeTestFrame(1500))
+	hdr := &Header{Fragment: 1, NumFragments: uint8(len(fragments)), PacketID: 1}
+	if _, ok := fr.reassemble(testSrc, hdr, fragments[0]); ok {
+		t.Fatalf("frame complete after only one fragment")
+	}
+
+	// Simulate the timeout expiring before the remaining fragments
+	// arrive. The incomplete frame should be discarded.
+	for _, fd := range fr.frames {
+		fd.lastRX = time.Now().Add(-2 * time.Minute)
+	}
+	for i := 1; i < len(fragments); i++ {
+		hdr.Fragment = uint8(i + 1)
+		if _, ok := fr.reassemble(testSrc, hdr, fragments[i]); ok {
+			t.Errorf("frame reassembled from fragments spanning the timeout")
+		}
+	}
+
+	// Timed out frames are cleaned up even when no more fragments for
+	// them are received.
+	fr.init(4, time.Minute)
+	fr.reassemble(testSrc, hdr, fragments[0])
+	for _, fd := range fr.frames {
+		fd.lastRX = time.Now().Add(-2 * time.Minute)
+	}
+	fr.expire()
+	if len(fr.frames) != 0 {
+		t.Errorf("timed out frame not discarded: %d remaining", len(fr.frames))
+	}
+}
+
+func TestReassembleBadFragment(t *testing.T) {
+	var fr frameReassembler
+	fr.init(4, time.Minute)
+	for _, fragment := range []uint8{0, 4} {
+		hdr := &Header{Fragment: fragment, NumFragments: 3, PacketID: 1}
+		if _, ok := fr.reassemble(testSrc, hdr, []byte{1, 2, 3}); ok {
+			t.Errorf("fragment %d of 3 produced a frame", fragment)
+		}
+	}
+}
+
+func TestRouterLargeFrames(t *testing.T) {
+	n := addressable.Wrap(ipxswitch.New())
+	serverNode := ipxtesting.MustNewNode(t, n)
+	clientNode := ipxtesting.MustNewNode(t, n)
+	server, client := NewRouter(serverNode), NewRouter(clientNode)
+	serverAddr := network.NodeAddress(serverNode)
+	clientAddr := network.NodeAddress(clientNode)
+	serverFrames, clientFrames := readFrames(server), readFrames(client)
+
+	// Frames too large for a single IPX packet are split into fragments
+	// by the sender and reassembled by the receiver, in both directions.
+	for _, test := range []struct {
+		name     string
+		from     *Router
+		to       <-chan []byte
+		destAddr ipx.Addr
+	}{
+		{"client to server", client, serverFrames, serverAddr},
+		{"server to client", server, clientFrames, clientAddr},
+	} {
+		frame := makeTestFrame(3000)
+		copy(frame[0:6], test.destAddr[:])
+		copy(frame[6:12], lanMAC)
+		if err := test.from.WritePacketData(frame); err != nil {
+			t.Fatal(err)
+		}
+		got := nextFrame(test.to)
+		if !bytes.Equal(got, frame) {
+			t.Errorf("%s: frame not reassembled correctly: sent %d bytes, got %d", test.name, len(frame), len(got))
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package ipxpkt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+const (
+	ethernetHeaderLen = 14
+	etherTypeARP      = 0x0806
+
+	// Offsets of the sender and target hardware addresses within an
+	// ARP packet for IPv4 over Ethernet.
+	arpSenderHWOffset = 8
+	arpTargetHWOffset = 18
+	arpPacketLen      = 28
+
+	// maxMACPrefixLen is the maximum length of a translated MAC address
+	// prefix, leaving at least three random bytes.
+	maxMACPrefixLen = 3
+)
+
+var (
+	// DefaultMACPrefix is the prefix used for translated MAC addresses
+	// if Config.MACPrefix is empty. The locally administered bit is set
+	// so that they will not conflict with real hardware.
+	DefaultMACPrefix = []byte{0x02}
+
+	// DefaultMACTimeout is the time after which an unused MAC address
+	// translation is forgotten if Config.MACTimeout is zero.
+	DefaultMACTimeout = 30 * time.Minute
+)
+
+type macAddr [6]byte
+
+// clientMAC identifies a MAC address used by a particular IPXPKT client;
+// two clients may use the same MAC address.
+type clientMAC struct {
+	client ipx.Addr
+	mac    macAddr
+}
+
+type macEntry struct {
+	clientMAC
+	translated macAddr
+	lastUsed   time.Time
+}
+
+// macTranslator maps the MAC addresses of IPXPKT clients to addresses that
+// it allocates, in a similar way to how network address translation maps
+// IP addresses.
+type macTranslator struct {
+	prefix  []byte
+	rand    io.Reader
+	timeout time.Duration
+
+	mu           sync.Mutex
+	byClient     map[clientMAC]*macEntry
+	byTranslated map[macAddr]*macEntry
+}
+
+func checkMACPrefix(prefix []byte) error {
+	if len(prefix) > maxMACPrefixLen {
+		return fmt.Errorf("MAC address prefix %x too long: at most %d bytes allowed", prefix, maxMACPrefixLen)
+	}
+	if len(prefix) > 0 && prefix[0]&0x01 != 0 {
+		return fmt.Errorf("MAC address prefix %x is a multicast prefix", prefix)
+	}
+	return nil
+}
+
+func newMACTranslator(prefix []byte, rand io.Reader, timeout time.Duration) *macTranslator {
+	return &macTranslator{
+		prefix:       prefix,
+		rand:         rand,
+		timeout:      timeout,
+		byClient:     make(map[clientMAC]*macEntry),
+		byTranslated: make(map[macAddr]*macEntry),
+	}
+}
+
+// expire removes translations that have not been used recently. The
+// caller must hold t.mu.
+func (t *macTranslator) expire(now time.Time) {
+	for addr, e := range t.byTranslated {
+		if now.Sub(e.lastUsed) >= t.timeout {
+			delete(t.byTranslated, addr)
+			delete(t.byClient, e.clientMAC)
+		}
+	}
+}
+
+// lookupClient returns the translation for the given client's MAC
+// address, allocating a new one if necessary. The caller must hold t.mu.
+func (t *macTranslator) lookupClient(cm clientMAC, now time.Time) (*macEntry, error) {
+	if e, ok := t.byClient[cm]; ok {
+		e.lastUsed = now
+		return e, nil
+	}
+	t.expire(now)
+	e := &macEntry{clientMAC: cm, lastUsed: now}
+	// Repeatedly generate a new address until we generate one that is
+	// not already in use.
+	for {
+		copy(e.translated[:], t.prefix)
+		if _, err := io.ReadFull(t.rand, e.translated[len(t.prefix):]); err != nil {
+			return nil, err
+		}
+		if _, ok := t.byTranslated[e.translated]; !ok {
+			break
+		}
+	}
+	t.byClient[cm] = e
+	t.byTranslated[e.translated] = e
+	return e, nil
+}
+
+// arpHardwareAddr returns the slice of an Ethernet frame containing the ARP
+// hardware address at the given offset, or nil if the frame is not an ARP
+// packet for IPv4 over Ethernet.
+func arpHardwareAddr(frame []byte, offset int) []byte {
+	if len(frame) < ethernetHeaderLen+arpPacketLen ||
+		binary.BigEndian.Uint16(frame[12:14]) != etherTypeARP {
+		return nil
+	}
+	arp := frame[ethernetHeaderLen:]
+	if binary.BigEndian.Uint16(arp[0:2]) != 1 || arp[4] != 6 {
+		return nil
+	}
+	return arp[offset : offset+6]
+}
+
+// translateOutbound rewrites a frame received from the given client
+// before it is sent to the physical network, replacing the client's MAC
+// address with the translated address.
+func (t *macTranslator) translateOutbound(client ipx.Addr, frame []byte) ([]byte, error) {
+	if len(frame) < ethernetHeaderLen {
+		return frame, nil
+	}
+	frame = append([]byte{}, frame...)
+	cm := clientMAC{client: client}
+	copy(cm.mac[:], frame[6:12])
+	t.mu.Lock()
+	e, err := t.lookupClient(cm, time.Now())
+	t.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	copy(frame[6:12], e.translated[:])
+	if sha := arpHardwareAddr(frame, arpSenderHWOffset); sha != nil && toMAC(sha) == cm.mac {
+		copy(sha, e.translated[:])
+	}
+	return frame, nil
+}
+
+// translateInbound rewrites a frame from the physical network that is
+// addressed to a translated MAC address, restoring the client's own
+// address. It returns the IPX address of the client to send the frame to,
+// or false if the frame is not addressed to a translated address.
+func (t *macTranslator) translateInbound(frame []byte) ([]byte, ipx.Addr, bool) {
+	if len(frame) < ethernetHeaderLen {
+		return frame, ipx.AddrNull, false
+	}
+	t.mu.Lock()
+	e, ok := t.byTranslated[toMAC(frame[0:6])]
+	var cm clientMAC
+	if ok {
+		e.lastUsed = time.Now()
+		cm = e.clientMAC
+	}
+	t.mu.Unlock()
+	if !ok {
+		return frame, ipx.AddrNull, false
+	}
+	frame = append([]byte{}, frame...)
+	copy(frame[0:6], cm.mac[:])
+	if tha := arpHardwareAddr(frame, arpTargetHWOffset); tha != nil && toMAC(tha) == e.translated {
+		copy(tha, cm.mac[:])
+	}
+	return frame, cm.client, true
+}
+
+func toMAC(b []byte) macAddr {
+	var result macAddr
+	copy(result[:], b)
+	return result
+}
@@ -0,0 +1,130 @@
+package ipxpkt
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+var (
+	broadcastMAC   = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	clientMACBytes = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x01}
+	lanMAC         = []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+)
+
+// makeARPFrame returns an Ethernet frame containing an ARP packet with
+// the given sender and target hardware addresses.
+func makeARPFrame(dest, src, sha, tha []byte) []byte {
+	frame := append(append([]byte{}, dest...), src...)
+	frame = append(frame, 0x08, 0x06)             // ARP
+	frame = append(frame, 0x00, 0x01, 0x08, 0x00) // Ethernet, IPv4
+	frame = append(frame, 6, 4, 0x00, 0x01)       // lengths, request
+	frame = append(frame, sha...)
+	frame = append(frame, 10, 0, 0, 1)
+	frame = append(frame, tha...)
+	frame = append(frame, 10, 0, 0, 2)
+	return frame
+}
+
+// readFrames returns a channel of the frames read from the given router.
+func readFrames(r *Router) <-chan []byte {
+	result := make(chan []byte, 16)
+	go func() {
+		for {
+			frame, _, err := r.ReadPacketData()
+			if err != nil {
+				close(result)
+				return
+			}
+			result <- frame
+		}
+	}()
+	return result
+}
+
+// nextFrame returns the next frame from the given channel, or nil if none
+// arrives quickly.
+func nextFrame(frames <-chan []byte) []byte {
+	select {
+	case frame := <-frames:
+		return frame
+	case <-time.After(200 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestTranslateMACs(t *testing.T) {
+	net := addressable.Wrap(ipxswitch.New())
+	serverNode := ipxtesting.MustNewNode(t, net)
+	server := NewRouterWithConfig(serverNode, &Config{
+		TranslateMACs: true,
+	})
+	serverAddr := network.NodeAddress(serverNode)
+	serverFrames := readFrames(server)
+	// Two clients using the same MAC address.
+	clients := []*Router{
+		NewRouter(ipxtesting.MustNewNode(t, net)),
+		NewRouter(ipxtesting.MustNewNode(t, net)),
+	}
+	clientFrames := []<-chan []byte{readFrames(clients[0]), readFrames(clients[1])}
+	var translated [][]byte
+	for i, c := range clients {
+		frame := makeARPFrame(serverAddr[:], clientMACBytes, clientMACBytes, make([]byte, 6))
+		if err := c.WritePacketData(frame); err != nil {
+			t.Fatal(err)
+		}
+		got := nextFrame(serverFrames)
+		if got == nil {
+			t.Fatalf("frame from client %d not received", i)
+		}
+		src := got[6:12]
+		if src[0] != DefaultMACPrefix[0] || bytes.Equal(src, clientMACBytes) {
+			t.Errorf("client %d: source MAC not translated: %x", i, src)
+		}
+		if sha := got[22:28]; !bytes.Equal(sha, src) {
+			t.Errorf("client %d: ARP sender address not translated: %x", i, sha)
+		}
+		translated = append(translated, append([]byte{}, src...))
+	}
+	if bytes.Equal(translated[0], translated[1]) {
+		t.Fatalf("both clients translated to the same address %x", translated[0])
+	}
+
+	// A reply to the second client's translated address is delivered
+	// only to the second client, with its own address restored.
+	reply := makeARPFrame(translated[1], lanMAC, lanMAC, translated[1])
+	if err := server.WritePacketData(reply); err != nil {
+		t.Fatal(err)
+	}
+	got := nextFrame(clientFrames[1])
+	if got == nil {
+		t.Fatalf("reply not received by client")
+	}
+	if !bytes.Equal(got[0:6], clientMACBytes) {
+		t.Errorf("destination MAC not restored: %x", got[0:6])
+	}
+	if tha := got[32:38]; !bytes.Equal(tha, clientMACBytes) {
+		t.Errorf("ARP target address not restored: %x", tha)
+	}
+	if got := nextFrame(clientFrames[0]); got != nil {
+		t.Errorf("reply delivered to wrong client: %x", got)
+	}
+}
+
+func TestTranslateMACsRandError(t *testing.T) {
+	// The random source runs out after the first translated address.
+	tr := newMACTranslator(DefaultMACPrefix, bytes.NewReader([]byte{1, 2, 3, 4, 5}), time.Minute)
+	for i, want := range []bool{true, false} {
+		client := ipx.Addr{0, 0, 0, 0, 0, byte(i)}
+		frame := makeARPFrame(broadcastMAC, clientMACBytes, clientMACBytes, make([]byte, 6))
+		if _, err := tr.translateOutbound(client, frame); (err == nil) != want {
+			t.Errorf("client %d: want success=%v, got error %v", i, want, err)
+		}
+	}
+}
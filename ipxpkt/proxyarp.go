@@ -0,0 +1,206 @@
+package ipxpkt
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+
+	arpRequest = 1
+	arpReply   = 2
+
+	// Offsets of the sender and target protocol addresses within an
+	// ARP packet for IPv4 over Ethernet.
+	arpSenderIPOffset = 14
+	arpTargetIPOffset = 24
+
+	// Offsets of the source and destination addresses within an IPv4
+	// header.
+	ipv4SrcOffset  = 12
+	ipv4DestOffset = 16
+	ipv4MinLen     = 20
+
+	// proxyARPTimeout is the time after which an address is forgotten
+	// if no ARP packets have been seen for it.
+	proxyARPTimeout = 30 * time.Minute
+
+	// proxyARPSweepInterval is how often expired addresses are removed.
+	proxyARPSweepInterval = time.Minute
+)
+
+type ipv4Addr [4]byte
+
+type proxyHost struct {
+	client   ipx.Addr
+	mac      macAddr
+	lastSeen time.Time
+}
+
+// arpProxy answers ARP requests from the physical network on behalf of
+// hosts on the IPX side of the router, giving the router's own address, and
+// forwards frames sent to that address to the right host. Addresses are only
+// learned within the configured network, and never for addresses that have
+// been seen in use on the physical network, so that an IPXPKT client cannot
+// take over the address of a physical host.
+type arpProxy struct {
+	mac     macAddr
+	network *net.IPNet
+
+	mu        sync.Mutex
+	hosts     map[ipv4Addr]*proxyHost
+	physical  map[ipv4Addr]time.Time
+	nextSweep time.Time
+}
+
+func newARPProxy(mac macAddr, network *net.IPNet) *arpProxy {
+	return &arpProxy{
+		mac:      mac,
+		network:  network,
+		hosts:    make(map[ipv4Addr]*proxyHost),
+		physical: make(map[ipv4Addr]time.Time),
+	}
+}
+
+// isIPv4ARP returns true if the frame is an ARP packet for IPv4 over
+// Ethernet.
+func isIPv4ARP(frame []byte) bool {
+	return arpHardwareAddr(frame, arpSenderHWOffset) != nil &&
+		binary.BigEndian.Uint16(frame[ethernetHeaderLen+2:]) == etherTypeIPv4 &&
+		frame[ethernetHeaderLen+5] == 4
+}
+
+// senderIP returns the IPv4 address claimed by the sender of the given
+// frame, if it is an ARP or (if includeIPv4 is true) IPv4 packet, and the
+// address is within the proxy's network.
+func (p *arpProxy) senderIP(frame []byte, includeIPv4 bool) (ipv4Addr, bool) {
+	var result ipv4Addr
+	switch {
+	case isIPv4ARP(frame):
+		copy(result[:], frame[ethernetHeaderLen+arpSenderIPOffset:])
+	case includeIPv4 && len(frame) >= ethernetHeaderLen+ipv4MinLen &&
+		binary.BigEndian.Uint16(frame[12:14]) == etherTypeIPv4:
+		copy(result[:], frame[ethernetHeaderLen+ipv4SrcOffset:])
+	default:
+		return result, false
+	}
+	return result, p.network.Contains(result[:])
+}
+
+// sweep removes expired addresses, at most once every
+// proxyARPSweepInterval. p.mu must be held when calling.
+func (p *arpProxy) sweep(now time.Time) {
+	if now.Before(p.nextSweep) {
+		return
+	}
+	p.nextSweep = now.Add(proxyARPSweepInterval)
+	for addr, h := range p.hosts {
+		if now.Sub(h.lastSeen) >= proxyARPTimeout {
+			delete(p.hosts, addr)
+		}
+	}
+	for addr, lastSeen := range p.physical {
+		if now.Sub(lastSeen) >= proxyARPTimeout {
+			delete(p.physical, addr)
+		}
+	}
+}
+
+// learn records the IPv4 address claimed in an ARP packet received from the
+// given client, unless the address is in use on the physical network.
+func (p *arpProxy) learn(client ipx.Addr, frame []byte) {
+	ip, ok := p.senderIP(frame, false)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(now)
+	if lastSeen, ok := p.physical[ip]; ok && now.Sub(lastSeen) < proxyARPTimeout {
+		return
+	}
+	p.hosts[ip] = &proxyHost{
+		client:   client,
+		mac:      toMAC(frame[6:12]),
+		lastSeen: now,
+	}
+}
+
+// notePhysical records the IPv4 address used by the sender of a frame from
+// the physical network. The address is no longer proxied if it was.
+func (p *arpProxy) notePhysical(frame []byte) {
+	ip, ok := p.senderIP(frame, true)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(now)
+	p.physical[ip] = now
+	delete(p.hosts, ip)
+}
+
+func (p *arpProxy) lookup(ip []byte) (proxyHost, bool) {
+	var addr ipv4Addr
+	copy(addr[:], ip)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.hosts[addr]
+	if !ok || time.Since(h.lastSeen) >= proxyARPTimeout {
+		return proxyHost{}, false
+	}
+	return *h, true
+}
+
+// reply returns an ARP reply to the given frame if it is an ARP request
+// for the address of an IPX-side host.
+func (p *arpProxy) reply(frame []byte) ([]byte, bool) {
+	if !isIPv4ARP(frame) {
+		return nil, false
+	}
+	arp := frame[ethernetHeaderLen:]
+	if binary.BigEndian.Uint16(arp[6:8]) != arpRequest {
+		return nil, false
+	}
+	if _, ok := p.lookup(arp[arpTargetIPOffset : arpTargetIPOffset+4]); !ok {
+		return nil, false
+	}
+	result := make([]byte, ethernetHeaderLen+arpPacketLen)
+	copy(result[0:6], arp[arpSenderHWOffset:arpSenderHWOffset+6])
+	copy(result[6:12], p.mac[:])
+	copy(result[12:ethernetHeaderLen], frame[12:ethernetHeaderLen])
+	replyARP := result[ethernetHeaderLen:]
+	copy(replyARP[0:6], arp[0:6])
+	binary.BigEndian.PutUint16(replyARP[6:8], arpReply)
+	copy(replyARP[arpSenderHWOffset:], p.mac[:])
+	copy(replyARP[arpSenderIPOffset:arpSenderIPOffset+4], arp[arpTargetIPOffset:arpTargetIPOffset+4])
+	copy(replyARP[arpTargetHWOffset:], arp[arpSenderHWOffset:arpSenderHWOffset+6])
+	copy(replyARP[arpTargetIPOffset:arpTargetIPOffset+4], arp[arpSenderIPOffset:arpSenderIPOffset+4])
+	return result, true
+}
+
+// forward rewrites an IPv4 frame from the physical network that was sent
+// to the router's address, so that it is addressed to the IPX-side host
+// with the destination IP address. It returns the IPX address of that host,
+// or false if the frame is not for a known host.
+func (p *arpProxy) forward(frame []byte) ([]byte, ipx.Addr, bool) {
+	if len(frame) < ethernetHeaderLen+ipv4MinLen ||
+		toMAC(frame[0:6]) != p.mac ||
+		binary.BigEndian.Uint16(frame[12:14]) != etherTypeIPv4 {
+		return frame, ipx.AddrNull, false
+	}
+	h, ok := p.lookup(frame[ethernetHeaderLen+ipv4DestOffset : ethernetHeaderLen+ipv4DestOffset+4])
+	if !ok {
+		return frame, ipx.AddrNull, false
+	}
+	frame = append([]byte{}, frame...)
+	copy(frame[0:6], h.mac[:])
+	return frame, h.client, true
+}
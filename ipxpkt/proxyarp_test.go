@@ -0,0 +1,212 @@
+package ipxpkt
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	clientIP    = net.IP{10, 0, 0, 1}
+	lanIP       = net.IP{10, 0, 0, 2}
+	proxySubnet = &net.IPNet{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(24, 32)}
+)
+
+func serializeLayers(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, l...); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte{}, buf.Bytes()...)
+}
+
+func makeARP(t *testing.T, op uint16, dest, sha []byte, spa net.IP, tha []byte, tpa net.IP) []byte {
+	return serializeLayers(t, &layers.Ethernet{
+		SrcMAC:       sha,
+		DstMAC:       dest,
+		EthernetType: layers.EthernetTypeARP,
+	}, &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         op,
+		SourceHwAddress:   sha,
+		SourceProtAddress: spa,
+		DstHwAddress:      tha,
+		DstProtAddress:    tpa,
+	})
+}
+
+func TestProxyARP(t *testing.T) {
+	n := addressable.Wrap(ipxswitch.New())
+	serverNode := ipxtesting.MustNewNode(t, n)
+	server := NewRouterWithConfig(serverNode, &Config{ProxyARPNetwork: proxySubnet})
+	serverAddr := network.NodeAddress(serverNode)
+	client := NewRouter(ipxtesting.MustNewNode(t, n))
+	serverFrames, clientFrames := readFrames(server), readFrames(client)
+
+	// The client announces its address, which the router learns.
+	announce := makeARP(t, layers.ARPRequest, serverAddr[:], clientMACBytes, clientIP, make([]byte, 6), lanIP)
+	if err := client.WritePacketData(announce); err != nil {
+		t.Fatal(err)
+	}
+	if nextFrame(serverFrames) == nil {
+		t.Fatalf("frame from client not received")
+	}
+
+	// A host on the physical network asks who has the client's address.
+	request := makeARP(t, layers.ARPRequest, layers.EthernetBroadcast, lanMAC, lanIP, make([]byte, 6), clientIP)
+	if err := server.WritePacketData(request); err != nil {
+		t.Fatal(err)
+	}
+	replyFrame := nextFrame(serverFrames)
+	if replyFrame == nil {
+		t.Fatalf("no ARP reply generated")
+	}
+	pkt := gopacket.NewPacket(replyFrame, layers.LayerTypeEthernet, gopacket.Default)
+	eth, _ := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	arp, _ := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if eth == nil || arp == nil {
+		t.Fatalf("reply is not an ARP packet: %v", pkt)
+	}
+	if !bytes.Equal(eth.DstMAC, lanMAC) || !bytes.Equal(eth.SrcMAC, serverAddr[:]) {
+		t.Errorf("wrong Ethernet addresses in reply: %v -> %v", eth.SrcMAC, eth.DstMAC)
+	}
+	switch {
+	case arp.Operation != layers.ARPReply:
+		t.Errorf("wrong ARP operation: want %d, got %d", layers.ARPReply, arp.Operation)
+	case !bytes.Equal(arp.SourceHwAddress, serverAddr[:]):
+		t.Errorf("wrong sender hardware address: %x", arp.SourceHwAddress)
+	case !bytes.Equal(arp.SourceProtAddress, clientIP):
+		t.Errorf("wrong sender protocol address: %v", net.IP(arp.SourceProtAddress))
+	case !bytes.Equal(arp.DstHwAddress, lanMAC):
+		t.Errorf("wrong target hardware address: %x", arp.DstHwAddress)
+	case !bytes.Equal(arp.DstProtAddress, lanIP):
+		t.Errorf("wrong target protocol address: %v", net.IP(arp.DstProtAddress))
+	}
+	if got := nextFrame(clientFrames); got != nil {
+		t.Errorf("proxied ARP request was passed to client: %x", got)
+	}
+
+	// Frames sent to the router's address are forwarded to the client.
+	ipFrame := serializeLayers(t, &layers.Ethernet{
+		SrcMAC:       lanMAC,
+		DstMAC:       serverAddr[:],
+		EthernetType: layers.EthernetTypeIPv4,
+	}, &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    lanIP,
+		DstIP:    clientIP,
+	}, gopacket.Payload("hello"))
+	if err := server.WritePacketData(ipFrame); err != nil {
+		t.Fatal(err)
+	}
+	got := nextFrame(clientFrames)
+	if got == nil {
+		t.Fatalf("IPv4 frame not forwarded to client")
+	}
+	if !bytes.Equal(got[0:6], clientMACBytes) {
+		t.Errorf("destination MAC not rewritten to client's: %x", got[0:6])
+	}
+}
+
+func TestProxyARPLearning(t *testing.T) {
+	routerMAC := macAddr{0x02, 0, 0, 0, 0, 0x99}
+	otherLANMAC := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x66}
+	clientAddr := ipx.Addr{0x02, 0, 0, 0, 0, 0x01}
+	announce := func(ip net.IP) []byte {
+		return makeARP(t, layers.ARPRequest, layers.EthernetBroadcast, clientMACBytes, ip, make([]byte, 6), lanIP)
+	}
+	whoHas := func(sha []byte, spa, tpa net.IP) []byte {
+		return makeARP(t, layers.ARPRequest, layers.EthernetBroadcast, sha, spa, make([]byte, 6), tpa)
+	}
+	ipv4From := func(ip net.IP) []byte {
+		return serializeLayers(t, &layers.Ethernet{
+			SrcMAC:       clientMACBytes,
+			DstMAC:       lanMAC,
+			EthernetType: layers.EthernetTypeIPv4,
+		}, &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    ip,
+			DstIP:    lanIP,
+		})
+	}
+
+	tests := []struct {
+		name        string
+		physical    [][]byte
+		client      [][]byte
+		clientFirst bool
+		request     []byte
+		want        bool
+	}{
+		{
+			name:    "announced by ARP",
+			client:  [][]byte{announce(clientIP)},
+			request: whoHas(lanMAC, lanIP, clientIP),
+			want:    true,
+		},
+		{
+			name:    "only seen in IPv4",
+			client:  [][]byte{ipv4From(clientIP)},
+			request: whoHas(lanMAC, lanIP, clientIP),
+			want:    false,
+		},
+		{
+			name:    "outside network",
+			client:  [][]byte{announce(net.IP{192, 168, 0, 1})},
+			request: whoHas(lanMAC, lanIP, net.IP{192, 168, 0, 1}),
+			want:    false,
+		},
+		{
+			name:     "already used on physical network",
+			physical: [][]byte{whoHas(lanMAC, lanIP, clientIP)},
+			client:   [][]byte{announce(lanIP)},
+			request:  whoHas(otherLANMAC, clientIP, lanIP),
+			want:     false,
+		},
+		{
+			name:        "claimed on physical network after learning",
+			client:      [][]byte{announce(clientIP)},
+			clientFirst: true,
+			physical:    [][]byte{whoHas(otherLANMAC, clientIP, lanIP)},
+			request:     whoHas(lanMAC, lanIP, clientIP),
+			want:        false,
+		},
+	}
+	for _, tc := range tests {
+		p := newARPProxy(routerMAC, proxySubnet)
+		learn := func() {
+			for _, f := range tc.client {
+				p.learn(clientAddr, f)
+			}
+		}
+		if tc.clientFirst {
+			learn()
+		}
+		for _, f := range tc.physical {
+			p.notePhysical(f)
+		}
+		if !tc.clientFirst {
+			learn()
+		}
+		if _, got := p.reply(tc.request); got != tc.want {
+			t.Errorf("%s: want reply %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
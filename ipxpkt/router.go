@@ -4,7 +4,12 @@ package ipxpkt
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
@@ -23,6 +28,53 @@ var (
 	_ = (phys.DuplexEthernetStream)(&Router{})
 )
 
+// Config contains configuration parameters for a Router.
+type Config struct {
+	// The maximum number of partially received frames that are held
+	// for reassembly at once. Fragments from different frames can be
+	// interleaved, so on lossy or reordering links a larger window can
+	// help. If zero, DefaultReassemblyWindow is used.
+	ReassemblyWindow int
+
+	// Partially received frames are discarded if no fragment is
+	// received for them in this long. If zero,
+	// DefaultReassemblyTimeout is used.
+	ReassemblyTimeout time.Duration
+
+	// If true, the source MAC addresses of frames from IPXPKT clients
+	// are replaced with addresses allocated by the router, and frames
+	// sent back to those addresses are mapped back to the client. This
+	// prevents conflicts when several clients use the same MAC address,
+	// for example because they all use the driver's defaults. The
+	// hardware addresses in ARP packets are translated too, but not
+	// those in other protocols, such as DHCP; frames sent to a client's
+	// own address are still delivered as normal.
+	TranslateMACs bool
+
+	// Prefix for translated MAC addresses; the remaining bytes are
+	// random. It may be at most three bytes long and must not be a
+	// multicast prefix. If empty, DefaultMACPrefix is used.
+	MACPrefix []byte
+
+	// Translations are forgotten if unused for this long. If zero,
+	// DefaultMACTimeout is used.
+	MACTimeout time.Duration
+
+	// If not nil, translated MAC addresses are generated using this
+	// source of random data instead of crypto/rand. This is intended
+	// for testing.
+	Rand io.Reader
+
+	// If not nil, the router answers ARP requests from the physical
+	// network for the IPv4 addresses of IPXPKT clients within this
+	// network (proxy ARP), giving its own IPX node address as the MAC
+	// address. Frames sent to that address are forwarded to the client
+	// with the destination IPv4 address. The addresses of clients are
+	// learned from the ARP packets that they send, except for addresses
+	// that have been seen in use on the physical network.
+	ProxyARPNetwork *net.IPNet
+}
+
 // Router implements the ipxpkt protocol and implements the same
 // DuplexEthernetStream interface as a real physical Ethernet link;
 // it communicates by sending and receiving IPX packets.
@@ -30,6 +82,15 @@ type Router struct {
 	node          network.Node
 	packetCounter uint16
 	fr            frameReassembler
+	nat           *macTranslator
+	proxy         *arpProxy
+
+	// Frames generated by the router itself, such as ARP replies, which
+	// are waiting to be returned by ReadPacketData. If ReadPacketData is
+	// blocked reading from the node, wake interrupts it.
+	mu      sync.Mutex
+	pending [][]byte
+	wake    context.CancelFunc
 }
 
 func (r *Router) Close() {
@@ -58,19 +119,66 @@ func (r *Router) unwrapFrame(packet *ipx.Packet) ([]byte, error) {
 	return frame, nil
 }
 
+// queueFrame queues a frame to be returned by ReadPacketData.
+func (r *Router) queueFrame(frame []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = append(r.pending, frame)
+	if r.wake != nil {
+		r.wake()
+	}
+}
+
+// readPacket reads a packet from the node, or returns a queued frame
+// instead if there is one.
+func (r *Router) readPacket() (*ipx.Packet, []byte, error) {
+	r.mu.Lock()
+	if len(r.pending) > 0 {
+		frame := r.pending[0]
+		r.pending = r.pending[1:]
+		r.mu.Unlock()
+		return nil, frame, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.wake = cancel
+	r.mu.Unlock()
+	packet, err := r.node.ReadPacket(ctx)
+	r.mu.Lock()
+	r.wake = nil
+	r.mu.Unlock()
+	cancel()
+	if errors.Is(err, context.Canceled) {
+		// Woken up by queueFrame.
+		return nil, nil, nil
+	}
+	return packet, nil, err
+}
+
 // readFrame reads an Ethernet frame from the router; it will block until
 // a complete frame arrives from another node.
 func (r *Router) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
-	// TODO: Better context we can use here?
-	ctx := context.Background()
 	for {
-		packet, err := r.node.ReadPacket(ctx)
+		packet, frame, err := r.readPacket()
 		if err != nil {
 			return nil, gopacket.CaptureInfo{}, err
-		}
-		frame, err := r.unwrapFrame(packet)
-		if err != nil {
-			// TODO: Log error?
+		} else if packet != nil {
+			frame, err = r.unwrapFrame(packet)
+			if err != nil {
+				// TODO: Log error?
+				continue
+			}
+			if r.proxy != nil {
+				r.proxy.learn(packet.Header.Src.Addr, frame)
+			}
+			if r.nat != nil {
+				frame, err = r.nat.translateOutbound(packet.Header.Src.Addr, frame)
+				if err != nil {
+					// No translated address could be
+					// allocated, so the frame is dropped.
+					continue
+				}
+			}
+		} else if frame == nil {
 			continue
 		}
 		ci := gopacket.CaptureInfo{
@@ -86,6 +194,15 @@ func (r *Router) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
 // wrapped and fragmented into one or more ipxpkt frames and written to the
 // IPX network.
 func (r *Router) WritePacketData(frame []byte) error {
+	if r.proxy != nil {
+		r.proxy.notePhysical(frame)
+		if reply, ok := r.proxy.reply(frame); ok {
+			// The client need not see the request, and would
+			// otherwise send a conflicting reply of its own.
+			r.queueFrame(reply)
+			return nil
+		}
+	}
 	hdr1 := &ipx.Header{
 		Src: ipx.HeaderAddr{
 			Addr:   network.NodeAddress(r.node),
@@ -101,6 +218,18 @@ func (r *Router) WritePacketData(frame []byte) error {
 	// address to forward to. This needs a routing table implementation
 	// equivalent to what ipxpkt does.
 	copy(hdr1.Dest.Addr[:], frame[0:6])
+	forwarded := false
+	if r.proxy != nil {
+		var client ipx.Addr
+		if frame, client, forwarded = r.proxy.forward(frame); forwarded {
+			hdr1.Dest.Addr = client
+		}
+	}
+	if r.nat != nil && !forwarded {
+		if f, client, ok := r.nat.translateInbound(frame); ok {
+			frame, hdr1.Dest.Addr = f, client
+		}
+	}
 
 	r.packetCounter++
 	fragments := fragmentFrame(frame)
@@ -138,10 +267,37 @@ func (r *Router) WritePacketData(frame []byte) error {
 	return nil
 }
 
+// NewRouter creates a new Router that sends and receives packets using the
+// given node, with the default configuration.
 func NewRouter(node network.Node) *Router {
+	return NewRouterWithConfig(node, &Config{})
+}
+
+// NewRouterWithConfig creates a new Router that sends and receives packets
+// using the given node. It panics if config.MACPrefix is invalid.
+func NewRouterWithConfig(node network.Node, config *Config) *Router {
 	r := &Router{
 		node: node,
 	}
-	r.fr.init()
+	r.fr.init(config.ReassemblyWindow, config.ReassemblyTimeout)
+	if config.TranslateMACs {
+		if err := checkMACPrefix(config.MACPrefix); err != nil {
+			panic(err)
+		}
+		prefix, random, timeout := config.MACPrefix, config.Rand, config.MACTimeout
+		if len(prefix) == 0 {
+			prefix = DefaultMACPrefix
+		}
+		if random == nil {
+			random = rand.Reader
+		}
+		if timeout == 0 {
+			timeout = DefaultMACTimeout
+		}
+		r.nat = newMACTranslator(prefix, random, timeout)
+	}
+	if config.ProxyARPNetwork != nil {
+		r.proxy = newARPProxy(macAddr(network.NodeAddress(node)), config.ProxyARPNetwork)
+	}
 	return r
 }
@@ -0,0 +1,68 @@
+// Package kernelipx implements an IPX transport that sends and receives
+// packets using the Linux kernel's native IPX stack (AF_IPX sockets). This
+// allows ipxbox to interwork with kernel IPX routing on systems where it is
+// available.
+//
+// Kernel requirements: IPX support was removed from the mainline Linux
+// kernel in version 4.18, so an older kernel (or an out-of-tree module) is
+// required, with the ipx module loaded and an interface configured (eg.
+// with ipx_interface or ipx_configure from the ipx-utils package). Support
+// must also be enabled at build time with the "kernelipx" build tag; on
+// other builds and platforms Open returns ErrNotImplemented.
+//
+// Since each kernel socket is bound to a single IPX socket number, a
+// separate transport must be opened for each socket number that should be
+// bridged. Packets are sent using the host's own IPX address as the source
+// address, and the kernel does not reveal the destination address of
+// received packets, so all received packets are treated as broadcasts.
+package kernelipx
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+const (
+	// sockaddrIPXLength is sizeof(struct sockaddr_ipx).
+	sockaddrIPXLength = 16
+
+	// afIPX is the value of AF_IPX on Linux.
+	afIPX = 4
+)
+
+var (
+	ErrNotImplemented = errors.New("kernel IPX sockets not supported on this platform or build")
+)
+
+// sockaddrIPX matches the layout of the Linux struct sockaddr_ipx.
+type sockaddrIPX struct {
+	Family  uint16
+	Port    [2]byte // network byte order
+	Network [4]byte
+	Node    [6]byte
+	Type    uint8
+	Zero    uint8
+}
+
+// makeSockaddr returns a sockaddrIPX for the given IPX address.
+func makeSockaddr(addr *ipx.HeaderAddr, packetType byte) *sockaddrIPX {
+	sa := &sockaddrIPX{
+		Family:  afIPX,
+		Network: addr.Network,
+		Node:    addr.Addr,
+		Type:    packetType,
+	}
+	binary.BigEndian.PutUint16(sa.Port[:], addr.Socket)
+	return sa
+}
+
+// headerAddr converts the socket address back into an ipx.HeaderAddr.
+func (sa *sockaddrIPX) headerAddr() ipx.HeaderAddr {
+	return ipx.HeaderAddr{
+		Network: sa.Network,
+		Addr:    sa.Node,
+		Socket:  binary.BigEndian.Uint16(sa.Port[:]),
+	}
+}
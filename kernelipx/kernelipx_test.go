@@ -0,0 +1,38 @@
+package kernelipx
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+func TestSockaddrLayout(t *testing.T) {
+	if size := unsafe.Sizeof(sockaddrIPX{}); size != sockaddrIPXLength {
+		t.Errorf("wrong size for sockaddrIPX: want %d, got %d", sockaddrIPXLength, size)
+	}
+}
+
+func TestSockaddrRoundTrip(t *testing.T) {
+	addr := &ipx.HeaderAddr{
+		Network: [4]byte{0x12, 0x34, 0x56, 0x78},
+		Addr:    [6]byte{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+		Socket:  0x869c,
+	}
+	sa := makeSockaddr(addr, 4)
+	if sa.Port != [2]byte{0x86, 0x9c} {
+		t.Errorf("socket not in network byte order: %+v", sa.Port)
+	}
+	if got := sa.headerAddr(); got != *addr {
+		t.Errorf("wrong address after round trip: want %+v, got %+v", *addr, got)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	conn, err := Open(0x869c)
+	if err != nil {
+		// Most systems do not have kernel IPX support.
+		t.Skipf("kernel IPX not available: %v", err)
+	}
+	conn.Close()
+}
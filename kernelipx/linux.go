@@ -0,0 +1,100 @@
+//go:build linux && kernelipx
+// +build linux,kernelipx
+
+package kernelipx
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+var _ = (ipx.ReadWriteCloser)(&conn{})
+
+type conn struct {
+	mu     sync.Mutex
+	fd     int
+	closed bool
+	local  ipx.HeaderAddr
+}
+
+func (c *conn) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	var buf [1500]byte
+	var sa sockaddrIPX
+	salen := uint32(sockaddrIPXLength)
+	n, _, errno := syscall.Syscall6(syscall.SYS_RECVFROM, uintptr(c.fd),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0,
+		uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&salen)))
+	if errno != 0 {
+		return nil, errno
+	}
+	dest := c.local
+	dest.Addr = ipx.AddrBroadcast
+	return &ipx.Packet{
+		Header: ipx.Header{
+			Checksum:   0xffff,
+			Length:     uint16(ipx.HeaderLength + int(n)),
+			PacketType: sa.Type,
+			Dest:       dest,
+			Src:        sa.headerAddr(),
+		},
+		Payload: append([]byte{}, buf[:n]...),
+	}, nil
+}
+
+func (c *conn) WritePacket(packet *ipx.Packet) error {
+	sa := makeSockaddr(&packet.Header.Dest, packet.Header.PacketType)
+	var payload unsafe.Pointer
+	if len(packet.Payload) > 0 {
+		payload = unsafe.Pointer(&packet.Payload[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SENDTO, uintptr(c.fd),
+		uintptr(payload), uintptr(len(packet.Payload)), 0,
+		uintptr(unsafe.Pointer(sa)), sockaddrIPXLength)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (c *conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	// Shut down first to unblock any goroutine blocked in ReadPacket.
+	syscall.Shutdown(c.fd, syscall.SHUT_RDWR)
+	return syscall.Close(c.fd)
+}
+
+// Open opens a kernel IPX socket bound to the given IPX socket number.
+func Open(socket uint16) (ipx.ReadWriteCloser, error) {
+	fd, err := syscall.Socket(syscall.AF_IPX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	sa := makeSockaddr(&ipx.HeaderAddr{Socket: socket}, 0)
+	_, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd),
+		uintptr(unsafe.Pointer(sa)), sockaddrIPXLength)
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+	// Find out what address the kernel assigned us.
+	salen := uint32(sockaddrIPXLength)
+	_, _, errno = syscall.Syscall(syscall.SYS_GETSOCKNAME, uintptr(fd),
+		uintptr(unsafe.Pointer(sa)), uintptr(unsafe.Pointer(&salen)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+	return &conn{
+		fd:    fd,
+		local: sa.headerAddr(),
+	}, nil
+}
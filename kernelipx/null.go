@@ -0,0 +1,15 @@
+//go:build !linux || !kernelipx
+// +build !linux !kernelipx
+
+package kernelipx
+
+import (
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// Open opens a kernel IPX socket bound to the given IPX socket number.
+// This build does not support kernel IPX, so ErrNotImplemented is
+// always returned.
+func Open(socket uint16) (ipx.ReadWriteCloser, error) {
+	return nil, ErrNotImplemented
+}
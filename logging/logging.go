@@ -0,0 +1,131 @@
+// Package logging implements a simple leveled wrapper around log.Logger.
+package logging
+
+import (
+	"fmt"
+	"log"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = map[Level]string{
+	LevelError: "error",
+	LevelWarn:  "warn",
+	LevelInfo:  "info",
+	LevelDebug: "debug",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel returns the Level with the given name: one of "error", "warn",
+// "info" or "debug".
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if n == name {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// Logger writes messages to an underlying log.Logger, discarding any that
+// are less severe than its level. A nil *Logger is valid and discards all
+// messages.
+type Logger struct {
+	out   *log.Logger
+	level Level
+}
+
+// New creates a Logger that writes messages at the given level or more
+// severe to out. If out is nil, nil is returned.
+func New(out *log.Logger, level Level) *Logger {
+	if out == nil {
+		return nil
+	}
+	return &Logger{out: out, level: level}
+}
+
+// Fields are key/value pairs describing an event, such as the addresses of
+// a client that has connected.
+type Fields map[string]string
+
+// StructuredWriter is implemented by log outputs that can record Fields
+// alongside a message; the syslog package implements it to write RFC 5424
+// structured data.
+type StructuredWriter interface {
+	WriteStructured(fields Fields, msg []byte) (int, error)
+}
+
+// LeveledWriter is implemented by log outputs that record the level of each
+// message along with any Fields; the syslog package implements it to set
+// the severity of each message. It takes precedence over StructuredWriter.
+type LeveledWriter interface {
+	WriteLeveled(level Level, fields Fields, msg []byte) (int, error)
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if l == nil || level > l.level {
+		return
+	}
+	if w, ok := l.out.Writer().(LeveledWriter); ok {
+		w.WriteLeveled(level, nil, []byte(fmt.Sprintf(format, args...)))
+		return
+	}
+	l.out.Printf(format, args...)
+}
+
+func (l *Logger) eventf(level Level, fields Fields, format string, args ...interface{}) {
+	if l == nil || level > l.level {
+		return
+	}
+	switch w := l.out.Writer().(type) {
+	case LeveledWriter:
+		w.WriteLeveled(level, fields, []byte(fmt.Sprintf(format, args...)))
+	case StructuredWriter:
+		w.WriteStructured(fields, []byte(fmt.Sprintf(format, args...)))
+	default:
+		l.out.Printf(format, args...)
+	}
+}
+
+// Errorf logs a message at LevelError.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+// Warnf logs a message at LevelWarn.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+// Infof logs a message at LevelInfo.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+// Debugf logs a message at LevelDebug.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+// InfoEventf logs a message at LevelInfo along with the given fields. If
+// the underlying output implements neither LeveledWriter nor
+// StructuredWriter, the fields are discarded and only the message is
+// logged; otherwise the message is passed to it directly, without any
+// prefix or flags set on the log.Logger.
+func (l *Logger) InfoEventf(fields Fields, format string, args ...interface{}) {
+	l.eventf(LevelInfo, fields, format, args...)
+}
@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(log.New(&buf, "", 0), LevelInfo)
+	l.Debugf("debug message")
+	l.Infof("info message")
+	l.Errorf("error message")
+	got := buf.String()
+	if strings.Contains(got, "debug message") {
+		t.Errorf("debug message logged at info level: %q", got)
+	}
+	if !strings.Contains(got, "info message") || !strings.Contains(got, "error message") {
+		t.Errorf("messages missing from log: %q", got)
+	}
+
+	var nilLogger *Logger
+	nilLogger.Errorf("discarded")
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{LevelError, LevelWarn, LevelInfo, LevelDebug} {
+		got, err := ParseLevel(l.String())
+		if err != nil || got != l {
+			t.Errorf("ParseLevel(%q) = %v, %v", l.String(), got, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("ParseLevel of unknown level succeeded")
+	}
+}
+
+type structuredBuffer struct {
+	bytes.Buffer
+	fields Fields
+}
+
+func (b *structuredBuffer) WriteStructured(fields Fields, msg []byte) (int, error) {
+	b.fields = fields
+	return b.Write(msg)
+}
+
+func TestInfoEventf(t *testing.T) {
+	var buf bytes.Buffer
+	New(log.New(&buf, "", 0), LevelInfo).InfoEventf(Fields{"key": "value"}, "event %d", 1)
+	if got := buf.String(); got != "event 1\n" {
+		t.Errorf("wrong message for plain output: %q", got)
+	}
+
+	var sbuf structuredBuffer
+	New(log.New(&sbuf, "", 0), LevelInfo).InfoEventf(Fields{"key": "value"}, "event %d", 2)
+	if got := sbuf.String(); got != "event 2" {
+		t.Errorf("wrong message for structured output: %q", got)
+	}
+	if sbuf.fields["key"] != "value" {
+		t.Errorf("fields not passed to structured output: %v", sbuf.fields)
+	}
+
+	var sbuf2 structuredBuffer
+	New(log.New(&sbuf2, "", 0), LevelWarn).InfoEventf(Fields{"key": "value"}, "discarded")
+	if sbuf2.Len() != 0 {
+		t.Errorf("info event logged at warn level: %q", sbuf2.String())
+	}
+}
+
+type leveledBuffer struct {
+	structuredBuffer
+	levels []Level
+}
+
+func (b *leveledBuffer) WriteLeveled(level Level, fields Fields, msg []byte) (int, error) {
+	b.levels = append(b.levels, level)
+	return b.WriteStructured(fields, msg)
+}
+
+func TestLeveledWriter(t *testing.T) {
+	var buf leveledBuffer
+	l := New(log.New(&buf, "prefix: ", 0), LevelDebug)
+	l.Errorf("error")
+	l.Warnf("warn")
+	l.InfoEventf(Fields{"key": "value"}, "info")
+	l.Debugf("debug")
+	want := []Level{LevelError, LevelWarn, LevelInfo, LevelDebug}
+	if !reflect.DeepEqual(buf.levels, want) {
+		t.Errorf("wrong levels: want %v, got %v", want, buf.levels)
+	}
+	if got := buf.String(); got != "errorwarninfodebug" {
+		t.Errorf("wrong messages: %q", got)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewSampler(New(log.New(&buf, "", 0), LevelDebug), 10)
+	for i := 0; i < 1000; i++ {
+		s.Debugf("packet %d", i)
+	}
+	got := strings.Count(buf.String(), "\n")
+	if got < 90 || got > 110 {
+		t.Errorf("want roughly 100 of 1000 messages logged, got %d", got)
+	}
+
+	var nilSampler *Sampler
+	nilSampler.Debugf("discarded")
+}
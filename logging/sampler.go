@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"sync/atomic"
+)
+
+// Sampler wraps a Logger for use on per-packet code paths, where logging
+// every message would flood the log on a busy server. Only one in every N
+// messages is passed through to the Logger, which then applies its usual
+// level filtering. A nil *Sampler is valid and discards all messages.
+type Sampler struct {
+	// Number of messages seen; first in the struct to guarantee 64-bit
+	// alignment for atomic operations.
+	count uint64
+
+	l *Logger
+	n uint64
+}
+
+// NewSampler creates a Sampler that passes one in every n messages through
+// to l. If n is less than 1, every message is passed through. If l is nil,
+// nil is returned.
+func NewSampler(l *Logger, n int) *Sampler {
+	if l == nil {
+		return nil
+	}
+	if n < 1 {
+		n = 1
+	}
+	return &Sampler{l: l, n: uint64(n)}
+}
+
+func (s *Sampler) sample() bool {
+	if s == nil || s.l.level < LevelDebug {
+		return false
+	}
+	return atomic.AddUint64(&s.count, 1)%s.n == 0
+}
+
+// Debugf logs a message at LevelDebug, if it is selected by the sampler.
+func (s *Sampler) Debugf(format string, args ...interface{}) {
+	if s.sample() {
+		s.l.Debugf(format, args...)
+	}
+}
@@ -0,0 +1,205 @@
+// Package metrics implements counters, gauges and latency histograms that
+// can be exported in the OpenMetrics (Prometheus) text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metric is a metric that can be written by WriteOpenMetrics.
+type Metric interface {
+	writeOpenMetrics(w io.Writer)
+}
+
+// Counter is a count of events that only ever increases.
+type Counter struct {
+	// Current value; first in the struct to guarantee 64-bit alignment
+	// for atomic operations.
+	value uint64
+
+	// Name and Help are used when exporting the counter. The name
+	// should not include the "_total" suffix, which is added on export.
+	Name, Help string
+}
+
+// NewCounter creates a new Counter.
+func NewCounter(name, help string) *Counter {
+	return &Counter{Name: name, Help: help}
+}
+
+// Add increases the counter by the given amount. It is safe to call on a
+// nil Counter, which does nothing.
+func (c *Counter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.value, n)
+}
+
+// Inc increases the counter by one.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) writeOpenMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.Name)
+	fmt.Fprintf(w, "# HELP %s %s\n", c.Name, c.Help)
+	fmt.Fprintf(w, "%s_total %d\n", c.Name, c.Value())
+}
+
+// Gauge is a value that can go up and down, such as the number of clients
+// currently connected.
+type Gauge struct {
+	// Current value; first in the struct to guarantee 64-bit alignment
+	// for atomic operations.
+	value int64
+
+	// Name and Help are used when exporting the gauge.
+	Name, Help string
+}
+
+// NewGauge creates a new Gauge.
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{Name: name, Help: help}
+}
+
+// Add adds the given amount, which may be negative, to the gauge. It is safe
+// to call on a nil Gauge, which does nothing.
+func (g *Gauge) Add(n int64) {
+	if g == nil {
+		return
+	}
+	atomic.AddInt64(&g.value, n)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *Gauge) writeOpenMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.Name)
+	fmt.Fprintf(w, "# HELP %s %s\n", g.Name, g.Help)
+	fmt.Fprintf(w, "%s %d\n", g.Name, g.Value())
+}
+
+// DefaultBuckets are the upper bounds of the buckets used by NewHistogram:
+// powers of two from 1ms to about 4 seconds.
+var DefaultBuckets = func() []time.Duration {
+	result := []time.Duration{}
+	for d := time.Millisecond; d < 5*time.Second; d *= 2 {
+		result = append(result, d)
+	}
+	return result
+}()
+
+// Histogram counts observed durations in a set of buckets.
+type Histogram struct {
+	// Name and Help are used when exporting the histogram.
+	Name, Help string
+
+	mu      sync.Mutex
+	buckets []time.Duration
+	counts  []uint64
+	count   uint64
+	sum     time.Duration
+}
+
+// HistogramSnapshot contains the state of a Histogram at a point in time.
+type HistogramSnapshot struct {
+	// Buckets contains the upper bound of each bucket, and Counts the
+	// cumulative number of observations less than or equal to it.
+	Buckets []time.Duration
+	Counts  []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+// NewHistogram creates a new Histogram with DefaultBuckets.
+func NewHistogram(name, help string) *Histogram {
+	return NewHistogramWithBuckets(name, help, DefaultBuckets)
+}
+
+// NewHistogramWithBuckets creates a new Histogram with the given bucket upper
+// bounds, which must be in increasing order.
+func NewHistogramWithBuckets(name, help string, buckets []time.Duration) *Histogram {
+	return &Histogram{
+		Name:    name,
+		Help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Observe records a duration in the histogram. It is safe to call on a nil
+// Histogram, which does nothing.
+func (h *Histogram) Observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count++
+	h.sum += d
+	for i, b := range h.buckets {
+		if d <= b {
+			h.counts[i]++
+			break
+		}
+	}
+}
+
+// Snapshot returns the current state of the histogram.
+func (h *Histogram) Snapshot() *HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := &HistogramSnapshot{
+		Buckets: h.buckets,
+		Counts:  make([]uint64, len(h.counts)),
+		Count:   h.count,
+		Sum:     h.sum,
+	}
+	var total uint64
+	for i, c := range h.counts {
+		total += c
+		result.Counts[i] = total
+	}
+	return result
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+func (h *Histogram) writeOpenMetrics(w io.Writer) {
+	s := h.Snapshot()
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.Name)
+	fmt.Fprintf(w, "# UNIT %s seconds\n", h.Name)
+	fmt.Fprintf(w, "# HELP %s %s\n", h.Name, h.Help)
+	for i, b := range s.Buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.Name, formatSeconds(b), s.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.Name, s.Count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.Name, formatSeconds(s.Sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.Name, s.Count)
+}
+
+// WriteOpenMetrics writes the given metrics to w in the OpenMetrics text
+// format. Histogram durations are expressed in seconds.
+func WriteOpenMetrics(w io.Writer, metrics ...Metric) error {
+	for _, m := range metrics {
+		m.writeOpenMetrics(w)
+	}
+	_, err := fmt.Fprintf(w, "# EOF\n")
+	return err
+}
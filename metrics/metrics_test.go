@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogramWithBuckets("test_seconds", "Test histogram.", []time.Duration{
+		10 * time.Millisecond, 100 * time.Millisecond,
+	})
+	for _, d := range []time.Duration{
+		5 * time.Millisecond, 10 * time.Millisecond,
+		50 * time.Millisecond, time.Second,
+	} {
+		h.Observe(d)
+	}
+	s := h.Snapshot()
+	if s.Count != 4 || s.Counts[0] != 2 || s.Counts[1] != 3 {
+		t.Errorf("wrong histogram counts: %+v", s)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteOpenMetrics(&buf, h); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`test_seconds_bucket{le="0.01"} 2`,
+		`test_seconds_bucket{le="0.1"} 3`,
+		`test_seconds_bucket{le="+Inf"} 4`,
+		`test_seconds_sum 1.065`,
+		`test_seconds_count 4`,
+		"# EOF",
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("output does not contain %q:\n%s", want, buf.String())
+		}
+	}
+
+	// Observing on a nil histogram does nothing.
+	var nilHistogram *Histogram
+	nilHistogram.Observe(time.Second)
+}
+
+func TestCounterAndGauge(t *testing.T) {
+	c := NewCounter("test_packets", "Test counter.")
+	c.Inc()
+	c.Add(2)
+	g := NewGauge("test_clients", "Test gauge.")
+	g.Add(5)
+	g.Add(-2)
+	if c.Value() != 3 || g.Value() != 3 {
+		t.Errorf("want counter and gauge to be 3, got %d and %d", c.Value(), g.Value())
+	}
+
+	var buf bytes.Buffer
+	if err := WriteOpenMetrics(&buf, c, g); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE test_packets counter",
+		"test_packets_total 3",
+		"# TYPE test_clients gauge",
+		"test_clients 3",
+		"# EOF",
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("output does not contain %q:\n%s", want, buf.String())
+		}
+	}
+
+	// Updating a nil counter or gauge does nothing.
+	var nilCounter *Counter
+	nilCounter.Inc()
+	var nilGauge *Gauge
+	nilGauge.Add(1)
+}
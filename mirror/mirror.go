@@ -0,0 +1,123 @@
+// Package mirror implements export of live traffic to a remote collector.
+// Packets read from a network tap are sent over UDP, so that traffic from
+// a number of servers can be aggregated in one place for analysis.
+//
+// Each UDP datagram contains a single packet, in the following format:
+//
+//	4 bytes    magic: "IPXM"
+//	1 byte     format version (currently 1)
+//	8 bytes    capture time, big-endian nanoseconds since the Unix epoch
+//	remainder  the IPX packet, including header
+package mirror
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+const (
+	// Magic is the string that begins every mirrored datagram.
+	Magic = "IPXM"
+
+	// Version is the version of the datagram format.
+	Version = 1
+
+	// HeaderLength is the length of the header that precedes the IPX
+	// packet in each datagram.
+	HeaderLength = 13
+)
+
+// Config contains configuration for an Exporter.
+type Config struct {
+	// Address of the collector (host:port).
+	Address string
+
+	// If greater than 1, only one in every SampleRate packets is sent.
+	SampleRate int
+
+	// If non-zero, the maximum number of packets sent per second.
+	// Packets beyond this rate are dropped.
+	MaxRate int
+}
+
+// Exporter sends mirrored packets to a collector.
+type Exporter struct {
+	config      Config
+	conn        net.Conn
+	count       int
+	windowStart time.Time
+	windowCount int
+}
+
+// New creates a new Exporter that sends to the configured collector.
+func New(config *Config) (*Exporter, error) {
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		config: *config,
+		conn:   conn,
+	}, nil
+}
+
+// Encode returns the datagram that is sent to the collector for the given
+// packet.
+func Encode(packet *ipx.Packet, t time.Time) ([]byte, error) {
+	packetBytes, err := packet.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, HeaderLength, HeaderLength+len(packetBytes))
+	copy(result[0:4], Magic)
+	result[4] = Version
+	binary.BigEndian.PutUint64(result[5:13], uint64(t.UnixNano()))
+	return append(result, packetBytes...), nil
+}
+
+// sample returns true if the next packet should be sent, applying the
+// sample rate and rate limit.
+func (e *Exporter) sample(now time.Time) bool {
+	e.count++
+	if e.config.SampleRate > 1 && e.count%e.config.SampleRate != 0 {
+		return false
+	}
+	if e.config.MaxRate > 0 {
+		if now.Sub(e.windowStart) >= time.Second {
+			e.windowStart = now
+			e.windowCount = 0
+		}
+		if e.windowCount >= e.config.MaxRate {
+			return false
+		}
+		e.windowCount++
+	}
+	return true
+}
+
+// Run reads packets from the given reader (typically a network tap) and
+// sends them to the collector, until the context is cancelled or the reader
+// returns an error.
+func (e *Exporter) Run(ctx context.Context, r ipx.Reader) error {
+	defer e.conn.Close()
+	for {
+		packet, err := r.ReadPacket(ctx)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if !e.sample(now) {
+			continue
+		}
+		data, err := Encode(packet, now)
+		if err != nil {
+			continue
+		}
+		// Errors are ignored; the collector may not be running yet.
+		e.conn.Write(data)
+	}
+}
@@ -0,0 +1,80 @@
+package mirror
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/pipe"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func TestMirror(t *testing.T) {
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	e, err := New(&Config{
+		Address:    collector.LocalAddr().String(),
+		SampleRate: 2,
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := pipe.New()
+	go e.Run(ctx, p)
+
+	packets := ipxtesting.TestPackets[:4]
+	for _, packet := range packets {
+		p.WritePacket(packet)
+	}
+
+	// Every second packet is sampled.
+	var buf [1500]byte
+	for i := 1; i < len(packets); i += 2 {
+		collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := collector.Read(buf[:])
+		if err != nil {
+			t.Fatalf("packet %d not received by collector: %v", i, err)
+		}
+		data := buf[:n]
+		if string(data[0:4]) != Magic || data[4] != Version {
+			t.Errorf("wrong datagram header: %x", data[:HeaderLength])
+		}
+		var got ipx.Packet
+		if err := got.UnmarshalBinary(data[HeaderLength:]); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&got, packets[i]) {
+			t.Errorf("wrong packet mirrored: want %+v, got %+v", packets[i], &got)
+		}
+	}
+	collector.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := collector.Read(buf[:]); err == nil {
+		t.Errorf("more packets received than expected for sample rate")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	e := &Exporter{config: Config{MaxRate: 3}}
+	now := time.Now()
+	sent := 0
+	for i := 0; i < 10; i++ {
+		if e.sample(now) {
+			sent++
+		}
+	}
+	if sent != 3 {
+		t.Errorf("want 3 packets sent in one second, got %d", sent)
+	}
+	if !e.sample(now.Add(time.Second)) {
+		t.Errorf("packet not sent in next second")
+	}
+}
@@ -7,6 +7,10 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/fragglet/ipxbox/ipx"
@@ -15,39 +19,162 @@ import (
 
 var (
 	_ = (network.Network)(&addressableNetwork{})
+	_ = (network.AddressRequester)(&addressableNetwork{})
 	_ = (network.Node)(&node{})
 
 	// WrongAddressError is returned when a packet is written with the
 	// wrong source IPX address.
 	WrongAddressError = errors.New("packet has wrong source address")
+
+	defaultAddressPrefix = []byte{0x02}
 )
 
+// maxAddressPrefixLen is the maximum length of an address prefix. It leaves
+// three random bytes, so there are plenty of addresses to go around.
+const maxAddressPrefixLen = 3
+
+// ParseAddressPrefix parses an address prefix for Config.AddressPrefix, in
+// the form of colon-separated hex bytes (eg. "02:a0"). The prefix may be at
+// most three bytes long, and the first byte must have the multicast bit
+// clear, so that assigned addresses are unicast addresses.
+func ParseAddressPrefix(s string) ([]byte, error) {
+	var result []byte
+	for _, part := range strings.Split(s, ":") {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || len(part) != 2 {
+			return nil, fmt.Errorf("invalid address prefix %q", s)
+		}
+		result = append(result, byte(b))
+	}
+	if err := checkAddressPrefix(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func checkAddressPrefix(prefix []byte) error {
+	if len(prefix) > maxAddressPrefixLen {
+		return fmt.Errorf("address prefix %x too long: at most %d bytes allowed", prefix, maxAddressPrefixLen)
+	}
+	if len(prefix) > 0 && prefix[0]&0x01 != 0 {
+		return fmt.Errorf("address prefix %x is a multicast address", prefix)
+	}
+	return nil
+}
+
+// SourcePolicy controls what happens when a node writes a packet with a
+// source address that does not match its assigned address.
+type SourcePolicy int
+
+const (
+	// SourceStrict drops the packet and returns WrongAddressError.
+	SourceStrict SourcePolicy = iota
+
+	// SourcePermissive forwards the packet unchanged, unless its source
+	// address is assigned to a different node, in which case the packet
+	// is dropped and WrongAddressError is returned. Otherwise a node
+	// could take over another node's address in the routing tables of
+	// the networks further in. Addresses that are not assigned to any
+	// node (for example, those of hosts on a bridged network) can
+	// still be used.
+	SourcePermissive
+
+	// SourceCorrect rewrites the source address to the node's assigned
+	// address before forwarding the packet.
+	SourceCorrect
+)
+
+// ParseSourcePolicy returns the SourcePolicy with the given name: one of
+// "strict", "permissive" or "correct".
+func ParseSourcePolicy(name string) (SourcePolicy, error) {
+	switch name {
+	case "strict":
+		return SourceStrict, nil
+	case "permissive":
+		return SourcePermissive, nil
+	case "correct":
+		return SourceCorrect, nil
+	}
+	return SourceStrict, fmt.Errorf("unknown source address policy %q", name)
+}
+
+// Config contains optional configuration for an addressable network.
+type Config struct {
+	// SourcePolicy controls how packets with the wrong source address
+	// are handled.
+	SourcePolicy SourcePolicy
+
+	// If not nil, addresses are generated using this source of random
+	// data instead of crypto/rand. This is intended for testing, where
+	// it can be used to make address allocation deterministic.
+	Rand io.Reader
+
+	// Prefix for the addresses that are assigned to nodes; the remaining
+	// bytes are random. If empty, the prefix 02 is used, which gives a
+	// unicast, locally administered address. Giving each of several
+	// bridged servers a different prefix prevents address collisions
+	// between them. See ParseAddressPrefix for the restrictions on the
+	// prefix.
+	AddressPrefix []byte
+
+	// Addresses that are used by the server itself (for example, as the
+	// source of server-generated packets), and which must never be
+	// assigned to a node. AddrNull and AddrBroadcast are always
+	// reserved.
+	Reserved []ipx.Addr
+}
+
 type addressableNetwork struct {
 	inner      network.Network
+	config     Config
+	reserved   map[ipx.Addr]bool
 	nodesByIPX map[ipx.Addr]*node
 	mu         sync.Mutex
 }
 
-func (n *addressableNetwork) NewNode() network.Node {
+func (n *addressableNetwork) NewNode() (network.Node, error) {
+	return n.NewNodeWithAddress(ipx.AddrNull)
+}
+
+// NewNodeWithAddress implements network.AddressRequester. If the requested
+// address is reserved or already in use, a random address is assigned
+// instead, the same as for NewNode.
+func (n *addressableNetwork) NewNodeWithAddress(addr ipx.Addr) (network.Node, error) {
 	result := &node{net: n}
+	n.mu.Lock()
+	if _, ok := n.nodesByIPX[addr]; !ok && !n.reserved[addr] {
+		result.addr = addr
+		n.nodesByIPX[addr] = result
+	}
+	n.mu.Unlock()
 	// Repeatedly generate a new IPX address until we generate one that
-	// is not already in use. A prefix of 02:... gives a Unicast address
-	// that is locally administered.
-	for {
+	// is not already in use or reserved.
+	prefixLen := len(n.config.AddressPrefix)
+	for result.addr == ipx.AddrNull {
 		var addr ipx.Addr
-		addr[0] = 0x02
-		rand.Read(addr[1:])
+		copy(addr[:], n.config.AddressPrefix)
+		if _, err := io.ReadFull(n.config.Rand, addr[prefixLen:]); err != nil {
+			return nil, err
+		}
+		if n.reserved[addr] {
+			continue
+		}
 		n.mu.Lock()
 		if _, ok := n.nodesByIPX[addr]; !ok {
 			result.addr = addr
 			n.nodesByIPX[addr] = result
-			n.mu.Unlock()
-			break
 		}
 		n.mu.Unlock()
 	}
-	result.inner = n.inner.NewNode()
-	return result
+	inner, err := n.inner.NewNode()
+	if err != nil {
+		n.mu.Lock()
+		delete(n.nodesByIPX, result.addr)
+		n.mu.Unlock()
+		return nil, err
+	}
+	result.inner = inner
+	return result, nil
 }
 
 type node struct {
@@ -82,11 +209,32 @@ func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 func (n *node) WritePacket(packet *ipx.Packet) error {
 	src := &packet.Header.Src
 	if src.Network != ipx.ZeroNetwork || src.Addr != n.addr {
-		return WrongAddressError
+		switch n.net.config.SourcePolicy {
+		case SourcePermissive:
+			if n.net.assignedElsewhere(src.Addr, n) {
+				return WrongAddressError
+			}
+		case SourceCorrect:
+			corrected := *packet
+			corrected.Header.Src.Network = ipx.ZeroNetwork
+			corrected.Header.Src.Addr = n.addr
+			packet = &corrected
+		default:
+			return WrongAddressError
+		}
 	}
 	return n.inner.WritePacket(packet)
 }
 
+// assignedElsewhere returns true if the given address is assigned to a node
+// other than the given one.
+func (n *addressableNetwork) assignedElsewhere(addr ipx.Addr, self *node) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	owner, ok := n.nodesByIPX[addr]
+	return ok && owner != self
+}
+
 func (n *node) Close() error {
 	n.net.mu.Lock()
 	delete(n.net.nodesByIPX, n.addr)
@@ -107,8 +255,32 @@ func (n *node) GetProperty(x interface{}) bool {
 // Wrap creates a network that wraps the given network but assigns a unique
 // IPX address to each node.
 func Wrap(n network.Network) network.Network {
-	return &addressableNetwork{
-		inner:      n,
+	return WrapWithConfig(n, &Config{})
+}
+
+// WrapWithConfig is like Wrap but takes additional configuration. It panics if
+// config.AddressPrefix is invalid; use ParseAddressPrefix to validate it.
+func WrapWithConfig(n network.Network, config *Config) network.Network {
+	if err := checkAddressPrefix(config.AddressPrefix); err != nil {
+		panic(err)
+	}
+	result := &addressableNetwork{
+		inner:  n,
+		config: *config,
+		reserved: map[ipx.Addr]bool{
+			ipx.AddrNull:      true,
+			ipx.AddrBroadcast: true,
+		},
 		nodesByIPX: map[ipx.Addr]*node{},
 	}
+	if result.config.Rand == nil {
+		result.config.Rand = rand.Reader
+	}
+	if len(result.config.AddressPrefix) == 0 {
+		result.config.AddressPrefix = defaultAddressPrefix
+	}
+	for _, addr := range config.Reserved {
+		result.reserved[addr] = true
+	}
+	return result
 }
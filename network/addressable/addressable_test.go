@@ -0,0 +1,222 @@
+package addressable
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func TestDeterministicAddress(t *testing.T) {
+	random := bytes.NewReader([]byte{
+		0x11, 0x22, 0x33, 0x44, 0x55,
+		// Second node collides with the first, so a new address
+		// is generated.
+		0x11, 0x22, 0x33, 0x44, 0x55,
+		0x66, 0x77, 0x88, 0x99, 0xaa,
+	})
+	n := WrapWithConfig(&ipxtesting.FakeNetwork{}, &Config{Rand: random})
+	for _, want := range []ipx.Addr{
+		{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+		{0x02, 0x66, 0x77, 0x88, 0x99, 0xaa},
+	} {
+		node := ipxtesting.MustNewNode(t, n)
+		if got := network.NodeAddress(node); got != want {
+			t.Errorf("wrong address assigned: want %s, got %s", want, got)
+		}
+	}
+}
+
+func TestSourcePolicy(t *testing.T) {
+	assigned := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	wrongAddr := ipx.Addr{0x02, 0x99, 0x99, 0x99, 0x99, 0x99}
+	for _, tc := range []struct {
+		policy  SourcePolicy
+		wantErr error
+		wantSrc ipx.Addr
+	}{
+		{SourceStrict, WrongAddressError, ipx.AddrNull},
+		{SourcePermissive, nil, wrongAddr},
+		{SourceCorrect, nil, assigned},
+	} {
+		var got *ipx.Packet
+		dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+			got = pkt
+		})
+		n := WrapWithConfig(&ipxtesting.FakeNetwork{Inner: dest}, &Config{
+			SourcePolicy: tc.policy,
+			Rand:         bytes.NewReader(assigned[1:]),
+		})
+		node := ipxtesting.MustNewNode(t, n)
+		err := node.WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast},
+				Src:  ipx.HeaderAddr{Addr: wrongAddr},
+			},
+		})
+		dest.Close()
+		switch {
+		case err != tc.wantErr:
+			t.Errorf("policy %d: want error %v, got %v", tc.policy, tc.wantErr, err)
+		case tc.wantErr != nil && got != nil:
+			t.Errorf("policy %d: packet forwarded: %+v", tc.policy, got)
+		case tc.wantErr == nil && (got == nil || got.Header.Src.Addr != tc.wantSrc):
+			t.Errorf("policy %d: want packet with source %s, got %+v", tc.policy, tc.wantSrc, got)
+		}
+	}
+}
+
+func TestPermissiveRefusesOtherNodesAddress(t *testing.T) {
+	var got *ipx.Packet
+	dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+		got = pkt
+	})
+	defer dest.Close()
+	n := WrapWithConfig(&ipxtesting.FakeNetwork{Inner: dest}, &Config{
+		SourcePolicy: SourcePermissive,
+	})
+	victim := ipxtesting.MustNewNode(t, n)
+	attacker := ipxtesting.MustNewNode(t, n)
+	err := attacker.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast},
+			Src:  ipx.HeaderAddr{Addr: network.NodeAddress(victim)},
+		},
+	})
+	if err != WrongAddressError {
+		t.Errorf("want error %v, got %v", WrongAddressError, err)
+	}
+	if got != nil {
+		t.Errorf("packet with another node's address forwarded: %+v", got)
+	}
+}
+
+// smallRand generates random data that makes every generated address one
+// of 02:00:00:00:00:00 to 02:00:00:00:00:07.
+type smallRand struct {
+	r *rand.Rand
+}
+
+func (s *smallRand) Read(data []byte) (int, error) {
+	for i := range data {
+		data[i] = 0
+	}
+	data[len(data)-1] = byte(s.r.Intn(8))
+	return len(data), nil
+}
+
+func TestReservedAddresses(t *testing.T) {
+	reserved := []ipx.Addr{
+		{0x02, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x02, 0x00, 0x00, 0x00, 0x00, 0x03},
+		{0x02, 0x00, 0x00, 0x00, 0x00, 0x07},
+	}
+	n := WrapWithConfig(&ipxtesting.FakeNetwork{}, &Config{
+		Rand:     &smallRand{rand.New(rand.NewSource(1))},
+		Reserved: reserved,
+	})
+	for i := 0; i < 1000; i++ {
+		node := ipxtesting.MustNewNode(t, n)
+		addr := network.NodeAddress(node)
+		for _, r := range reserved {
+			if addr == r {
+				t.Fatalf("iteration %d: reserved address %s was assigned", i, addr)
+			}
+		}
+		node.Close()
+	}
+}
+
+func TestRequestedAddress(t *testing.T) {
+	n := WrapWithConfig(&ipxtesting.FakeNetwork{}, &Config{
+		Reserved: []ipx.Addr{{0x02, 0xff, 0xff, 0xff, 0x00, 0x00}},
+	})
+	want := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	node, err := network.NewNodeWithAddress(n, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := network.NodeAddress(node); addr != want {
+		t.Errorf("want requested address %s, got %s", want, addr)
+	}
+
+	// The address is now in use, so a different one is assigned.
+	node2, err := network.NewNodeWithAddress(n, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := network.NodeAddress(node2); addr == want {
+		t.Errorf("address %s assigned twice", want)
+	}
+
+	// Once the first node is closed, the address can be requested again.
+	node.Close()
+	node, err = network.NewNodeWithAddress(n, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := network.NodeAddress(node); addr != want {
+		t.Errorf("want requested address %s after close, got %s", want, addr)
+	}
+
+	for _, addr := range []ipx.Addr{ipx.AddrNull, ipx.AddrBroadcast, {0x02, 0xff, 0xff, 0xff, 0x00, 0x00}} {
+		node, err := network.NewNodeWithAddress(n, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := network.NodeAddress(node); got == addr {
+			t.Errorf("reserved address %s was assigned on request", addr)
+		}
+	}
+}
+
+func TestAddressPrefix(t *testing.T) {
+	random := bytes.NewReader([]byte{0x11, 0x22, 0x33, 0x44})
+	n := WrapWithConfig(&ipxtesting.FakeNetwork{}, &Config{
+		Rand:          random,
+		AddressPrefix: []byte{0x06, 0xab},
+	})
+	want := ipx.Addr{0x06, 0xab, 0x11, 0x22, 0x33, 0x44}
+	node := ipxtesting.MustNewNode(t, n)
+	if got := network.NodeAddress(node); got != want {
+		t.Errorf("wrong address assigned: want %s, got %s", want, got)
+	}
+}
+
+func TestParseAddressPrefix(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []byte
+		ok   bool
+	}{
+		{"02", []byte{0x02}, true},
+		{"06:ab", []byte{0x06, 0xab}, true},
+		{"02:ab:cd", []byte{0x02, 0xab, 0xcd}, true},
+		{"02:ab:cd:ef", nil, false},
+		{"03", nil, false},
+		{"0g", nil, false},
+		{"2", nil, false},
+		{"", nil, false},
+	}
+	for _, test := range tests {
+		got, err := ParseAddressPrefix(test.s)
+		if (err == nil) != test.ok || !bytes.Equal(got, test.want) {
+			t.Errorf("ParseAddressPrefix(%q) = %x, %v; want %x, ok=%v",
+				test.s, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestRandError(t *testing.T) {
+	// The random source runs out after the first address.
+	n := WrapWithConfig(&ipxtesting.FakeNetwork{}, &Config{
+		Rand: bytes.NewReader([]byte{0x11, 0x22, 0x33, 0x44, 0x55}),
+	})
+	ipxtesting.MustNewNode(t, n)
+	if _, err := n.NewNode(); err == nil {
+		t.Errorf("NewNode succeeded after random source was exhausted")
+	}
+}
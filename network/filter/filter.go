@@ -1,17 +1,19 @@
 // Package filter implements a network that wraps another network but drops
-// packets using well-known ports.
+// packets according to a set of rules. By default, packets using well-known
+// ports are dropped.
 package filter
 
 import (
 	"context"
 	"errors"
+	"sync/atomic"
 
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
 )
 
 var (
-	_ = (network.Network)(&filteringNetwork{})
+	_ = (network.Network)(&Network{})
 	_ = (network.Node)(&filter{})
 
 	// Well-known IPX ports used for NetBIOS/SMB.
@@ -32,28 +34,65 @@ var (
 	FilteredPacketError = errors.New("packet filtered")
 )
 
+// Rule is a function that returns true if the given packet should be
+// filtered.
+type Rule func(*ipx.Packet) bool
+
+// ruleHolder holds the current Rule, which may be replaced at any time.
+type ruleHolder struct {
+	v atomic.Value
+}
+
+// ruleValue wraps a Rule, since atomic.Value cannot store nil.
+type ruleValue struct {
+	rule Rule
+}
+
+func makeRuleHolder(rule Rule) *ruleHolder {
+	h := &ruleHolder{}
+	h.set(rule)
+	return h
+}
+
+func (h *ruleHolder) set(rule Rule) {
+	h.v.Store(ruleValue{rule})
+}
+
+func (h *ruleHolder) shouldFilter(packet *ipx.Packet) bool {
+	rule := h.v.Load().(ruleValue).rule
+	return rule != nil && rule(packet)
+}
+
 type filter struct {
 	inner ipx.ReadWriteCloser
+	rules *ruleHolder
 }
 
 func shouldFilter(hdr *ipx.Header) bool {
 	return netbiosPorts[hdr.Dest.Socket] || netbiosPorts[hdr.Src.Socket]
 }
 
+// IsNetBIOS returns true if the given packet uses one of the well-known
+// port numbers that are filtered by this package. It can be used as a
+// predicate by code that wants to apply the same filtering rules.
+func IsNetBIOS(packet *ipx.Packet) bool {
+	return shouldFilter(&packet.Header)
+}
+
 func (f *filter) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 	for {
 		packet, err := f.inner.ReadPacket(ctx)
 		if err != nil {
 			return nil, err
 		}
-		if !shouldFilter(&packet.Header) {
+		if !f.rules.shouldFilter(packet) {
 			return packet, nil
 		}
 	}
 }
 
 func (f *filter) WritePacket(packet *ipx.Packet) error {
-	if shouldFilter(&packet.Header) {
+	if f.rules.shouldFilter(packet) {
 		return FilteredPacketError
 	}
 	return f.inner.WritePacket(packet)
@@ -70,22 +109,41 @@ func (f *filter) GetProperty(x interface{}) bool {
 	return false
 }
 
-type filteringNetwork struct {
+// Network is an implementation of network.Network that filters packets
+// according to a Rule. The rule can be replaced at runtime.
+type Network struct {
 	inner network.Network
+	rules *ruleHolder
+}
+
+func (n *Network) NewNode() (network.Node, error) {
+	inner, err := n.inner.NewNode()
+	if err != nil {
+		return nil, err
+	}
+	return &filter{
+		inner: inner,
+		rules: n.rules,
+	}, nil
 }
 
-func (n *filteringNetwork) NewNode() network.Node {
-	return &filter{inner: n.inner.NewNode()}
+// SetRule replaces the rule used to filter packets. The new rule takes
+// effect immediately for all nodes, including existing ones, so filtering
+// can be changed without disconnecting clients. A nil rule allows all
+// packets.
+func (n *Network) SetRule(rule Rule) {
+	n.rules.set(rule)
 }
 
 // Wrap creates a network that wraps the given network but rejects packets
-// using certain well-known port numbers which could present a security risk.
-func Wrap(n network.Network) network.Network {
-	return &filteringNetwork{inner: n}
+// using certain well-known port numbers which could present a security risk
+// (see NetBIOSRules).
+func Wrap(n network.Network) *Network {
+	return WrapWithRules(n, NetBIOSRules())
 }
 
 // New creates a new ReadWriteCloser that wraps the given ReadWriteCloser
 // but discards packets using well-known port numbers.
 func New(inner ipx.ReadWriteCloser) ipx.ReadWriteCloser {
-	return &filter{inner: inner}
+	return NewWithRules(inner, NetBIOSRules())
 }
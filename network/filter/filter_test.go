@@ -1,6 +1,7 @@
 package filter
 
 import (
+	"sync"
 	"testing"
 
 	"github.com/fragglet/ipxbox/ipx"
@@ -71,3 +72,52 @@ func TestFilteredWrites(t *testing.T) {
 		}
 	})
 }
+
+// TestSetRule replaces the filtering rule while packets are being written,
+// to check that the new rule applies to existing nodes. It is intended to be
+// run with the race detector enabled.
+func TestSetRule(t *testing.T) {
+	var mu sync.Mutex
+	gotPackets := 0
+	dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+		mu.Lock()
+		gotPackets++
+		mu.Unlock()
+	})
+	defer dest.Close()
+	n := Wrap(&ipxtesting.FakeNetwork{Inner: dest})
+	node := ipxtesting.MustNewNode(t, n)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			node.WritePacket(makeTestPacket(badSocket, badSocket))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		n.SetRule(nil)
+		n.SetRule(IsNetBIOS)
+	}
+	<-done
+
+	// With NetBIOS filtering in place, nothing gets through.
+	mu.Lock()
+	gotPackets = 0
+	mu.Unlock()
+	if err := node.WritePacket(makeTestPacket(badSocket, badSocket)); err != FilteredPacketError {
+		t.Errorf("want error %v, got %v", FilteredPacketError, err)
+	}
+
+	// Once filtering is disabled, the existing node can send NetBIOS
+	// packets.
+	n.SetRule(nil)
+	if err := node.WritePacket(makeTestPacket(badSocket, badSocket)); err != nil {
+		t.Errorf("error on WritePacket after disabling filter: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if gotPackets != 1 {
+		t.Errorf("want gotPackets=1, got=%d", gotPackets)
+	}
+}
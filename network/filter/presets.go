@@ -0,0 +1,61 @@
+package filter
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Well-known socket numbers of Novell protocols that send periodic
+// broadcasts, which are of no use to games.
+const (
+	SocketSAP     = 0x452 // Service Advertising Protocol
+	SocketRIP     = 0x453 // Routing Information Protocol
+	SocketNetBIOS = 0x455 // NetBIOS
+)
+
+var (
+	// BlockSAP drops Service Advertising Protocol packets.
+	BlockSAP = dropSocket(SocketSAP)
+
+	// BlockRIP drops Routing Information Protocol packets.
+	BlockRIP = dropSocket(SocketRIP)
+
+	// BlockNetBIOS drops NetBIOS packets. Unlike NetBIOSRules it only
+	// covers the NetBIOS socket itself, not the other sockets used
+	// for file sharing.
+	BlockNetBIOS = dropSocket(SocketNetBIOS)
+
+	// Presets maps the names of preset rules to the rules.
+	Presets = map[string]Rules{
+		"sap":     BlockSAP,
+		"rip":     BlockRIP,
+		"netbios": BlockNetBIOS,
+	}
+)
+
+func dropSocket(socket uint16) Rules {
+	return Rules{{Match: Match{Socket: socket}, Action: Drop}}
+}
+
+func presetNames() []string {
+	result := []string{}
+	for name := range Presets {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// LookupPresets returns the combined rules from Presets with the given
+// names. An error is returned if any name is not recognized.
+func LookupPresets(names []string) (Rules, error) {
+	result := Rules{}
+	for _, name := range names {
+		rules, ok := Presets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter preset %q; valid presets are: %v", name, presetNames())
+		}
+		result = append(result, rules...)
+	}
+	return result, nil
+}
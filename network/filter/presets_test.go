@@ -0,0 +1,49 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func TestPresets(t *testing.T) {
+	rules, err := LookupPresets([]string{"sap", "rip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotPackets := 0
+	dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+		gotPackets++
+	})
+	defer dest.Close()
+	f := NewWithRules(dest, rules)
+
+	// A SAP General Service Query, as sent by NetWare clients.
+	sap := &ipx.Packet{
+		Header: ipx.Header{
+			Src:  ipx.HeaderAddr{Addr: ipx.Addr{0x02, 0, 0, 0, 0, 1}, Socket: 0x4001},
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: SocketSAP},
+		},
+		Payload: []byte{0x00, 0x01, 0xff, 0xff},
+	}
+	if err := f.WritePacket(sap); err != FilteredPacketError {
+		t.Errorf("SAP packet: want %v, got %v", FilteredPacketError, err)
+	}
+	if err := f.WritePacket(makeTestPacket(SocketRIP, SocketRIP)); err != FilteredPacketError {
+		t.Errorf("RIP packet: want %v, got %v", FilteredPacketError, err)
+	}
+	// NetBIOS was not requested, and game traffic always passes.
+	for _, socket := range []uint16{SocketNetBIOS, goodSocket} {
+		if err := f.WritePacket(makeTestPacket(socket, socket)); err != nil {
+			t.Errorf("socket %#x: error on WritePacket: %v", socket, err)
+		}
+	}
+	if gotPackets != 2 {
+		t.Errorf("want gotPackets=2, got %d", gotPackets)
+	}
+
+	if _, err := LookupPresets([]string{"sap", "ncp"}); err == nil {
+		t.Errorf("LookupPresets succeeded with unknown preset")
+	}
+}
@@ -0,0 +1,214 @@
+package filter
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+// Action is what to do with a packet that matches a RuleEntry.
+type Action int
+
+const (
+	Allow Action = iota
+	Drop
+)
+
+func (a Action) String() string {
+	if a == Drop {
+		return "drop"
+	}
+	return "allow"
+}
+
+// Match describes the packets that a RuleEntry applies to. A packet must
+// satisfy all the conditions to match; zero-valued fields are ignored, so
+// the zero Match matches every packet.
+type Match struct {
+	// If non-zero, either the source or destination socket must be this
+	// socket number.
+	Socket uint16
+
+	// If not nil, the source or destination node address must be this
+	// address.
+	Src, Dest *ipx.Addr
+
+	// If true, the packet must be addressed to the broadcast address.
+	Broadcast bool
+
+	// If non-zero, bounds on the size of the packet in bytes, including
+	// the IPX header.
+	MinSize, MaxSize int
+}
+
+// Matches returns true if the given packet matches.
+func (m *Match) Matches(packet *ipx.Packet) bool {
+	hdr := &packet.Header
+	size := ipx.HeaderLength + len(packet.Payload)
+	switch {
+	case m.Socket != 0 && hdr.Src.Socket != m.Socket && hdr.Dest.Socket != m.Socket:
+		return false
+	case m.Src != nil && hdr.Src.Addr != *m.Src:
+		return false
+	case m.Dest != nil && hdr.Dest.Addr != *m.Dest:
+		return false
+	case m.Broadcast && hdr.Dest.Addr != ipx.AddrBroadcast:
+		return false
+	case m.MinSize != 0 && size < m.MinSize:
+		return false
+	case m.MaxSize != 0 && size > m.MaxSize:
+		return false
+	}
+	return true
+}
+
+// RuleEntry is one entry in a list of Rules.
+type RuleEntry struct {
+	Match
+	Action Action
+}
+
+// Rules is an ordered list of rules. The action of the first entry that
+// matches a packet decides whether it is allowed or dropped; packets that
+// match no entry are allowed.
+type Rules []RuleEntry
+
+// Action returns the action to take for the given packet.
+func (r Rules) Action(packet *ipx.Packet) Action {
+	for i := range r {
+		if r[i].Matches(packet) {
+			return r[i].Action
+		}
+	}
+	return Allow
+}
+
+// Rule returns a Rule that filters the packets that are dropped by this
+// list of rules.
+func (r Rules) Rule() Rule {
+	return func(packet *ipx.Packet) bool {
+		return r.Action(packet) == Drop
+	}
+}
+
+// NetBIOSRules returns the preset rules used by Wrap and New, which drop
+// packets using well-known port numbers which could present a security
+// risk. They drop the same packets as IsNetBIOS.
+func NetBIOSRules() Rules {
+	sockets := []int{}
+	for socket := range netbiosPorts {
+		sockets = append(sockets, int(socket))
+	}
+	sort.Ints(sockets)
+	result := Rules{}
+	for _, socket := range sockets {
+		result = append(result, RuleEntry{
+			Match:  Match{Socket: uint16(socket)},
+			Action: Drop,
+		})
+	}
+	return result
+}
+
+func parseAddr(s string) (*ipx.Addr, error) {
+	addr, err := ipx.ParseAddr(s)
+	if err != nil {
+		return nil, err
+	}
+	return &addr, nil
+}
+
+func parseRuleEntry(s string) (RuleEntry, error) {
+	var result RuleEntry
+	fields := strings.Fields(s)
+	switch {
+	case len(fields) == 0:
+		return result, fmt.Errorf("empty rule")
+	case fields[0] == "allow":
+		result.Action = Allow
+	case fields[0] == "drop":
+		result.Action = Drop
+	default:
+		return result, fmt.Errorf("rule %q must start with \"allow\" or \"drop\"", s)
+	}
+	for _, cond := range fields[1:] {
+		if cond == "broadcast" {
+			result.Broadcast = true
+			continue
+		}
+		parts := strings.SplitN(cond, "=", 2)
+		if len(parts) != 2 {
+			return result, fmt.Errorf("invalid condition %q", cond)
+		}
+		var err error
+		switch parts[0] {
+		case "socket":
+			var socket uint64
+			socket, err = strconv.ParseUint(parts[1], 0, 16)
+			result.Socket = uint16(socket)
+		case "src":
+			result.Src, err = parseAddr(parts[1])
+		case "dest":
+			result.Dest, err = parseAddr(parts[1])
+		case "min_size":
+			result.MinSize, err = strconv.Atoi(parts[1])
+		case "max_size":
+			result.MaxSize, err = strconv.Atoi(parts[1])
+		default:
+			err = fmt.Errorf("unknown condition")
+		}
+		if err != nil {
+			return result, fmt.Errorf("invalid condition %q: %w", cond, err)
+		}
+	}
+	return result, nil
+}
+
+// ParseRules parses a list of rules separated by semicolons, for example
+// "drop socket=0x869c; allow broadcast". Each rule is "allow" or "drop",
+// followed by conditions that must all be true for the rule to match:
+//
+//	socket=N     source or destination socket is N
+//	src=ADDR     source node address is ADDR, eg. 02:00:00:00:00:01
+//	dest=ADDR    destination node address is ADDR
+//	broadcast    packet is addressed to the broadcast address
+//	min_size=N   packet is at least N bytes long, including the header
+//	max_size=N   packet is at most N bytes long, including the header
+//
+// An empty string gives an empty list of rules.
+func ParseRules(s string) (Rules, error) {
+	result := Rules{}
+	if strings.TrimSpace(s) == "" {
+		return result, nil
+	}
+	for _, entry := range strings.Split(s, ";") {
+		re, err := parseRuleEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+// WrapWithRules creates a network that wraps the given network and filters
+// packets according to the given rules.
+func WrapWithRules(n network.Network, rules Rules) *Network {
+	return &Network{
+		inner: n,
+		rules: makeRuleHolder(rules.Rule()),
+	}
+}
+
+// NewWithRules creates a new ReadWriteCloser that wraps the given
+// ReadWriteCloser and filters packets according to the given rules.
+func NewWithRules(inner ipx.ReadWriteCloser, rules Rules) ipx.ReadWriteCloser {
+	return &filter{
+		inner: inner,
+		rules: makeRuleHolder(rules.Rule()),
+	}
+}
@@ -0,0 +1,89 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+func TestRules(t *testing.T) {
+	client := ipx.Addr{0x02, 0, 0, 0, 0, 1}
+	other := ipx.Addr{0x02, 0, 0, 0, 0, 2}
+	packet := func(src, dest ipx.Addr, socket uint16, payloadLen int) *ipx.Packet {
+		return &ipx.Packet{
+			Header: ipx.Header{
+				Src:  ipx.HeaderAddr{Addr: src, Socket: socket},
+				Dest: ipx.HeaderAddr{Addr: dest, Socket: socket},
+			},
+			Payload: make([]byte, payloadLen),
+		}
+	}
+	for _, test := range []struct {
+		name   string
+		rules  string
+		packet *ipx.Packet
+		want   Action
+	}{
+		{"no rules", "", packet(client, other, 0x455, 0), Allow},
+		{"socket match", "drop socket=0x869c", packet(client, other, 0x869c, 0), Drop},
+		{"socket mismatch", "drop socket=0x869c", packet(client, other, 0x869b, 0), Allow},
+		{"first match wins", "allow socket=0x869c; drop", packet(client, other, 0x869c, 0), Allow},
+		{"whitelist", "allow socket=0x869c; drop", packet(client, other, 0x869b, 0), Drop},
+		{"src match", "drop src=02:00:00:00:00:01", packet(client, other, 1, 0), Drop},
+		{"src mismatch", "drop src=02:00:00:00:00:01", packet(other, client, 1, 0), Allow},
+		{"dest match", "drop dest=02:00:00:00:00:01", packet(other, client, 1, 0), Drop},
+		{"broadcast", "drop broadcast", packet(client, ipx.AddrBroadcast, 1, 0), Drop},
+		{"not broadcast", "drop broadcast", packet(client, other, 1, 0), Allow},
+		{"all conditions must match", "drop broadcast socket=5", packet(client, ipx.AddrBroadcast, 1, 0), Allow},
+		{"min size", "drop min_size=100", packet(client, other, 1, 100-ipx.HeaderLength), Drop},
+		{"under min size", "drop min_size=100", packet(client, other, 1, 99-ipx.HeaderLength), Allow},
+		{"over max size", "drop max_size=100", packet(client, other, 1, 101-ipx.HeaderLength), Allow},
+	} {
+		rules, err := ParseRules(test.rules)
+		if err != nil {
+			t.Errorf("%s: ParseRules(%q) failed: %v", test.name, test.rules, err)
+			continue
+		}
+		if got := rules.Action(test.packet); got != test.want {
+			t.Errorf("%s: rules %q: want %v, got %v", test.name, test.rules, test.want, got)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	addr := ipx.Addr{0x02, 0, 0, 0, 0, 1}
+	rules, err := ParseRules(" allow dest=02:00:00:00:00:01 max_size=200 ;drop socket=17 broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Rules{
+		{Match: Match{Dest: &addr, MaxSize: 200}, Action: Allow},
+		{Match: Match{Socket: 17, Broadcast: true}, Action: Drop},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("wrong rules: want %+v, got %+v", want, rules)
+	}
+	for _, bad := range []string{
+		"reject socket=1",
+		"drop socket=0x10000",
+		"drop src=02:00",
+		"drop size=10",
+		"drop socket",
+		"allow;",
+	} {
+		if _, err := ParseRules(bad); err == nil {
+			t.Errorf("ParseRules(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestNetBIOSRules(t *testing.T) {
+	rules := NetBIOSRules()
+	for socket := uint16(0); socket < 0xffff; socket++ {
+		p := makeTestPacket(goodSocket, socket)
+		if got, want := rules.Action(p) == Drop, IsNetBIOS(p); got != want {
+			t.Errorf("socket %#x: rules drop=%v, IsNetBIOS=%v", socket, got, want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Package gamefilter implements a network that wraps another network but
+// only forwards packets that are recognized as belonging to one of an
+// allowed list of games. This can be used by public servers to prevent
+// them from being abused as a general purpose relay.
+package gamefilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+var (
+	_ = (network.Network)(&filteringNetwork{})
+	_ = (network.Node)(&filter{})
+
+	// UnrecognizedGameError is returned when a packet is written that
+	// does not match any of the allowed game signatures.
+	UnrecognizedGameError = errors.New("packet does not match any allowed game")
+
+	// Signatures contains signatures for some well-known games, indexed
+	// by name. Additional signatures can be added to recognize other
+	// games.
+	Signatures = map[string]*Signature{
+		"doom": {
+			// Also used by Heretic, Hexen and Strife, which all
+			// share the same IPXSETUP code.
+			Name:    "doom",
+			Sockets: []uint16{0x869c},
+		},
+		"descent": {
+			Name:    "descent",
+			Sockets: []uint16{0x5100},
+		},
+		"quake": {
+			Name:    "quake",
+			Sockets: []uint16{26000, 26001},
+			// All Quake IPX packets start with a four byte
+			// header that precedes the message.
+			Match: func(packet *ipx.Packet) bool {
+				return len(packet.Payload) > 4
+			},
+		},
+	}
+)
+
+// Signature describes how to recognize the packets sent by a game.
+type Signature struct {
+	// Name is a short name that identifies the game.
+	Name string
+
+	// Packets sent from or to any of these sockets may belong to this
+	// game.
+	Sockets []uint16
+
+	// If not nil, Match is invoked as an additional heuristic check for
+	// packets that use one of the sockets in Sockets. It returns true
+	// if the packet looks like it belongs to this game.
+	Match func(*ipx.Packet) bool
+}
+
+func (s *Signature) matches(packet *ipx.Packet) bool {
+	hdr := &packet.Header
+	for _, socket := range s.Sockets {
+		if hdr.Dest.Socket == socket || hdr.Src.Socket == socket {
+			return s.Match == nil || s.Match(packet)
+		}
+	}
+	return false
+}
+
+// Lookup returns the signatures from Signatures for the given game names.
+// An error is returned if any name is not recognized.
+func Lookup(names []string) ([]*Signature, error) {
+	result := []*Signature{}
+	for _, name := range names {
+		sig, ok := Signatures[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown game %q; valid games are: %v", name, knownGames())
+		}
+		result = append(result, sig)
+	}
+	return result, nil
+}
+
+// Identify returns the name of the game that the given packet appears to
+// belong to, using the signatures in Signatures. If several games match,
+// the first by name is returned. This is called for every packet, so it
+// does not allocate.
+func Identify(packet *ipx.Packet) (string, bool) {
+	result := ""
+	for name, sig := range Signatures {
+		if (result == "" || name < result) && sig.matches(packet) {
+			result = name
+		}
+	}
+	return result, result != ""
+}
+
+func knownGames() []string {
+	result := []string{}
+	for name := range Signatures {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+type filter struct {
+	inner      ipx.ReadWriteCloser
+	signatures []*Signature
+}
+
+func (f *filter) allowed(packet *ipx.Packet) bool {
+	for _, sig := range f.signatures {
+		if sig.matches(packet) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *filter) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	for {
+		packet, err := f.inner.ReadPacket(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if f.allowed(packet) {
+			return packet, nil
+		}
+	}
+}
+
+func (f *filter) WritePacket(packet *ipx.Packet) error {
+	if !f.allowed(packet) {
+		return UnrecognizedGameError
+	}
+	return f.inner.WritePacket(packet)
+}
+
+func (f *filter) Close() error {
+	return f.inner.Close()
+}
+
+func (f *filter) GetProperty(x interface{}) bool {
+	if node, ok := f.inner.(network.Node); ok {
+		return node.GetProperty(x)
+	}
+	return false
+}
+
+type filteringNetwork struct {
+	inner      network.Network
+	signatures []*Signature
+}
+
+func (n *filteringNetwork) NewNode() (network.Node, error) {
+	inner, err := n.inner.NewNode()
+	if err != nil {
+		return nil, err
+	}
+	return &filter{
+		inner:      inner,
+		signatures: n.signatures,
+	}, nil
+}
+
+// Wrap creates a network that wraps the given network but only forwards
+// packets that match one of the given game signatures.
+func Wrap(n network.Network, signatures []*Signature) network.Network {
+	return &filteringNetwork{
+		inner:      n,
+		signatures: signatures,
+	}
+}
+
+// New creates a new ReadWriteCloser that wraps the given ReadWriteCloser
+// but discards packets that do not match one of the given game signatures.
+func New(inner ipx.ReadWriteCloser, signatures []*Signature) ipx.ReadWriteCloser {
+	return &filter{
+		inner:      inner,
+		signatures: signatures,
+	}
+}
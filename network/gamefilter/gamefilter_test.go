@@ -0,0 +1,89 @@
+package gamefilter
+
+import (
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func makeTestPacket(socket uint16, payload string) *ipx.Packet {
+	return &ipx.Packet{
+		Header: ipx.Header{
+			Src: ipx.HeaderAddr{
+				Addr:   ipx.AddrNull,
+				Socket: socket,
+			},
+			Dest: ipx.HeaderAddr{
+				Addr:   ipx.AddrBroadcast,
+				Socket: socket,
+			},
+		},
+		Payload: []byte(payload),
+	}
+}
+
+func TestAllowedGames(t *testing.T) {
+	gotPackets := 0
+	dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+		gotPackets++
+	})
+	defer dest.Close()
+
+	sigs, err := Lookup([]string{"doom", "quake"})
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	filter := New(dest, sigs)
+
+	for _, tc := range []struct {
+		name    string
+		packet  *ipx.Packet
+		allowed bool
+	}{
+		{"doom", makeTestPacket(0x869c, "doom data"), true},
+		{"quake", makeTestPacket(26000, "\x00\x00\x00\x00quake"), true},
+		{"quake heuristic", makeTestPacket(26000, "\x00"), false},
+		{"descent not allowed", makeTestPacket(0x5100, "descent"), false},
+		{"unknown game", makeTestPacket(0x1234, "data"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gotPackets = 0
+			err := filter.WritePacket(tc.packet)
+			switch {
+			case tc.allowed && (err != nil || gotPackets != 1):
+				t.Errorf("packet not forwarded: err=%v, gotPackets=%d", err, gotPackets)
+			case !tc.allowed && (err != UnrecognizedGameError || gotPackets != 0):
+				t.Errorf("packet not dropped: err=%v, gotPackets=%d", err, gotPackets)
+			}
+		})
+	}
+}
+
+func TestLookupUnknown(t *testing.T) {
+	if _, err := Lookup([]string{"doom", "nonexistent"}); err == nil {
+		t.Errorf("want error looking up unknown game, got nil")
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	for _, tc := range []struct {
+		packet *ipx.Packet
+		want   string
+	}{
+		{makeTestPacket(0x869c, "doom data"), "doom"},
+		{makeTestPacket(0x5100, "descent"), "descent"},
+		{makeTestPacket(26000, "\x00\x00\x00\x00quake"), "quake"},
+		{makeTestPacket(26000, "\x00"), ""},
+		{makeTestPacket(0x1234, "data"), ""},
+	} {
+		got, ok := Identify(tc.packet)
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("Identify(socket %#x) = %q, %v; want %q", tc.packet.Header.Dest.Socket, got, ok, tc.want)
+		}
+	}
+	packet := makeTestPacket(0x1234, "data")
+	if allocs := testing.AllocsPerRun(100, func() { Identify(packet) }); allocs != 0 {
+		t.Errorf("Identify made %v allocations per call, want 0", allocs)
+	}
+}
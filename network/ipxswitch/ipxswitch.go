@@ -4,20 +4,54 @@ package ipxswitch
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/metrics"
 	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/network/pipe"
 )
 
 type Network struct {
+	// If true, unicast packets addressed to the sender's own address are
+	// delivered back to it. By default such packets are dropped, since a
+	// buggy client could otherwise cause pointless reflection.
+	ReflectSelfAddressed bool
+
+	// If not nil, packets queued for delivery to nodes are accounted
+	// against this budget. This should be set before any nodes are
+	// created.
+	Budget *pipe.Budget
+
+	// If not nil, the time that packets spend queued for delivery to
+	// nodes is recorded in this histogram. This should be set before
+	// any nodes are created.
+	QueueTime *metrics.Histogram
+
+	// If non-zero, the maximum number of nodes that can be attached to
+	// the network at once. NewNode returns TooManyNodesError once this
+	// limit is reached.
+	MaxNodes int
+
+	// If non-zero, the maximum number of mirrors that can be open at
+	// once. NewMirror returns TooManyMirrorsError once this limit is
+	// reached.
+	MaxMirrors int
+
+	// If not nil, this is incremented for every unicast packet sent to
+	// an address that is not in use by any node. Such packets are
+	// delivered to every node, as for a broadcast.
+	UnknownDestinations *metrics.Counter
+
 	mu         sync.RWMutex
 	nodesByID  map[int]*node
 	nextNodeID int
 	table      *routingTable
+	mirrors    map[*Mirror]bool
 }
 
 type node struct {
@@ -29,6 +63,19 @@ type node struct {
 var (
 	_ = (network.Network)(&Network{})
 	_ = (network.Node)(&node{})
+	_ = (ipx.ReadCloser)(&Mirror{})
+
+	// TooManyNodesError is returned by NewNode if the maximum number of
+	// nodes are already attached to the network.
+	TooManyNodesError = errors.New("too many nodes attached to network")
+
+	// TooManyMirrorsError is returned by NewMirror if the maximum
+	// number of mirrors are already open.
+	TooManyMirrorsError = errors.New("too many mirrors open")
+
+	// InvalidMirrorError is returned by NewMirror if the target address
+	// is not a unicast address.
+	InvalidMirrorError = errors.New("invalid mirror: target must be a unicast address")
 )
 
 // Close removes the node from its parent network; future calls to ReadPacket()
@@ -57,18 +104,26 @@ func (n *node) GetProperty(x interface{}) bool {
 }
 
 // NewNode creates a new node on the network.
-func (n *Network) NewNode() network.Node {
+func (n *Network) NewNode() (network.Node, error) {
 	node := &node{
-		net:    n,
-		rxpipe: pipe.New(),
+		net: n,
+		rxpipe: pipe.NewWithOptions(&pipe.Options{
+			Budget:    n.Budget,
+			QueueTime: n.QueueTime,
+		}),
 	}
 	n.mu.Lock()
+	if n.MaxNodes > 0 && len(n.nodesByID) >= n.MaxNodes {
+		n.mu.Unlock()
+		node.rxpipe.Close()
+		return nil, TooManyNodesError
+	}
 	node.nodeID = n.nextNodeID
 	n.nextNodeID++
 	n.nodesByID[node.nodeID] = node
 	n.mu.Unlock()
 	n.table.AddPort(node.nodeID)
-	return node
+	return node, nil
 }
 
 func (n *Network) broadcastPacket(packet *ipx.Packet, src ipx.Writer) error {
@@ -95,14 +150,40 @@ func (n *Network) broadcastPacket(packet *ipx.Packet, src ipx.Writer) error {
 	return nil
 }
 
+// isUnicast returns true if the given address identifies a single node: it
+// is neither the null address nor a broadcast or multicast address.
+func isUnicast(addr ipx.Addr) bool {
+	return addr != ipx.AddrNull && addr[0]&0x01 == 0
+}
+
 // forwardPacket receives a packet and forwards it on to another node.
+// Forwarding happens synchronously in the goroutine of the sending node,
+// and each node has a single FIFO receive pipe. This guarantees that
+// packets from one source to a particular destination are always
+// delivered in the order they were sent; any future change to make
+// forwarding concurrent must preserve this property, since many games
+// do not cope well with reordered packets.
 func (n *Network) forwardPacket(packet *ipx.Packet, src ipx.Writer) error {
+	hdr := &packet.Header
+	if hdr.Dest.Addr == hdr.Src.Addr && isUnicast(hdr.Dest.Addr) {
+		srcNode, ok := src.(*node)
+		if !ok || !n.ReflectSelfAddressed {
+			return nil
+		}
+		return srcNode.rxpipe.WritePacket(packet)
+	}
 	destNodeID := n.table.LookupDest(&packet.Header.Dest)
 	if destNodeID == broadcastDest {
+		if hdr.Dest.Addr != ipx.AddrBroadcast {
+			n.UnknownDestinations.Inc()
+		}
 		return n.broadcastPacket(packet, src)
 	}
 	n.mu.RLock()
 	node, ok := n.nodesByID[destNodeID]
+	if ok && node != src {
+		n.mirrorPacket(packet)
+	}
 	n.mu.RUnlock()
 	if !ok || node == src {
 		return nil
@@ -110,10 +191,105 @@ func (n *Network) forwardPacket(packet *ipx.Packet, src ipx.Writer) error {
 	return node.rxpipe.WritePacket(packet)
 }
 
+// Mirror receives copies of the unicast packets sent to and from one node
+// of a Network, for spectating. It is read-only: it is not a node, has no
+// address, and nothing can be sent into the network through it.
+type Mirror struct {
+	// Number of packets dropped; first in the struct to guarantee
+	// 64-bit alignment for atomic operations.
+	dropped uint64
+
+	net    *Network
+	target ipx.Addr
+	rxpipe ipx.ReadWriteCloser
+}
+
+// NewMirror creates a Mirror that receives a copy of every unicast packet
+// sent to or from the node with the given address. Delivery to the real
+// destination is not affected; if the mirror is not read quickly enough,
+// copies are dropped (see Mirror.Dropped). The mirror must be closed when
+// no longer needed.
+func (n *Network) NewMirror(target ipx.Addr) (*Mirror, error) {
+	if target == ipx.AddrNull || target == ipx.AddrBroadcast {
+		return nil, InvalidMirrorError
+	}
+	m := &Mirror{
+		net:    n,
+		target: target,
+		rxpipe: pipe.NewWithOptions(&pipe.Options{
+			Budget: n.Budget,
+		}),
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.MaxMirrors > 0 && len(n.mirrors) >= n.MaxMirrors {
+		m.rxpipe.Close()
+		return nil, TooManyMirrorsError
+	}
+	n.mirrors[m] = true
+	return m, nil
+}
+
+// Mirrors returns the addresses of the nodes whose traffic is currently
+// being mirrored.
+func (n *Network) Mirrors() []ipx.Addr {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	seen := map[ipx.Addr]bool{}
+	result := []ipx.Addr{}
+	for m := range n.mirrors {
+		if !seen[m.target] {
+			seen[m.target] = true
+			result = append(result, m.target)
+		}
+	}
+	return result
+}
+
+// mirrorPacket writes a copy of a unicast packet to every mirror of its
+// source or destination. This is called with a read lock held.
+func (n *Network) mirrorPacket(packet *ipx.Packet) {
+	hdr := &packet.Header
+	for m := range n.mirrors {
+		if m.target != hdr.Src.Addr && m.target != hdr.Dest.Addr {
+			continue
+		}
+		if m.rxpipe.WritePacket(packet) != nil {
+			atomic.AddUint64(&m.dropped, 1)
+		}
+	}
+}
+
+// Target returns the address of the node whose traffic is mirrored.
+func (m *Mirror) Target() ipx.Addr {
+	return m.target
+}
+
+// Dropped returns the number of packets that were not delivered to the
+// mirror because its buffer was full (or the memory budget was exceeded).
+func (m *Mirror) Dropped() uint64 {
+	return atomic.LoadUint64(&m.dropped)
+}
+
+// ReadPacket reads the next mirrored packet.
+func (m *Mirror) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	return m.rxpipe.ReadPacket(ctx)
+}
+
+// Close detaches the mirror from the network and then closes its receive
+// pipe, so that nothing can be writing to the pipe as it is closed.
+func (m *Mirror) Close() error {
+	m.net.mu.Lock()
+	delete(m.net.mirrors, m)
+	m.net.mu.Unlock()
+	return m.rxpipe.Close()
+}
+
 // New creates a new Network.
 func New() *Network {
 	return &Network{
 		nodesByID: map[int]*node{},
 		table:     makeRoutingTable(),
+		mirrors:   map[*Mirror]bool{},
 	}
 }
@@ -0,0 +1,317 @@
+package ipxswitch
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/metrics"
+	"github.com/fragglet/ipxbox/network"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+var destAddr = ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+
+func makeSequencePacket(src ipx.Addr, seq int) *ipx.Packet {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(seq))
+	return &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: destAddr, Socket: 0x869c},
+			Src:  ipx.HeaderAddr{Addr: src, Socket: 0x869c},
+		},
+		Payload: payload,
+	}
+}
+
+// makeDestNode creates a new node and sends a packet from it so that the
+// switch learns its address.
+func makeDestNode(t *testing.T, n *Network) network.Node {
+	dest := ipxtesting.MustNewNode(t, n)
+	dest.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast},
+			Src:  ipx.HeaderAddr{Addr: destAddr},
+		},
+	})
+	return dest
+}
+
+func TestPacketOrdering(t *testing.T) {
+	n := New()
+	const numSenders = 4
+	// Total packets must fit in the destination's receive pipe.
+	const packetsPerSender = 4
+	dest := makeDestNode(t, n)
+	senders := []network.Node{}
+	for i := 0; i < numSenders; i++ {
+		senders = append(senders, ipxtesting.MustNewNode(t, n))
+	}
+
+	var wg sync.WaitGroup
+	for i, sender := range senders {
+		wg.Add(1)
+		go func(i int, sender network.Node) {
+			defer wg.Done()
+			src := ipx.Addr{0x02, 0, 0, 0, 0, byte(i + 1)}
+			for seq := 0; seq < packetsPerSender; seq++ {
+				if err := sender.WritePacket(makeSequencePacket(src, seq)); err != nil {
+					t.Errorf("sender %d: WritePacket failed: %v", i, err)
+				}
+			}
+		}(i, sender)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	nextSeq := map[ipx.Addr]int{}
+	for i := 0; i < numSenders*packetsPerSender; i++ {
+		packet, err := dest.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("ReadPacket failed after %d packets: %v", i, err)
+		}
+		src := packet.Header.Src.Addr
+		seq := int(binary.BigEndian.Uint32(packet.Payload))
+		if seq != nextSeq[src] {
+			t.Errorf("packet from %s out of order: want seq %d, got %d", src, nextSeq[src], seq)
+		}
+		nextSeq[src] = seq + 1
+	}
+}
+
+func TestNoReflectBroadcasts(t *testing.T) {
+	// Nodes such as bridges and uplinks must never receive their own
+	// broadcasts back, or they would echo them onto the network they
+	// came from.
+	broadcast := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 0x869c},
+			Src:  ipx.HeaderAddr{Addr: destAddr, Socket: 0x869c},
+		},
+	}
+	n := New()
+	bridge := ipxtesting.MustNewNode(t, n)
+	other := ipxtesting.MustNewNode(t, n)
+	if err := bridge.WritePacket(broadcast); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := other.ReadPacket(ctx); err != nil {
+		t.Errorf("other node did not receive broadcast: %v", err)
+	}
+	if packet, err := bridge.ReadPacket(ctx); err == nil {
+		t.Errorf("bridge node received its own broadcast: %+v", packet)
+	}
+}
+
+func TestSelfAddressed(t *testing.T) {
+	selfAddressed := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: destAddr, Socket: 0x869c},
+			Src:  ipx.HeaderAddr{Addr: destAddr, Socket: 0x869c},
+		},
+	}
+	for _, reflect := range []bool{false, true} {
+		n := New()
+		n.ReflectSelfAddressed = reflect
+		sender := ipxtesting.MustNewNode(t, n)
+		if err := sender.WritePacket(selfAddressed); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		packet, err := sender.ReadPacket(ctx)
+		cancel()
+		switch {
+		case reflect && err != nil:
+			t.Errorf("sender did not receive self-addressed packet: %v", err)
+		case !reflect && err == nil:
+			t.Errorf("self-addressed packet forwarded back to sender: %+v", packet)
+		}
+	}
+}
+
+// TestNonUnicastSelfAddressed checks that packets whose source and
+// destination are the same broadcast or null address are still forwarded
+// to other nodes, since they do not identify the sender.
+func TestNonUnicastSelfAddressed(t *testing.T) {
+	for _, addr := range []ipx.Addr{ipx.AddrBroadcast, ipx.AddrNull} {
+		n := New()
+		sender := ipxtesting.MustNewNode(t, n)
+		receiver := ipxtesting.MustNewNode(t, n)
+		if err := sender.WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: addr, Socket: 0x869c},
+				Src:  ipx.HeaderAddr{Addr: addr, Socket: 0x869c},
+			},
+		}); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err := receiver.ReadPacket(ctx)
+		cancel()
+		if err != nil {
+			t.Errorf("packet from %s to %s not forwarded: %v", addr, addr, err)
+		}
+	}
+}
+
+func TestMaxNodes(t *testing.T) {
+	n := New()
+	n.MaxNodes = 2
+	node1 := ipxtesting.MustNewNode(t, n)
+	ipxtesting.MustNewNode(t, n)
+	if _, err := n.NewNode(); err != TooManyNodesError {
+		t.Fatalf("NewNode over limit: want %v, got %v", TooManyNodesError, err)
+	}
+	// Closing a node frees up space for another.
+	node1.Close()
+	if _, err := n.NewNode(); err != nil {
+		t.Errorf("NewNode after Close failed: %v", err)
+	}
+}
+
+func TestUnknownDestinations(t *testing.T) {
+	n := New()
+	n.UnknownDestinations = metrics.NewCounter("test_unknown", "Test counter.")
+	sender := ipxtesting.MustNewNode(t, n)
+	src := ipx.Addr{0x02, 0, 0, 0, 0, 1}
+
+	// Neither broadcasts nor packets to a known node are counted.
+	makeDestNode(t, n)
+	sender.WritePacket(makeSequencePacket(src, 0))
+	if got := n.UnknownDestinations.Value(); got != 0 {
+		t.Errorf("want no unknown destinations, got %d", got)
+	}
+
+	unknown := makeSequencePacket(src, 1)
+	unknown.Header.Dest.Addr = ipx.Addr{0x02, 0, 0, 0, 0, 9}
+	sender.WritePacket(unknown)
+	if got := n.UnknownDestinations.Value(); got != 1 {
+		t.Errorf("want 1 unknown destination, got %d", got)
+	}
+}
+
+// drain discards any packets queued for delivery to the given node.
+func drain(node network.Node) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := node.ReadPacket(ctx)
+		cancel()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	targetAddr := ipx.Addr{0x02, 0, 0, 0, 0, 1}
+	peerAddr := ipx.Addr{0x02, 0, 0, 0, 0, 2}
+	otherAddr := ipx.Addr{0x02, 0, 0, 0, 0, 3}
+	n := New()
+	nodes := map[ipx.Addr]network.Node{}
+	for _, addr := range []ipx.Addr{targetAddr, peerAddr, otherAddr} {
+		nodes[addr] = ipxtesting.MustNewNode(t, n)
+		nodes[addr].WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast},
+				Src:  ipx.HeaderAddr{Addr: addr},
+			},
+		})
+	}
+	for _, node := range nodes {
+		drain(node)
+	}
+	if _, err := n.NewMirror(ipx.AddrBroadcast); err != InvalidMirrorError {
+		t.Errorf("NewMirror of broadcast address: want %v, got %v", InvalidMirrorError, err)
+	}
+	m, err := n.NewMirror(targetAddr)
+	if err != nil {
+		t.Fatalf("NewMirror failed: %v", err)
+	}
+
+	unicast := func(src, dest ipx.Addr) *ipx.Packet {
+		return &ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: dest, Socket: 0x869c},
+				Src:  ipx.HeaderAddr{Addr: src, Socket: 0x869c},
+			},
+		}
+	}
+	expectPacket := func(r ipx.Reader, want *ipx.Packet, what string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		got, err := r.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("%s: packet not received: %v", what, err)
+		} else if got.Header != want.Header {
+			t.Errorf("%s: wrong packet: want %+v, got %+v", what, want, got)
+		}
+	}
+	expectNothing := func(r ipx.Reader, what string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if got, err := r.ReadPacket(ctx); err == nil {
+			t.Errorf("%s: unexpected packet received: %+v", what, got)
+		}
+	}
+
+	toTarget := unicast(peerAddr, targetAddr)
+	nodes[peerAddr].WritePacket(toTarget)
+	expectPacket(nodes[targetAddr], toTarget, "target")
+	expectPacket(m, toTarget, "mirror of packet to target")
+
+	fromTarget := unicast(targetAddr, peerAddr)
+	nodes[targetAddr].WritePacket(fromTarget)
+	expectPacket(nodes[peerAddr], fromTarget, "peer")
+	expectPacket(m, fromTarget, "mirror of packet from target")
+
+	// Mirrored traffic is never delivered to other nodes, and traffic
+	// not involving the target is not mirrored.
+	expectNothing(nodes[otherAddr], "other node")
+	toOther := unicast(peerAddr, otherAddr)
+	nodes[peerAddr].WritePacket(toOther)
+	expectPacket(nodes[otherAddr], toOther, "other node")
+	expectNothing(m, "mirror of unrelated traffic")
+
+	if got := n.Mirrors(); len(got) != 1 || got[0] != targetAddr {
+		t.Errorf("Mirrors: want [%v], got %v", targetAddr, got)
+	}
+	m.Close()
+	if got := n.Mirrors(); len(got) != 0 {
+		t.Errorf("Mirrors after Close: want none, got %v", got)
+	}
+	nodes[peerAddr].WritePacket(toTarget)
+	expectPacket(nodes[targetAddr], toTarget, "target")
+}
+
+func TestMaxMirrors(t *testing.T) {
+	n := New()
+	n.MaxMirrors = 2
+	target := ipx.Addr{0x02, 0, 0, 0, 0, 1}
+	var mirrors []*Mirror
+	for i := 0; i < 2; i++ {
+		m, err := n.NewMirror(target)
+		if err != nil {
+			t.Fatalf("NewMirror %d failed: %v", i, err)
+		}
+		mirrors = append(mirrors, m)
+	}
+	if _, err := n.NewMirror(target); err != TooManyMirrorsError {
+		t.Errorf("want %v, got %v", TooManyMirrorsError, err)
+	}
+	mirrors[0].Close()
+	m, err := n.NewMirror(target)
+	if err != nil {
+		t.Fatalf("NewMirror after Close failed: %v", err)
+	}
+	m.Close()
+	mirrors[1].Close()
+}
@@ -7,8 +7,29 @@ import (
 
 // Network represents the concept of an IPX network.
 type Network interface {
-	// NewNode creates a new network node.
-	NewNode() Node
+	// NewNode creates a new network node. An error is returned if the
+	// node cannot be created, for example because the network is full.
+	NewNode() (Node, error)
+}
+
+// AddressRequester is implemented by networks that can create a node with a
+// particular IPX address; for example, so that a client that reconnects can
+// be given the same address that it had before.
+type AddressRequester interface {
+	// NewNodeWithAddress is like NewNode, but the new node is given the
+	// requested address if it is available.
+	NewNodeWithAddress(addr ipx.Addr) (Node, error)
+}
+
+// NewNodeWithAddress creates a new node in the given network, requesting
+// that it be assigned the given IPX address. The address is only a
+// preference: if the network does not implement AddressRequester, or the
+// address is not available, this behaves the same as NewNode.
+func NewNodeWithAddress(n Network, addr ipx.Addr) (Node, error) {
+	if r, ok := n.(AddressRequester); ok {
+		return r.NewNodeWithAddress(addr)
+	}
+	return n.NewNode()
 }
 
 // Node represents a node attached to an IPX network.
@@ -13,8 +13,10 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/metrics"
 )
 
 const (
@@ -32,12 +34,115 @@ var (
 	_ = (ipx.ReadWriteCloser)(&pipe{})
 
 	PipeFullError = errors.New("pipe buffer is full")
+
+	// BudgetExceededError is returned when a packet cannot be written
+	// to a pipe because its Budget has been exceeded.
+	BudgetExceededError = errors.New("packet buffer memory limit exceeded")
 )
 
+// Budget tracks the total memory used by packets buffered in a set of
+// pipes, and enforces a soft limit on it. This is coarse accounting based
+// on the size of the packets, and is intended to protect the process from
+// running out of memory under heavy load or abuse.
+type Budget struct {
+	mu          sync.Mutex
+	used, limit int64
+
+	// over is set once the limit is reached or a packet does not fit,
+	// and cleared once usage falls back below the low-water mark, so
+	// that Exceeded does not flap while the budget is nearly full.
+	over bool
+}
+
+// NewBudget creates a new Budget with the given limit in bytes.
+func NewBudget(limit int64) *Budget {
+	return &Budget{limit: limit}
+}
+
+// Used returns the number of bytes currently in use.
+func (b *Budget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// Exceeded returns true if the budget's limit has been reached, or a packet
+// has been refused because it did not fit. It stays true until usage falls
+// below three quarters of the limit.
+func (b *Budget) Exceeded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.over
+}
+
+func (b *Budget) lowWaterMark() int64 {
+	return b.limit - b.limit/4
+}
+
+func (b *Budget) reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		b.over = true
+		return false
+	}
+	b.used += n
+	if b.used >= b.limit {
+		b.over = true
+	}
+	return true
+}
+
+func (b *Budget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	if b.used < b.lowWaterMark() {
+		b.over = false
+	}
+}
+
+func packetSize(pkt *ipx.Packet) int64 {
+	return int64(ipx.HeaderLength + len(pkt.Payload))
+}
+
+// Options contains optional settings for a pipe.
+type Options struct {
+	// If not nil, the memory used by buffered packets is accounted
+	// against this Budget. Once the budget has been exceeded,
+	// WritePacket() will return errors.
+	Budget *Budget
+
+	// If not nil, the time that each packet spends buffered in the pipe
+	// is recorded in this histogram.
+	QueueTime *metrics.Histogram
+
+	// Maximum number of packets to buffer before WritePacket() starts
+	// returning PipeFullError. If zero, a default size is used that is
+	// suitable for delivering packets to a client.
+	Size int
+}
+
+// queuedPacket is a packet in the pipe's buffer.
+type queuedPacket struct {
+	pkt        *ipx.Packet
+	queuedTime time.Time
+}
+
 type pipe struct {
-	ch     chan *ipx.Packet
-	closed bool
-	mu     sync.Mutex
+	ch        chan queuedPacket
+	closed    bool
+	mu        sync.Mutex
+	budget    *Budget
+	queueTime *metrics.Histogram
+}
+
+// released is called when a packet is removed from the pipe, to return its
+// memory to the budget.
+func (p *pipe) released(pkt *ipx.Packet) {
+	if p.budget != nil {
+		p.budget.release(packetSize(pkt))
+	}
 }
 
 func (p *pipe) Close() error {
@@ -46,6 +151,10 @@ func (p *pipe) Close() error {
 	if !p.closed {
 		p.closed = true
 		close(p.ch)
+		// Packets still in the buffer will never be read now.
+		for qp := range p.ch {
+			p.released(qp.pkt)
+		}
 	}
 	return nil
 }
@@ -61,10 +170,18 @@ func (p *pipe) WritePacket(pkt *ipx.Packet) error {
 	if p.closed {
 		return io.ErrClosedPipe
 	}
+	if p.budget != nil && !p.budget.reserve(packetSize(pkt)) {
+		return BudgetExceededError
+	}
+	qp := queuedPacket{pkt: pkt}
+	if p.queueTime != nil {
+		qp.queuedTime = time.Now()
+	}
 	select {
-	case p.ch <- pkt:
+	case p.ch <- qp:
 		return nil
 	default:
+		p.released(pkt)
 		return PipeFullError
 	}
 }
@@ -81,19 +198,43 @@ func (p *pipe) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
-	case pkt, ok := <-p.ch:
+	case qp, ok := <-p.ch:
 		if !ok {
 			return nil, io.ErrClosedPipe
 		}
-		return pkt, nil
+		p.released(qp.pkt)
+		if p.queueTime != nil {
+			p.queueTime.Observe(time.Since(qp.queuedTime))
+		}
+		return qp.pkt, nil
 	}
 }
 
 // New returns a new pipe that buffers a number of writes internally.
 // This is conceptually similar to io.Pipe(), but for IPX packets.
 func New() *pipe {
+	return NewWithBudget(nil)
+}
+
+// NewWithBudget returns a new pipe like New, but the memory used by buffered
+// packets is accounted against the given Budget. Once the budget has been
+// exceeded, WritePacket() will return errors. If the budget is nil, no
+// accounting is performed.
+func NewWithBudget(b *Budget) *pipe {
+	return NewWithOptions(&Options{Budget: b})
+}
+
+// NewWithOptions returns a new pipe like New, configured with the given
+// options.
+func NewWithOptions(o *Options) *pipe {
+	size := o.Size
+	if size <= 0 {
+		size = maxBufferedPackets
+	}
 	p := &pipe{
-		ch: make(chan *ipx.Packet, maxBufferedPackets),
+		ch:        make(chan queuedPacket, size),
+		budget:    o.Budget,
+		queueTime: o.QueueTime,
 	}
 	return p
 }
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/metrics"
 )
 
 var (
@@ -102,3 +103,96 @@ func TestClosingSocket(t *testing.T) {
 		t.Errorf("want error %v, got %v", io.ErrClosedPipe, err)
 	}
 }
+
+func TestBudget(t *testing.T) {
+	packetSize := int64(ipx.HeaderLength + len(testPacket.Payload))
+	b := NewBudget(5 * packetSize)
+	p1, p2 := NewWithBudget(b), NewWithBudget(b)
+	for i := 0; i < 3; i++ {
+		if err := p1.WritePacket(testPacket); err != nil {
+			t.Fatalf("failed WritePacket: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := p2.WritePacket(testPacket); err != nil {
+			t.Fatalf("failed WritePacket: %v", err)
+		}
+	}
+	if !b.Exceeded() {
+		t.Errorf("budget not exceeded after using %d bytes", b.Used())
+	}
+	// Budget is shared between pipes, so writes to either now fail.
+	if err := p1.WritePacket(testPacket); err != BudgetExceededError {
+		t.Errorf("want error %v, got %v", BudgetExceededError, err)
+	}
+	if err := p2.WritePacket(testPacket); err != BudgetExceededError {
+		t.Errorf("want error %v, got %v", BudgetExceededError, err)
+	}
+
+	// Reading a packet frees up space again.
+	if _, err := p1.ReadPacket(context.Background()); err != nil {
+		t.Fatalf("failed ReadPacket: %v", err)
+	}
+	if err := p2.WritePacket(testPacket); err != nil {
+		t.Errorf("failed WritePacket after freeing space: %v", err)
+	}
+
+	// Closing pipes releases any packets still buffered.
+	p1.Close()
+	p2.Close()
+	if used := b.Used(); used != 0 {
+		t.Errorf("%d bytes still in use after closing pipes", used)
+	}
+}
+
+func TestBudgetMixedSizes(t *testing.T) {
+	b := NewBudget(200)
+	p := NewWithBudget(b)
+	packetOfSize := func(n int) *ipx.Packet {
+		return &ipx.Packet{Payload: make([]byte, n-ipx.HeaderLength)}
+	}
+	for _, n := range []int{30, 160} {
+		if err := p.WritePacket(packetOfSize(n)); err != nil {
+			t.Fatalf("failed WritePacket: %v", err)
+		}
+	}
+	if b.Exceeded() {
+		t.Errorf("budget exceeded after using only %d bytes", b.Used())
+	}
+	// The limit is not reached exactly, but the next packet does not
+	// fit, so the budget is now exceeded.
+	if err := p.WritePacket(packetOfSize(40)); err != BudgetExceededError {
+		t.Errorf("want error %v, got %v", BudgetExceededError, err)
+	}
+	if !b.Exceeded() {
+		t.Errorf("budget not exceeded after packet was refused (%d bytes used)", b.Used())
+	}
+	// The budget stays exceeded until usage falls below the low-water
+	// mark.
+	for _, want := range []bool{true, false} {
+		if _, err := p.ReadPacket(context.Background()); err != nil {
+			t.Fatalf("failed ReadPacket: %v", err)
+		}
+		if got := b.Exceeded(); got != want {
+			t.Errorf("with %d bytes used: want Exceeded() = %v, got %v", b.Used(), want, got)
+		}
+	}
+}
+
+func TestQueueTime(t *testing.T) {
+	h := metrics.NewHistogram("queue_time_seconds", "Test histogram.")
+	p := NewWithOptions(&Options{QueueTime: h})
+	for _, packet := range makeTestPackets(3) {
+		p.WritePacket(packet)
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, err := p.ReadPacket(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := h.Snapshot()
+	if s.Count != 3 || s.Sum < 30*time.Millisecond {
+		t.Errorf("queue time not recorded: %+v", s)
+	}
+}
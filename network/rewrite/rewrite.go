@@ -0,0 +1,244 @@
+// Package rewrite implements a network that wraps another network and
+// rewrites the packets sent and received by each node, as a compatibility
+// shim for games with unusual expectations; for example, games that only
+// work on a particular network number.
+//
+// Transforms are chosen per node, based on the game that the node is
+// detected to be playing (see gamefilter.Identify).
+package rewrite
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+var (
+	_ = (network.Network)(&rewritingNetwork{})
+	_ = (network.AddressRequester)(&rewritingNetwork{})
+	_ = (network.Node)(&node{})
+)
+
+// Transform describes how packets are rewritten for a particular game.
+type Transform struct {
+	// If not nil, packets delivered to the node have their source and
+	// destination network numbers set to this value. Packets written by
+	// the node have them reset to zero.
+	Network *[4]byte
+
+	// Sockets maps socket numbers used by the node to the socket numbers
+	// used on the network. Packets written by the node are rewritten
+	// using this mapping, and packets delivered to the node using the
+	// reverse mapping.
+	Sockets map[uint16]uint16
+}
+
+func (t *Transform) reverseSocket(socket uint16) uint16 {
+	for from, to := range t.Sockets {
+		if to == socket {
+			return from
+		}
+	}
+	return socket
+}
+
+func (t *Transform) mapSocket(socket uint16) uint16 {
+	if to, ok := t.Sockets[socket]; ok {
+		return to
+	}
+	return socket
+}
+
+// Outgoing returns a copy of a packet written by a node, rewritten for
+// forwarding onto the network.
+func (t *Transform) Outgoing(packet *ipx.Packet) *ipx.Packet {
+	result := *packet
+	hdr := &result.Header
+	if t.Network != nil {
+		hdr.Src.Network = ipx.ZeroNetwork
+		hdr.Dest.Network = ipx.ZeroNetwork
+	}
+	hdr.Src.Socket = t.mapSocket(hdr.Src.Socket)
+	hdr.Dest.Socket = t.mapSocket(hdr.Dest.Socket)
+	return &result
+}
+
+// Incoming returns a copy of a packet from the network, rewritten for
+// delivery to a node.
+func (t *Transform) Incoming(packet *ipx.Packet) *ipx.Packet {
+	result := *packet
+	hdr := &result.Header
+	if t.Network != nil {
+		hdr.Src.Network = *t.Network
+		hdr.Dest.Network = *t.Network
+	}
+	hdr.Src.Socket = t.reverseSocket(hdr.Src.Socket)
+	hdr.Dest.Socket = t.reverseSocket(hdr.Dest.Socket)
+	return &result
+}
+
+// ParseTransforms parses transforms from a comma-separated list of rules,
+// where each rule has one of the following forms:
+//
+//	game/socket/FROM/TO    Remap socket FROM used by the game to TO.
+//	game/network/NUMBER    Use the given (hexadecimal) network number.
+//
+// Socket numbers may be given in decimal or in hex with a 0x prefix.
+func ParseTransforms(s string) (map[string]*Transform, error) {
+	result := map[string]*Transform{}
+	for _, rule := range strings.Split(s, ",") {
+		fields := strings.Split(rule, "/")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid rewrite rule %q", rule)
+		}
+		t, ok := result[fields[0]]
+		if !ok {
+			t = &Transform{Sockets: map[uint16]uint16{}}
+			result[fields[0]] = t
+		}
+		switch {
+		case fields[1] == "socket" && len(fields) == 4:
+			from, err := strconv.ParseUint(fields[2], 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid socket in rewrite rule %q: %v", rule, err)
+			}
+			to, err := strconv.ParseUint(fields[3], 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid socket in rewrite rule %q: %v", rule, err)
+			}
+			t.Sockets[uint16(from)] = uint16(to)
+		case fields[1] == "network" && len(fields) == 3:
+			n, err := strconv.ParseUint(fields[2], 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network number in rewrite rule %q: %v", rule, err)
+			}
+			t.Network = &[4]byte{}
+			binary.BigEndian.PutUint32(t.Network[:], uint32(n))
+		default:
+			return nil, fmt.Errorf("invalid rewrite rule %q", rule)
+		}
+	}
+	return result, nil
+}
+
+// Config contains configuration for a rewriting network.
+type Config struct {
+	// Identify is called on packets written by each node until it
+	// returns true, to determine which game the node is playing. A node
+	// that uses one of the sockets remapped by a transform is always
+	// identified as playing the corresponding game, since such packets
+	// may not otherwise be recognized.
+	Identify func(*ipx.Packet) (string, bool)
+
+	// Transforms to apply, indexed by game name.
+	Transforms map[string]*Transform
+}
+
+func (c *Config) identify(packet *ipx.Packet) (string, bool) {
+	hdr := &packet.Header
+	for game, t := range c.Transforms {
+		_, srcOK := t.Sockets[hdr.Src.Socket]
+		_, destOK := t.Sockets[hdr.Dest.Socket]
+		if srcOK || destOK {
+			return game, true
+		}
+	}
+	if c.Identify == nil {
+		return "", false
+	}
+	return c.Identify(packet)
+}
+
+type node struct {
+	inner      network.Node
+	config     *Config
+	mu         sync.Mutex
+	identified bool
+	transform  *Transform
+}
+
+func (n *node) getTransform() *Transform {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.transform
+}
+
+// identify checks if a packet written by the node identifies the game
+// being played, and returns the transform to apply.
+func (n *node) identify(packet *ipx.Packet) *Transform {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.identified {
+		if game, ok := n.config.identify(packet); ok {
+			n.identified = true
+			n.transform = n.config.Transforms[game]
+		}
+	}
+	return n.transform
+}
+
+func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	packet, err := n.inner.ReadPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if t := n.getTransform(); t != nil {
+		packet = t.Incoming(packet)
+	}
+	return packet, nil
+}
+
+func (n *node) WritePacket(packet *ipx.Packet) error {
+	if t := n.identify(packet); t != nil {
+		packet = t.Outgoing(packet)
+	}
+	return n.inner.WritePacket(packet)
+}
+
+func (n *node) Close() error {
+	return n.inner.Close()
+}
+
+func (n *node) GetProperty(x interface{}) bool {
+	return n.inner.GetProperty(x)
+}
+
+type rewritingNetwork struct {
+	inner  network.Network
+	config *Config
+}
+
+func (n *rewritingNetwork) NewNode() (network.Node, error) {
+	return n.wrapNode(n.inner.NewNode())
+}
+
+// NewNodeWithAddress implements network.AddressRequester, passing the
+// request through to the wrapped network.
+func (n *rewritingNetwork) NewNodeWithAddress(addr ipx.Addr) (network.Node, error) {
+	return n.wrapNode(network.NewNodeWithAddress(n.inner, addr))
+}
+
+func (n *rewritingNetwork) wrapNode(inner network.Node, err error) (network.Node, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &node{
+		inner:  inner,
+		config: n.config,
+	}, nil
+}
+
+// Wrap creates a network that wraps the given network but rewrites packets
+// sent and received by each node according to the game that it is playing.
+func Wrap(n network.Network, config *Config) network.Network {
+	return &rewritingNetwork{
+		inner:  n,
+		config: config,
+	}
+}
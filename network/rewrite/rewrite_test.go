@@ -0,0 +1,65 @@
+package rewrite
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func TestSocketRemap(t *testing.T) {
+	transforms, err := ParseTransforms("doom/socket/0x869b/0x869c,doom/network/00000001")
+	if err != nil {
+		t.Fatalf("ParseTransforms failed: %v", err)
+	}
+	var got *ipx.Packet
+	dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+		got = pkt
+	})
+	defer dest.Close()
+	n := Wrap(&ipxtesting.FakeNetwork{Inner: dest}, &Config{
+		// Identified by the remapped socket.
+		Transforms: transforms,
+	})
+	node := ipxtesting.MustNewNode(t, n)
+
+	sent := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{
+				Network: [4]byte{0, 0, 0, 1},
+				Addr:    ipx.AddrBroadcast,
+				Socket:  0x869b,
+			},
+			Src: ipx.HeaderAddr{
+				Network: [4]byte{0, 0, 0, 1},
+				Addr:    ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+				Socket:  0x869b,
+			},
+		},
+	}
+	if err := node.WritePacket(sent); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	want := *sent
+	want.Header.Dest.Network = ipx.ZeroNetwork
+	want.Header.Dest.Socket = 0x869c
+	want.Header.Src.Network = ipx.ZeroNetwork
+	want.Header.Src.Socket = 0x869c
+	if !reflect.DeepEqual(got, &want) {
+		t.Errorf("wrong rewritten packet: want %+v, got %+v", &want, got)
+	}
+
+	// The transform is reversed for packets delivered to the node.
+	if back := transforms["doom"].Incoming(got); !reflect.DeepEqual(back, sent) {
+		t.Errorf("wrong reverse transform: want %+v, got %+v", sent, back)
+	}
+}
+
+func TestParseTransformsInvalid(t *testing.T) {
+	for _, s := range []string{"doom", "doom/socket/1", "doom/socket/x/1", "doom/network/zz", "doom/foo/1"} {
+		if _, err := ParseTransforms(s); err == nil {
+			t.Errorf("ParseTransforms(%q) succeeded, want error", s)
+		}
+	}
+}
@@ -4,26 +4,39 @@ package stats
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/logging"
 	"github.com/fragglet/ipxbox/network"
 )
 
 var (
-	_ = (network.Network)(&statsNetwork{})
+	_ = (network.Network)(&Network{})
+	_ = (network.AddressRequester)(&Network{})
 	_ = (network.Node)(&node{})
+	_ = (json.Marshaler)(&Network{})
 )
 
 type Statistics struct {
 	rxPackets, txPackets uint64
 	rxBytes, txBytes     uint64
+	rxBroadcasts         uint64
+	dropped              uint64
 	connectTime          time.Time
+	game                 string
 }
 
 func (s *Statistics) String() string {
-	result := fmt.Sprintf("connected for %s; ", time.Since(s.connectTime))
+	result := ""
+	if s.game != "" {
+		result = fmt.Sprintf("playing %s; ", s.game)
+	}
+	result += fmt.Sprintf("connected for %s; ", time.Since(s.connectTime))
 	result += fmt.Sprintf("received %d packets (%d bytes), ",
 		s.rxPackets, s.rxBytes)
 	result += fmt.Sprintf("sent %d packets (%d bytes)",
@@ -31,24 +44,164 @@ func (s *Statistics) String() string {
 	return result
 }
 
-type statsNetwork struct {
-	inner network.Network
+// Counters contains packet and byte counters in a form that is suitable
+// for encoding as JSON. As with Statistics, "received" counts packets
+// received from the node, and "sent" counts packets sent to it.
+type Counters struct {
+	RxPackets uint64 `json:"rx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+
+	// RxBroadcasts counts the received packets that were addressed to
+	// the broadcast address, and Dropped counts the packets received
+	// from the node that were not forwarded (for example, because they
+	// were filtered). Dropped packets are not included in the other
+	// received counters.
+	RxBroadcasts uint64 `json:"rx_broadcasts"`
+	Dropped      uint64 `json:"dropped"`
+}
+
+func (c *Counters) add(s *Statistics) {
+	c.RxPackets += s.rxPackets
+	c.RxBytes += s.rxBytes
+	c.TxPackets += s.txPackets
+	c.TxBytes += s.txBytes
+	c.RxBroadcasts += s.rxBroadcasts
+	c.Dropped += s.dropped
+}
+
+// NodeCounters contains the counters for a single node.
+type NodeCounters struct {
+	// Address is the IPX address of the node, if it has one.
+	Address     string    `json:"address,omitempty"`
+	ConnectTime time.Time `json:"connect_time"`
+
+	// Game is the name of the game the node appears to be playing, if
+	// it has been identified.
+	Game string `json:"game,omitempty"`
+	Counters
+}
+
+// Snapshot contains the statistics for a Network at a point in time.
+type Snapshot struct {
+	Nodes []NodeCounters `json:"nodes"`
+
+	// Total contains the sum of counters for all nodes, including
+	// nodes that have since been closed.
+	Total Counters `json:"total"`
+}
+
+// Config contains configuration parameters for a Network.
+type Config struct {
+	// If non-zero, Run logs a summary of the traffic through the network
+	// at this interval. Otherwise Run does nothing.
+	LogInterval time.Duration
+
+	// Logger receives the periodic summaries, at the info level.
+	Logger *logging.Logger
+}
+
+// Network is an implementation of network.Network that gathers statistics
+// on the packets sent and received by each node.
+type Network struct {
+	// If not nil, Identify is called on packets received from each node
+	// until it returns true, to label the node with the name of the game
+	// that it is playing (see gamefilter.Identify). This should be set
+	// before any nodes are created.
+	Identify func(*ipx.Packet) (string, bool)
+
+	config Config
+	inner  network.Network
+	mu     sync.Mutex
+	nodes  map[*node]bool
+	closed Counters
+}
+
+func (n *Network) NewNode() (network.Node, error) {
+	return n.wrapNode(n.inner.NewNode())
 }
 
-func (n *statsNetwork) NewNode() network.Node {
-	return &node{
-		inner: n.inner.NewNode(),
+// NewNodeWithAddress implements network.AddressRequester, passing the
+// request through to the wrapped network.
+func (n *Network) NewNodeWithAddress(addr ipx.Addr) (network.Node, error) {
+	return n.wrapNode(network.NewNodeWithAddress(n.inner, addr))
+}
+
+func (n *Network) wrapNode(inner network.Node, err error) (network.Node, error) {
+	if err != nil {
+		return nil, err
+	}
+	result := &node{
+		net:   n,
+		inner: inner,
 		stats: Statistics{
 			connectTime: time.Now(),
 		},
 	}
+	n.mu.Lock()
+	n.nodes[result] = true
+	n.mu.Unlock()
+	return result, nil
+}
+
+// Snapshot returns the current statistics for all nodes in the network.
+func (n *Network) Snapshot() *Snapshot {
+	n.mu.Lock()
+	nodes := []*node{}
+	for node := range n.nodes {
+		nodes = append(nodes, node)
+	}
+	result := &Snapshot{
+		Nodes: []NodeCounters{},
+		Total: n.closed,
+	}
+	n.mu.Unlock()
+
+	for _, node := range nodes {
+		s := node.statistics()
+		nc := NodeCounters{
+			ConnectTime: s.connectTime,
+			Game:        s.game,
+		}
+		if addr := network.NodeAddress(node.inner); addr != ipx.AddrNull {
+			nc.Address = addr.String()
+		}
+		nc.add(&s)
+		result.Total.add(&s)
+		result.Nodes = append(result.Nodes, nc)
+	}
+	return result
+}
+
+// MarshalJSON returns a JSON encoding of a Snapshot of the network.
+func (n *Network) MarshalJSON() ([]byte, error) {
+	return json.Marshal(n.Snapshot())
+}
+
+func (n *Network) nodeClosed(node *node) {
+	s := node.statistics()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.nodes[node] {
+		delete(n.nodes, node)
+		n.closed.add(&s)
+	}
 }
 
 type node struct {
+	net   *Network
 	inner network.Node
+	mu    sync.Mutex
 	stats Statistics
 }
 
+func (n *node) statistics() Statistics {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stats
+}
+
 func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 	packet, err := n.inner.ReadPacket(ctx)
 	if err != nil {
@@ -57,38 +210,126 @@ func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 	// This might be slightly counterintuitive: when a client *reads*
 	// a packet, it's because we want to transmit to them, while when
 	// we *write* a packet it's because we've received from them.
+	n.mu.Lock()
 	n.stats.txPackets++
 	n.stats.txBytes += uint64(len(packet.Payload) + ipx.HeaderLength)
+	n.mu.Unlock()
 	return packet, nil
 }
 
 func (n *node) WritePacket(packet *ipx.Packet) error {
 	if err := n.inner.WritePacket(packet); err != nil {
+		n.mu.Lock()
+		n.stats.dropped++
+		n.mu.Unlock()
 		return err
 	}
+	n.mu.Lock()
 	n.stats.rxPackets++
 	n.stats.rxBytes += uint64(len(packet.Payload) + ipx.HeaderLength)
+	if packet.Header.Dest.Addr == ipx.AddrBroadcast {
+		n.stats.rxBroadcasts++
+	}
+	if n.stats.game == "" && n.net.Identify != nil {
+		if game, ok := n.net.Identify(packet); ok {
+			n.stats.game = game
+		}
+	}
+	n.mu.Unlock()
 	return nil
 }
 
 func (n *node) Close() error {
+	n.net.nodeClosed(n)
 	return n.inner.Close()
 }
 
 func (n *node) GetProperty(x interface{}) bool {
 	switch x.(type) {
 	case *Statistics:
-		*x.(*Statistics) = n.stats
+		*x.(*Statistics) = n.statistics()
 		return true
 	default:
 		return n.inner.GetProperty(x)
 	}
 }
 
+// Run logs a summary of the traffic through the network every
+// Config.LogInterval, until the context is cancelled. Each summary covers
+// the traffic since the previous one. If no interval is configured, it
+// returns immediately.
+func (n *Network) Run(ctx context.Context) {
+	if n.config.LogInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(n.config.LogInterval)
+	defer ticker.Stop()
+	last := n.Snapshot().Total
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s := n.Snapshot()
+		n.config.Logger.Infof("%s", summarize(len(s.Nodes), &last, &s.Total, n.config.LogInterval))
+		last = s.Total
+	}
+}
+
+// summarize returns a one-line summary of the difference between two sets
+// of total counters, taken the given time apart.
+func summarize(nodes int, last, now *Counters, period time.Duration) string {
+	return fmt.Sprintf("stats: %d nodes active; in the last %s received "+
+		"%d packets (%d bytes, %d broadcasts), sent %d packets "+
+		"(%d bytes), dropped %d packets", nodes, period,
+		now.RxPackets-last.RxPackets, now.RxBytes-last.RxBytes,
+		now.RxBroadcasts-last.RxBroadcasts,
+		now.TxPackets-last.TxPackets, now.TxBytes-last.TxBytes,
+		now.Dropped-last.Dropped)
+}
+
 // Wrap creates a network that wraps the given network but gathers statistics
 // about packets that are sent and received.
-func Wrap(n network.Network) network.Network {
-	return &statsNetwork{inner: n}
+func Wrap(n network.Network) *Network {
+	return WrapWithConfig(n, &Config{})
+}
+
+// WrapWithConfig is like Wrap, but uses the given configuration.
+func WrapWithConfig(n network.Network, config *Config) *Network {
+	return &Network{
+		config: *config,
+		inner:  n,
+		nodes:  map[*node]bool{},
+	}
+}
+
+// CountersFor returns the packet and byte counters for the given Node, if
+// they can be fetched.
+func CountersFor(node network.Node) (Counters, bool) {
+	var s Statistics
+	var result Counters
+	if !node.GetProperty(&s) {
+		return result, false
+	}
+	result.add(&s)
+	return result, true
+}
+
+// Handler returns an HTTP handler that serves Snapshots of the given
+// networks as an indented JSON object, keyed by the names in the map. It
+// is intended for quick debugging with tools like curl.
+func Handler(networks map[string]*Network) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshots := map[string]*Snapshot{}
+		for name, n := range networks {
+			snapshots[name] = n.Snapshot()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(snapshots)
+	})
 }
 
 // Summary returns a string describing statistics for the given Node, if
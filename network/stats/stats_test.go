@@ -0,0 +1,161 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/logging"
+	"github.com/fragglet/ipxbox/network/filter"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func TestSnapshotJSON(t *testing.T) {
+	n := Wrap(&ipxtesting.FakeNetwork{
+		Address: ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+	})
+	node := ipxtesting.MustNewNode(t, n)
+	for _, packet := range ipxtesting.TestPackets {
+		if err := node.WritePacket(packet); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+
+	data, err := json.Marshal(n)
+	if err != nil {
+		t.Fatalf("failed to marshal JSON: %v", err)
+	}
+	var got Snapshot
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("failed to unmarshal JSON %q: %v", data, err)
+	}
+	wantPackets := uint64(len(ipxtesting.TestPackets))
+	if len(got.Nodes) != 1 {
+		t.Fatalf("want 1 node in snapshot, got %d: %s", len(got.Nodes), data)
+	}
+	if got.Nodes[0].Address != "02:11:22:33:44:55" {
+		t.Errorf("wrong address in snapshot: %s", data)
+	}
+	if got.Nodes[0].RxPackets != wantPackets || got.Total.RxPackets != wantPackets {
+		t.Errorf("want %d received packets in snapshot: %s", wantPackets, data)
+	}
+
+	// Fields are still counted in the total after the node is closed.
+	node.Close()
+	snapshot := n.Snapshot()
+	if len(snapshot.Nodes) != 0 || snapshot.Total.RxPackets != wantPackets {
+		t.Errorf("wrong snapshot after close: %+v", snapshot)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	n := Wrap(&ipxtesting.FakeNetwork{})
+	n.Identify = func(packet *ipx.Packet) (string, bool) {
+		return "doom", packet.Header.Dest.Socket == 0x869c
+	}
+	node := ipxtesting.MustNewNode(t, n)
+	node.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Socket: 0x869c},
+		},
+	})
+	snapshot := n.Snapshot()
+	if len(snapshot.Nodes) != 1 || snapshot.Nodes[0].Game != "doom" {
+		t.Errorf("node not labelled with game: %+v", snapshot)
+	}
+}
+
+func TestDropsAndBroadcasts(t *testing.T) {
+	n := Wrap(filter.Wrap(&ipxtesting.FakeNetwork{}))
+	node := ipxtesting.MustNewNode(t, n)
+	packet := func(dest ipx.Addr, socket uint16) *ipx.Packet {
+		return &ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: dest, Socket: socket},
+			},
+		}
+	}
+	node.WritePacket(packet(ipx.AddrBroadcast, 1))
+	node.WritePacket(packet(ipx.Addr{0x02, 0, 0, 0, 0, 1}, 1))
+	if err := node.WritePacket(packet(ipx.AddrBroadcast, 0x455)); err == nil {
+		t.Fatalf("NetBIOS packet was not filtered")
+	}
+
+	want := Counters{
+		RxPackets:    2,
+		RxBytes:      2 * uint64(ipx.HeaderLength),
+		RxBroadcasts: 1,
+		Dropped:      1,
+	}
+	if got, _ := CountersFor(node); got != want {
+		t.Errorf("wrong counters: want %+v, got %+v", want, got)
+	}
+
+	rec := httptest.NewRecorder()
+	Handler(map[string]*Network{"clients": n}).ServeHTTP(rec, httptest.NewRequest("GET", "/stats.json", nil))
+	var got map[string]*Snapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to unmarshal JSON %q: %v", rec.Body.Bytes(), err)
+	}
+	if s, ok := got["clients"]; !ok || s.Total != want {
+		t.Errorf("wrong totals served: want %+v, got %s", want, rec.Body.Bytes())
+	}
+}
+
+func TestRunLogsSummaries(t *testing.T) {
+	var buf syncBuffer
+	n := WrapWithConfig(&ipxtesting.FakeNetwork{}, &Config{
+		LogInterval: 10 * time.Millisecond,
+		Logger:      logging.New(log.New(&buf, "", 0), logging.LevelInfo),
+	})
+	node := ipxtesting.MustNewNode(t, n)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		n.Run(ctx)
+		close(done)
+	}()
+	waitFor := func(want string) {
+		t.Helper()
+		for start := time.Now(); !strings.Contains(buf.String(), want); {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("summary not logged; want %q, got %q", want, buf.String())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// Wait until Run has started before sending the packet.
+	waitFor("stats: 1 nodes active; in the last 10ms received 0 packets")
+	node.WritePacket(&ipx.Packet{Header: ipx.Header{Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast}}})
+	waitFor("received 1 packets (30 bytes, 1 broadcasts)")
+	cancel()
+	<-done
+	// Deltas are logged, so the packet is only counted once.
+	if strings.Count(buf.String(), "received 1 packets") != 1 {
+		t.Errorf("packet counted more than once: %q", buf.String())
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
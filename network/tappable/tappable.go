@@ -4,7 +4,9 @@ package tappable
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
@@ -14,47 +16,147 @@ import (
 var (
 	_ = (network.Network)(&TappableNetwork{})
 	_ = (network.Node)(&node{})
-	_ = (ipx.ReadCloser)(&tap{})
+	_ = (ipx.ReadCloser)(&Tap{})
+
+	// TooManyTapsError is returned by NewTap if the maximum number of
+	// taps are already open.
+	TooManyTapsError = errors.New("too many network taps open")
+)
+
+// Direction identifies which way a packet seen by a tap was travelling.
+type Direction int
+
+const (
+	// FromClient packets were written into the network by a client.
+	FromClient Direction = iota
+
+	// Forwarded packets were delivered by the network to a client.
+	Forwarded
+
+	// ServerOriginated packets were generated by the server itself and
+	// sent to a client; for example, keepalive pings and registration
+	// replies. See RecordOriginated.
+	ServerOriginated
+
+	numDirections
 )
 
+func (d Direction) String() string {
+	switch d {
+	case FromClient:
+		return "from-client"
+	case Forwarded:
+		return "forwarded"
+	case ServerOriginated:
+		return "server-originated"
+	default:
+		return "unknown"
+	}
+}
+
+// originatedRecorder is the property type fetched from a node by
+// RecordOriginated.
+type originatedRecorder func(*ipx.Packet)
+
 type TappableNetwork struct {
+	// Packet counts for each direction. This is first in the struct to
+	// guarantee 64-bit alignment for atomic operations.
+	counts [numDirections]uint64
+
+	// If non-zero, the maximum number of taps that may be open at once.
+	MaxTaps int
+
+	// If not nil, packets buffered in taps are accounted against this
+	// budget, in addition to the per-tap buffer size.
+	Budget *pipe.Budget
+
+	// Number of packets buffered in each tap before further packets are
+	// dropped. If zero, a default size is used. Taps never block the
+	// network; if a tap is not read quickly enough, packets are dropped
+	// and counted (see Tap.Dropped).
+	TapBufferSize int
+
 	inner     network.Network
 	nextTapID int
-	taps      map[int]*tap
+	taps      map[int]*Tap
 	mu        sync.RWMutex
 }
 
-func (n *TappableNetwork) NewNode() network.Node {
+func (n *TappableNetwork) NewNode() (network.Node, error) {
+	inner, err := n.inner.NewNode()
+	if err != nil {
+		return nil, err
+	}
 	return &node{
 		net:   n,
-		inner: n.inner.NewNode(),
-	}
+		inner: inner,
+	}, nil
+}
+
+// NewTap creates a new tap that receives a copy of every packet written into
+// the network. The tap must be closed when no longer needed. If MaxTaps taps
+// are already open, TooManyTapsError is returned.
+func (n *TappableNetwork) NewTap() (*Tap, error) {
+	return n.NewTapForDirections(FromClient)
 }
 
-func (n *TappableNetwork) NewTap() ipx.ReadCloser {
+// NewTapForDirections is like NewTap, but the tap receives a copy of every
+// packet travelling in any of the given directions.
+func (n *TappableNetwork) NewTapForDirections(directions ...Direction) (*Tap, error) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	tap := &tap{
-		net:    n,
-		rxpipe: pipe.New(),
-		tapID:  n.nextTapID,
+	if n.MaxTaps > 0 && len(n.taps) >= n.MaxTaps {
+		return nil, TooManyTapsError
+	}
+	tap := &Tap{
+		net: n,
+		rxpipe: pipe.NewWithOptions(&pipe.Options{
+			Budget: n.Budget,
+			Size:   n.TapBufferSize,
+		}),
+		tapID: n.nextTapID,
+	}
+	for _, d := range directions {
+		tap.wanted[d] = true
 	}
 	n.nextTapID++
 	n.taps[tap.tapID] = tap
-	return tap
+	return tap, nil
 }
 
+// Count returns the number of packets that have passed through the network
+// in the given direction.
+func (n *TappableNetwork) Count(d Direction) uint64 {
+	return atomic.LoadUint64(&n.counts[d])
+}
+
+// deleteTap removes a tap from the network. Since this takes the write lock,
+// it waits for any concurrent calls to writeToTaps to complete; once it
+// returns, no more packets will be written to the tap.
 func (n *TappableNetwork) deleteTap(tapID int) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	delete(n.taps, tapID)
 }
 
-func (n *TappableNetwork) writeToTaps(packet *ipx.Packet) {
+func (n *TappableNetwork) writeToTaps(packet *ipx.Packet, d Direction) {
+	atomic.AddUint64(&n.counts[d], 1)
 	n.mu.RLock()
 	defer n.mu.RUnlock()
 	for _, tap := range n.taps {
-		tap.rxpipe.WritePacket(packet)
+		if tap.wanted[d] {
+			tap.write(packet, d)
+		}
+	}
+}
+
+// RecordOriginated records a packet that the server generated itself and
+// sent to the client of the given node, so that it is seen by taps. It does
+// nothing if the node does not belong to a TappableNetwork.
+func RecordOriginated(node network.Node, packet *ipx.Packet) {
+	var record originatedRecorder
+	if node.GetProperty(&record) {
+		record(packet)
 	}
 }
 
@@ -64,11 +166,15 @@ type node struct {
 }
 
 func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
-	return n.inner.ReadPacket(ctx)
+	packet, err := n.inner.ReadPacket(ctx)
+	if err == nil {
+		n.net.writeToTaps(packet, Forwarded)
+	}
+	return packet, err
 }
 
 func (n *node) WritePacket(packet *ipx.Packet) error {
-	n.net.writeToTaps(packet)
+	n.net.writeToTaps(packet, FromClient)
 	return n.inner.WritePacket(packet)
 }
 
@@ -77,20 +183,78 @@ func (n *node) Close() error {
 }
 
 func (n *node) GetProperty(x interface{}) bool {
-	return n.inner.GetProperty(x)
+	switch x.(type) {
+	case *originatedRecorder:
+		*x.(*originatedRecorder) = func(packet *ipx.Packet) {
+			n.net.writeToTaps(packet, ServerOriginated)
+		}
+		return true
+	default:
+		return n.inner.GetProperty(x)
+	}
 }
 
-type tap struct {
+// Tap receives copies of packets travelling through a TappableNetwork.
+type Tap struct {
+	// Number of packets dropped; first in the struct to guarantee
+	// 64-bit alignment for atomic operations.
+	dropped uint64
+
 	rxpipe ipx.ReadWriteCloser
 	net    *TappableNetwork
 	tapID  int
+	wanted [numDirections]bool
+
+	// directions holds the direction of each packet in rxpipe, in the
+	// same order. mu is held across writing a packet to rxpipe and
+	// appending its direction, so that a reader always finds the
+	// direction of the packet it has just read.
+	mu         sync.Mutex
+	directions []Direction
+}
+
+func (t *Tap) write(packet *ipx.Packet, d Direction) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rxpipe.WritePacket(packet) == nil {
+		t.directions = append(t.directions, d)
+	} else {
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// Dropped returns the number of packets that were not delivered to the tap
+// because its buffer was full (or the memory budget was exceeded). A
+// steadily increasing count indicates that the tap is not being read
+// quickly enough.
+func (t *Tap) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// ReadTappedPacket reads the next packet from the tap, along with the
+// direction in which it was travelling.
+func (t *Tap) ReadTappedPacket(ctx context.Context) (*ipx.Packet, Direction, error) {
+	packet, err := t.rxpipe.ReadPacket(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.directions[0]
+	t.directions = t.directions[1:]
+	return packet, d, nil
 }
 
-func (t *tap) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
-	return t.rxpipe.ReadPacket(ctx)
+func (t *Tap) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	packet, _, err := t.ReadTappedPacket(ctx)
+	return packet, err
 }
 
-func (t *tap) Close() error {
+// Close detaches the tap from the network and then closes its receive pipe.
+// The order is important: the tap is removed first so that nothing can be
+// writing to the pipe as it is closed. Any blocked ReadPacket call returns
+// io.ErrClosedPipe, and packets still buffered in the tap are discarded.
+func (t *Tap) Close() error {
 	t.net.deleteTap(t.tapID)
 	return t.rxpipe.Close()
 }
@@ -100,6 +264,6 @@ func (t *tap) Close() error {
 func Wrap(n network.Network) *TappableNetwork {
 	return &TappableNetwork{
 		inner: n,
-		taps:  make(map[int]*tap),
+		taps:  make(map[int]*Tap),
 	}
 }
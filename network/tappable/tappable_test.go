@@ -0,0 +1,162 @@
+package tappable
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+// TestTapTeardown repeatedly creates, reads from and closes taps while
+// packets are being written into the network. It is intended to be run with
+// the race detector enabled.
+func TestTapTeardown(t *testing.T) {
+	n := Wrap(&ipxtesting.FakeNetwork{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		node := ipxtesting.MustNewNode(t, n)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				for _, packet := range ipxtesting.TestPackets {
+					node.WritePacket(packet)
+				}
+				time.Sleep(10 * time.Microsecond)
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		tap, err := n.NewTap()
+		if err != nil {
+			t.Fatalf("NewTap failed: %v", err)
+		}
+		readDone := make(chan error)
+		go func() {
+			for {
+				if _, err := tap.ReadPacket(ctx); err != nil {
+					readDone <- err
+					return
+				}
+			}
+		}()
+		time.Sleep(100 * time.Microsecond)
+		tap.Close()
+		if err := <-readDone; !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("ReadPacket after Close: want %v, got %v", io.ErrClosedPipe, err)
+		}
+		if _, err := tap.ReadPacket(ctx); !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("ReadPacket on closed tap: want %v, got %v", io.ErrClosedPipe, err)
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	n.mu.RLock()
+	numTaps := len(n.taps)
+	n.mu.RUnlock()
+	if numTaps != 0 {
+		t.Errorf("%d taps still attached after close", numTaps)
+	}
+}
+
+func TestMaxTaps(t *testing.T) {
+	n := Wrap(&ipxtesting.FakeNetwork{})
+	n.MaxTaps = 2
+	var taps []ipx.ReadCloser
+	for i := 0; i < n.MaxTaps; i++ {
+		tap, err := n.NewTap()
+		if err != nil {
+			t.Fatalf("NewTap failed: %v", err)
+		}
+		taps = append(taps, tap)
+	}
+	if _, err := n.NewTap(); err != TooManyTapsError {
+		t.Errorf("NewTap beyond limit: want %v, got %v", TooManyTapsError, err)
+	}
+
+	// Closing a tap frees up a slot.
+	taps[0].Close()
+	if _, err := n.NewTap(); err != nil {
+		t.Errorf("NewTap after close failed: %v", err)
+	}
+}
+
+func TestTapDirections(t *testing.T) {
+	ctx := context.Background()
+	n := Wrap(&ipxtesting.FakeNetwork{
+		Inner: ipxtesting.MakeCallbackDest(func(*ipx.Packet) {}),
+	})
+	clientTap, err := n.NewTap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allTap, err := n.NewTapForDirections(FromClient, Forwarded, ServerOriginated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := ipxtesting.MustNewNode(t, n)
+	sent, originated := ipxtesting.TestPackets[0], ipxtesting.TestPackets[1]
+	node.WritePacket(sent)
+	RecordOriginated(node, originated)
+
+	packet, d, err := allTap.ReadTappedPacket(ctx)
+	if err != nil || packet != sent || d != FromClient {
+		t.Errorf("want sent packet from client, got %+v, %v, %v", packet, d, err)
+	}
+	packet, d, err = allTap.ReadTappedPacket(ctx)
+	if err != nil || packet != originated || d != ServerOriginated {
+		t.Errorf("want server-originated packet, got %+v, %v, %v", packet, d, err)
+	}
+
+	// NewTap only sees packets from clients.
+	if packet, err := clientTap.ReadPacket(ctx); err != nil || packet != sent {
+		t.Errorf("want sent packet, got %+v, %v", packet, err)
+	}
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if packet, err := clientTap.ReadPacket(shortCtx); err == nil {
+		t.Errorf("default tap received server-originated packet: %+v", packet)
+	}
+
+	for d, want := range map[Direction]uint64{FromClient: 1, Forwarded: 0, ServerOriginated: 1} {
+		if got := n.Count(d); got != want {
+			t.Errorf("wrong count for %v: want %d, got %d", d, want, got)
+		}
+	}
+}
+
+func TestTapDropped(t *testing.T) {
+	n := Wrap(&ipxtesting.FakeNetwork{})
+	n.TapBufferSize = 2
+	tap, err := n.NewTap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tap.Close()
+	node := ipxtesting.MustNewNode(t, n)
+	// Nothing is reading from the tap, but writes must not block.
+	for _, packet := range ipxtesting.TestPackets {
+		if err := node.WritePacket(packet); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+	want := uint64(len(ipxtesting.TestPackets) - n.TapBufferSize)
+	if got := tap.Dropped(); got != want {
+		t.Errorf("wrong dropped count: want %d, got %d", want, got)
+	}
+	for i := 0; i < n.TapBufferSize; i++ {
+		if packet, err := tap.ReadPacket(context.Background()); err != nil || packet != ipxtesting.TestPackets[i] {
+			t.Errorf("packet %d: want %+v, got %+v, %v", i, ipxtesting.TestPackets[i], packet, err)
+		}
+	}
+}
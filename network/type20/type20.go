@@ -0,0 +1,119 @@
+// Package type20 implements a network that wraps another network and applies
+// the propagation rules for IPX type 20 (NetBIOS broadcast) packets.
+//
+// Type 20 packets carry a list of up to eight network numbers at the start of
+// the payload, recording each network the packet has passed through. The
+// TransControl field counts the number of entries in the list. Before
+// forwarding, a router checks that its own network does not already appear
+// in the list (which would mean the packet is looping) and appends its own
+// network number. Packets that have already passed through eight networks
+// are discarded.
+package type20
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+const (
+	// PacketType is the IPX packet type for NetBIOS broadcasts.
+	PacketType = 20
+
+	// MaxNetworks is the number of entries in the network list, and the
+	// maximum number of networks a type 20 packet may pass through.
+	MaxNetworks = 8
+
+	networkListLength = MaxNetworks * 4
+)
+
+var (
+	_ = (network.Network)(&type20Network{})
+	_ = (network.Node)(&node{})
+
+	// DroppedPacketError is returned when a type 20 packet is not
+	// forwarded, either because it has already passed through this
+	// network or because it has passed through too many networks.
+	DroppedPacketError = errors.New("type 20 packet dropped")
+)
+
+// Propagate applies the type 20 propagation rules for a packet being
+// forwarded onto the network with the given network number. If the packet
+// should be forwarded, a copy is returned with the network list updated.
+// Packets of other types are returned unchanged.
+func Propagate(packet *ipx.Packet, netNum [4]byte) (*ipx.Packet, bool) {
+	if packet.Header.PacketType != PacketType {
+		return packet, true
+	}
+	hops := int(packet.Header.TransControl)
+	if hops >= MaxNetworks || len(packet.Payload) < networkListLength {
+		return nil, false
+	}
+	for i := 0; i < hops; i++ {
+		if bytes.Equal(packet.Payload[i*4:i*4+4], netNum[:]) {
+			return nil, false
+		}
+	}
+	result := &ipx.Packet{
+		Header:  packet.Header,
+		Payload: append([]byte{}, packet.Payload...),
+	}
+	copy(result.Payload[hops*4:], netNum[:])
+	result.Header.TransControl++
+	return result, true
+}
+
+type node struct {
+	inner  network.Node
+	netNum [4]byte
+}
+
+func (n *node) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	return n.inner.ReadPacket(ctx)
+}
+
+func (n *node) WritePacket(packet *ipx.Packet) error {
+	packet, ok := Propagate(packet, n.netNum)
+	if !ok {
+		return DroppedPacketError
+	}
+	return n.inner.WritePacket(packet)
+}
+
+func (n *node) Close() error {
+	return n.inner.Close()
+}
+
+func (n *node) GetProperty(x interface{}) bool {
+	return n.inner.GetProperty(x)
+}
+
+type type20Network struct {
+	inner  network.Network
+	netNum [4]byte
+}
+
+func (n *type20Network) NewNode() (network.Node, error) {
+	inner, err := n.inner.NewNode()
+	if err != nil {
+		return nil, err
+	}
+	return &node{
+		inner:  inner,
+		netNum: n.netNum,
+	}, nil
+}
+
+// Wrap creates a network that wraps the given network and applies the type 20
+// propagation rules to packets written into it, treating the network as
+// having the given network number. The network number should be non-zero and
+// unique among any networks that are bridged together.
+func Wrap(n network.Network, netNum [4]byte) network.Network {
+	return &type20Network{
+		inner:  n,
+		netNum: netNum,
+	}
+}
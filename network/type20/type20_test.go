@@ -0,0 +1,84 @@
+package type20
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+var (
+	network1 = [4]byte{0, 0, 0, 1}
+	network2 = [4]byte{0, 0, 0, 2}
+)
+
+func makeType20Packet() *ipx.Packet {
+	return &ipx.Packet{
+		Header: ipx.Header{
+			PacketType: PacketType,
+			Dest: ipx.HeaderAddr{
+				Addr:   ipx.AddrBroadcast,
+				Socket: 0x455,
+			},
+		},
+		Payload: make([]byte, networkListLength+16),
+	}
+}
+
+func TestPropagate(t *testing.T) {
+	packet := makeType20Packet()
+	p1, ok := Propagate(packet, network1)
+	if !ok {
+		t.Fatalf("packet not forwarded onto first network")
+	}
+	if p1.Header.TransControl != 1 || !bytes.Equal(p1.Payload[0:4], network1[:]) {
+		t.Errorf("network list not updated: hops=%d, list=%x", p1.Header.TransControl, p1.Payload[:networkListLength])
+	}
+	if packet.Header.TransControl != 0 {
+		t.Errorf("original packet was modified")
+	}
+
+	p2, ok := Propagate(p1, network2)
+	if !ok {
+		t.Fatalf("packet not forwarded onto second network")
+	}
+	if p2.Header.TransControl != 2 || !bytes.Equal(p2.Payload[4:8], network2[:]) {
+		t.Errorf("network list not updated: hops=%d, list=%x", p2.Header.TransControl, p2.Payload[:networkListLength])
+	}
+
+	// Looped back to the first network?
+	if _, ok := Propagate(p2, network1); ok {
+		t.Errorf("looped packet was forwarded")
+	}
+
+	// Too many hops?
+	packet.Header.TransControl = MaxNetworks
+	if _, ok := Propagate(packet, network1); ok {
+		t.Errorf("packet forwarded after %d hops", MaxNetworks)
+	}
+
+	// Payload too short for the network list.
+	if _, ok := Propagate(&ipx.Packet{Header: ipx.Header{PacketType: PacketType}}, network1); ok {
+		t.Errorf("packet without network list was forwarded")
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	var got []*ipx.Packet
+	dest := ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+		got = append(got, pkt)
+	})
+	defer dest.Close()
+	n := ipxtesting.MustNewNode(t, Wrap(&ipxtesting.FakeNetwork{Inner: dest}, network1))
+
+	if err := n.WritePacket(makeType20Packet()); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	if len(got) != 1 || got[0].Header.TransControl != 1 {
+		t.Fatalf("packet not forwarded with updated network list: %+v", got)
+	}
+	if err := n.WritePacket(got[0]); err != DroppedPacketError {
+		t.Errorf("looped packet: want %v, got %v", DroppedPacketError, err)
+	}
+}
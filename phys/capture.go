@@ -0,0 +1,116 @@
+package phys
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// captureSnapLen is the maximum frame length recorded in capture files.
+const captureSnapLen = 65536
+
+var (
+	_ = (DuplexEthernetStream)(&PcapWriter{})
+	_ = (DuplexEthernetStream)(&PcapReader{})
+)
+
+// PcapWriter is a DuplexEthernetStream that wraps another stream, recording
+// every frame that is read from or written to it in a pcap file. This allows
+// the traffic crossing the physical bridge to be examined with tools like
+// Wireshark, or to be replayed later using PcapReader.
+type PcapWriter struct {
+	inner DuplexEthernetStream
+	f     *os.File
+	mu    sync.Mutex
+	w     *pcapgo.Writer
+}
+
+// NewPcapWriter creates a new pcap file at the given path and returns a
+// PcapWriter that records the frames passing through the given stream to it.
+func NewPcapWriter(path string, inner DuplexEthernetStream) (*PcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(captureSnapLen, layers.LinkTypeEthernet); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &PcapWriter{
+		inner: inner,
+		f:     f,
+		w:     w,
+	}, nil
+}
+
+func (w *PcapWriter) capture(ci gopacket.CaptureInfo, data []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// An error writing the capture file should not interrupt the bridge
+	// itself, so it is ignored.
+	w.w.WritePacket(ci, data)
+}
+
+func (w *PcapWriter) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := w.inner.ReadPacketData()
+	if err == nil {
+		w.capture(ci, data)
+	}
+	return data, ci, err
+}
+
+func (w *PcapWriter) WritePacketData(data []byte) error {
+	w.capture(gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(data),
+		Length:        len(data),
+	}, data)
+	return w.inner.WritePacketData(data)
+}
+
+func (w *PcapWriter) Close() {
+	w.inner.Close()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.f.Close()
+}
+
+// PcapReader is a DuplexEthernetStream that replays the frames in a pcap
+// file, for example one recorded using PcapWriter. ReadPacketData returns
+// io.EOF once all frames have been read. It is read-only: frames written to
+// it are discarded.
+type PcapReader struct {
+	f *os.File
+	r *pcapgo.Reader
+}
+
+// NewPcapReader opens the pcap file at the given path for replaying.
+func NewPcapReader(path string) (*PcapReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &PcapReader{f: f, r: r}, nil
+}
+
+func (r *PcapReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return r.r.ReadPacketData()
+}
+
+func (r *PcapReader) WritePacketData(data []byte) error {
+	return nil
+}
+
+func (r *PcapReader) Close() {
+	r.f.Close()
+}
@@ -3,43 +3,60 @@ package phys
 import (
 	"flag"
 	"fmt"
+	"strings"
+	"time"
+
 	"github.com/songgao/water"
 )
 
 type Flags struct {
 	PcapDevice      *string
+	BPFFilter       *string
 	EnableTap       *bool
 	EthernetFraming *string
+	Keepalive       *time.Duration
+	CaptureFile     *string
+	LoopWindow      *time.Duration
+	LoopCacheSize   *int
 }
 
 func RegisterFlags() *Flags {
 	f := &Flags{}
 	maybeAddPcapDeviceFlag(f)
 	f.EnableTap = flag.Bool("enable_tap", false, "Bridge the server to a tap device.")
-	f.EthernetFraming = flag.String("ethernet_framing", "auto", `Framing to use when sending Ethernet packets. Valid values are "auto", "802.2", "802.3raw", "snap" and "eth-ii".`)
+	f.EthernetFraming = flag.String("ethernet_framing", "auto", framingFlagHelp())
+	f.Keepalive = flag.Duration("phys_keepalive", 0, "If non-zero, send a keepalive frame to the physical network if nothing has been sent for this long, to keep the switch port active.")
+	f.CaptureFile = flag.String("capture_file", "", "If set, record all frames sent and received on the physical network to the given pcap file.")
+	f.LoopWindow = flag.Duration("bridge_loop_window", DefaultLoopGuardConfig.Window, "Drop packets from the physical network that are identical to one sent to it within this time, to prevent packets looping if the network is bridged more than once. Zero disables loop detection.")
+	f.LoopCacheSize = flag.Int("bridge_loop_cache_size", DefaultLoopGuardConfig.Size, "Maximum number of recently sent packets remembered for --bridge_loop_window.")
 	return f
 }
 
 func (f *Flags) EthernetStream(captureNonIPX bool) (DuplexEthernetStream, error) {
+	var stream DuplexEthernetStream
+	var err error
 	if *f.EnableTap {
-		return NewTap(water.Config{})
+		stream, err = NewTap(water.Config{})
+	} else {
+		stream, err = openPcapHandle(f, captureNonIPX)
+	}
+	if err != nil || stream == nil || *f.CaptureFile == "" {
+		return stream, err
 	}
-	return openPcapHandle(f, captureNonIPX)
+	w, err := NewPcapWriter(*f.CaptureFile, stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return w, nil
 }
 
-func (f *Flags) makeFramer() (Framer, error) {
-	framerName := *f.EthernetFraming
-	if framerName == "auto" {
-		return &automaticFramer{
-			fallback: Framer802_2,
-		}, nil
-	}
-	for _, framer := range allFramers {
-		if framerName == framer.Name() {
-			return framer, nil
-		}
+func framingFlagHelp() string {
+	names := []string{`"auto"`}
+	for _, info := range Framers() {
+		names = append(names, fmt.Sprintf("%q", info.Name))
 	}
-	return nil, fmt.Errorf("unknown Ethernet framing %q", framerName)
+	return fmt.Sprintf("Framing to use when sending Ethernet packets. Valid values are %s.", strings.Join(names, ", "))
 }
 
 func (f *Flags) MakePhys(captureNonIPX bool) (*Phys, error) {
@@ -47,7 +64,7 @@ func (f *Flags) MakePhys(captureNonIPX bool) (*Phys, error) {
 	if err != nil {
 		return nil, err
 	} else if stream != nil {
-		framer, err := f.makeFramer()
+		framer, err := MakeFramer(*f.EthernetFraming)
 		if err != nil {
 			return nil, err
 		}
@@ -1,6 +1,7 @@
 package phys
 
 import (
+	"fmt"
 	"net"
 	"sync"
 
@@ -29,8 +30,54 @@ var (
 	FramerEthernetII = framerEthernetII{}
 
 	allFramers = []Framer{Framer802_2, Framer802_3Raw, FramerEthernetII, FramerSNAP}
+
+	framerDescriptions = map[Framer]string{
+		Framer802_2:      "IEEE 802.3 with 802.2 LLC header (Novell default from NetWare 3.12)",
+		Framer802_3Raw:   "Raw IEEE 802.3 without LLC header (Novell default before NetWare 3.12)",
+		FramerEthernetII: "Ethernet II with EtherType 0x8137",
+		FramerSNAP:       "IEEE 802.3 with 802.2 LLC and SNAP headers",
+	}
 )
 
+// FramerInfo describes one of the supported Ethernet framing types.
+type FramerInfo struct {
+	Name        string
+	Description string
+	Framer      Framer
+}
+
+// Framers returns a description of all supported Ethernet framing types.
+// This does not include the "auto" framing type, which detects the framing
+// used on the network (see MakeFramer).
+func Framers() []FramerInfo {
+	result := []FramerInfo{}
+	for _, framer := range allFramers {
+		result = append(result, FramerInfo{
+			Name:        framer.Name(),
+			Description: framerDescriptions[framer],
+			Framer:      framer,
+		})
+	}
+	return result
+}
+
+// MakeFramer returns the Framer with the given name. The special name "auto"
+// returns a framer that detects the framing type used on the network,
+// falling back to 802.2 until another type is detected.
+func MakeFramer(name string) (Framer, error) {
+	if name == "auto" {
+		return &automaticFramer{
+			fallback: Framer802_2,
+		}, nil
+	}
+	for _, info := range Framers() {
+		if name == info.Name {
+			return info.Framer, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown Ethernet framing %q", name)
+}
+
 // Unframe parses the layers in the given packet to locate and extract
 // an IPX payload.
 func Unframe(pkt gopacket.Packet, framer Framer) ([]byte, bool) {
@@ -119,8 +166,10 @@ func (framer802_3Raw) Unframe(eth *layers.Ethernet, nextLayers []gopacket.Layer)
 	if len(nextLayers) < 1 {
 		return nil, false
 	}
+	// There is no LLC header, but gopacket decodes the start of the
+	// IPX header as one.
 	llc, ok := nextLayers[0].(*layers.LLC)
-	if !ok || llc.DSAP != lsapNovell || llc.SSAP != lsapNovell {
+	if !ok {
 		return nil, false
 	}
 	llcBytes := llc.LayerContents()
@@ -211,12 +260,21 @@ func (framerEthernetII) Unframe(eth *layers.Ethernet, nextLayers []gopacket.Laye
 
 func (framerEthernetII) Name() string { return "eth-ii" }
 
-// automaticFramer picks a framer based on the first IPX packet it receives.
+// automaticFramer picks a framer based on the IPX packets it receives. The
+// first autoDetectFrames packets received from other machines are counted by
+// framing type; while counting, the most common type so far is used for
+// sending, and once done, the most common type is used from then on. This
+// avoids being misled by a single machine on the network using a different
+// framing from the rest.
 type automaticFramer struct {
 	framer, fallback Framer
+	counts           map[Framer]int
+	total            int
 	mu               sync.RWMutex
 }
 
+const autoDetectFrames = 5
+
 func (f *automaticFramer) Frame(dest net.HardwareAddr, packet *ipx.Packet) ([]gopacket.SerializableLayer, error) {
 	f.mu.RLock()
 	framer := f.framer
@@ -229,23 +287,35 @@ func (f *automaticFramer) Frame(dest net.HardwareAddr, packet *ipx.Packet) ([]go
 
 func (f *automaticFramer) detectedFramer(detected Framer, payload []byte) {
 	f.mu.RLock()
-	framer := f.framer
+	done := f.total >= autoDetectFrames
 	f.mu.RUnlock()
-	if framer == nil {
-		// We received a packet and know what framing it used. But
-		// before we use this as our autodetected framing, make sure
-		// that this isn't a looped-back packet and really came from
-		// another machine on the network.
-		ipxpkt := &ipx.Packet{}
-		if err := ipxpkt.UnmarshalBinary(payload); err != nil {
-			return
-		}
-		if ipxpkt.Header.TransControl != loopbackDetectValue {
-			// TODO: Write detected.Name() to log file
-			f.mu.Lock()
-			f.framer = detected
-			f.mu.Unlock()
-		}
+	if done {
+		return
+	}
+	// We received a packet and know what framing it used. But before we
+	// count it towards our autodetected framing, make sure that this
+	// isn't a looped-back packet and really came from another machine
+	// on the network.
+	ipxpkt := &ipx.Packet{}
+	if err := ipxpkt.UnmarshalBinary(payload); err != nil {
+		return
+	}
+	if isBridgeTag(ipxpkt.Header.TransControl) {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.total >= autoDetectFrames {
+		return
+	}
+	if f.counts == nil {
+		f.counts = make(map[Framer]int)
+	}
+	f.counts[detected]++
+	f.total++
+	// TODO: Write detected.Name() to log file
+	if f.framer == nil || f.counts[detected] > f.counts[f.framer] {
+		f.framer = detected
 	}
 }
 
@@ -0,0 +1,131 @@
+package phys
+
+import (
+	"net"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestFramers(t *testing.T) {
+	want := []string{"802.2", "802.3raw", "eth-ii", "snap"}
+	framers := Framers()
+	if len(framers) != len(want) {
+		t.Fatalf("want %d framers, got %d: %+v", len(want), len(framers), framers)
+	}
+	packet := &ipx.Packet{
+		Header: ipx.Header{
+			// Raw 802.3 framing relies on the checksum field
+			// always being 0xffff.
+			Checksum: 0xffff,
+			Dest:     ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 0x869c},
+			Src: ipx.HeaderAddr{
+				Addr:   ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+				Socket: 0x869c,
+			},
+		},
+		Payload: []byte("hello"),
+	}
+	for i, info := range framers {
+		if info.Name != want[i] || info.Description == "" {
+			t.Errorf("framer %d: want name %q with description, got %+v", i, want[i], info)
+		}
+		framer, err := MakeFramer(info.Name)
+		if err != nil || framer != info.Framer {
+			t.Errorf("MakeFramer(%q) = %v, %v", info.Name, framer, err)
+		}
+
+		// Check the framer can frame and unframe a packet.
+		ls, err := info.Framer.Frame(net.HardwareAddr(ipx.AddrBroadcast[:]), packet)
+		if err != nil {
+			t.Errorf("%s: Frame failed: %v", info.Name, err)
+			continue
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, ls...); err != nil {
+			t.Errorf("%s: serialize failed: %v", info.Name, err)
+			continue
+		}
+		pkt := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+		if _, ok := Unframe(pkt, info.Framer); !ok {
+			t.Errorf("%s: failed to unframe framed packet", info.Name)
+		}
+	}
+	if _, err := MakeFramer("auto"); err != nil {
+		t.Errorf("MakeFramer(\"auto\") failed: %v", err)
+	}
+	if _, err := MakeFramer("bogus"); err == nil {
+		t.Errorf("MakeFramer(\"bogus\") succeeded")
+	}
+}
+
+func frameAndParse(t *testing.T, framer Framer, packet *ipx.Packet) gopacket.Packet {
+	t.Helper()
+	ls, err := framer.Frame(net.HardwareAddr(ipx.AddrBroadcast[:]), packet)
+	if err != nil {
+		t.Fatalf("%s: Frame failed: %v", framer.Name(), err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, ls...); err != nil {
+		t.Fatalf("%s: serialize failed: %v", framer.Name(), err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestAutomaticFramer(t *testing.T) {
+	packet := &ipx.Packet{
+		Header: ipx.Header{
+			Checksum: 0xffff,
+			Dest:     ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 0x869c},
+			Src: ipx.HeaderAddr{
+				Addr:   ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+				Socket: 0x869c,
+			},
+		},
+		Payload: []byte("hello"),
+	}
+	framer, err := MakeFramer("auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sentWith checks which framing the automatic framer uses to send.
+	sentWith := func(want Framer) {
+		t.Helper()
+		pkt := frameAndParse(t, framer, packet)
+		if _, ok := Unframe(pkt, want); !ok {
+			t.Errorf("automatic framer not sending with %s framing", want.Name())
+		}
+	}
+	receive := func(f Framer) {
+		t.Helper()
+		if _, ok := Unframe(frameAndParse(t, f, packet), framer); !ok {
+			t.Fatalf("automatic framer failed to unframe %s packet", f.Name())
+		}
+	}
+
+	// 802.2 is used until something is received.
+	sentWith(Framer802_2)
+	receive(FramerEthernetII)
+	sentWith(FramerEthernetII)
+
+	// Looped-back packets are ignored.
+	looped := *packet
+	looped.Header.TransControl = newBridgeTag()
+	for i := 0; i < autoDetectFrames; i++ {
+		Unframe(frameAndParse(t, FramerSNAP, &looped), framer)
+	}
+	sentWith(FramerEthernetII)
+
+	// The most common framing wins, and is kept once enough packets
+	// have been seen.
+	for i := 1; i < autoDetectFrames; i++ {
+		receive(FramerSNAP)
+	}
+	sentWith(FramerSNAP)
+	for i := 0; i < autoDetectFrames; i++ {
+		receive(FramerEthernetII)
+	}
+	sentWith(FramerSNAP)
+}
@@ -0,0 +1,52 @@
+package phys
+
+import (
+	"context"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// KeepaliveAddr is the source address used for keepalive frames. It is a
+// locally administered address that must never be assigned to a client.
+var KeepaliveAddr = ipx.Addr{0x02, 0xff, 0xff, 0xff, 0x00, 0x01}
+
+// keepalivePacket is a benign packet that is sent to keep the physical
+// network link active. It is broadcast to socket zero, which no IPX
+// application listens on, so receiving nodes will simply discard it.
+var keepalivePacket = &ipx.Packet{
+	Header: ipx.Header{
+		Dest: ipx.HeaderAddr{
+			Addr:   ipx.AddrBroadcast,
+			Socket: 0,
+		},
+		Src: ipx.HeaderAddr{
+			Addr:   KeepaliveAddr,
+			Socket: 0,
+		},
+	},
+}
+
+// SendKeepalives periodically writes a keepalive frame to the physical
+// network if nothing else has been written in the given interval. Some
+// switches prune ports that have been idle for a long time; this keeps the
+// port active even if there is no traffic from the virtual network. It runs
+// until the given context is cancelled.
+func (s *Sink) SendKeepalives(ctx context.Context, interval time.Duration) {
+	for {
+		s.mu.Lock()
+		nextTime := s.lastWriteTime.Add(interval)
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(nextTime)):
+		}
+		s.mu.Lock()
+		idle := !time.Now().Before(s.lastWriteTime.Add(interval))
+		s.mu.Unlock()
+		if idle {
+			s.WritePacket(keepalivePacket)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package phys
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type mockSink struct {
+	frames chan []byte
+}
+
+func (s *mockSink) WritePacketData(data []byte) error {
+	s.frames <- append([]byte{}, data...)
+	return nil
+}
+
+func (s *mockSink) Close() {}
+
+func TestKeepalives(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ms := &mockSink{frames: make(chan []byte, 16)}
+	sink := NewSink(ms, Framer802_2)
+	const interval = 50 * time.Millisecond
+	go sink.SendKeepalives(ctx, interval)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		var frame []byte
+		select {
+		case frame = <-ms.frames:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("keepalive %d not sent", i)
+		}
+		pkt := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		payload, ok := Unframe(pkt, Framer802_2)
+		if !ok {
+			t.Fatalf("keepalive frame is not an IPX frame: %v", pkt)
+		}
+		var packet ipx.Packet
+		if err := packet.UnmarshalBinary(payload); err != nil {
+			t.Fatal(err)
+		}
+		if packet.Header.Src.Addr != KeepaliveAddr {
+			t.Errorf("wrong keepalive source address: %v", packet.Header.Src.Addr)
+		}
+	}
+	// The first keepalive is sent immediately as nothing has been
+	// written yet; the following two are each sent after an interval.
+	if elapsed := time.Since(start); elapsed < 2*interval {
+		t.Errorf("keepalives sent too quickly: 3 sent in %v", elapsed)
+	}
+}
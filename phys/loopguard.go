@@ -0,0 +1,145 @@
+package phys
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/logging"
+)
+
+var _ = (ipx.ReadWriteCloser)(&LoopGuard{})
+
+// LoopGuardConfig contains configuration parameters for a LoopGuard.
+type LoopGuardConfig struct {
+	// Window is how long a packet is remembered for after it is
+	// written to the physical network. An identical packet read back
+	// within this time is dropped.
+	Window time.Duration
+
+	// Size is the maximum number of packets to remember. If more than
+	// this many are written within the window, the oldest are
+	// forgotten.
+	Size int
+
+	// Logger is used to log dropped packets at LevelDebug. It may be nil.
+	Logger *logging.Logger
+}
+
+// DefaultLoopGuardConfig is the configuration used by NewLoopGuard.
+var DefaultLoopGuardConfig = LoopGuardConfig{
+	Window: 250 * time.Millisecond,
+	Size:   4096,
+}
+
+type seenPacket struct {
+	signature uint64
+	time      time.Time
+}
+
+// LoopGuard wraps the connection to the physical network and drops packets
+// read from it that were recently written to it. If two servers are bridged
+// to the same network segment, or a frame is echoed back to us, packets
+// could otherwise loop between the physical and virtual networks
+// indefinitely. Other identical packets, such as a game resending the same
+// packet, are not affected.
+type LoopGuard struct {
+	inner  ipx.ReadWriteCloser
+	config LoopGuardConfig
+
+	mu sync.Mutex
+	// Most recent time each signature was written, and the order in
+	// which signatures were written, oldest first, so they can be
+	// expired.
+	seen  map[uint64]time.Time
+	order []seenPacket
+}
+
+// NewLoopGuard creates a LoopGuard wrapping the given connection with the
+// default configuration.
+func NewLoopGuard(inner ipx.ReadWriteCloser) *LoopGuard {
+	return NewLoopGuardWithConfig(inner, &DefaultLoopGuardConfig)
+}
+
+// NewLoopGuardWithConfig creates a LoopGuard wrapping the given connection.
+func NewLoopGuardWithConfig(inner ipx.ReadWriteCloser, config *LoopGuardConfig) *LoopGuard {
+	return &LoopGuard{
+		inner:  inner,
+		config: *config,
+		seen:   make(map[uint64]time.Time),
+	}
+}
+
+// signature returns a hash of the packet's header and payload. The
+// transport control field is excluded since routers increment it.
+func signature(packet *ipx.Packet) uint64 {
+	hdr := packet.Header
+	hdr.TransControl = 0
+	hdrBytes, _ := hdr.MarshalBinary()
+	h := fnv.New64a()
+	h.Write(hdrBytes)
+	h.Write(packet.Payload)
+	return h.Sum64()
+}
+
+func (g *LoopGuard) expire(now time.Time) {
+	n := 0
+	for n < len(g.order) && (len(g.order)-n > g.config.Size || now.Sub(g.order[n].time) >= g.config.Window) {
+		sp := g.order[n]
+		if g.seen[sp.signature] == sp.time {
+			delete(g.seen, sp.signature)
+		}
+		n++
+	}
+	g.order = g.order[n:]
+}
+
+// recordWritten records that the given packet has been written.
+func (g *LoopGuard) recordWritten(packet *ipx.Packet) {
+	sig := signature(packet)
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.seen[sig] = now
+	g.order = append(g.order, seenPacket{sig, now})
+	g.expire(now)
+}
+
+// wasWritten returns true if the given packet was written within the window.
+func (g *LoopGuard) wasWritten(packet *ipx.Packet) bool {
+	sig := signature(packet)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire(time.Now())
+	_, ok := g.seen[sig]
+	return ok
+}
+
+// ReadPacket reads a packet from the physical network, skipping any that
+// were recently written to it.
+func (g *LoopGuard) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	for {
+		packet, err := g.inner.ReadPacket(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !g.wasWritten(packet) {
+			return packet, nil
+		}
+		g.config.Logger.Debugf("loop guard: dropped packet that looped back from physical network: %v -> %v",
+			packet.Header.Src.Addr, packet.Header.Dest.Addr)
+	}
+}
+
+// WritePacket writes a packet to the physical network, remembering it so
+// that it is dropped if it comes back.
+func (g *LoopGuard) WritePacket(packet *ipx.Packet) error {
+	g.recordWritten(packet)
+	return g.inner.WritePacket(packet)
+}
+
+func (g *LoopGuard) Close() error {
+	return g.inner.Close()
+}
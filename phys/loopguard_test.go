@@ -0,0 +1,93 @@
+package phys
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+// readWithTimeout reads a packet, returning nil if none arrives quickly.
+func readWithTimeout(t *testing.T, r ipx.Reader) *ipx.Packet {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	packet, err := r.ReadPacket(ctx)
+	if err != nil {
+		return nil
+	}
+	return packet
+}
+
+func TestLoopGuard(t *testing.T) {
+	guarded, physEnd := ipxtesting.MakeLoopbackPair("guarded", "phys")
+	g := NewLoopGuardWithConfig(guarded, &LoopGuardConfig{
+		Window: 500 * time.Millisecond,
+		Size:   16,
+	})
+	first, second := ipxtesting.TestPackets[0], ipxtesting.TestPackets[1]
+
+	// Identical packets from the physical network are not suppressed,
+	// since games may legitimately send the same packet twice.
+	physEnd.WritePacket(first)
+	physEnd.WritePacket(first)
+	for i := 0; i < 2; i++ {
+		if readWithTimeout(t, g) == nil {
+			t.Fatalf("packet %d was not received", i)
+		}
+	}
+
+	// Nor are identical packets written to it.
+	for i := 0; i < 2; i++ {
+		if err := g.WritePacket(second); err != nil {
+			t.Fatal(err)
+		}
+		if readWithTimeout(t, physEnd) == nil {
+			t.Fatalf("written packet %d was not sent", i)
+		}
+	}
+
+	// A packet that we sent being echoed back to us is suppressed, even
+	// if its transport control field has been incremented.
+	echo := *second
+	echo.Header.TransControl++
+	physEnd.WritePacket(&echo)
+	if p := readWithTimeout(t, g); p != nil {
+		t.Errorf("echoed packet was not suppressed: %+v", p)
+	}
+
+	// Once the window has passed, the packet is allowed through again.
+	time.Sleep(500 * time.Millisecond)
+	physEnd.WritePacket(second)
+	if readWithTimeout(t, g) == nil {
+		t.Errorf("packet was suppressed after the window expired")
+	}
+}
+
+func TestLoopGuardSize(t *testing.T) {
+	guarded, physEnd := ipxtesting.MakeLoopbackPair("guarded", "phys")
+	g := NewLoopGuardWithConfig(guarded, &LoopGuardConfig{
+		Window: time.Minute,
+		Size:   2,
+	})
+	packets := ipxtesting.TestPackets[:3]
+	for _, p := range packets {
+		if err := g.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+		if readWithTimeout(t, physEnd) == nil {
+			t.Fatalf("packet was not sent: %+v", p)
+		}
+	}
+	// The first packet has been forgotten, since the cache only holds
+	// the two most recent.
+	physEnd.WritePacket(packets[0])
+	if readWithTimeout(t, g) == nil {
+		t.Errorf("packet was suppressed after being evicted from the cache")
+	}
+	physEnd.WritePacket(packets[2])
+	if p := readWithTimeout(t, g); p != nil {
+		t.Errorf("looped packet was not suppressed: %+v", p)
+	}
+}
@@ -5,20 +5,40 @@ package phys
 import (
 	"flag"
 	"fmt"
+	"io"
+	"net"
+	"os"
+
 	"github.com/google/gopacket/pcap"
-	"strings"
 )
 
-func listNetDevices() (string, error) {
+// listNetDevices writes a description of every network device that can be
+// used with --pcap_device: its name, followed by its description and
+// addresses, if it has any.
+func listNetDevices(w io.Writer) error {
 	ifaces, err := pcap.FindAllDevs()
 	if err != nil {
-		return "", err
+		return err
+	}
+	if len(ifaces) == 0 {
+		fmt.Fprintln(w, "No network devices found. You may need to run with root or administrator privileges.")
+		return nil
 	}
-	result := []string{}
 	for _, iface := range ifaces {
-		result = append(result, fmt.Sprintf("%q", iface.Name))
+		fmt.Fprintf(w, "%s\n", iface.Name)
+		if iface.Description != "" {
+			fmt.Fprintf(w, "\tDescription: %s\n", iface.Description)
+		}
+		for _, addr := range iface.Addresses {
+			if addr.Netmask != nil {
+				ipnet := &net.IPNet{IP: addr.IP, Mask: addr.Netmask}
+				fmt.Fprintf(w, "\tAddress: %s\n", ipnet)
+			} else {
+				fmt.Fprintf(w, "\tAddress: %s\n", addr.IP)
+			}
+		}
 	}
-	return strings.Join(result, ", "), nil
+	return nil
 }
 
 func openPcapHandle(f *Flags, captureNonIPX bool) (DuplexEthernetStream, error) {
@@ -26,11 +46,10 @@ func openPcapHandle(f *Flags, captureNonIPX bool) (DuplexEthernetStream, error)
 		return nil, nil
 	}
 	if *f.PcapDevice == "list" {
-		devices, err := listNetDevices()
-		if err != nil {
-			return nil, err
+		if err := listNetDevices(os.Stdout); err != nil {
+			return nil, fmt.Errorf("failed to list network devices: %w", err)
 		}
-		return nil, fmt.Errorf("valid network devices are: %v", devices)
+		os.Exit(0)
 	}
 	handle, err := pcap.OpenLive(*f.PcapDevice, 1500, true, pcap.BlockForever)
 	if err != nil {
@@ -40,11 +59,17 @@ func openPcapHandle(f *Flags, captureNonIPX bool) (DuplexEthernetStream, error)
 	// the network will get delivered back to us.
 	handle.SetDirection(pcap.DirectionIn)
 	// As an optimization we set a filter to only deliver IPX packets
-	// because they're all we care about. However, when ipxpkt routing is
-	// enabled we want all Ethernet frames.
+	// because they're all we care about. The filter can be overridden
+	// with a narrower one. However, when ipxpkt routing is enabled we
+	// want all Ethernet frames.
 	if !captureNonIPX {
-		if err := handle.SetBPFFilter("ipx"); err != nil {
-			return nil, err
+		filter := "ipx"
+		if *f.BPFFilter != "" {
+			filter = *f.BPFFilter
+		}
+		if err := handle.SetBPFFilter(filter); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("invalid BPF filter %q: %w", filter, err)
 		}
 	}
 	return handle, nil
@@ -52,4 +77,5 @@ func openPcapHandle(f *Flags, captureNonIPX bool) (DuplexEthernetStream, error)
 
 func maybeAddPcapDeviceFlag(f *Flags) {
 	f.PcapDevice = flag.String("pcap_device", "", `Send and receive packets to the given device ("list" to list all devices)`)
+	f.BPFFilter = flag.String("bpf_filter", "", `BPF filter expression selecting the frames to capture from --pcap_device, instead of "ipx". Ignored if --enable_ipxpkt is set, since that requires all frames.`)
 }
@@ -4,25 +4,66 @@ package phys
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network/pipe"
+	"github.com/fragglet/ipxbox/network/type20"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
 )
 
-// loopbackDetectValue is a special magic value that the TransControl
-// field is set to when IPX packets are written to a physical interface.
-// We use this to detect packets if they have been looped back and
-// captured again due to bug #18, and discard them.
-const loopbackDetectValue = 127
+// Packets written to a physical interface are tagged by setting their
+// TransControl field to a bridge tag: a value with the top bit set that is
+// different for each Sink. Real IPX routers discard packets after 16 hops,
+// so these values never occur naturally. The tag serves two purposes:
+//
+//   - A packet carrying our own tag has been looped back and captured again
+//     due to bug #18, and is discarded.
+//   - A packet carrying any other tag was bridged onto the segment by
+//     another ipxbox server (or by another bridge of our own). It is
+//     delivered to the virtual network as normal, but keeps its tag, and
+//     Phys.WritePacket refuses to write it back to a physical network.
+//     This stops broadcasts from looping between servers that are bridged
+//     to the same segment.
+//
+// Older versions of ipxbox tagged every packet with legacyBridgeTag, which
+// is treated as another server's tag.
+const (
+	bridgeTagBit    = 0x80
+	legacyBridgeTag = 127
+)
+
+// nextBridgeTag is used to allocate a distinct tag to each Sink. It starts
+// at a random value so that servers sharing a segment are unlikely to use
+// the same tag.
+var nextBridgeTag = randomUint32()
+
+func randomUint32() uint32 {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return binary.BigEndian.Uint32(buf[:])
+}
+
+func newBridgeTag() uint8 {
+	return bridgeTagBit | uint8(atomic.AddUint32(&nextBridgeTag, 1)&^bridgeTagBit)
+}
+
+// isBridgeTag returns true if the given TransControl value shows that a
+// packet has already been bridged by an ipxbox server.
+func isBridgeTag(transControl uint8) bool {
+	return transControl&bridgeTagBit != 0 || transControl == legacyBridgeTag
+}
 
 var (
 	_ = (ipx.WriteCloser)(&Sink{})
@@ -72,6 +113,10 @@ func (s *pcapgoSinkShim) Close() {}
 type Sink struct {
 	pds    PacketDataSink
 	framer Framer
+	tag    uint8
+
+	mu            sync.Mutex
+	lastWriteTime time.Time
 }
 
 // WritePacket implements the ipx.Writer interface, and will write the
@@ -82,7 +127,13 @@ func (s *Sink) WritePacket(packet *ipx.Packet) error {
 	opts := gopacket.SerializeOptions{}
 	modifiedHeader := packet.Header
 	modifiedHeader.Checksum = 0
-	modifiedHeader.TransControl = loopbackDetectValue
+	// Type 20 packets use the TransControl field as the count of
+	// networks the packet has passed through, so it must not be
+	// overwritten. Looped-back type 20 packets are instead detected by
+	// the network list in the packet (see the type20 package).
+	if packet.Header.PacketType != type20.PacketType {
+		modifiedHeader.TransControl = s.tag
+	}
 	layers, err := s.framer.Frame(dest, &ipx.Packet{
 		Header:  modifiedHeader,
 		Payload: packet.Payload,
@@ -91,6 +142,9 @@ func (s *Sink) WritePacket(packet *ipx.Packet) error {
 		return err
 	}
 	gopacket.SerializeLayers(buf, opts, layers...)
+	s.mu.Lock()
+	s.lastWriteTime = time.Now()
+	s.mu.Unlock()
 	return s.pds.WritePacketData(buf.Bytes())
 }
 
@@ -105,6 +159,7 @@ func NewSink(pds PacketDataSink, framer Framer) *Sink {
 	return &Sink{
 		pds:    pds,
 		framer: framer,
+		tag:    newBridgeTag(),
 	}
 }
 
@@ -122,6 +177,7 @@ type Phys struct {
 	rxpipe ipx.ReadWriteCloser
 	nonIPX *nonIPX
 	mu     sync.Mutex
+	runErr error
 }
 
 func (p *Phys) Close() error {
@@ -135,7 +191,25 @@ func (p *Phys) Close() error {
 	return nil
 }
 
+// Run reads frames from the physical network until an error occurs, and
+// must be called for packets to be received. When it returns, ReadPacket
+// returns the same error, so that anything copying packets from the
+// physical network stops rather than silently waiting forever.
 func (p *Phys) Run() error {
+	err := p.run()
+	if err == nil || errors.Is(err, io.EOF) {
+		// Readers treat EOF as a clean shutdown, but the physical
+		// network going away is not.
+		err = io.ErrUnexpectedEOF
+	}
+	p.mu.Lock()
+	p.runErr = err
+	p.mu.Unlock()
+	p.rxpipe.Close()
+	return err
+}
+
+func (p *Phys) run() error {
 	for {
 		pkt, err := p.ps.NextPacket()
 		if err != nil {
@@ -148,7 +222,7 @@ func (p *Phys) Run() error {
 				return err
 			}
 			// We discard looped-back packets (bug #18):
-			if ipxpkt.Header.TransControl != loopbackDetectValue {
+			if ipxpkt.Header.TransControl != p.Sink.tag {
 				p.rxpipe.WritePacket(ipxpkt)
 			}
 		} else {
@@ -164,7 +238,25 @@ func (p *Phys) Run() error {
 // ReadPacket implements the ipx.Reader interface, and will block until an
 // IPX packet is read from the physical interface.
 func (p *Phys) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
-	return p.rxpipe.ReadPacket(ctx)
+	packet, err := p.rxpipe.ReadPacket(ctx)
+	if err == io.ErrClosedPipe {
+		p.mu.Lock()
+		if p.runErr != nil {
+			err = fmt.Errorf("reading from physical network: %w", p.runErr)
+		}
+		p.mu.Unlock()
+	}
+	return packet, err
+}
+
+// WritePacket writes the given IPX packet to the physical interface, unless
+// it has already been bridged from a physical network by an ipxbox server,
+// in which case it is silently dropped.
+func (p *Phys) WritePacket(packet *ipx.Packet) error {
+	if packet.Header.PacketType != type20.PacketType && isBridgeTag(packet.Header.TransControl) {
+		return nil
+	}
+	return p.Sink.WritePacket(packet)
 }
 
 // NonIPX returns a DuplexEthernetStream from which all non-IPX Ethernet frames
@@ -248,9 +340,12 @@ func (ni *nonIPX) WritePacketData(frame []byte) error {
 
 func (ni *nonIPX) Close() {
 	ni.phys.mu.Lock()
-	close(ni.frames)
-	ni.phys.nonIPX = nil
-	ni.phys.mu.Unlock()
+	defer ni.phys.mu.Unlock()
+	// It may already have been closed, along with the Phys.
+	if ni.phys.nonIPX == ni {
+		close(ni.frames)
+		ni.phys.nonIPX = nil
+	}
 }
 
 func NewPhys(stream DuplexEthernetStream, framer Framer) *Phys {
@@ -277,26 +372,25 @@ func copyLoop(a, b DuplexEthernetStream) error {
 	}
 }
 
-// CopyFrames starts a background process that copies packets between the
-// given two streams.
-func CopyFrames(a, b DuplexEthernetStream) error {
-	var wg sync.WaitGroup
-	wg.Add(2)
-	var err1, err2 error
+// CopyFrames copies frames in both directions between the given two
+// streams until the context is cancelled or copying stops in either
+// direction. Both streams are then closed, so that copying in the other
+// direction also stops. The first error to occur is returned.
+func CopyFrames(ctx context.Context, a, b DuplexEthernetStream) error {
+	errs := make(chan error, 2)
 	go func() {
-		err1 = copyLoop(a, b)
-		wg.Done()
+		errs <- copyLoop(a, b)
 	}()
 	go func() {
-		err2 = copyLoop(b, a)
-		wg.Done()
+		errs <- copyLoop(b, a)
 	}()
-	wg.Wait()
-	if err1 != nil {
-		return err1
-	}
-	if err2 != nil {
-		return err2
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = ctx.Err()
 	}
-	return nil
+	a.Close()
+	b.Close()
+	return err
 }
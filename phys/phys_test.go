@@ -0,0 +1,168 @@
+package phys
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+	"github.com/google/gopacket"
+)
+
+// segment simulates a physical Ethernet segment; every frame written by a
+// port is received by all ports, including the sender (as can happen when
+// capturing with pcap; see bug #18).
+type segment struct {
+	mu     sync.Mutex
+	ports  []*segmentPort
+	frames int
+}
+
+type segmentPort struct {
+	seg *segment
+	rx  chan []byte
+}
+
+func (s *segment) newPort() *segmentPort {
+	p := &segmentPort{seg: s, rx: make(chan []byte, 16)}
+	s.mu.Lock()
+	s.ports = append(s.ports, p)
+	s.mu.Unlock()
+	return p
+}
+
+func (s *segment) numFrames() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.frames
+}
+
+func (p *segmentPort) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	frame, ok := <-p.rx
+	if !ok {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	return frame, gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(frame),
+		Length:        len(frame),
+	}, nil
+}
+
+func (p *segmentPort) WritePacketData(frame []byte) error {
+	p.seg.mu.Lock()
+	defer p.seg.mu.Unlock()
+	p.seg.frames++
+	for _, port := range p.seg.ports {
+		port.rx <- append([]byte{}, frame...)
+	}
+	return nil
+}
+
+func (p *segmentPort) Close() {}
+
+func TestBridgedBroadcastNotLooped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	seg := &segment{}
+
+	// Two virtual networks bridged to the same segment. The second is
+	// bridged twice, so without loop prevention a broadcast received
+	// by one of its bridges would be written back by the other.
+	var clients []ipx.ReadWriteCloser
+	for _, numBridges := range []int{1, 2} {
+		net := ipxswitch.New()
+		for j := 0; j < numBridges; j++ {
+			p := NewPhys(seg.newPort(), Framer802_2)
+			go p.Run()
+			go ipx.DuplexCopyPackets(ctx, p, ipxtesting.MustNewNode(t, net))
+		}
+		clients = append(clients, ipxtesting.MustNewNode(t, net))
+	}
+
+	want := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 0x869c},
+			Src: ipx.HeaderAddr{
+				Addr:   ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55},
+				Socket: 0x869c,
+			},
+		},
+		Payload: []byte("broadcast"),
+	}
+	clients[0].WritePacket(want)
+
+	// The broadcast crosses the bridge and is delivered on the other
+	// virtual network.
+	readCtx, readCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer readCancel()
+	got, err := clients[1].ReadPacket(readCtx)
+	if err != nil {
+		t.Fatalf("bridged broadcast not received: %v", err)
+	}
+	if got.Header.Src != want.Header.Src || !bytes.Equal(got.Payload, want.Payload) {
+		t.Errorf("wrong packet received: want %+v, got %+v", want, got)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if n := seg.numFrames(); n != 1 {
+		t.Errorf("broadcast was re-bridged: want 1 frame on segment, got %d", n)
+	}
+	readCtx, readCancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer readCancel()
+	if packet, err := clients[0].ReadPacket(readCtx); err == nil {
+		t.Errorf("broadcast looped back to sender: %+v", packet)
+	}
+}
+
+func TestBridgeStopsWhenCaptureFails(t *testing.T) {
+	seg := &segment{}
+	port := seg.newPort()
+	p := NewPhys(port, Framer802_2)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- p.Run()
+	}()
+	bridgeErr := make(chan error, 1)
+	go func() {
+		bridgeErr <- ipx.DuplexCopyPackets(context.Background(), p, ipxtesting.MustNewNode(t, ipxswitch.New()))
+	}()
+
+	// The capture handle going away must stop the whole bridge, not
+	// just the direction reading from the physical network.
+	close(port.rx)
+	for _, ch := range []chan error{runErr, bridgeErr} {
+		select {
+		case err := <-ch:
+			if err == nil {
+				t.Errorf("want error when capture stops, got nil")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("bridge did not stop after capture failed")
+		}
+	}
+}
+
+func TestCopyFramesCancel(t *testing.T) {
+	seg := &segment{}
+	a, b := seg.newPort(), seg.newPort()
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- CopyFrames(ctx, a, b)
+	}()
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("wrong error: want %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("CopyFrames did not return after context was cancelled")
+	}
+}
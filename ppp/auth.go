@@ -0,0 +1,222 @@
+package ppp
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ppp/lcp"
+	"github.com/fragglet/ipxbox/ppp/mschap"
+)
+
+const (
+	// authName is the name that we send in CHAP Challenge messages.
+	authName = "ipxbox"
+
+	// Length of the Value field in an MS-CHAPv2 Response: peer challenge,
+	// eight reserved bytes, NT-Response and a flags byte.
+	msCHAPv2ResponseLen = mschap.ChallengeLen + 8 + mschap.NTResponseLen + 1
+)
+
+var (
+	// ErrAuthenticationFailed is returned when a peer fails to prove that
+	// it knows the password for the user name it gave.
+	ErrAuthenticationFailed = errors.New("authentication failed")
+)
+
+// CHAPAlgorithm identifies the algorithm used for CHAP authentication. The
+// values are those used in the LCP Authentication-Protocol option.
+type CHAPAlgorithm uint8
+
+const (
+	CHAPMD5  CHAPAlgorithm = 0x05
+	MSCHAPv2 CHAPAlgorithm = 0x81
+)
+
+func (a CHAPAlgorithm) String() string {
+	switch a {
+	case CHAPMD5:
+		return "CHAP-MD5"
+	case MSCHAPv2:
+		return "MS-CHAPv2"
+	}
+	return fmt.Sprintf("CHAPAlgorithm(%#x)", uint8(a))
+}
+
+// Challenge describes a CHAP challenge that was sent to a peer, for checking
+// the response that it sent back.
+type Challenge struct {
+	Algorithm  CHAPAlgorithm
+	Identifier uint8
+	Value      []byte
+
+	// For MS-CHAPv2, the challenge chosen by the peer, which it sends
+	// along with its response.
+	PeerChallenge []byte
+}
+
+// Authenticator is a store of user credentials that is used to check the
+// responses peers send to challenges during authentication.
+type Authenticator interface {
+	// CheckPassword returns true if the response is valid for the given
+	// user and challenge. For CHAP-MD5 the response is the MD5 hash
+	// defined in RFC 1994; for MS-CHAPv2 it is the NT-Response, and the
+	// user name has any domain prefix removed. For MS-CHAPv2 the NT hash
+	// of the user's password (see mschap.NTPasswordHash) must also be
+	// returned, as it is needed to sign the Success message and to derive
+	// keys for MPPE encryption.
+	CheckPassword(user string, challenge *Challenge, response []byte) (passwordHash [16]byte, ok bool)
+}
+
+// challenger implements the authenticator side of CHAP, with either MD5 or
+// MS-CHAPv2 as the algorithm. It is driven in the same way as a negotiator.
+type challenger struct {
+	auth          Authenticator
+	challenge     Challenge
+	sendPPP       func(p []byte) error
+	mu            sync.Mutex
+	numChallenges int
+	sendTime      time.Time
+	done          bool
+	err           error
+
+	// Set once the peer has successfully authenticated. The Success
+	// message is kept in case the peer did not receive it and resends
+	// its Response.
+	passwordHash [16]byte
+	ntResponse   []byte
+	success      []byte
+}
+
+func newChallenger(auth Authenticator, algorithm CHAPAlgorithm, sendPPP func(p []byte) error) *challenger {
+	return &challenger{
+		auth: auth,
+		challenge: Challenge{
+			Algorithm: algorithm,
+			Value:     make([]byte, mschap.ChallengeLen),
+		},
+		sendPPP: sendPPP,
+	}
+}
+
+func (c *challenger) send(code lcp.CHAPCode, data []byte) {
+	payload, err := (&lcp.CHAP{
+		Code:       code,
+		Identifier: c.challenge.Identifier,
+		Data:       data,
+	}).MarshalBinary()
+	if err != nil {
+		return
+	}
+	if err := c.sendPPP(payload); err != nil {
+		c.err = err
+		c.done = true
+	}
+}
+
+func (c *challenger) sendChallenge() {
+	c.challenge.Identifier++
+	c.numChallenges++
+	c.sendTime = time.Now()
+	v := &lcp.CHAPValue{Value: c.challenge.Value, Name: authName}
+	data, _ := v.MarshalBinary()
+	c.send(lcp.CHAPChallenge, data)
+}
+
+func (c *challenger) fail(err error) {
+	msg := "Authentication failure"
+	if c.challenge.Algorithm == MSCHAPv2 {
+		msg = fmt.Sprintf("E=691 R=0 C=%X V=3 M=%s", c.challenge.Value, msg)
+	}
+	c.send(lcp.CHAPFailure, []byte(msg))
+	c.err = err
+	c.done = true
+}
+
+func (c *challenger) handleResponse(r *lcp.CHAP) {
+	if r.Identifier != c.challenge.Identifier {
+		return
+	}
+	if c.done {
+		// The peer may not have received our Success message.
+		if c.err == nil {
+			c.send(lcp.CHAPSuccess, c.success)
+		}
+		return
+	}
+	var v lcp.CHAPValue
+	if err := v.UnmarshalBinary(r.Data); err != nil {
+		c.fail(fmt.Errorf("%w: malformed response", ErrAuthenticationFailed))
+		return
+	}
+	user, response := v.Name, v.Value
+	if c.challenge.Algorithm == MSCHAPv2 {
+		if len(v.Value) != msCHAPv2ResponseLen {
+			c.fail(fmt.Errorf("%w: malformed MS-CHAPv2 response", ErrAuthenticationFailed))
+			return
+		}
+		user = mschap.UserName(user)
+		c.challenge.PeerChallenge = v.Value[:mschap.ChallengeLen]
+		response = v.Value[mschap.ChallengeLen+8 : mschap.ChallengeLen+8+mschap.NTResponseLen]
+	}
+	passwordHash, ok := c.auth.CheckPassword(user, &c.challenge, response)
+	if !ok {
+		c.fail(fmt.Errorf("%w: bad %v response for user %q", ErrAuthenticationFailed, c.challenge.Algorithm, user))
+		return
+	}
+	c.success = []byte("Access granted")
+	if c.challenge.Algorithm == MSCHAPv2 {
+		c.passwordHash = passwordHash
+		c.ntResponse = append([]byte{}, response...)
+		c.success = []byte(mschap.GenerateAuthenticatorResponse(
+			passwordHash, response, c.challenge.PeerChallenge,
+			c.challenge.Value, user) + " M=Access granted")
+	}
+	c.send(lcp.CHAPSuccess, c.success)
+	c.done = true
+}
+
+func (c *challenger) RecvPacket(r *lcp.CHAP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r.Code == lcp.CHAPResponse {
+		c.handleResponse(r)
+	}
+}
+
+// StartAuthentication sends Challenge messages to the peer until it sends
+// a Response or too many have been sent.
+func (c *challenger) StartAuthentication() {
+	c.mu.Lock()
+	if _, err := rand.Read(c.challenge.Value); err != nil {
+		c.err, c.done = err, true
+	}
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		done := c.done
+		if !done && time.Now().After(c.sendTime.Add(requestTimeout)) {
+			if c.numChallenges >= maxConfigureRequests {
+				c.err = fmt.Errorf("%w: no response after sending %d challenges", ErrAuthenticationFailed, c.numChallenges)
+				c.done = true
+			} else {
+				c.sendChallenge()
+			}
+		}
+		c.mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Done returns true once authentication has completed, along with an
+// error if it failed.
+func (c *challenger) Done() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done, c.err
+}
@@ -0,0 +1,119 @@
+package ppp
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ppp/lcp"
+	"github.com/fragglet/ipxbox/ppp/mschap"
+)
+
+type authTest struct {
+	t         *testing.T
+	c         *challenger
+	sent      []*lcp.CHAP
+	challenge *lcp.CHAP
+}
+
+func newAuthTest(t *testing.T, algorithm CHAPAlgorithm) *authTest {
+	at := &authTest{t: t}
+	users := Users{"user": "clientPass"}
+	at.c = newChallenger(users, algorithm, func(p []byte) error {
+		c := &lcp.CHAP{}
+		if err := c.UnmarshalBinary(p); err != nil {
+			t.Fatalf("challenger sent undecodable packet: %x", p)
+		}
+		at.sent = append(at.sent, c)
+		return nil
+	})
+	copy(at.c.challenge.Value, "0123456789abcdef")
+	at.c.sendChallenge()
+	at.challenge = at.sent[0]
+	return at
+}
+
+// respond sends a Response to the challenge, and returns the reply that
+// was sent.
+func (at *authTest) respond(name, password string) *lcp.CHAP {
+	at.t.Helper()
+	if at.challenge.Code != lcp.CHAPChallenge {
+		at.t.Fatalf("want challenge, got %+v", at.challenge)
+	}
+	var cv lcp.CHAPValue
+	if err := cv.UnmarshalBinary(at.challenge.Data); err != nil {
+		at.t.Fatal(err)
+	}
+	var value []byte
+	switch at.c.challenge.Algorithm {
+	case CHAPMD5:
+		h := md5.New()
+		h.Write([]byte{at.challenge.Identifier})
+		h.Write([]byte(password))
+		h.Write(cv.Value)
+		value = h.Sum(nil)
+	case MSCHAPv2:
+		peerChallenge := []byte("fedcba9876543210")
+		value = append(value, peerChallenge...)
+		value = append(value, make([]byte, 8)...)
+		value = append(value, mschap.GenerateNTResponse(cv.Value, peerChallenge, mschap.UserName(name), password)...)
+		value = append(value, 0)
+	}
+	data, _ := (&lcp.CHAPValue{Value: value, Name: name}).MarshalBinary()
+	numSent := len(at.sent)
+	at.c.RecvPacket(&lcp.CHAP{
+		Code:       lcp.CHAPResponse,
+		Identifier: at.challenge.Identifier,
+		Data:       data,
+	})
+	if len(at.sent) == numSent {
+		at.t.Fatalf("no reply sent to response")
+	}
+	return at.sent[len(at.sent)-1]
+}
+
+func TestAuthentication(t *testing.T) {
+	at := newAuthTest(t, MSCHAPv2)
+	reply := at.respond(`DOMAIN\user`, "clientPass")
+	if reply.Code != lcp.CHAPSuccess || !strings.HasPrefix(string(reply.Data), "S=") {
+		t.Fatalf("want success, got %+v", reply)
+	}
+	if done, err := at.c.Done(); !done || err != nil {
+		t.Errorf("authentication not complete: done=%v, err=%v", done, err)
+	}
+	if at.c.passwordHash != mschap.NTPasswordHash("clientPass") || len(at.c.ntResponse) != mschap.NTResponseLen {
+		t.Errorf("keying material not saved: %+v", at.c)
+	}
+	// Peer didn't get the Success message; it is resent.
+	if again := at.respond("user", "clientPass"); string(again.Data) != string(reply.Data) {
+		t.Errorf("wrong Success message resent: want %q, got %q", reply.Data, again.Data)
+	}
+
+	at = newAuthTest(t, CHAPMD5)
+	if reply := at.respond("user", "clientPass"); reply.Code != lcp.CHAPSuccess {
+		t.Fatalf("want success, got %+v", reply)
+	}
+}
+
+func TestAuthenticationFailure(t *testing.T) {
+	for _, test := range []struct {
+		algorithm      CHAPAlgorithm
+		name, password string
+		wantMsg        string
+	}{
+		{MSCHAPv2, "user", "wrongPass", fmt.Sprintf("E=691 R=0 C=%X V=3", "0123456789abcdef")},
+		{MSCHAPv2, "nobody", "clientPass", "E=691"},
+		{CHAPMD5, "user", "wrongPass", "Authentication failure"},
+	} {
+		at := newAuthTest(t, test.algorithm)
+		reply := at.respond(test.name, test.password)
+		if reply.Code != lcp.CHAPFailure || !strings.HasPrefix(string(reply.Data), test.wantMsg) {
+			t.Errorf("%+v: want failure, got %+v", test, reply)
+		}
+		if _, err := at.c.Done(); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("%+v: want ErrAuthenticationFailed, got %v", test, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package l2tp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	avpFlagMandatory = 0x8000
+	avpFlagHidden    = 0x4000
+	avpLengthMask    = 0x03ff
+	avpHeaderLength  = 6
+)
+
+// AttributeType identifies the type of an AVP.
+type AttributeType uint16
+
+// Attribute types, from RFC 2661. Only those used by this package are
+// listed.
+const (
+	AttrMessageType         AttributeType = 0
+	AttrResultCode          AttributeType = 1
+	AttrProtocolVersion     AttributeType = 2
+	AttrFramingCapabilities AttributeType = 3
+	AttrHostName            AttributeType = 7
+	AttrVendorName          AttributeType = 8
+	AttrAssignedTunnelID    AttributeType = 9
+	AttrChallenge           AttributeType = 11
+	AttrAssignedSessionID   AttributeType = 14
+	AttrCallSerialNumber    AttributeType = 15
+)
+
+var (
+	HiddenAVPError = errors.New("hidden AVPs are not supported")
+)
+
+// AVP is an attribute-value pair contained in an L2TP control message.
+type AVP struct {
+	Mandatory bool
+	VendorID  uint16
+	Type      AttributeType
+	Value     []byte
+}
+
+// Uint16 returns the value of the AVP as an integer.
+func (a *AVP) Uint16() (uint16, error) {
+	if len(a.Value) != 2 {
+		return 0, fmt.Errorf("AVP %d: want 2 byte value, got %d bytes", a.Type, len(a.Value))
+	}
+	return binary.BigEndian.Uint16(a.Value), nil
+}
+
+// Uint16AVP returns a mandatory AVP with a 16-bit integer value.
+func Uint16AVP(attrType AttributeType, value uint16) AVP {
+	result := AVP{Mandatory: true, Type: attrType, Value: []byte{0, 0}}
+	binary.BigEndian.PutUint16(result.Value, value)
+	return result
+}
+
+// EncodeAVPs returns the wire encoding of the given AVPs.
+func EncodeAVPs(avps []AVP) []byte {
+	result := []byte{}
+	for _, avp := range avps {
+		var hdr [avpHeaderLength]byte
+		flags := uint16(len(avp.Value) + avpHeaderLength)
+		if avp.Mandatory {
+			flags |= avpFlagMandatory
+		}
+		binary.BigEndian.PutUint16(hdr[0:2], flags)
+		binary.BigEndian.PutUint16(hdr[2:4], avp.VendorID)
+		binary.BigEndian.PutUint16(hdr[4:6], uint16(avp.Type))
+		result = append(result, hdr[:]...)
+		result = append(result, avp.Value...)
+	}
+	return result
+}
+
+// DecodeAVPs parses the AVPs in the payload of an L2TP control message.
+func DecodeAVPs(data []byte) ([]AVP, error) {
+	result := []AVP{}
+	for len(data) > 0 {
+		if len(data) < avpHeaderLength {
+			return nil, MessageTooShort
+		}
+		flags := binary.BigEndian.Uint16(data[0:2])
+		length := int(flags & avpLengthMask)
+		if length < avpHeaderLength || length > len(data) {
+			return nil, fmt.Errorf("AVP has invalid length %d", length)
+		}
+		if flags&avpFlagHidden != 0 {
+			return nil, HiddenAVPError
+		}
+		result = append(result, AVP{
+			Mandatory: flags&avpFlagMandatory != 0,
+			VendorID:  binary.BigEndian.Uint16(data[2:4]),
+			Type:      AttributeType(binary.BigEndian.Uint16(data[4:6])),
+			Value:     data[avpHeaderLength:length],
+		})
+		data = data[length:]
+	}
+	return result, nil
+}
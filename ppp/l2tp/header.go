@@ -0,0 +1,109 @@
+package l2tp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	flagType     = 0x8000
+	flagLength   = 0x4000
+	flagSequence = 0x0800
+	flagOffset   = 0x0200
+	versionMask  = 0x000f
+
+	version = 2
+)
+
+var (
+	MessageTooShort = errors.New("L2TP message too short")
+)
+
+// Header represents the header of an L2TP message, as defined in RFC 2661.
+// Control messages always include the length and sequence fields; data
+// messages sent by this package never do, but they are accepted if present.
+type Header struct {
+	IsControl           bool
+	HasSequence         bool
+	TunnelID, SessionID uint16
+	Ns, Nr              uint16
+}
+
+// Encode returns an L2TP message containing this header followed by the
+// given payload.
+func (h *Header) Encode(payload []byte) []byte {
+	var flags uint16 = version
+	result := []byte{0, 0}
+	if h.IsControl {
+		flags |= flagType | flagLength | flagSequence
+		result = append(result, 0, 0)
+	} else if h.HasSequence {
+		flags |= flagSequence
+	}
+	result = append(result, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(result[len(result)-4:], h.TunnelID)
+	binary.BigEndian.PutUint16(result[len(result)-2:], h.SessionID)
+	if flags&flagSequence != 0 {
+		result = append(result, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(result[len(result)-4:], h.Ns)
+		binary.BigEndian.PutUint16(result[len(result)-2:], h.Nr)
+	}
+	binary.BigEndian.PutUint16(result[0:2], flags)
+	result = append(result, payload...)
+	if flags&flagLength != 0 {
+		binary.BigEndian.PutUint16(result[2:4], uint16(len(result)))
+	}
+	return result
+}
+
+// Decode populates the header from the given L2TP message, returning the
+// payload that follows it.
+func (h *Header) Decode(data []byte) ([]byte, error) {
+	if len(data) < 6 {
+		return nil, MessageTooShort
+	}
+	flags := binary.BigEndian.Uint16(data[0:2])
+	if v := flags & versionMask; v != version {
+		return nil, fmt.Errorf("unsupported L2TP version %d", v)
+	}
+	h.IsControl = flags&flagType != 0
+	h.HasSequence = flags&flagSequence != 0
+	if h.IsControl && (flags&flagLength == 0 || !h.HasSequence) {
+		return nil, fmt.Errorf("control message without length and sequence fields")
+	}
+	offset := 2
+	if flags&flagLength != 0 {
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if length > len(data) {
+			return nil, MessageTooShort
+		}
+		data = data[:length]
+		offset += 2
+	}
+	if len(data) < offset+4 {
+		return nil, MessageTooShort
+	}
+	h.TunnelID = binary.BigEndian.Uint16(data[offset : offset+2])
+	h.SessionID = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+	offset += 4
+	h.Ns, h.Nr = 0, 0
+	if h.HasSequence {
+		if len(data) < offset+4 {
+			return nil, MessageTooShort
+		}
+		h.Ns = binary.BigEndian.Uint16(data[offset : offset+2])
+		h.Nr = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+		offset += 4
+	}
+	if flags&flagOffset != 0 {
+		if len(data) < offset+2 {
+			return nil, MessageTooShort
+		}
+		offset += 2 + int(binary.BigEndian.Uint16(data[offset:offset+2]))
+		if len(data) < offset {
+			return nil, MessageTooShort
+		}
+	}
+	return data[offset:], nil
+}
@@ -0,0 +1,124 @@
+package l2tp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	payload := []byte("payload")
+	for _, h := range []Header{
+		{IsControl: true, HasSequence: true, TunnelID: 1234, SessionID: 5678, Ns: 9, Nr: 65535},
+		{TunnelID: 1, SessionID: 2},
+		{HasSequence: true, TunnelID: 3, SessionID: 4, Ns: 5, Nr: 6},
+	} {
+		data := h.Encode(payload)
+		var h2 Header
+		got, err := h2.Decode(data)
+		if err != nil {
+			t.Errorf("failed to decode %+v: %v", h, err)
+			continue
+		}
+		if !reflect.DeepEqual(h, h2) {
+			t.Errorf("header mismatch: want %+v, got %+v", h, h2)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("payload mismatch: want %x, got %x", payload, got)
+		}
+	}
+}
+
+func TestHeaderControlEncoding(t *testing.T) {
+	h := &Header{IsControl: true, TunnelID: 0x1234, SessionID: 0x5678, Ns: 1, Nr: 2}
+	got := h.Encode([]byte{0xaa})
+	want := []byte{
+		0xc8, 0x02, // T, L, S flags; version 2
+		0x00, 0x0d, // length
+		0x12, 0x34, 0x56, 0x78, // tunnel, session
+		0x00, 0x01, 0x00, 0x02, // Ns, Nr
+		0xaa,
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("wrong encoding: want %x, got %x", want, got)
+	}
+}
+
+func TestHeaderDecodeOffset(t *testing.T) {
+	data := []byte{
+		0x02, 0x02, // O flag; version 2
+		0x00, 0x01, 0x00, 0x02, // tunnel, session
+		0x00, 0x02, 0xff, 0xff, // offset size and padding
+		0xff, 0x03,
+	}
+	var h Header
+	payload, err := h.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, []byte{0xff, 0x03}) {
+		t.Errorf("wrong payload: %x", payload)
+	}
+}
+
+func TestHeaderDecodeMalformed(t *testing.T) {
+	for _, data := range [][]byte{
+		{},
+		{0x00, 0x02, 0x00},
+		// Wrong version:
+		{0x00, 0x03, 0x00, 0x01, 0x00, 0x02},
+		// Control message without length or sequence fields:
+		{0x80, 0x02, 0x00, 0x01, 0x00, 0x02},
+		// Length field longer than message:
+		{0xc8, 0x02, 0x00, 0x20, 0x00, 0x01, 0x00, 0x02, 0, 0, 0, 0},
+		// Truncated sequence fields:
+		{0x08, 0x02, 0x00, 0x01, 0x00, 0x02, 0x00},
+		// Offset beyond end of message:
+		{0x02, 0x02, 0x00, 0x01, 0x00, 0x02, 0x00, 0x10},
+	} {
+		var h Header
+		if _, err := h.Decode(data); err == nil {
+			t.Errorf("malformed message %x decoded without error", data)
+		}
+	}
+}
+
+func TestAVPRoundTrip(t *testing.T) {
+	avps := []AVP{
+		Uint16AVP(AttrMessageType, msgSCCRQ),
+		{Type: AttrHostName, Value: []byte("example")},
+		{Mandatory: true, VendorID: 311, Type: 99, Value: []byte{}},
+	}
+	got, err := DecodeAVPs(EncodeAVPs(avps))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, avps) {
+		t.Errorf("AVP mismatch: want %+v, got %+v", avps, got)
+	}
+	if v, err := got[0].Uint16(); err != nil || v != msgSCCRQ {
+		t.Errorf("wrong message type: %d, %v", v, err)
+	}
+	if _, err := got[1].Uint16(); err == nil {
+		t.Errorf("Uint16 of non-integer AVP returned no error")
+	}
+}
+
+func TestAVPDecodeMalformed(t *testing.T) {
+	for _, data := range [][]byte{
+		// Truncated header:
+		{0x80, 0x08, 0x00},
+		// Length shorter than header:
+		{0x80, 0x04, 0x00, 0x00, 0x00, 0x00},
+		// Length longer than data:
+		{0x80, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01},
+	} {
+		if _, err := DecodeAVPs(data); err == nil {
+			t.Errorf("malformed AVPs %x decoded without error", data)
+		}
+	}
+	hidden := []byte{0xc0, 0x08, 0x00, 0x00, 0x00, 0x07, 0x12, 0x34}
+	if _, err := DecodeAVPs(hidden); err != HiddenAVPError {
+		t.Errorf("hidden AVP: want %v, got %v", HiddenAVPError, err)
+	}
+}
@@ -0,0 +1,668 @@
+// Package l2tp contains an implementation of an L2TP (RFC 2661) server that
+// carries PPP sessions over UDP, as an alternative to PPTP for connecting
+// machines to the IPX network. Like the pptp package, it is deliberately
+// limited in scope: there is no IPsec, tunnel authentication is not
+// supported, and only incoming calls can be made. PPP-level authentication
+// and MPPE encryption can be enabled in the same way as for PPTP.
+package l2tp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/ppp"
+)
+
+const (
+	// DefaultAddress is the address that the server listens on if none
+	// is configured.
+	DefaultAddress = ":1701"
+
+	// DefaultMaxTunnels is the maximum number of tunnels that can be
+	// open at once if Config.MaxTunnels is zero.
+	DefaultMaxTunnels = 64
+
+	// DefaultMaxSessions is the maximum number of sessions in each
+	// tunnel if Config.MaxSessions is zero.
+	DefaultMaxSessions = 4
+
+	// DefaultIdleTimeout is the time after which a tunnel is closed if
+	// nothing is received from the peer, if Config.IdleTimeout is zero.
+	DefaultIdleTimeout = 2 * time.Minute
+
+	retransmitInterval = 1 * time.Second
+	maxRetransmits     = 5
+	recvQueueSize      = 16
+)
+
+// Control message types.
+const (
+	msgSCCRQ   = 1
+	msgSCCRP   = 2
+	msgSCCCN   = 3
+	msgStopCCN = 4
+	msgHello   = 6
+	msgICRQ    = 10
+	msgICRP    = 11
+	msgICCN    = 12
+	msgCDN     = 14
+)
+
+// Result codes sent in StopCCN and CDN messages. The meaning of code 4
+// depends on the message type.
+const (
+	resultGeneralError   = 2
+	resultAdministrative = 3
+	resultNotAuthorized  = 4 // StopCCN
+	resultNoFacilities   = 4 // CDN
+)
+
+var _ = (io.ReadWriteCloser)(&session{})
+
+// Config contains configuration parameters for an L2TP server.
+type Config struct {
+	// Address to listen on, in the form accepted by net.ListenUDP. If
+	// empty, DefaultAddress is used.
+	Address string
+
+	// Maximum number of tunnels that can be open at once. Requests for
+	// new tunnels beyond this are ignored. If zero, DefaultMaxTunnels
+	// is used.
+	MaxTunnels int
+
+	// Maximum number of sessions in each tunnel. Further incoming calls
+	// are refused. If zero, DefaultMaxSessions is used.
+	MaxSessions int
+
+	// Tunnels are closed if nothing is received from the peer for this
+	// long. A Hello message is sent to the peer halfway through, which
+	// a live peer acknowledges. If zero, DefaultIdleTimeout is used.
+	IdleTimeout time.Duration
+
+	// PPP contains configuration for the PPP sessions, such as whether
+	// clients must authenticate and encrypt their traffic.
+	PPP ppp.Config
+}
+
+// Server is an implementation of an L2TP server.
+type Server struct {
+	conn         *net.UDPConn
+	n            network.Network
+	config       Config
+	mu           sync.Mutex
+	tunnels      map[uint16]*tunnel
+	nextTunnelID uint16
+}
+
+// sentMessage is a control message that has been sent but not yet
+// acknowledged by the peer.
+type sentMessage struct {
+	ns        uint16
+	sessionID uint16
+	payload   []byte
+	sendTime  time.Time
+	retries   int
+}
+
+// tunnel represents an L2TP control connection with a peer.
+type tunnel struct {
+	s             *Server
+	addr          *net.UDPAddr
+	id, peerID    uint16
+	mu            sync.Mutex
+	ns, nr        uint16
+	unacked       []*sentMessage
+	sessions      map[uint16]*session
+	nextSessionID uint16
+	closed        bool
+	lastRecvTime  time.Time
+	helloSent     bool
+}
+
+// session represents a PPP session carried inside a tunnel. It implements
+// io.ReadWriteCloser, reading and writing PPP frames.
+type session struct {
+	t          *tunnel
+	id, peerID uint16
+	recvQueue  chan []byte
+
+	// mu protects the fields below.
+	mu         sync.Mutex
+	closed     bool
+	peerClosed bool
+	ppp        *ppp.Session
+}
+
+// seqBefore returns true if sequence number a comes before b, allowing for
+// wraparound.
+func seqBefore(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func findAVP(avps []AVP, attrType AttributeType) (*AVP, bool) {
+	for i := range avps {
+		if avps[i].VendorID == 0 && avps[i].Type == attrType {
+			return &avps[i], true
+		}
+	}
+	return nil, false
+}
+
+// resultCodeAVP returns a Result Code AVP with the given result code.
+func resultCodeAVP(code uint16) AVP {
+	return Uint16AVP(AttrResultCode, code)
+}
+
+func (s *session) Read(p []byte) (int, error) {
+	frame, ok := <-s.recvQueue
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, frame), nil
+}
+
+func (s *session) Write(frame []byte) (int, error) {
+	h := &Header{TunnelID: s.t.peerID, SessionID: s.peerID}
+	if _, err := s.t.s.conn.WriteToUDP(h.Encode(frame), s.t.addr); err != nil {
+		return 0, err
+	}
+	return len(frame), nil
+}
+
+func (s *session) Close() error {
+	s.t.mu.Lock()
+	if s.t.sessions[s.id] == s {
+		delete(s.t.sessions, s.id)
+	}
+	s.t.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		close(s.recvQueue)
+		s.closed = true
+	}
+	return nil
+}
+
+// deliver places a received PPP frame onto the session's receive queue,
+// dropping it if the queue is full.
+func (s *session) deliver(frame []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.recvQueue <- frame:
+	default:
+	}
+}
+
+// run runs the PPP session until it terminates, then tells the peer that
+// the call has been disconnected if it does not already know.
+func (s *session) run(ctx context.Context, p *ppp.Session) {
+	p.Run(ctx)
+	p.Close()
+	s.mu.Lock()
+	peerClosed := s.peerClosed
+	s.mu.Unlock()
+	if !peerClosed {
+		s.t.sendControl(s.peerID, msgCDN,
+			resultCodeAVP(resultAdministrative),
+			Uint16AVP(AttrAssignedSessionID, s.id))
+	}
+}
+
+// transmit sends a control message to the peer. t.mu must be held.
+func (t *tunnel) transmit(sm *sentMessage) {
+	h := &Header{
+		IsControl: true,
+		TunnelID:  t.peerID,
+		SessionID: sm.sessionID,
+		Ns:        sm.ns,
+		Nr:        t.nr,
+	}
+	t.s.conn.WriteToUDP(h.Encode(sm.payload), t.addr)
+	sm.sendTime = time.Now()
+}
+
+// sendControl sends a new control message to the peer, which will be
+// retransmitted until it is acknowledged.
+func (t *tunnel) sendControl(sessionID uint16, msgType uint16, avps ...AVP) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	avps = append([]AVP{Uint16AVP(AttrMessageType, msgType)}, avps...)
+	sm := &sentMessage{
+		ns:        t.ns,
+		sessionID: sessionID,
+		payload:   EncodeAVPs(avps),
+	}
+	t.ns++
+	t.unacked = append(t.unacked, sm)
+	t.transmit(sm)
+}
+
+// sendZLB sends a Zero-Length Body message to acknowledge received control
+// messages when there is no other message to send. t.mu must be held.
+func (t *tunnel) sendZLB() {
+	h := &Header{
+		IsControl: true,
+		TunnelID:  t.peerID,
+		Ns:        t.ns,
+		Nr:        t.nr,
+	}
+	t.s.conn.WriteToUDP(h.Encode(nil), t.addr)
+}
+
+// ackReceived discards sent messages that have been acknowledged by the
+// peer. t.mu must be held.
+func (t *tunnel) ackReceived(nr uint16) {
+	unacked := []*sentMessage{}
+	for _, sm := range t.unacked {
+		if !seqBefore(sm.ns, nr) {
+			unacked = append(unacked, sm)
+		}
+	}
+	t.unacked = unacked
+}
+
+// retransmit runs as a background goroutine for the lifetime of the tunnel,
+// retransmitting control messages that have not been acknowledged. If the
+// peer stops responding, or nothing is received from it for the idle
+// timeout, the tunnel is closed.
+func (t *tunnel) retransmit(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			t.close()
+			return
+		case <-time.After(retransmitInterval):
+		}
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			return
+		}
+		idle := time.Since(t.lastRecvTime)
+		timedOut := idle >= t.s.config.IdleTimeout
+		sendHello := !t.helloSent && idle >= t.s.config.IdleTimeout/2
+		if sendHello {
+			t.helloSent = true
+		}
+		for _, sm := range t.unacked {
+			if timedOut {
+				break
+			}
+			if time.Since(sm.sendTime) < retransmitInterval {
+				continue
+			}
+			if sm.retries >= maxRetransmits {
+				timedOut = true
+				break
+			}
+			sm.retries++
+			t.transmit(sm)
+		}
+		t.mu.Unlock()
+		if timedOut {
+			t.close()
+			return
+		}
+		if sendHello {
+			t.sendControl(0, msgHello)
+		}
+	}
+}
+
+// close shuts down the tunnel and all sessions inside it.
+func (t *tunnel) close() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	sessions := []*session{}
+	for _, s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	t.mu.Unlock()
+	for _, s := range sessions {
+		s.closeSession()
+	}
+	t.s.mu.Lock()
+	delete(t.s.tunnels, t.id)
+	t.s.mu.Unlock()
+}
+
+// closeSession shuts down the session because the peer has disconnected
+// the call or the tunnel has been closed.
+func (s *session) closeSession() {
+	s.mu.Lock()
+	s.peerClosed = true
+	p := s.ppp
+	s.mu.Unlock()
+	if p != nil {
+		p.Close()
+	} else {
+		s.Close()
+	}
+}
+
+// stop closes the tunnel, sending a StopCCN message to the peer with the
+// given result code.
+func (t *tunnel) stop(resultCode uint16) {
+	t.sendControl(0, msgStopCCN,
+		Uint16AVP(AttrAssignedTunnelID, t.id),
+		resultCodeAVP(resultCode))
+	t.close()
+}
+
+func (t *tunnel) handleICRQ(avps []AVP) bool {
+	avp, ok := findAVP(avps, AttrAssignedSessionID)
+	if !ok {
+		return false
+	}
+	peerID, err := avp.Uint16()
+	if err != nil {
+		return false
+	}
+	t.mu.Lock()
+	if len(t.sessions) >= t.s.config.MaxSessions {
+		t.mu.Unlock()
+		t.sendControl(peerID, msgCDN,
+			resultCodeAVP(resultNoFacilities),
+			Uint16AVP(AttrAssignedSessionID, 0))
+		return true
+	}
+	for t.nextSessionID == 0 || t.sessions[t.nextSessionID] != nil {
+		t.nextSessionID++
+	}
+	s := &session{
+		t:         t,
+		id:        t.nextSessionID,
+		peerID:    peerID,
+		recvQueue: make(chan []byte, recvQueueSize),
+	}
+	t.sessions[s.id] = s
+	t.nextSessionID++
+	t.mu.Unlock()
+	t.sendControl(peerID, msgICRP, Uint16AVP(AttrAssignedSessionID, s.id))
+	return true
+}
+
+func (t *tunnel) handleICCN(ctx context.Context, sessionID uint16) bool {
+	t.mu.Lock()
+	s, ok := t.sessions[sessionID]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	if s.ppp != nil || s.closed {
+		s.mu.Unlock()
+		return false
+	}
+	node, err := t.s.n.NewNode()
+	if err != nil {
+		s.peerClosed = true
+		s.mu.Unlock()
+		s.Close()
+		t.sendControl(s.peerID, msgCDN,
+			resultCodeAVP(resultGeneralError),
+			Uint16AVP(AttrAssignedSessionID, s.id))
+		return true
+	}
+	p := ppp.NewSessionWithConfig(s, node, &t.s.config.PPP)
+	s.ppp = p
+	s.mu.Unlock()
+	go s.run(ctx, p)
+	return false
+}
+
+func (t *tunnel) handleCDN(sessionID uint16) {
+	t.mu.Lock()
+	s, ok := t.sessions[sessionID]
+	t.mu.Unlock()
+	if ok {
+		s.closeSession()
+	}
+}
+
+// processControl processes a control message received from the peer.
+func (t *tunnel) processControl(ctx context.Context, h *Header, payload []byte) {
+	t.mu.Lock()
+	t.ackReceived(h.Nr)
+	if len(payload) == 0 {
+		// Zero-Length Body; only an acknowledgement.
+		t.mu.Unlock()
+		return
+	}
+	if h.Ns != t.nr {
+		// Retransmission of a message we have already received,
+		// possibly because our acknowledgement was lost, or a
+		// message received out of order, which is discarded.
+		if seqBefore(h.Ns, t.nr) {
+			t.sendZLB()
+		}
+		t.mu.Unlock()
+		return
+	}
+	t.nr++
+	t.mu.Unlock()
+
+	replied := false
+	avps, err := DecodeAVPs(payload)
+	if err == nil && len(avps) > 0 && avps[0].Type == AttrMessageType {
+		msgType, _ := avps[0].Uint16()
+		switch msgType {
+		case msgStopCCN:
+			t.mu.Lock()
+			t.sendZLB()
+			t.mu.Unlock()
+			t.close()
+			return
+		case msgICRQ:
+			replied = t.handleICRQ(avps)
+		case msgICCN:
+			replied = t.handleICCN(ctx, h.SessionID)
+		case msgCDN:
+			t.handleCDN(h.SessionID)
+		}
+	}
+	if !replied {
+		t.mu.Lock()
+		t.sendZLB()
+		t.mu.Unlock()
+	}
+}
+
+// processData processes a data message received from the peer.
+func (t *tunnel) processData(h *Header, payload []byte) {
+	t.mu.Lock()
+	s, ok := t.sessions[h.SessionID]
+	t.mu.Unlock()
+	if ok {
+		s.deliver(payload)
+	}
+}
+
+// newTunnel is called when a control message is received that is not for
+// any existing tunnel. It must be a request to start a new one.
+func (s *Server) newTunnel(ctx context.Context, h *Header, payload []byte, addr *net.UDPAddr) {
+	avps, err := DecodeAVPs(payload)
+	if err != nil || len(avps) == 0 || h.Ns != 0 {
+		return
+	}
+	if msgType, _ := avps[0].Uint16(); avps[0].Type != AttrMessageType || msgType != msgSCCRQ {
+		return
+	}
+	avp, ok := findAVP(avps, AttrAssignedTunnelID)
+	if !ok {
+		return
+	}
+	peerID, err := avp.Uint16()
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	for _, t := range s.tunnels {
+		if t.peerID == peerID && t.addr.String() == addr.String() {
+			// Retransmitted SCCRQ for a tunnel we already
+			// created; our SCCRP will be retransmitted too.
+			s.mu.Unlock()
+			return
+		}
+	}
+	if len(s.tunnels) >= s.config.MaxTunnels {
+		s.mu.Unlock()
+		return
+	}
+	for s.nextTunnelID == 0 || s.tunnels[s.nextTunnelID] != nil {
+		s.nextTunnelID++
+	}
+	t := &tunnel{
+		s:            s,
+		addr:         addr,
+		id:           s.nextTunnelID,
+		peerID:       peerID,
+		nr:           1,
+		sessions:     map[uint16]*session{},
+		lastRecvTime: time.Now(),
+	}
+	s.tunnels[t.id] = t
+	s.nextTunnelID++
+	s.mu.Unlock()
+
+	go t.retransmit(ctx)
+	if _, ok := findAVP(avps, AttrChallenge); ok {
+		// The peer wants to authenticate the tunnel, but we have
+		// no shared secret to do so with.
+		t.stop(resultNotAuthorized)
+		return
+	}
+	t.sendControl(0, msgSCCRP,
+		Uint16AVP(AttrProtocolVersion, 0x0100),
+		AVP{Mandatory: true, Type: AttrFramingCapabilities, Value: []byte{0, 0, 0, 3}},
+		AVP{Mandatory: true, Type: AttrHostName, Value: []byte("ipxbox")},
+		AVP{Type: AttrVendorName, Value: []byte("ipxbox")},
+		Uint16AVP(AttrAssignedTunnelID, t.id))
+}
+
+func (s *Server) processMessage(ctx context.Context, data []byte, addr *net.UDPAddr) {
+	var h Header
+	payload, err := h.Decode(data)
+	if err != nil {
+		return
+	}
+	if h.TunnelID == 0 {
+		if h.IsControl {
+			s.newTunnel(ctx, &h, payload, addr)
+		}
+		return
+	}
+	s.mu.Lock()
+	t, ok := s.tunnels[h.TunnelID]
+	s.mu.Unlock()
+	if !ok || t.addr.String() != addr.String() {
+		return
+	}
+	t.mu.Lock()
+	t.lastRecvTime = time.Now()
+	t.helloSent = false
+	t.mu.Unlock()
+	if h.IsControl {
+		t.processControl(ctx, &h, payload)
+	} else {
+		t.processData(&h, payload)
+	}
+}
+
+// Run receives and processes L2TP messages. It blocks until the server is
+// shut down, so it should be invoked in a dedicated goroutine. If the server
+// is shut down by calling Close, nil is returned; otherwise the error that
+// caused it to stop is returned.
+func (s *Server) Run(ctx context.Context) error {
+	var buf [4096]byte
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf[:])
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error receiving L2TP message: %w", err)
+		}
+		data := append([]byte{}, buf[:n]...)
+		s.processMessage(ctx, data, addr)
+	}
+}
+
+// Addr returns the address that the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close shuts down the server and all tunnels.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	tunnels := []*tunnel{}
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	s.mu.Unlock()
+	for _, t := range tunnels {
+		t.stop(resultAdministrative)
+	}
+	return s.conn.Close()
+}
+
+// NewServer creates a new L2TP server with the default configuration, where
+// clients are connected to the given network.
+func NewServer(n network.Network) (*Server, error) {
+	return NewServerWithConfig(n, &Config{})
+}
+
+// NewServerWithConfig creates a new L2TP server, where clients are connected
+// to the given network.
+func NewServerWithConfig(n network.Network, config *Config) (*Server, error) {
+	if config.PPP.Encryption != 0 && config.PPP.Authenticator == nil {
+		return nil, ppp.ErrEncryptionNeedsAuth
+	}
+	c := *config
+	if c.MaxTunnels == 0 {
+		c.MaxTunnels = DefaultMaxTunnels
+	}
+	if c.MaxSessions == 0 {
+		c.MaxSessions = DefaultMaxSessions
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = DefaultIdleTimeout
+	}
+	address := c.Address
+	if address == "" {
+		address = DefaultAddress
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for L2TP messages on %s: %w", address, err)
+	}
+	return &Server{
+		conn:    conn,
+		n:       n,
+		config:  c,
+		tunnels: map[uint16]*tunnel{},
+	}, nil
+}
@@ -0,0 +1,486 @@
+package l2tp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/ppp"
+	"github.com/fragglet/ipxbox/ppp/lcp"
+	"github.com/fragglet/ipxbox/ppp/mppe"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	clientTunnelID  = 7
+	clientSessionID = 9
+)
+
+// testClient is a minimal L2TP client (LAC) used to exercise the server.
+type testClient struct {
+	t                   *testing.T
+	conn                *net.UDPConn
+	tunnelID, sessionID uint16
+	ns, nr              uint16
+}
+
+func newTestClient(t *testing.T, s *Server) *testClient {
+	conn, err := net.DialUDP("udp", nil, s.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to connect to server: %v", err)
+	}
+	return &testClient{t: t, conn: conn}
+}
+
+func (c *testClient) recv() (*Header, []byte) {
+	c.t.Helper()
+	var buf [1500]byte
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.conn.Read(buf[:])
+	if err != nil {
+		c.t.Fatalf("failed to receive message: %v", err)
+	}
+	h := &Header{}
+	payload, err := h.Decode(buf[:n])
+	if err != nil {
+		c.t.Fatalf("failed to decode message %x: %v", buf[:n], err)
+	}
+	if h.TunnelID != clientTunnelID {
+		c.t.Fatalf("message sent with wrong tunnel ID: want %d, got %d", clientTunnelID, h.TunnelID)
+	}
+	return h, payload
+}
+
+func (c *testClient) sendControl(sessionID uint16, msgType uint16, avps ...AVP) {
+	h := &Header{
+		IsControl: true,
+		TunnelID:  c.tunnelID,
+		SessionID: sessionID,
+		Ns:        c.ns,
+		Nr:        c.nr,
+	}
+	avps = append([]AVP{Uint16AVP(AttrMessageType, msgType)}, avps...)
+	c.conn.Write(h.Encode(EncodeAVPs(avps)))
+	c.ns++
+}
+
+// expectControl waits for a control message of the given type, skipping
+// any acknowledgements, and returns its AVPs.
+func (c *testClient) expectControl(msgType uint16) []AVP {
+	c.t.Helper()
+	for {
+		h, payload := c.recv()
+		if !h.IsControl || len(payload) == 0 {
+			continue
+		}
+		if h.Ns != c.nr {
+			c.t.Fatalf("wrong sequence number: want %d, got %d", c.nr, h.Ns)
+		}
+		c.nr++
+		avps, err := DecodeAVPs(payload)
+		if err != nil {
+			c.t.Fatalf("failed to decode AVPs: %v", err)
+		}
+		if got, _ := avps[0].Uint16(); got != msgType {
+			c.t.Fatalf("wrong message type: want %d, got %d", msgType, got)
+		}
+		return avps
+	}
+}
+
+func (c *testClient) assignedID(avps []AVP, attrType AttributeType) uint16 {
+	c.t.Helper()
+	avp, ok := findAVP(avps, attrType)
+	if !ok {
+		c.t.Fatalf("AVP %d missing from %+v", attrType, avps)
+	}
+	id, err := avp.Uint16()
+	if err != nil || id == 0 {
+		c.t.Fatalf("bad assigned ID: %d, %v", id, err)
+	}
+	return id
+}
+
+// connect establishes a tunnel and a session inside it.
+func (c *testClient) connect() {
+	c.sendControl(0, msgSCCRQ,
+		Uint16AVP(AttrProtocolVersion, 0x0100),
+		AVP{Mandatory: true, Type: AttrHostName, Value: []byte("client")},
+		AVP{Mandatory: true, Type: AttrFramingCapabilities, Value: []byte{0, 0, 0, 3}},
+		Uint16AVP(AttrAssignedTunnelID, clientTunnelID))
+	avps := c.expectControl(msgSCCRP)
+	c.tunnelID = c.assignedID(avps, AttrAssignedTunnelID)
+	c.sendControl(0, msgSCCCN)
+	c.sendControl(0, msgICRQ,
+		Uint16AVP(AttrAssignedSessionID, clientSessionID),
+		AVP{Mandatory: true, Type: AttrCallSerialNumber, Value: []byte{0, 0, 0, 1}})
+	avps = c.expectControl(msgICRP)
+	c.sessionID = c.assignedID(avps, AttrAssignedSessionID)
+	c.sendControl(c.sessionID, msgICCN)
+}
+
+func (c *testClient) sendPPP(pppType layers.PPPType, payload []byte) {
+	frame := []byte{0xff, 0x03, byte(pppType >> 8), byte(pppType)}
+	h := &Header{TunnelID: c.tunnelID, SessionID: c.sessionID}
+	c.conn.Write(h.Encode(append(frame, payload...)))
+}
+
+func (c *testClient) sendLCP(pppType layers.PPPType, msgType lcp.MessageType, id uint8, opts []lcp.Option) {
+	c.t.Helper()
+	l := &lcp.LCP{
+		Type:       msgType,
+		Identifier: id,
+		Data:       &lcp.ConfigureData{Options: opts},
+	}
+	data, err := l.MarshalBinary()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.sendPPP(pppType, data)
+}
+
+// recvLCP waits for the next LCP or IPXCP message sent over the session.
+func (c *testClient) recvLCP() (layers.PPPType, *lcp.LCP) {
+	c.t.Helper()
+	for {
+		h, payload := c.recv()
+		if h.IsControl {
+			continue
+		}
+		if h.SessionID != clientSessionID {
+			c.t.Fatalf("data message with wrong session ID: want %d, got %d", clientSessionID, h.SessionID)
+		}
+		if len(payload) < 4 || payload[0] != 0xff || payload[1] != 0x03 {
+			c.t.Fatalf("bad PPP frame: %x", payload)
+		}
+		pppType := layers.PPPType(payload[2])<<8 | layers.PPPType(payload[3])
+		if pppType != lcp.PPPTypeLCP && pppType != lcp.PPPTypeIPXCP {
+			continue
+		}
+		l := &lcp.LCP{}
+		if err := l.UnmarshalBinary(payload[4:]); err != nil {
+			c.t.Fatalf("failed to decode LCP message: %v", err)
+		}
+		return pppType, l
+	}
+}
+
+// negotiate runs LCP and IPXCP negotiation with the server, returning the
+// node address assigned by the server.
+func (c *testClient) negotiate() ipx.Addr {
+	c.t.Helper()
+	var addr ipx.Addr
+	done := map[string]bool{}
+	c.sendLCP(lcp.PPPTypeLCP, lcp.ConfigureRequest, 1, []lcp.Option{
+		{Type: lcp.OptionMagicNumber, Data: []byte{1, 2, 3, 4}},
+	})
+	for len(done) < 4 {
+		pppType, l := c.recvLCP()
+		switch l.Type {
+		case lcp.ConfigureRequest:
+			opts := l.Data.(*lcp.ConfigureData).Options
+			c.sendLCP(pppType, lcp.ConfigureAck, l.Identifier, opts)
+			if pppType == lcp.PPPTypeIPXCP && !done["server ipxcp"] {
+				// Ask to be assigned a node address.
+				c.sendLCP(pppType, lcp.ConfigureRequest, 1, []lcp.Option{
+					{Type: lcp.OptionIPXNode, Data: make([]byte, 6)},
+				})
+			}
+			done["server "+pppTypeName(pppType)] = true
+		case lcp.ConfigureNak:
+			opts := l.Data.(*lcp.ConfigureData).Options
+			if pppType != lcp.PPPTypeIPXCP || len(opts) != 1 || opts[0].Type != lcp.OptionIPXNode {
+				c.t.Fatalf("unexpected Configure-Nak: %+v", l)
+			}
+			copy(addr[:], opts[0].Data)
+			c.sendLCP(pppType, lcp.ConfigureRequest, l.Identifier+1, opts)
+		case lcp.ConfigureAck:
+			done["client "+pppTypeName(pppType)] = true
+		default:
+			c.t.Fatalf("unexpected message during negotiation: %+v", l)
+		}
+	}
+	return addr
+}
+
+func pppTypeName(pppType layers.PPPType) string {
+	if pppType == lcp.PPPTypeIPXCP {
+		return "ipxcp"
+	}
+	return "lcp"
+}
+
+func TestPPPSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan *ipx.Packet, 1)
+	nodeAddr := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	n := &ipxtesting.FakeNetwork{
+		Inner: ipxtesting.MakeCallbackDest(func(pkt *ipx.Packet) {
+			received <- pkt
+		}),
+		Address: nodeAddr,
+	}
+	s, err := NewServerWithConfig(n, &Config{Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+
+	c := newTestClient(t, s)
+	c.connect()
+	if got := c.negotiate(); got != nodeAddr {
+		t.Errorf("wrong node address assigned: want %v, got %v", nodeAddr, got)
+	}
+
+	want := ipxtesting.TestPackets[0]
+	data, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.sendPPP(ppp.PPPTypeIPX, data)
+	select {
+	case got := <-received:
+		gotData, _ := got.MarshalBinary()
+		if !bytes.Equal(gotData, data) {
+			t.Errorf("wrong packet received: want %+v, got %+v", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("IPX packet sent over L2TP was not received")
+	}
+
+	// Disconnecting the call closes the session.
+	c.sendControl(c.sessionID, msgCDN,
+		Uint16AVP(AttrResultCode, 1),
+		Uint16AVP(AttrAssignedSessionID, clientSessionID))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		tun := s.tunnels[c.tunnelID]
+		s.mu.Unlock()
+		tun.mu.Lock()
+		numSessions := len(tun.sessions)
+		tun.mu.Unlock()
+		if numSessions == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("session not closed after CDN")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// rejectAll is a ppp.Authenticator that accepts no users.
+type rejectAll struct{}
+
+func (rejectAll) CheckPassword(string, *ppp.Challenge, []byte) ([16]byte, bool) {
+	return [16]byte{}, false
+}
+
+func TestPPPAuthentication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewServerWithConfig(&ipxtesting.FakeNetwork{}, &Config{
+		Address: "127.0.0.1:0",
+		PPP:     ppp.Config{Authenticator: rejectAll{}},
+	})
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+
+	c := newTestClient(t, s)
+	c.connect()
+	c.sendLCP(lcp.PPPTypeLCP, lcp.ConfigureRequest, 1, []lcp.Option{
+		{Type: lcp.OptionMagicNumber, Data: []byte{1, 2, 3, 4}},
+	})
+	for {
+		pppType, l := c.recvLCP()
+		if pppType != lcp.PPPTypeLCP || l.Type != lcp.ConfigureRequest {
+			continue
+		}
+		for _, opt := range l.Data.(*lcp.ConfigureData).Options {
+			if opt.Type == lcp.OptionAuthProtocol {
+				return
+			}
+		}
+		t.Fatalf("server did not request authentication: %+v", l)
+	}
+}
+
+func TestEncryptionNeedsAuth(t *testing.T) {
+	_, err := NewServerWithConfig(&ipxtesting.FakeNetwork{}, &Config{
+		Address: "127.0.0.1:0",
+		PPP:     ppp.Config{Encryption: mppe.Strength128},
+	})
+	if err != ppp.ErrEncryptionNeedsAuth {
+		t.Errorf("want error %v, got %v", ppp.ErrEncryptionNeedsAuth, err)
+	}
+}
+
+func TestChallengeRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewServerWithConfig(&ipxtesting.FakeNetwork{}, &Config{Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+
+	c := newTestClient(t, s)
+	c.sendControl(0, msgSCCRQ,
+		Uint16AVP(AttrProtocolVersion, 0x0100),
+		Uint16AVP(AttrAssignedTunnelID, clientTunnelID),
+		AVP{Mandatory: true, Type: AttrChallenge, Value: []byte("challenge")})
+	avps := c.expectControl(msgStopCCN)
+	avp, ok := findAVP(avps, AttrResultCode)
+	if !ok {
+		t.Fatalf("StopCCN has no result code: %+v", avps)
+	}
+	if code, _ := avp.Uint16(); code != resultNotAuthorized {
+		t.Errorf("wrong result code: want %d, got %d", resultNotAuthorized, code)
+	}
+}
+
+func TestRunReturnsOnClose(t *testing.T) {
+	s, err := NewServerWithConfig(&ipxtesting.FakeNetwork{}, &Config{Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Run(context.Background())
+	}()
+	s.Close()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Run returned error after Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after Close")
+	}
+}
+
+// expectNothing checks that no message is received from the server for a
+// short time, other than acknowledgements.
+func (c *testClient) expectNothing() {
+	c.t.Helper()
+	var buf [1500]byte
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := c.conn.Read(buf[:])
+		if err != nil {
+			return
+		}
+		h := &Header{}
+		if payload, err := h.Decode(buf[:n]); err != nil || len(payload) > 0 {
+			c.t.Fatalf("unexpected message received: %x", buf[:n])
+		}
+	}
+}
+
+func TestMaxTunnels(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewServerWithConfig(&ipxtesting.FakeNetwork{}, &Config{
+		Address:    "127.0.0.1:0",
+		MaxTunnels: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+
+	for i, want := range []bool{true, false} {
+		c := newTestClient(t, s)
+		c.sendControl(0, msgSCCRQ,
+			Uint16AVP(AttrProtocolVersion, 0x0100),
+			Uint16AVP(AttrAssignedTunnelID, clientTunnelID))
+		if want {
+			c.expectControl(msgSCCRP)
+		} else {
+			c.expectNothing()
+		}
+		s.mu.Lock()
+		numTunnels := len(s.tunnels)
+		s.mu.Unlock()
+		if numTunnels != 1 {
+			t.Errorf("after %d tunnel requests: want 1 tunnel, got %d", i+1, numTunnels)
+		}
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewServerWithConfig(&ipxtesting.FakeNetwork{}, &Config{
+		Address:     "127.0.0.1:0",
+		MaxSessions: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+
+	c := newTestClient(t, s)
+	c.connect()
+	c.sendControl(0, msgICRQ,
+		Uint16AVP(AttrAssignedSessionID, clientSessionID+1),
+		AVP{Mandatory: true, Type: AttrCallSerialNumber, Value: []byte{0, 0, 0, 2}})
+	avps := c.expectControl(msgCDN)
+	avp, ok := findAVP(avps, AttrResultCode)
+	if !ok {
+		t.Fatalf("CDN has no result code: %+v", avps)
+	}
+	if code, _ := avp.Uint16(); code != resultNoFacilities {
+		t.Errorf("wrong result code: want %d, got %d", resultNoFacilities, code)
+	}
+}
+
+func TestIdleTunnelTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewServerWithConfig(&ipxtesting.FakeNetwork{}, &Config{
+		Address:     "127.0.0.1:0",
+		IdleTimeout: 2 * retransmitInterval,
+	})
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+
+	c := newTestClient(t, s)
+	c.sendControl(0, msgSCCRQ,
+		Uint16AVP(AttrProtocolVersion, 0x0100),
+		Uint16AVP(AttrAssignedTunnelID, clientTunnelID))
+	avps := c.expectControl(msgSCCRP)
+	c.tunnelID = c.assignedID(avps, AttrAssignedTunnelID)
+	c.sendControl(0, msgSCCCN)
+
+	// The server checks that the peer is still there before closing
+	// the tunnel.
+	c.expectControl(msgHello)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		numTunnels := len(s.tunnels)
+		s.mu.Unlock()
+		if numTunnels == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("idle tunnel not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,21 @@
+package lcp
+
+import (
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// PPPTypeCCP is the Compression Control Protocol (RFC 1962), which
+	// uses the same message format as LCP.
+	PPPTypeCCP = layers.PPPType(0x80fd)
+
+	// PPPTypeCompressed is the protocol number of compressed (or for
+	// MPPE, encrypted) datagrams.
+	PPPTypeCompressed = layers.PPPType(0x00fd)
+)
+
+// CCP options.
+var (
+	// OptionMPPE negotiates MPPE encryption (RFC 3078).
+	OptionMPPE = OptionType(18)
+)
@@ -0,0 +1,116 @@
+package lcp
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const PPPTypeCHAP = layers.PPPType(0xc223)
+
+var (
+	LayerTypeCHAP = gopacket.RegisterLayerType(1819, gopacket.LayerTypeMetadata{
+		Name:    "CHAP",
+		Decoder: gopacket.DecodeFunc(decodeCHAP),
+	})
+
+	// Values of OptionAuthProtocol that request CHAP authentication
+	// with MD5 (RFC 1994) and MS-CHAPv2 (RFC 2759).
+	AuthProtocolCHAPMD5  = []byte{0xc2, 0x23, 0x05}
+	AuthProtocolMSCHAPv2 = []byte{0xc2, 0x23, 0x81}
+)
+
+var _ = gopacket.SerializableLayer(&CHAP{})
+
+type CHAPCode uint8
+
+// CHAP message codes, from RFC 1994.
+const (
+	CHAPChallenge CHAPCode = iota + 1
+	CHAPResponse
+	CHAPSuccess
+	CHAPFailure
+)
+
+// CHAPValue contains the data of Challenge and Response messages: a value
+// (whose meaning depends on the CHAP algorithm) followed by a name.
+type CHAPValue struct {
+	Value []byte
+	Name  string
+}
+
+func (v *CHAPValue) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return MessageTooShort
+	}
+	v.Value = data[1 : 1+data[0]]
+	v.Name = string(data[1+data[0]:])
+	return nil
+}
+
+func (v *CHAPValue) MarshalBinary() ([]byte, error) {
+	result := []byte{byte(len(v.Value))}
+	result = append(result, v.Value...)
+	result = append(result, v.Name...)
+	return result, nil
+}
+
+// CHAP is a gopacket layer for the PPP Challenge Handshake Authentication
+// Protocol. The format of Data depends on Code: for Challenge and Response
+// messages it can be decoded as a CHAPValue, while for Success and Failure
+// it is a message.
+type CHAP struct {
+	layers.BaseLayer
+	Code       CHAPCode
+	Identifier uint8
+	Data       []byte
+}
+
+func (c *CHAP) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return MessageTooShort
+	}
+	lenField := int(binary.BigEndian.Uint16(data[2:4]))
+	if lenField < 4 || lenField > len(data) {
+		return MessageTooShort
+	}
+	c.Code = CHAPCode(data[0])
+	c.Identifier = data[1]
+	c.Data = data[4:lenField]
+	c.Contents = data
+	c.Payload = nil
+	return nil
+}
+
+func (c *CHAP) MarshalBinary() ([]byte, error) {
+	result := []byte{byte(c.Code), c.Identifier, 0, 0}
+	binary.BigEndian.PutUint16(result[2:4], uint16(len(c.Data)+4))
+	return append(result, c.Data...), nil
+}
+
+func (c *CHAP) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	src, err := c.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	dest, err := b.PrependBytes(len(src))
+	if err != nil {
+		return err
+	}
+	copy(dest, src)
+	return nil
+}
+
+func (c *CHAP) LayerType() gopacket.LayerType {
+	return LayerTypeCHAP
+}
+
+func decodeCHAP(data []byte, p gopacket.PacketBuilder) error {
+	c := &CHAP{}
+	if err := c.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	p.AddLayer(c)
+	return nil
+}
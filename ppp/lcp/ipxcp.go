@@ -6,6 +6,7 @@ import (
 
 const PPPTypeIPXCP = layers.PPPType(0x802B)
 
+// IPXCP options, from RFC 1552.
 var (
 	OptionIPXNetwork               = OptionType(1)
 	OptionIPXNode                  = OptionType(2)
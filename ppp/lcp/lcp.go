@@ -15,6 +15,7 @@ const PPPTypeLCP = layers.PPPType(0xc021)
 
 var (
 	MessageTooShort = errors.New("LCP message too short")
+	BadOptionLength = errors.New("LCP option has invalid length")
 
 	LayerTypeLCP = gopacket.RegisterLayerType(1818, gopacket.LayerTypeMetadata{
 		Name:    "LCP",
@@ -79,6 +80,9 @@ func (d *ConfigureData) UnmarshalBinary(data []byte) error {
 		}
 		optType := OptionType(data[0])
 		optLen := data[1]
+		if optLen < 2 {
+			return BadOptionLength
+		}
 		if int(optLen) > len(data) {
 			return MessageTooShort
 		}
@@ -254,4 +258,12 @@ func init() {
 		DecodeWith: gopacket.DecodeFunc(decodeLCP),
 		Name:       "IPXCP",
 	}
+	layers.PPPTypeMetadata[PPPTypeCCP] = layers.EnumMetadata{
+		DecodeWith: gopacket.DecodeFunc(decodeLCP),
+		Name:       "CCP",
+	}
+	layers.PPPTypeMetadata[PPPTypeCHAP] = layers.EnumMetadata{
+		DecodeWith: gopacket.DecodeFunc(decodeCHAP),
+		Name:       "CHAP",
+	}
 }
@@ -0,0 +1,61 @@
+package lcp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+func TestIPXCPOptions(t *testing.T) {
+	l := &LCP{
+		Type:       ConfigureRequest,
+		Identifier: 7,
+		Data: &ConfigureData{
+			Options: []Option{
+				{Type: OptionIPXNetwork, Data: []byte{0, 0, 0, 0}},
+				{Type: OptionIPXNode, Data: []byte{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}},
+				{Type: OptionIPXConfigurationComplete, Data: []byte{}},
+			},
+		},
+	}
+	encoded, err := l.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0x01, 0x07, 0x00, 0x14, // Configure-Request, id 7, length 20
+		0x01, 0x06, 0x00, 0x00, 0x00, 0x00, // IPX-Network
+		0x02, 0x08, 0x02, 0x11, 0x22, 0x33, 0x44, 0x55, // IPX-Node
+		0x06, 0x02, // IPX-Configuration-Complete
+	}
+	if !bytes.Equal(encoded, want) {
+		t.Errorf("wrong encoding:\nwant: %x\ngot:  %x", want, encoded)
+	}
+
+	pkt := gopacket.NewPacket(encoded, LayerTypeLCP, gopacket.Default)
+	decoded, ok := pkt.Layer(LayerTypeLCP).(*LCP)
+	if !ok {
+		t.Fatalf("failed to decode: %v", pkt.ErrorLayer())
+	}
+	if decoded.Type != l.Type || decoded.Identifier != l.Identifier {
+		t.Errorf("wrong header decoded: %+v", decoded)
+	}
+	if !reflect.DeepEqual(decoded.Data, l.Data) {
+		t.Errorf("wrong options decoded: want %+v, got %+v", l.Data, decoded.Data)
+	}
+}
+
+func TestBadOptionLength(t *testing.T) {
+	for _, data := range [][]byte{
+		{0x01, 0x00},             // length too short
+		{0x01, 0x06, 0x00, 0x00}, // length past end of data
+		{0x01},                   // truncated option header
+	} {
+		var cd ConfigureData
+		if err := cd.UnmarshalBinary(data); err == nil {
+			t.Errorf("malformed options %x decoded as %+v", data, cd.Options)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Package mppe implements Microsoft Point-to-Point Encryption (MPPE), as
+// defined in RFC 3078, using keys derived from MS-CHAPv2 authentication as
+// defined in RFC 3079. Only stateless mode is supported, where the key is
+// changed for every packet; this is the default used by pppd, and is
+// supported by the Windows built-in VPN clients.
+package mppe
+
+import (
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fragglet/ipxbox/ppp/mschap"
+)
+
+// Strengths is a set of MPPE key strengths. The values are the bits that
+// represent them in the MPPE CCP option.
+type Strengths uint32
+
+const (
+	Strength40  Strengths = 0x20
+	Strength56  Strengths = 0x80
+	Strength128 Strengths = 0x40
+
+	AllStrengths = Strength40 | Strength56 | Strength128
+)
+
+const (
+	// Other bits in the CCP option: stateless mode, the obsolete D bit,
+	// and MPPC compression.
+	bitStateless = 0x01000000
+	bitObsolete  = 0x10
+	bitMPPC      = 0x01
+
+	// Flags in the header of an MPPE packet.
+	flagFlushed   = 0x8000
+	flagEncrypted = 0x1000
+
+	ccountSpace = 0x1000
+	headerLen   = 2
+)
+
+var (
+	ErrTooShort     = errors.New("MPPE packet too short")
+	ErrNotEncrypted = errors.New("MPPE packet is not encrypted")
+	ErrLatePacket   = errors.New("MPPE packet received out of order")
+
+	masterKeyMagic = []byte("This is the MPPE Master Key")
+	// The naming is from the client's point of view; these are the
+	// server's receive and send keys respectively.
+	clientSendKeyMagic = []byte("On the client side, this is the send key; on the server side, it is the receive key.")
+	clientRecvKeyMagic = []byte("On the client side, this is the receive key; on the server side, it is the send key.")
+
+	shaPad1 = make([]byte, 40)
+	shaPad2 = []byte(strings.Repeat("\xf2", 40))
+)
+
+// ParseStrengths parses a comma-separated list of key strengths in bits,
+// such as "40,128".
+func ParseStrengths(s string) (Strengths, error) {
+	var result Strengths
+	for _, field := range strings.Split(s, ",") {
+		bits, err := strconv.Atoi(strings.TrimSpace(field))
+		switch {
+		case err == nil && bits == 40:
+			result |= Strength40
+		case err == nil && bits == 56:
+			result |= Strength56
+		case err == nil && bits == 128:
+			result |= Strength128
+		default:
+			return 0, fmt.Errorf("invalid MPPE key strength %q: must be 40, 56 or 128", field)
+		}
+	}
+	return result, nil
+}
+
+// Strongest returns the strongest key strength in the set, or zero if the
+// set is empty.
+func (s Strengths) Strongest() Strengths {
+	for _, strength := range []Strengths{Strength128, Strength56, Strength40} {
+		if s&strength != 0 {
+			return strength
+		}
+	}
+	return 0
+}
+
+func (s Strengths) keyLen() int {
+	if s == Strength128 {
+		return 16
+	}
+	return 8
+}
+
+// OptionValue returns the value of the CCP option requesting stateless MPPE
+// with any of the given key strengths.
+func OptionValue(s Strengths) []byte {
+	var result [4]byte
+	binary.BigEndian.PutUint32(result[:], bitStateless|uint32(s&AllStrengths))
+	return result[:]
+}
+
+// OfferedStrengths returns the key strengths in the value of an MPPE CCP
+// option, ignoring any other bits. It is used to choose a strength to
+// suggest to a peer that has requested an unacceptable value.
+func OfferedStrengths(value []byte) Strengths {
+	if len(value) != 4 {
+		return 0
+	}
+	return Strengths(binary.BigEndian.Uint32(value)) & AllStrengths
+}
+
+// ParseOption parses the value of an MPPE CCP option, returning the key
+// strengths it contains. False is returned if the value is invalid or
+// requests something other than stateless MPPE.
+func ParseOption(value []byte) (Strengths, bool) {
+	if len(value) != 4 {
+		return 0, false
+	}
+	bits := binary.BigEndian.Uint32(value)
+	if bits&bitStateless == 0 || bits&^(bitStateless|uint32(AllStrengths)) != 0 {
+		return 0, false
+	}
+	return Strengths(bits) & AllStrengths, true
+}
+
+func masterKey(passwordHash [16]byte, ntResponse []byte) []byte {
+	hashHash := mschap.HashNTPasswordHash(passwordHash)
+	h := sha1.New()
+	h.Write(hashHash[:])
+	h.Write(ntResponse)
+	h.Write(masterKeyMagic)
+	return h.Sum(nil)[:16]
+}
+
+func startKey(masterKey []byte, magic []byte) []byte {
+	h := sha1.New()
+	h.Write(masterKey)
+	h.Write(shaPad1)
+	h.Write(magic)
+	h.Write(shaPad2)
+	return h.Sum(nil)[:16]
+}
+
+// ServerKeys returns the send and receive start keys for the server end of
+// a link, derived from the NT hash of the user's password (see
+// mschap.NTPasswordHash) and the NT-Response sent by the client during
+// MS-CHAPv2 authentication.
+func ServerKeys(passwordHash [16]byte, ntResponse []byte) (send, recv []byte) {
+	mk := masterKey(passwordHash, ntResponse)
+	return startKey(mk, clientRecvKeyMagic), startKey(mk, clientSendKeyMagic)
+}
+
+// Cipher encrypts or decrypts the packets sent in one direction of a link.
+type Cipher struct {
+	strength   Strengths
+	startKey   []byte
+	sessionKey []byte
+	rc4        *rc4.Cipher
+	ccount     uint16
+}
+
+// NewCipher creates a Cipher using the given start key (see ServerKeys) and
+// key strength, which must be a single strength.
+func NewCipher(startKey []byte, strength Strengths) *Cipher {
+	keyLen := strength.keyLen()
+	c := &Cipher{
+		strength:   strength,
+		startKey:   append([]byte{}, startKey[:keyLen]...),
+		sessionKey: append([]byte{}, startKey[:keyLen]...),
+		ccount:     ccountSpace - 1,
+	}
+	c.rekey(true)
+	return c
+}
+
+// rekey changes the session key, as described in RFC 3078 section 7.3.
+// Following other implementations, the initial session key is not passed
+// through RC4.
+func (c *Cipher) rekey(initial bool) {
+	h := sha1.New()
+	h.Write(c.startKey)
+	h.Write(shaPad1)
+	h.Write(c.sessionKey)
+	h.Write(shaPad2)
+	interimKey := h.Sum(nil)[:len(c.sessionKey)]
+	if initial {
+		copy(c.sessionKey, interimKey)
+	} else {
+		// The key is never empty, so this never fails.
+		r, _ := rc4.NewCipher(interimKey)
+		r.XORKeyStream(c.sessionKey, interimKey)
+	}
+	switch c.strength {
+	case Strength40:
+		copy(c.sessionKey, []byte{0xd1, 0x26, 0x9e})
+	case Strength56:
+		c.sessionKey[0] = 0xd1
+	}
+	c.rc4, _ = rc4.NewCipher(c.sessionKey)
+}
+
+// Encrypt returns an MPPE packet containing the given PPP protocol number
+// and payload.
+func (c *Cipher) Encrypt(protocol uint16, payload []byte) []byte {
+	c.ccount = (c.ccount + 1) % ccountSpace
+	c.rekey(false)
+	result := make([]byte, headerLen+2+len(payload))
+	binary.BigEndian.PutUint16(result[0:], flagFlushed|flagEncrypted|c.ccount)
+	binary.BigEndian.PutUint16(result[2:], protocol)
+	copy(result[4:], payload)
+	c.rc4.XORKeyStream(result[headerLen:], result[headerLen:])
+	return result
+}
+
+// Decrypt decrypts the given MPPE packet, returning the PPP protocol number
+// and payload that it contains. Packets that arrive after a later packet
+// has already been decrypted are rejected with ErrLatePacket.
+func (c *Cipher) Decrypt(packet []byte) (uint16, []byte, error) {
+	if len(packet) < headerLen+2 {
+		return 0, nil, ErrTooShort
+	}
+	header := binary.BigEndian.Uint16(packet)
+	if header&flagEncrypted == 0 {
+		return 0, nil, ErrNotEncrypted
+	}
+	ccount := header % ccountSpace
+	if diff := (ccount - c.ccount) % ccountSpace; diff == 0 || diff > ccountSpace/2 {
+		return 0, nil, ErrLatePacket
+	}
+	// The key changes for every packet, including any that were lost.
+	for c.ccount != ccount {
+		c.ccount = (c.ccount + 1) % ccountSpace
+		c.rekey(false)
+	}
+	decrypted := make([]byte, len(packet)-headerLen)
+	c.rc4.XORKeyStream(decrypted, packet[headerLen:])
+	return binary.BigEndian.Uint16(decrypted), decrypted[2:], nil
+}
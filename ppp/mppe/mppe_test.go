@@ -0,0 +1,85 @@
+package mppe
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ppp/mschap"
+)
+
+func TestServerKeys(t *testing.T) {
+	// Test vectors from RFC 3079, section 3.5.3, which uses the same
+	// values as the MS-CHAPv2 example in RFC 2759.
+	authChallenge, _ := hex.DecodeString("5b5d7c7d7b3f2f3e3c2c602132262628")
+	peerChallenge, _ := hex.DecodeString("21402324255e262a28295f2b3a337c7e")
+	ntResponse := mschap.GenerateNTResponse(authChallenge, peerChallenge, "User", "clientPass")
+
+	if got, want := masterKey(mschap.NTPasswordHash("clientPass"), ntResponse), "fdece3717a8c838cb388e527ae3cdd31"; hex.EncodeToString(got) != want {
+		t.Errorf("masterKey = %x, want %s", got, want)
+	}
+	send, _ := ServerKeys(mschap.NTPasswordHash("clientPass"), ntResponse)
+	if want := "8b7cdc149b993a1ba118cb153f56dccb"; hex.EncodeToString(send) != want {
+		t.Errorf("send start key = %x, want %s", send, want)
+	}
+	c := NewCipher(send, Strength128)
+	if want := "405cb2247a7956e6e211007ae27b22d4"; hex.EncodeToString(c.sessionKey) != want {
+		t.Errorf("initial session key = %x, want %s", c.sessionKey, want)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 16)
+	for _, strength := range []Strengths{Strength40, Strength56, Strength128} {
+		sender, receiver := NewCipher(key, strength), NewCipher(key, strength)
+		var packets [][]byte
+		for i := 0; i < 5; i++ {
+			packets = append(packets, sender.Encrypt(0x2b, []byte{byte(i), 1, 2, 3}))
+		}
+		// Packet 1 is lost, and packet 2 is received after packet 3.
+		for _, i := range []int{0, 3, 2, 4} {
+			protocol, payload, err := receiver.Decrypt(packets[i])
+			if i == 2 {
+				if err != ErrLatePacket {
+					t.Errorf("%x: late packet: want ErrLatePacket, got %v", strength, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%x: packet %d: decrypt failed: %v", strength, i, err)
+			}
+			if want := []byte{byte(i), 1, 2, 3}; protocol != 0x2b || !bytes.Equal(payload, want) {
+				t.Errorf("%x: packet %d: want %x, got protocol %x, %x", strength, i, want, protocol, payload)
+			}
+		}
+		if _, _, err := receiver.Decrypt(packets[4]); err != ErrLatePacket {
+			t.Errorf("%x: repeated packet: want ErrLatePacket, got %v", strength, err)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	value := OptionValue(Strength40 | Strength128)
+	if want := []byte{0x01, 0, 0, 0x60}; !bytes.Equal(value, want) {
+		t.Errorf("OptionValue = %x, want %x", value, want)
+	}
+	if s, ok := ParseOption(value); !ok || s != Strength40|Strength128 {
+		t.Errorf("ParseOption(%x) = %x, %v", value, s, ok)
+	}
+	// Stateful mode and MPPC compression are not supported.
+	for _, value := range [][]byte{{0, 0, 0, 0x40}, {0x01, 0, 0, 0x41}, {0x01, 0, 0}} {
+		if s, ok := ParseOption(value); ok {
+			t.Errorf("ParseOption(%x) = %x, want failure", value, s)
+		}
+	}
+	if got := (Strength40 | Strength56).Strongest(); got != Strength56 {
+		t.Errorf("Strongest = %x, want %x", got, Strength56)
+	}
+	s, err := ParseStrengths("40, 128")
+	if err != nil || s != Strength40|Strength128 {
+		t.Errorf("ParseStrengths = %x, %v", s, err)
+	}
+	if _, err := ParseStrengths("64"); err == nil {
+		t.Errorf("ParseStrengths(\"64\") succeeded")
+	}
+}
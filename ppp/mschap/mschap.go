@@ -0,0 +1,127 @@
+// Package mschap implements the cryptographic parts of the Microsoft
+// PPP CHAP extensions, version 2 (MS-CHAPv2), as defined in RFC 2759. This
+// is the authentication protocol used by the Windows built-in VPN clients,
+// and the keys for MPPE encryption are derived from it.
+package mschap
+
+import (
+	"crypto/des"
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	// ChallengeLen is the length of the authenticator and peer
+	// challenges.
+	ChallengeLen = 16
+
+	// NTResponseLen is the length of the NT-Response sent by the peer.
+	NTResponseLen = 24
+)
+
+var (
+	magic1 = []byte("Magic server to client signing constant")
+	magic2 = []byte("Pad to make it do more than one iteration")
+)
+
+// UserName returns the user name to use in MS-CHAPv2 calculations, which is
+// the name sent by the peer with any Windows domain prefix removed.
+func UserName(name string) string {
+	if i := strings.LastIndex(name, "\\"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// md4Sum returns the MD4 digest of the given data. MD4 is broken and must
+// not be used for anything else, but MS-CHAP uses it to hash passwords, so
+// there is no choice here.
+func md4Sum(data []byte) [16]byte {
+	var result [16]byte
+	h := md4.New()
+	h.Write(data)
+	copy(result[:], h.Sum(nil))
+	return result
+}
+
+// NTPasswordHash returns the MD4 hash of the given password, encoded as
+// UTF-16 (little endian).
+func NTPasswordHash(password string) [16]byte {
+	var buf []byte
+	for _, c := range utf16.Encode([]rune(password)) {
+		buf = append(buf, byte(c), byte(c>>8))
+	}
+	return md4Sum(buf)
+}
+
+// HashNTPasswordHash returns the MD4 hash of an NT password hash.
+func HashNTPasswordHash(hash [16]byte) [16]byte {
+	return md4Sum(hash[:])
+}
+
+func challengeHash(peerChallenge, authChallenge []byte, userName string) []byte {
+	h := sha1.New()
+	h.Write(peerChallenge)
+	h.Write(authChallenge)
+	h.Write([]byte(userName))
+	return h.Sum(nil)[:8]
+}
+
+// desKey expands a 7 byte key into the 8 byte form used by DES, where the
+// low bit of each byte is an (ignored) parity bit.
+func desKey(k []byte) []byte {
+	return []byte{
+		k[0],
+		k[0]<<7 | k[1]>>1,
+		k[1]<<6 | k[2]>>2,
+		k[2]<<5 | k[3]>>3,
+		k[3]<<4 | k[4]>>4,
+		k[4]<<3 | k[5]>>5,
+		k[5]<<2 | k[6]>>6,
+		k[6] << 1,
+	}
+}
+
+func challengeResponse(challenge []byte, passwordHash [16]byte) []byte {
+	var zHash [21]byte
+	copy(zHash[:], passwordHash[:])
+	result := make([]byte, 0, NTResponseLen)
+	for i := 0; i < 3; i++ {
+		// The key is always 8 bytes, so this never fails.
+		block, _ := des.NewCipher(desKey(zHash[i*7 : i*7+7]))
+		var out [8]byte
+		block.Encrypt(out[:], challenge)
+		result = append(result, out[:]...)
+	}
+	return result
+}
+
+// GenerateNTResponse returns the NT-Response that a peer with the given
+// user name and password should send in reply to the given challenges.
+func GenerateNTResponse(authChallenge, peerChallenge []byte, userName, password string) []byte {
+	challenge := challengeHash(peerChallenge, authChallenge, userName)
+	return challengeResponse(challenge, NTPasswordHash(password))
+}
+
+// GenerateAuthenticatorResponse returns the authenticator response string
+// (of the form "S=<40 hex digits>") that is sent to the peer on successful
+// authentication, proving that the authenticator also knows the password.
+// The password is given as its NT hash (see NTPasswordHash).
+func GenerateAuthenticatorResponse(passwordHash [16]byte, ntResponse, peerChallenge, authChallenge []byte, userName string) string {
+	hashHash := HashNTPasswordHash(passwordHash)
+	h := sha1.New()
+	h.Write(hashHash[:])
+	h.Write(ntResponse)
+	h.Write(magic1)
+	digest := h.Sum(nil)
+
+	h = sha1.New()
+	h.Write(digest)
+	h.Write(challengeHash(peerChallenge, authChallenge, userName))
+	h.Write(magic2)
+	return fmt.Sprintf("S=%X", h.Sum(nil))
+}
@@ -0,0 +1,75 @@
+package mschap
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestMD4(t *testing.T) {
+	// Test vectors from RFC 1320.
+	tests := map[string]string{
+		"":               "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"a":              "bde52cb31de33e46245e05fbdbd6fb24",
+		"abc":            "a448017aaf21d8525fc10ae87aa6729d",
+		"message digest": "d9130a8164549fe818874806e1c7014b",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	}
+	for in, want := range tests {
+		got := md4Sum([]byte(in))
+		if hex.EncodeToString(got[:]) != want {
+			t.Errorf("md4Sum(%q) = %x, want %s", in, got, want)
+		}
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	result, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestMSCHAPv2(t *testing.T) {
+	// Test vectors from RFC 2759, section 9.2.
+	const (
+		userName = "User"
+		password = "clientPass"
+	)
+	authChallenge := mustDecodeHex(t, "5b5d7c7d7b3f2f3e3c2c602132262628")
+	peerChallenge := mustDecodeHex(t, "21402324255e262a28295f2b3a337c7e")
+
+	if got, want := challengeHash(peerChallenge, authChallenge, userName), "d02e4386bce91226"; hex.EncodeToString(got) != want {
+		t.Errorf("challengeHash = %x, want %s", got, want)
+	}
+	hash := NTPasswordHash(password)
+	if want := "44ebba8d5312b8d611474411f56989ae"; hex.EncodeToString(hash[:]) != want {
+		t.Errorf("NTPasswordHash = %x, want %s", hash, want)
+	}
+	ntResponse := GenerateNTResponse(authChallenge, peerChallenge, userName, password)
+	if want := "82309ecd8d708b5ea08faa3981cd83544233114a3d85d6df"; hex.EncodeToString(ntResponse) != want {
+		t.Errorf("GenerateNTResponse = %x, want %s", ntResponse, want)
+	}
+	hashHash := HashNTPasswordHash(hash)
+	if want := "41c00c584bd2d91c4017a2a12fa59f3f"; hex.EncodeToString(hashHash[:]) != want {
+		t.Errorf("HashNTPasswordHash = %x, want %s", hashHash, want)
+	}
+	authResponse := GenerateAuthenticatorResponse(NTPasswordHash(password), ntResponse, peerChallenge, authChallenge, userName)
+	if want := "S=407A5589115FD0D6209F510FE9C04566932CDA56"; authResponse != want {
+		t.Errorf("GenerateAuthenticatorResponse = %q, want %q", authResponse, want)
+	}
+}
+
+func TestUserName(t *testing.T) {
+	for in, want := range map[string]string{
+		"User":         "User",
+		"DOMAIN\\User": "User",
+		"A\\B\\User":   "User",
+		"user@example": "user@example",
+	} {
+		if got := UserName(in); got != want {
+			t.Errorf("UserName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -19,6 +19,27 @@ const (
 type option struct {
 	value    []byte
 	validate func(o *option, newValue []byte) bool
+
+	// If not nil, this value is suggested to the peer in Configure-Nak
+	// replies instead of the current value.
+	preferred []byte
+
+	// If not nil, suggest is called with the value requested by the peer
+	// (nil if absent) to choose the value to suggest in a Configure-Nak.
+	// It takes precedence over preferred.
+	suggest func(requested []byte) []byte
+}
+
+// suggestion returns the value to suggest to the peer in a Configure-Nak,
+// given the value it requested.
+func (o *option) suggestion(requested []byte) []byte {
+	if o.suggest != nil {
+		return o.suggest(requested)
+	}
+	if o.preferred != nil {
+		return o.preferred
+	}
+	return o.value
 }
 
 func (o *option) validateValue(value []byte) bool {
@@ -44,6 +65,14 @@ func requiredOption(o *option, newValue []byte) bool {
 	return newValue != nil
 }
 
+// optionalValue returns a validator function that accepts the option being
+// absent, but if it is present, it must have the given value.
+func optionalValue(want []byte) func(o *option, newValue []byte) bool {
+	return func(o *option, newValue []byte) bool {
+		return newValue == nil || bytes.Equal(newValue, want)
+	}
+}
+
 type negotiator struct {
 	localOptions, remoteOptions   map[lcp.OptionType]*option
 	sendPPP                       func(p []byte) error
@@ -115,7 +144,7 @@ func (n *negotiator) handleConfigureRequest(l *lcp.LCP) {
 			if badOpts[opt.Type] {
 				replyOpts = append(replyOpts, lcp.Option{
 					Type: opt.Type,
-					Data: n.remoteOptions[opt.Type].value,
+					Data: n.remoteOptions[opt.Type].suggestion(opt.Data),
 				})
 			}
 		}
@@ -124,7 +153,7 @@ func (n *negotiator) handleConfigureRequest(l *lcp.LCP) {
 			if newValues[ot] == nil {
 				replyOpts = append(replyOpts, lcp.Option{
 					Type: ot,
-					Data: n.remoteOptions[ot].value,
+					Data: n.remoteOptions[ot].suggestion(nil),
 				})
 			}
 		}
@@ -271,8 +300,10 @@ func (n *negotiator) maybeSendRequest() {
 }
 
 func (n *negotiator) StartNegotiation() {
+	n.mu.Lock()
 	n.requestSequence = 1
 	n.err = nil
+	n.mu.Unlock()
 	for {
 		n.mu.Lock()
 		done := n.localComplete || n.err != nil
@@ -0,0 +1,149 @@
+package ppp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/ppp/lcp"
+	"github.com/fragglet/ipxbox/ppp/mppe"
+	"github.com/google/gopacket"
+)
+
+type negotiationTest struct {
+	t    *testing.T
+	n    *negotiator
+	sent []*lcp.LCP
+}
+
+func newNegotiationTest(t *testing.T, addr ipx.Addr) *negotiationTest {
+	nt := &negotiationTest{t: t}
+	nt.n = newIPXCPNegotiator(addr, nt.sendPPP)
+	return nt
+}
+
+func (nt *negotiationTest) sendPPP(p []byte) error {
+	pkt := gopacket.NewPacket(p, lcp.LayerTypeLCP, gopacket.Default)
+	l, ok := pkt.Layer(lcp.LayerTypeLCP).(*lcp.LCP)
+	if !ok {
+		nt.t.Fatalf("negotiator sent undecodable packet: %x", p)
+	}
+	nt.sent = append(nt.sent, l)
+	return nil
+}
+
+// recv passes an IPXCP message to the negotiator as though it had been
+// received from the peer, and returns the reply that was sent, if any.
+func (nt *negotiationTest) recv(msgType lcp.MessageType, id uint8, opts ...lcp.Option) *lcp.LCP {
+	l := &lcp.LCP{
+		Type:       msgType,
+		Identifier: id,
+		Data:       &lcp.ConfigureData{Options: opts},
+	}
+	data, err := l.MarshalBinary()
+	if err != nil {
+		nt.t.Fatal(err)
+	}
+	numSent := len(nt.sent)
+	nt.n.RecvPacket(gopacket.NewPacket(data, lcp.LayerTypeLCP, gopacket.Default))
+	if len(nt.sent) == numSent {
+		return nil
+	}
+	return nt.sent[len(nt.sent)-1]
+}
+
+func (nt *negotiationTest) expectReply(reply *lcp.LCP, msgType lcp.MessageType, id uint8, opts ...lcp.Option) {
+	nt.t.Helper()
+	if reply == nil {
+		nt.t.Fatalf("no reply sent; want %v", msgType)
+	}
+	if reply.Type != msgType || reply.Identifier != id {
+		nt.t.Fatalf("wrong reply: want type=%v id=%d, got %+v", msgType, id, reply)
+	}
+	if len(opts) == 0 {
+		opts = []lcp.Option{}
+	}
+	if got := reply.Data.(*lcp.ConfigureData).Options; !reflect.DeepEqual(got, opts) {
+		nt.t.Errorf("wrong options in %v: want %+v, got %+v", msgType, opts, got)
+	}
+}
+
+func TestIPXCPNegotiation(t *testing.T) {
+	addr := ipx.Addr{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	zeroNetwork := lcp.Option{Type: lcp.OptionIPXNetwork, Data: []byte{0, 0, 0, 0}}
+	assignedNode := lcp.Option{Type: lcp.OptionIPXNode, Data: addr[:]}
+	nt := newNegotiationTest(t, addr)
+
+	// Peer asks us to assign it a node number; we Nak with the
+	// address it has been assigned.
+	reply := nt.recv(lcp.ConfigureRequest, 1, zeroNetwork,
+		lcp.Option{Type: lcp.OptionIPXNode, Data: make([]byte, 6)})
+	nt.expectReply(reply, lcp.ConfigureNak, 1, assignedNode)
+
+	// Peer asks for a network number other than zero.
+	reply = nt.recv(lcp.ConfigureRequest, 2,
+		lcp.Option{Type: lcp.OptionIPXNetwork, Data: []byte{1, 2, 3, 4}},
+		assignedNode)
+	nt.expectReply(reply, lcp.ConfigureNak, 2, zeroNetwork)
+
+	// Options we do not support are rejected.
+	routing := lcp.Option{Type: lcp.OptionIPXRoutingProtocol, Data: []byte{0, 2}}
+	reply = nt.recv(lcp.ConfigureRequest, 3, zeroNetwork, assignedNode, routing)
+	nt.expectReply(reply, lcp.ConfigureReject, 3, routing)
+
+	// Acceptable request is acknowledged.
+	complete := lcp.Option{Type: lcp.OptionIPXConfigurationComplete, Data: []byte{}}
+	reply = nt.recv(lcp.ConfigureRequest, 4, zeroNetwork, assignedNode, complete)
+	nt.expectReply(reply, lcp.ConfigureAck, 4, zeroNetwork, assignedNode, complete)
+	if done, _ := nt.n.Done(); done {
+		t.Fatalf("negotiation done before our request was acknowledged")
+	}
+
+	// Our own request: the peer rejects the node number option, so we
+	// send a new request without it.
+	nt.n.sendConfigureRequest()
+	reply = nt.recv(lcp.ConfigureReject, 0,
+		lcp.Option{Type: lcp.OptionIPXNode, Data: make([]byte, 6)})
+	nt.expectReply(reply, lcp.ConfigureRequest, 1, zeroNetwork)
+
+	nt.recv(lcp.ConfigureAck, 1, zeroNetwork)
+	if done, err := nt.n.Done(); !done || err != nil {
+		t.Errorf("negotiation not complete: done=%v, err=%v", done, err)
+	}
+}
+
+func TestCCPNegotiation(t *testing.T) {
+	nt := &negotiationTest{t: t}
+	nt.n = newCCPNegotiator(mppe.Strength40|mppe.Strength128, nt.sendPPP)
+	mppeOption := func(s mppe.Strengths) lcp.Option {
+		return lcp.Option{Type: lcp.OptionMPPE, Data: mppe.OptionValue(s)}
+	}
+
+	// Peer must request MPPE.
+	reply := nt.recv(lcp.ConfigureRequest, 1)
+	nt.expectReply(reply, lcp.ConfigureNak, 1, mppeOption(mppe.Strength128))
+
+	// Peer offers several strengths including ones we do not allow; we
+	// choose the strongest that we have in common.
+	reply = nt.recv(lcp.ConfigureRequest, 2, mppeOption(mppe.Strength40|mppe.Strength56))
+	nt.expectReply(reply, lcp.ConfigureNak, 2, mppeOption(mppe.Strength40))
+
+	// Stateful mode is not supported.
+	reply = nt.recv(lcp.ConfigureRequest, 3,
+		lcp.Option{Type: lcp.OptionMPPE, Data: []byte{0, 0, 0, 0x40}})
+	nt.expectReply(reply, lcp.ConfigureNak, 3, mppeOption(mppe.Strength128))
+
+	reply = nt.recv(lcp.ConfigureRequest, 4, mppeOption(mppe.Strength40))
+	nt.expectReply(reply, lcp.ConfigureAck, 4, mppeOption(mppe.Strength40))
+
+	// We offer all our allowed strengths, and accept the peer's choice.
+	nt.n.sendConfigureRequest()
+	nt.expectReply(nt.sent[len(nt.sent)-1], lcp.ConfigureRequest, 0,
+		mppeOption(mppe.Strength40|mppe.Strength128))
+	reply = nt.recv(lcp.ConfigureNak, 0, mppeOption(mppe.Strength40))
+	nt.expectReply(reply, lcp.ConfigureRequest, 1, mppeOption(mppe.Strength40))
+	nt.recv(lcp.ConfigureAck, 1, mppeOption(mppe.Strength40))
+	if done, err := nt.n.Done(); !done || err != nil {
+		t.Errorf("negotiation not complete: done=%v, err=%v", done, err)
+	}
+}
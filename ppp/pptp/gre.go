@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -29,12 +30,28 @@ var _ = (io.ReadWriteCloser)(&greSession{})
 // greSession is used to send and receive packets for a particular PPP-over-GRE
 // session.
 type greSession struct {
-	s                           *greServer
-	closed                      bool
-	recvQueue                   chan gopacket.Packet
-	addr                        net.IP
-	sendCallID, recvCallID      uint16
+	s                      *greServer
+	closed                 bool
+	recvQueue              chan gopacket.Packet
+	addr                   net.IP
+	sendCallID, recvCallID uint16
+
+	// seqMu protects the sequence numbers, since packets are sent and
+	// received from different goroutines.
+	seqMu                       sync.Mutex
 	sentSeq, recvSeq, recvAcked uint32
+
+	// lastRecvTime is the time that a packet was last received for this
+	// session. It is protected by the server's mutex.
+	lastRecvTime time.Time
+}
+
+// idleTime returns the time since a packet was last received for the
+// session.
+func (s *greSession) idleTime() time.Duration {
+	s.s.mu.Lock()
+	defer s.s.mu.Unlock()
+	return time.Since(s.lastRecvTime)
 }
 
 func (s *greSession) recvPacket(p []byte) (int, error) {
@@ -50,11 +67,16 @@ func (s *greSession) recvPacket(p []byte) (int, error) {
 	// TODO: Consider selectively breaking this requirement for some
 	// packets, ie. encapsulated IPX frames.
 	if greHeader.SeqPresent {
-		if greHeader.Seq < s.recvSeq {
+		s.seqMu.Lock()
+		inSequence := greHeader.Seq >= s.recvSeq
+		if inSequence {
+			// TODO: if we don't otherwise send a packet, send an empty ack packet
+			s.recvSeq = greHeader.Seq
+		}
+		s.seqMu.Unlock()
+		if !inSequence {
 			return 0, outOfSequencePacket
 		}
-		// TODO: if we don't otherwise send a packet, send an empty ack packet
-		s.recvSeq = greHeader.Seq
 	}
 	result := ls[1].LayerPayload()
 	copy(p[0:len(result)], result)
@@ -87,6 +109,10 @@ func (s *greSession) sendPacket(frame []byte) (int, error) {
 		Key:        uint32(len(frame)<<16) | uint32(s.sendCallID),
 		Version:    1, // Enhanced GRE
 	}
+	// The lock is held until the packet is sent, so that packets are
+	// sent in sequence number order.
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
 	if len(frame) > 0 {
 		greHeader.Seq = s.sentSeq
 		greHeader.SeqPresent = true
@@ -142,8 +168,8 @@ type greServer struct {
 	mu       sync.Mutex
 }
 
-func startGREServer() (*greServer, error) {
-	conn, err := net.ListenIP(fmt.Sprintf("ip4:%d", greProtocol), nil)
+func startGREServer(addr *net.IPAddr) (*greServer, error) {
+	conn, err := net.ListenIP(fmt.Sprintf("ip4:%d", greProtocol), addr)
 	if err != nil {
 		return nil, err
 	}
@@ -155,11 +181,12 @@ func startGREServer() (*greServer, error) {
 
 func (s *greServer) startSession(remoteAddr net.IP, sendCallID, recvCallID uint16) (*greSession, error) {
 	session := &greSession{
-		s:          s,
-		addr:       remoteAddr,
-		recvQueue:  make(chan gopacket.Packet, recvQueueSize),
-		sendCallID: sendCallID,
-		recvCallID: recvCallID,
+		s:            s,
+		addr:         remoteAddr,
+		recvQueue:    make(chan gopacket.Packet, recvQueueSize),
+		sendCallID:   sendCallID,
+		recvCallID:   recvCallID,
+		lastRecvTime: time.Now(),
 	}
 	sk := session.sessionKey()
 	s.mu.Lock()
@@ -193,6 +220,7 @@ func (s *greServer) processPacket(pkt gopacket.Packet) error {
 	if !ok || session.closed {
 		return unknownSession
 	}
+	session.lastRecvTime = time.Now()
 	// Try to place onto session's receive queue, but don't block.
 	select {
 	case session.recvQueue <- pkt:
@@ -8,16 +8,35 @@ package pptp
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/stats"
 	"github.com/fragglet/ipxbox/ppp"
 )
 
 const (
-	pptpPort    = 1723
+	// DefaultAddress is the address that the server listens on for
+	// PPTP control connections if none is configured.
+	DefaultAddress = ":1723"
+
 	magicNumber = 0x1a2b3c4d
+
+	// Result codes for Outgoing-Call-Reply messages.
+	resultGeneralError = 2
+	resultBusy         = 4
+)
+
+var (
+	// TooManySessionsError is returned when a new PPP session cannot
+	// be started because the maximum number are already active.
+	TooManySessionsError = errors.New("too many PPP sessions active")
 )
 
 const (
@@ -39,10 +58,27 @@ const (
 )
 
 type Connection struct {
-	callID uint16
-	conn   net.Conn
-	ppp    *ppp.Session
-	s      *Server
+	callID      uint16
+	conn        net.Conn
+	ppp         *ppp.Session
+	node        network.Node
+	s           *Server
+	connectTime time.Time
+}
+
+// SessionInfo describes an active PPP session.
+type SessionInfo struct {
+	RemoteAddr  net.Addr
+	IPXAddr     ipx.Addr
+	ConnectTime time.Time
+
+	// Counters contains packet and byte counters for the session, if
+	// the network gathers statistics (see the stats package).
+	Counters stats.Counters
+
+	// IPXCP contains the addressing negotiated with the client, or is
+	// nil if IPXCP negotiation has not yet completed.
+	IPXCP *ppp.IPXCPInfo
 }
 
 func (c *Connection) sendMessage(msg []byte) {
@@ -109,29 +145,62 @@ func (c *Connection) Close() error {
 	}
 }
 
-func (c *Connection) startPPPSession(ctx context.Context, sendCallID uint16) {
+// startPPPSession starts the PPP session for the call, if it has not already
+// been started.
+func (c *Connection) startPPPSession(ctx context.Context, sendCallID uint16) error {
 	if c.ppp != nil {
-		return
+		return nil
+	}
+	if err := c.s.addSession(); err != nil {
+		return err
 	}
 	addr := c.conn.RemoteAddr().(*net.TCPAddr)
-	var err error
 	gre, err := c.s.greServer.startSession(addr.IP, sendCallID, c.callID)
 	if err != nil {
-		// TODO: Send back error message? Log error?
-		c.conn.Close()
-		return
+		c.s.removeSession(c)
+		return err
+	}
+	node, err := c.s.n.NewNode()
+	if err != nil {
+		gre.Close()
+		c.s.removeSession(c)
+		return err
+	}
+	c.connectTime = time.Now()
+	c.ppp = ppp.NewSessionWithConfig(gre, node, &c.s.config.PPP)
+	c.node = c.ppp.Node()
+	c.s.sessionStarted(c)
+	if c.s.config.IdleTimeout > 0 {
+		go c.checkIdle(ctx, gre, c.s.config.IdleTimeout)
 	}
-	node := c.s.n.NewNode()
-	c.ppp = ppp.NewSession(gre, node)
 	go func() {
 		err := c.ppp.Run(ctx)
 		if err != nil {
 			// TODO: log error?
 		}
+		c.s.removeSession(c)
 		// Once the PPP session terminates, close the PPTP control
 		// connection as well.
 		c.Close()
 	}()
+	return nil
+}
+
+// checkIdle runs as a background goroutine while a PPP session is active,
+// terminating the session if nothing is received for the given time.
+func (c *Connection) checkIdle(ctx context.Context, gre *greSession, timeout time.Duration) {
+	for !c.ppp.Terminated() {
+		idle := gre.idleTime()
+		if idle >= timeout {
+			c.ppp.Terminate(fmt.Errorf("session idle for %v", idle.Round(time.Second)))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(timeout - idle):
+		}
+	}
 }
 
 func (c *Connection) handleOutgoingCall(ctx context.Context, msg []byte) {
@@ -140,7 +209,7 @@ func (c *Connection) handleOutgoingCall(ctx context.Context, msg []byte) {
 	}
 	// Start up GRE session if we have not already.
 	sendCallID := binary.BigEndian.Uint16(msg[10:12])
-	c.startPPPSession(ctx, sendCallID)
+	err := c.startPPPSession(ctx, sendCallID)
 	reply := []byte{
 		0x00, 0x01, // Message type
 		0x1a, 0x2b, 0x3c, 0x4d, // Magic cookie
@@ -167,6 +236,16 @@ func (c *Connection) handleOutgoingCall(ctx context.Context, msg []byte) {
 	copy(reply[18:22], msg[18:22])
 	// Copy peer's call ID.
 	copy(reply[12:14], msg[10:12])
+	if err != nil {
+		if err == TooManySessionsError {
+			reply[14] = resultBusy
+		} else {
+			reply[14] = resultGeneralError
+		}
+		c.sendMessage(reply)
+		c.Close()
+		return
+	}
 	c.sendMessage(reply)
 }
 
@@ -233,29 +312,127 @@ func newConnection(s *Server, conn net.Conn, callID uint16) *Connection {
 	}
 }
 
+// Config contains configuration parameters for a PPTP server.
+type Config struct {
+	// Address to listen on for PPTP control connections, in the form
+	// accepted by net.Listen. If empty, DefaultAddress is used. PPTP
+	// clients always connect to TCP port 1723, so an alternate port is
+	// only useful behind a proxy or port forward.
+	Address string
+
+	// IP address to receive GRE packets on. If empty, the host part
+	// of Address is used, or all addresses if that is empty too.
+	GREAddress string
+
+	// If non-zero, the maximum number of PPP sessions that can be
+	// active at once. Further calls are refused as busy.
+	MaxSessions int
+
+	// If non-zero, PPP sessions are terminated if nothing is received
+	// from the client for this long, freeing their network node.
+	IdleTimeout time.Duration
+
+	// PPP contains configuration for the PPP sessions, such as whether
+	// clients must authenticate and encrypt their traffic.
+	PPP ppp.Config
+}
+
 // Server is an implementation of a PPTP server.
 type Server struct {
-	listener   *net.TCPListener
-	nextCallID uint16
-	n          network.Network
-	greServer  *greServer
+	listener    *net.TCPListener
+	nextCallID  uint16
+	n           network.Network
+	greServer   *greServer
+	config      Config
+	mu          sync.Mutex
+	sessions    map[*Connection]bool
+	numSessions int
+}
+
+// addSession is called when a new PPP session is started, and returns
+// TooManySessionsError if the session limit has been reached.
+func (s *Server) addSession() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.config.MaxSessions > 0 && s.numSessions >= s.config.MaxSessions {
+		return TooManySessionsError
+	}
+	s.numSessions++
+	return nil
+}
+
+// sessionStarted is called once a PPP session has been attached to the
+// network, so that it appears in the list returned by Sessions.
+func (s *Server) sessionStarted(c *Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[c] = true
+}
+
+func (s *Server) removeSession(c *Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, c)
+	s.numSessions--
+}
+
+// Sessions returns a description of every active PPP session.
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	conns := []*Connection{}
+	for c := range s.sessions {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	result := []SessionInfo{}
+	for _, c := range conns {
+		si := SessionInfo{
+			RemoteAddr:  c.conn.RemoteAddr(),
+			IPXAddr:     network.NodeAddress(c.node),
+			ConnectTime: c.connectTime,
+		}
+		si.Counters, _ = stats.CountersFor(c.node)
+		var info ppp.IPXCPInfo
+		if c.node.GetProperty(&info) {
+			si.IPXCP = &info
+		}
+		result = append(result, si)
+	}
+	return result
 }
 
 // Run listens for and accepts new connections to the server. It blocks until
 // the server is shut down, so it should be invoked in a dedicated goroutine.
-func (s *Server) Run(ctx context.Context) {
-	go s.greServer.Run()
+// If the server is shut down by calling Close, nil is returned; otherwise the
+// error that caused it to stop is returned.
+func (s *Server) Run(ctx context.Context) error {
+	greErr := make(chan error, 1)
+	go func() {
+		err := s.greServer.Run()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			greErr <- err
+			s.listener.Close()
+		}
+	}()
+	defer s.listener.Close()
 	for {
 		conn, err := s.listener.Accept()
-		if err != nil {
-			break
+		select {
+		case err := <-greErr:
+			return fmt.Errorf("error receiving GRE packets: %w", err)
+		default:
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error accepting PPTP connection: %w", err)
 		}
 		// TODO: Subcontext per connection and cancel on close
 		c := newConnection(s, conn, s.nextCallID)
 		go c.run(ctx)
 		s.nextCallID = (s.nextCallID + 1) & 0xffff
 	}
-	s.listener.Close()
 }
 
 func (s *Server) Close() error {
@@ -263,22 +440,57 @@ func (s *Server) Close() error {
 	return s.listener.Close()
 }
 
+// Addr returns the address that the server is listening on for PPTP control
+// connections.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// NewServer creates a new PPTP server with the default configuration, where
+// clients are connected to the given network.
 func NewServer(n network.Network) (*Server, error) {
-	gs, err := startGREServer()
+	return NewServerWithConfig(n, &Config{})
+}
+
+// NewServerWithConfig creates a new PPTP server, where clients are connected
+// to the given network.
+func NewServerWithConfig(n network.Network, config *Config) (*Server, error) {
+	if config.PPP.Encryption != 0 && config.PPP.Authenticator == nil {
+		return nil, ppp.ErrEncryptionNeedsAuth
+	}
+	address := config.Address
+	if address == "" {
+		address = DefaultAddress
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
 		return nil, err
 	}
-	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
-		Port: pptpPort,
-	})
+	greAddr := &net.IPAddr{IP: tcpAddr.IP}
+	if config.GREAddress != "" {
+		greAddr, err = net.ResolveIPAddr("ip4", config.GREAddress)
+		if err != nil {
+			return nil, err
+		}
+	}
+	gs, err := startGREServer(greAddr)
+	if errors.Is(err, os.ErrPermission) {
+		return nil, fmt.Errorf("failed to open raw socket for GRE packets "+
+			"(the cap_net_raw capability is needed): %w", err)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open raw socket for GRE packets: %w", err)
+	}
+	listener, err := net.ListenTCP("tcp", tcpAddr)
 	if err != nil {
 		gs.Close()
-		return nil, err
+		return nil, fmt.Errorf("failed to listen for PPTP connections on %s: %w", address, err)
 	}
 	return &Server{
 		listener:   listener,
 		nextCallID: 384,
 		n:          n,
 		greServer:  gs,
+		config:     *config,
+		sessions:   map[*Connection]bool{},
 	}, nil
 }
@@ -0,0 +1,177 @@
+package pptp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	"github.com/fragglet/ipxbox/network/stats"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+// newTestServer creates a server with the given configuration, skipping the
+// test if raw socket access (needed for GRE) is not available.
+func newTestServer(t *testing.T, config *Config) *Server {
+	s, err := NewServerWithConfig(&ipxtesting.FakeNetwork{}, config)
+	if errors.Is(err, os.ErrPermission) {
+		t.Skipf("no raw socket access to receive GRE packets: %v", err)
+	} else if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	return s
+}
+
+func TestConfiguredAddress(t *testing.T) {
+	s := newTestServer(t, &Config{Address: "127.0.0.1:0"})
+	defer s.Close()
+	addr := s.Addr().(*net.TCPAddr)
+	if !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port == 0 {
+		t.Errorf("server not bound to configured address: %v", addr)
+	}
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("failed to connect to server: %v", err)
+	}
+	conn.Close()
+}
+
+func TestBindFailure(t *testing.T) {
+	s := newTestServer(t, &Config{Address: "127.0.0.1:0"})
+	defer s.Close()
+	addr := s.Addr().String()
+
+	_, err := NewServerWithConfig(&ipxtesting.FakeNetwork{}, &Config{Address: addr})
+	if err == nil {
+		t.Fatalf("second server bound to address %s already in use", addr)
+	}
+	if !strings.Contains(err.Error(), addr) {
+		t.Errorf("error does not describe address %s: %v", addr, err)
+	}
+}
+
+func TestRunReturnsOnClose(t *testing.T) {
+	s := newTestServer(t, &Config{Address: "127.0.0.1:0"})
+	result := make(chan error)
+	go func() {
+		result <- s.Run(context.Background())
+	}()
+	s.Close()
+	if err := <-result; err != nil {
+		t.Errorf("Run returned error after Close: %v", err)
+	}
+}
+
+// startTestSession starts a PPP session on a server without any PPTP control
+// connection, for testing session management.
+func startTestSession(t *testing.T, s *Server) (*Connection, error) {
+	conn, other := net.Pipe()
+	t.Cleanup(func() { other.Close() })
+	c := newConnection(s, &tcpConn{conn}, s.nextCallID)
+	s.nextCallID++
+	return c, c.startPPPSession(context.Background(), 1)
+}
+
+// tcpConn wraps a net.Conn to report a TCP remote address, as expected by
+// startPPPSession.
+type tcpConn struct {
+	net.Conn
+}
+
+func (c *tcpConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+}
+
+// makeSessionTestServer creates a server that is not listening for PPTP
+// control connections, attached to a network that only allows one node.
+func makeSessionTestServer(t *testing.T, config *Config) *Server {
+	gs, err := startGREServer(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if errors.Is(err, os.ErrPermission) {
+		t.Skipf("no raw socket access to send GRE packets: %v", err)
+	} else if err != nil {
+		t.Fatalf("failed to start GRE server: %v", err)
+	}
+	t.Cleanup(func() { gs.Close() })
+	n := ipxswitch.New()
+	n.MaxNodes = 1
+	return &Server{
+		n:         stats.Wrap(addressable.Wrap(n)),
+		greServer: gs,
+		config:    *config,
+		sessions:  map[*Connection]bool{},
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := makeSessionTestServer(t, &Config{IdleTimeout: 50 * time.Millisecond})
+	c, err := startTestSession(t, s)
+	if err != nil {
+		t.Fatalf("failed to start session: %v", err)
+	}
+	// The network only allows one node, so a new node can only be
+	// created once the idle session has been torn down.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		node, err := s.n.NewNode()
+		if err == nil {
+			node.Close()
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("node not released after idle timeout: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !c.ppp.Terminated() {
+		t.Errorf("idle session not terminated")
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	s := makeSessionTestServer(t, &Config{MaxSessions: 1})
+	c, err := startTestSession(t, s)
+	if err != nil {
+		t.Fatalf("failed to start first session: %v", err)
+	}
+	if _, err := startTestSession(t, s); err != TooManySessionsError {
+		t.Errorf("second session: want %v, got %v", TooManySessionsError, err)
+	}
+	c.ppp.Terminate(nil)
+}
+
+func TestSessions(t *testing.T) {
+	s := makeSessionTestServer(t, &Config{})
+	c, err := startTestSession(t, s)
+	if err != nil {
+		t.Fatalf("failed to start session: %v", err)
+	}
+	sessions := s.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("want one session listed, got %+v", sessions)
+	}
+	got := sessions[0]
+	if want := c.conn.RemoteAddr().String(); got.RemoteAddr.String() != want {
+		t.Errorf("wrong remote address: want %s, got %s", want, got.RemoteAddr)
+	}
+	if want := network.NodeAddress(c.node); got.IPXAddr != want || want == ipx.AddrNull {
+		t.Errorf("wrong IPX address: want %s, got %s", want, got.IPXAddr)
+	}
+	if got.ConnectTime.IsZero() {
+		t.Errorf("connect time not set")
+	}
+
+	c.ppp.Terminate(nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Sessions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("terminated session still listed: %+v", s.Sessions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
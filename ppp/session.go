@@ -1,6 +1,7 @@
 package ppp
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
@@ -15,6 +16,7 @@ import (
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/ppp/lcp"
+	"github.com/fragglet/ipxbox/ppp/mppe"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -26,14 +28,42 @@ const (
 
 var (
 	// supportedProtocols defines all the PPP protocol types that we
-	// support. Any other type triggers a Protocol-Reject response.
+	// always support. Any other type triggers a Protocol-Reject
+	// response, unless enabled by the session configuration.
 	supportedProtocols = map[layers.PPPType]bool{
 		PPPTypeIPX:       true,
 		lcp.PPPTypeIPXCP: true,
 		lcp.PPPTypeLCP:   true,
 	}
+
+	// ErrEncryptionNeedsAuth is returned when MPPE encryption is
+	// configured without an Authenticator; the keys are derived from the
+	// MS-CHAPv2 exchange.
+	ErrEncryptionNeedsAuth = errors.New("MPPE encryption requires MS-CHAPv2 authentication")
 )
 
+// IPXCPInfo contains the IPX addressing that was negotiated with the peer
+// using IPXCP. It can be fetched with GetProperty on the node returned by
+// Session.Node, once negotiation has completed.
+type IPXCPInfo struct {
+	Network [4]byte
+	Node    ipx.Addr
+}
+
+// Config contains optional configuration parameters for a Session.
+type Config struct {
+	// If not nil, the peer must authenticate using CHAP, and its
+	// response is checked using the Authenticator. MS-CHAPv2 is
+	// requested, but the peer may negotiate CHAP-MD5 instead unless
+	// encryption is enabled.
+	Authenticator Authenticator
+
+	// If non-zero, all IPX traffic must be encrypted using stateless
+	// MPPE, with one of these key strengths. The keys are derived from
+	// the MS-CHAPv2 exchange, so Authenticator must also be set.
+	Encryption mppe.Strengths
+}
+
 type linkState uint8
 
 const (
@@ -45,6 +75,7 @@ const (
 )
 
 type Session struct {
+	config             Config
 	node               network.Node
 	channel            io.ReadWriteCloser
 	mu                 sync.Mutex // protects state
@@ -52,7 +83,13 @@ type Session struct {
 	negotiators        map[layers.PPPType]*negotiator
 	numProtocolRejects uint8
 	magicNumber        uint32
-	terminateError     error
+	terminateError     error // protected by mu
+	authAlgorithm      CHAPAlgorithm
+	ipxcp              *IPXCPInfo // protected by mu
+	challenger         *challenger
+
+	// Ciphers for MPPE, set once CCP negotiation has completed.
+	sendCipher, recvCipher *mppe.Cipher
 }
 
 func (s *Session) Close() error {
@@ -88,6 +125,14 @@ func (s *Session) Terminated() bool {
 	return s.state == stateTerminate || s.state == stateDead
 }
 
+// inNetworkState returns true if link setup has completed and IPX traffic
+// can be exchanged with the peer.
+func (s *Session) inNetworkState() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == stateNetwork
+}
+
 // sendPackets continually reads packets from upstream and forwards them over
 // the PPP channel.
 func (s *Session) sendPackets(ctx context.Context) error {
@@ -96,10 +141,7 @@ func (s *Session) sendPackets(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		s.mu.Lock()
-		ok := s.state == stateNetwork
-		s.mu.Unlock()
-		if !ok {
+		if !s.inNetworkState() {
 			// Not yet in network state
 			continue
 		}
@@ -107,13 +149,57 @@ func (s *Session) sendPackets(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		if err := s.sendPPP(marshaled, PPPTypeIPX); err != nil {
+		if err := s.sendIPX(marshaled); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// sendIPX sends an IPX packet over the PPP channel, encrypting it first if
+// MPPE has been negotiated.
+func (s *Session) sendIPX(payload []byte) error {
+	s.mu.Lock()
+	c := s.sendCipher
+	if c != nil {
+		payload = c.Encrypt(uint16(PPPTypeIPX), payload)
+	}
+	s.mu.Unlock()
+	if c != nil {
+		return s.sendPPP(payload, lcp.PPPTypeCompressed)
+	}
+	if s.config.Encryption != 0 {
+		// Never send IPX unencrypted when encryption is required.
+		return nil
+	}
+	return s.sendPPP(payload, PPPTypeIPX)
+}
+
+// supports returns true if the given PPP protocol type is supported by this
+// session.
+func (s *Session) supports(pppType layers.PPPType) bool {
+	switch {
+	case supportedProtocols[pppType]:
+		return true
+	case pppType == lcp.PPPTypeCHAP:
+		return s.config.Authenticator != nil
+	case pppType == lcp.PPPTypeCCP, pppType == lcp.PPPTypeCompressed:
+		return s.config.Encryption != 0
+	}
+	return false
+}
+
+// receiveIPX forwards an IPX packet received over the PPP channel upstream.
+func (s *Session) receiveIPX(payload []byte) {
+	packet := &ipx.Packet{}
+	if err := packet.UnmarshalBinary(payload); err != nil {
+		// TODO: Bad packet - log error?
+		return
+	}
+	// Ignore errors; it may have just been a filtered packet.
+	s.node.WritePacket(packet)
+}
+
 func (s *Session) handleLCP(l *lcp.LCP) bool {
 	switch l.Type {
 	case lcp.TerminateRequest:
@@ -159,7 +245,7 @@ func (s *Session) recvAndProcess() error {
 		return nil
 	}
 	ppp := pppLayer.(*layers.PPP)
-	if !supportedProtocols[ppp.PPPType] {
+	if !s.supports(ppp.PPPType) {
 		s.sendLCP(&lcp.LCP{
 			Type:       lcp.ProtocolReject,
 			Identifier: s.numProtocolRejects,
@@ -172,15 +258,32 @@ func (s *Session) recvAndProcess() error {
 		return nil
 	}
 
-	if ppp.PPPType == PPPTypeIPX {
-		packet := &ipx.Packet{}
-		if err := packet.UnmarshalBinary(ppp.LayerPayload()); err != nil {
-			// TODO: Bad packet - log error?
+	switch ppp.PPPType {
+	case PPPTypeIPX:
+		// IPX packets are only accepted once the link is fully set
+		// up, so that a peer cannot skip authentication. When
+		// encryption is required, unencrypted packets are dropped.
+		if s.config.Encryption == 0 && s.inNetworkState() {
+			s.receiveIPX(ppp.LayerPayload())
+		}
+		return nil
+	case lcp.PPPTypeCompressed:
+		s.mu.Lock()
+		c := s.recvCipher
+		s.mu.Unlock()
+		if c == nil || !s.inNetworkState() {
 			return nil
 		}
-		s.node.WritePacket(packet)
-		// Don't return error; it may have just been a filtered
-		// packet.
+		protocol, payload, err := c.Decrypt(ppp.LayerPayload())
+		if err == nil && layers.PPPType(protocol) == PPPTypeIPX {
+			s.receiveIPX(payload)
+		}
+		return nil
+	case lcp.PPPTypeCHAP:
+		l := pkt.Layer(lcp.LayerTypeCHAP)
+		if l != nil && s.challenger != nil {
+			s.challenger.RecvPacket(l.(*lcp.CHAP))
+		}
 		return nil
 	}
 	if ppp.PPPType == lcp.PPPTypeLCP {
@@ -209,6 +312,16 @@ func (s *Session) negotiate() error {
 			validate: nonNegotiable,
 		},
 	}
+	if s.config.Authenticator != nil {
+		// The peer may ask for plain CHAP-MD5 instead, but MPPE
+		// keys can only be derived from MS-CHAPv2.
+		localOptions[lcp.OptionAuthProtocol] = &option{
+			value: lcp.AuthProtocolMSCHAPv2,
+			validate: func(o *option, newValue []byte) bool {
+				return s.config.Encryption == 0 && bytes.Equal(newValue, lcp.AuthProtocolCHAPMD5)
+			},
+		}
+	}
 	remoteOptions := map[lcp.OptionType]*option{
 		lcp.OptionMagicNumber: &option{
 			value:    []byte{0, 0, 0, 0},
@@ -243,11 +356,43 @@ func (s *Session) negotiate() error {
 	}
 	// Negotiation successful
 	s.magicNumber = binary.BigEndian.Uint32(magicNumber)
+	if o, ok := localOptions[lcp.OptionAuthProtocol]; ok {
+		s.authAlgorithm = CHAPAlgorithm(o.value[2])
+	}
 	return nil
 }
 
-// negotiateIPX runs IPXCP negotiation phase of PPP link setup.
-func (s *Session) negotiateIPX() error {
+// authenticate runs the authentication phase of PPP link setup, if the
+// session is configured to require authentication.
+func (s *Session) authenticate() error {
+	if s.config.Authenticator == nil {
+		return nil
+	}
+	s.setState(stateAuthenticate)
+	c := newChallenger(s.config.Authenticator, s.authAlgorithm, func(p []byte) error {
+		return s.sendPPP(p, lcp.PPPTypeCHAP)
+	})
+	s.challenger = c
+	go c.StartAuthentication()
+
+	for {
+		if s.Terminated() {
+			return fmt.Errorf("link terminated during authentication phase")
+		}
+		if done, err := c.Done(); done {
+			return err // may be nil
+		}
+		if err := s.recvAndProcess(); err != nil {
+			return err
+		}
+	}
+}
+
+// newIPXCPNegotiator creates a negotiator for the IPXCP options, as defined
+// in RFC 1552. The peer is assigned the given node address, and the link
+// uses network number zero, which is the network number used throughout the
+// virtual network.
+func newIPXCPNegotiator(addr ipx.Addr, sendPPP func(p []byte) error) *negotiator {
 	localOptions := map[lcp.OptionType]*option{
 		lcp.OptionIPXNetwork: &option{
 			value: []byte{0, 0, 0, 0},
@@ -258,35 +403,149 @@ func (s *Session) negotiateIPX() error {
 	}
 	// TODO: Make address negotiable so that client can supply a
 	// desired address?
-	addr := network.NodeAddress(s.node)
 	remoteOptions := map[lcp.OptionType]*option{
+		// The peer must use the node address that it has been
+		// assigned on the network; if it asks for any other address
+		// (including zero, which means "assign me one"), it is sent
+		// a Configure-Nak with the assigned address.
 		lcp.OptionIPXNode: &option{
 			value:    addr[:],
 			validate: nonNegotiable,
 		},
+		// The peer need not state a network number, but if it does,
+		// it must be zero; any other value is Nak'ed.
+		lcp.OptionIPXNetwork: &option{
+			validate:  optionalValue(ipx.ZeroNetwork[:]),
+			preferred: ipx.ZeroNetwork[:],
+		},
+		// The peer can indicate that it needs no further
+		// configuration; this option carries no data.
+		lcp.OptionIPXConfigurationComplete: &option{},
 	}
-
-	n := &negotiator{
+	return &negotiator{
 		localOptions:  localOptions,
 		remoteOptions: remoteOptions,
-		sendPPP: func(p []byte) error {
-			return s.sendPPP(p, lcp.PPPTypeIPXCP)
+		sendPPP:       sendPPP,
+	}
+}
+
+// newCCPNegotiator creates a negotiator for CCP (RFC 1962) that only accepts
+// stateless MPPE (RFC 3078), using one of the given key strengths. We offer
+// all the strengths and let the peer choose between them, as the Windows
+// clients expect.
+func newCCPNegotiator(strengths mppe.Strengths, sendPPP func(p []byte) error) *negotiator {
+	validate := func(o *option, newValue []byte) bool {
+		s, ok := mppe.ParseOption(newValue)
+		return ok && s != 0 && s == s.Strongest() && s&strengths != 0
+	}
+	localOptions := map[lcp.OptionType]*option{
+		lcp.OptionMPPE: &option{
+			value:    mppe.OptionValue(strengths),
+			validate: validate,
 		},
 	}
+	remoteOptions := map[lcp.OptionType]*option{
+		// If the peer asks for more than one strength, or for
+		// something other than stateless MPPE, we suggest the
+		// strongest that we have in common.
+		// The initial value is never valid, so that a Configure-Request
+		// without the option is Nak'ed.
+		lcp.OptionMPPE: &option{
+			value:    []byte{},
+			validate: validate,
+			suggest: func(requested []byte) []byte {
+				common := mppe.OfferedStrengths(requested) & strengths
+				if common == 0 {
+					common = strengths
+				}
+				return mppe.OptionValue(common.Strongest())
+			},
+		},
+	}
+	return &negotiator{
+		localOptions:  localOptions,
+		remoteOptions: remoteOptions,
+		sendPPP:       sendPPP,
+	}
+}
+
+// negotiateIPX runs IPXCP negotiation phase of PPP link setup. If encryption
+// is enabled, CCP is negotiated at the same time, and all IPX traffic is
+// encrypted once it has completed.
+func (s *Session) negotiateIPX() error {
+	n := newIPXCPNegotiator(network.NodeAddress(s.node), func(p []byte) error {
+		return s.sendPPP(p, lcp.PPPTypeIPXCP)
+	})
 	s.negotiators[lcp.PPPTypeIPXCP] = n
-	go n.StartNegotiation()
+	negotiators := []*negotiator{n}
+	var ccp *negotiator
+	if s.config.Encryption != 0 {
+		ccp = newCCPNegotiator(s.config.Encryption, func(p []byte) error {
+			return s.sendPPP(p, lcp.PPPTypeCCP)
+		})
+		s.negotiators[lcp.PPPTypeCCP] = ccp
+		negotiators = append(negotiators, ccp)
+	}
+	for _, n := range negotiators {
+		go n.StartNegotiation()
+	}
 
 	for {
 		if s.Terminated() {
 			return fmt.Errorf("link terminated during IPX protocol negotiation")
 		}
-		if done, err := n.Done(); done {
-			return err // may be nil
+		allDone := true
+		for _, n := range negotiators {
+			done, err := n.Done()
+			if err != nil {
+				return err
+			}
+			allDone = allDone && done
+		}
+		if allDone {
+			break
 		}
 		if err := s.recvAndProcess(); err != nil {
 			return err
 		}
 	}
+	s.saveIPXCPInfo(n)
+	if ccp != nil {
+		return s.startEncryption(ccp)
+	}
+	return nil
+}
+
+// saveIPXCPInfo records the addressing negotiated by the given IPXCP
+// negotiator, for the IPXCPInfo property.
+func (s *Session) saveIPXCPInfo(n *negotiator) {
+	info := &IPXCPInfo{}
+	n.mu.Lock()
+	copy(info.Network[:], n.remoteOptions[lcp.OptionIPXNetwork].value)
+	copy(info.Node[:], n.remoteOptions[lcp.OptionIPXNode].value)
+	n.mu.Unlock()
+	s.mu.Lock()
+	s.ipxcp = info
+	s.mu.Unlock()
+}
+
+// startEncryption sets up the MPPE ciphers once CCP negotiation has
+// completed. The same key strength is used in both directions.
+func (s *Session) startEncryption(ccp *negotiator) error {
+	ccp.mu.Lock()
+	strength, _ := mppe.ParseOption(ccp.remoteOptions[lcp.OptionMPPE].value)
+	local, _ := mppe.ParseOption(ccp.localOptions[lcp.OptionMPPE].value)
+	ccp.mu.Unlock()
+	if strength&local == 0 {
+		return fmt.Errorf("peer negotiated invalid MPPE options")
+	}
+	c := s.challenger
+	send, recv := mppe.ServerKeys(c.passwordHash, c.ntResponse)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendCipher = mppe.NewCipher(send, strength)
+	s.recvCipher = mppe.NewCipher(recv, strength)
+	return nil
 }
 
 func (s *Session) runNetwork() error {
@@ -327,14 +586,22 @@ func (s *Session) Terminate(err error) {
 			Data: []byte(msg),
 		},
 	})
-	s.Close()
+	s.mu.Lock()
 	s.terminateError = err
+	s.mu.Unlock()
+	s.Close()
 }
 
 func (s *Session) doRun() error {
+	if s.config.Encryption != 0 && s.config.Authenticator == nil {
+		return ErrEncryptionNeedsAuth
+	}
 	if err := s.negotiate(); err != nil {
 		return err
 	}
+	if err := s.authenticate(); err != nil {
+		return err
+	}
 	if err := s.negotiateIPX(); err != nil {
 		return err
 	}
@@ -371,16 +638,55 @@ func (s *Session) Run(ctx context.Context) error {
 		return err
 	})
 	err := eg.Wait()
-	if s.terminateError != nil {
-		err = s.terminateError
+	s.mu.Lock()
+	terminateError := s.terminateError
+	s.mu.Unlock()
+	if terminateError != nil {
+		err = terminateError
 	} else {
 		s.Terminate(err)
 	}
 	return err
 }
 
+// node wraps the network node of a Session to add the IPXCPInfo property.
+type node struct {
+	network.Node
+	s *Session
+}
+
+func (n *node) GetProperty(x interface{}) bool {
+	info, ok := x.(*IPXCPInfo)
+	if !ok {
+		return n.Node.GetProperty(x)
+	}
+	n.s.mu.Lock()
+	defer n.s.mu.Unlock()
+	if n.s.ipxcp == nil {
+		return false
+	}
+	*info = *n.s.ipxcp
+	return true
+}
+
+// Node returns the network node that the session forwards IPX traffic to
+// and from. As well as the properties of the underlying node, it provides
+// the IPXCPInfo property.
+func (s *Session) Node() network.Node {
+	return &node{Node: s.node, s: s}
+}
+
+// NewSession creates a new Session with the default configuration, which
+// requires no authentication or encryption.
 func NewSession(channel io.ReadWriteCloser, node network.Node) *Session {
+	return NewSessionWithConfig(channel, node, &Config{})
+}
+
+// NewSessionWithConfig creates a new Session for a PPP link over the given
+// channel, where IPX traffic is forwarded to and from the given node.
+func NewSessionWithConfig(channel io.ReadWriteCloser, node network.Node, config *Config) *Session {
 	return &Session{
+		config:      *config,
 		state:       stateEstablish,
 		channel:     channel,
 		node:        node,
@@ -0,0 +1,145 @@
+package ppp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func TestIPXCPInfoProperty(t *testing.T) {
+	inner, err := addressable.Wrap(ipxswitch.New()).NewNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	s := NewSession(nil, inner)
+	node := s.Node()
+	var info IPXCPInfo
+	if node.GetProperty(&info) {
+		t.Errorf("IPXCPInfo available before negotiation: %+v", info)
+	}
+	// Properties of the underlying node are still available.
+	addr := network.NodeAddress(inner)
+	if got := network.NodeAddress(node); got != addr {
+		t.Errorf("wrong node address: want %s, got %s", addr, got)
+	}
+
+	n := newIPXCPNegotiator(addr, func([]byte) error { return nil })
+	s.saveIPXCPInfo(n)
+	if !node.GetProperty(&info) {
+		t.Fatalf("IPXCPInfo not available after negotiation")
+	}
+	want := IPXCPInfo{Network: ipx.ZeroNetwork, Node: addr}
+	if info != want {
+		t.Errorf("wrong IPXCPInfo: want %+v, got %+v", want, info)
+	}
+}
+
+// sendIPXFrame writes a PPP frame containing an IPX packet to the given
+// channel, as a peer would.
+func sendIPXFrame(t *testing.T, channel net.Conn, packet *ipx.Packet) {
+	t.Helper()
+	payload, err := packet.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := append([]byte{0xff, 0x03, 0x00, byte(PPPTypeIPX)}, payload...)
+	go channel.Write(frame)
+}
+
+// receivedIPX returns true if a packet is received by the given node.
+func receivedIPX(node network.Node) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := node.ReadPacket(ctx)
+	return err == nil
+}
+
+func TestIPXDroppedBeforeNetworkState(t *testing.T) {
+	for _, state := range []linkState{stateEstablish, stateAuthenticate} {
+		n := addressable.Wrap(ipxswitch.New())
+		inner := ipxtesting.MustNewNode(t, n)
+		other := ipxtesting.MustNewNode(t, n)
+		local, remote := net.Pipe()
+		s := NewSessionWithConfig(local, inner, &Config{
+			Authenticator: Users{"user": "password"},
+		})
+		s.setState(state)
+
+		packet := &ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast},
+				Src:  ipx.HeaderAddr{Addr: network.NodeAddress(inner)},
+			},
+		}
+		sendIPXFrame(t, remote, packet)
+		if err := s.recvAndProcess(); err != nil {
+			t.Fatal(err)
+		}
+		if receivedIPX(other) {
+			t.Errorf("IPX packet forwarded in state %d, before link setup completed", state)
+		}
+
+		s.setState(stateNetwork)
+		sendIPXFrame(t, remote, packet)
+		if err := s.recvAndProcess(); err != nil {
+			t.Fatal(err)
+		}
+		if !receivedIPX(other) {
+			t.Errorf("IPX packet not forwarded in network state")
+		}
+		s.Close()
+		remote.Close()
+	}
+}
+
+func TestIPXWithoutAuthentication(t *testing.T) {
+	n := addressable.Wrap(ipxswitch.New())
+	inner := ipxtesting.MustNewNode(t, n)
+	other := ipxtesting.MustNewNode(t, n)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	s := NewSessionWithConfig(local, inner, &Config{
+		Authenticator: Users{"user": "password"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	// Discard everything the server sends; the peer ignores the LCP
+	// and CHAP exchanges and just sends IPX packets.
+	go func() {
+		var buf [1500]byte
+		for {
+			if _, err := remote.Read(buf[:]); err != nil {
+				return
+			}
+		}
+	}()
+
+	packet := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast},
+			Src:  ipx.HeaderAddr{Addr: network.NodeAddress(inner)},
+		},
+	}
+	payload, err := packet.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		frame := append([]byte{0xff, 0x03, 0x00, byte(PPPTypeIPX)}, payload...)
+		if _, err := remote.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if receivedIPX(other) {
+		t.Errorf("IPX packet from unauthenticated peer was forwarded")
+	}
+}
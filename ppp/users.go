@@ -0,0 +1,68 @@
+package ppp
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fragglet/ipxbox/ppp/mschap"
+)
+
+var _ = (Authenticator)(Users{})
+
+// Users is a simple Authenticator that contains the passwords for a set of
+// users, indexed by user name.
+type Users map[string]string
+
+// ReadUsersFile reads a file of user names and passwords, one pair per line
+// separated by whitespace. Blank lines and lines starting with '#' are
+// ignored.
+func ReadUsersFile(filename string) (Users, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(Users)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"user password\"", filename, lineNum)
+		}
+		users[fields[0]] = fields[1]
+	}
+	return users, scanner.Err()
+}
+
+// CheckPassword implements the Authenticator interface.
+func (u Users) CheckPassword(user string, c *Challenge, response []byte) ([16]byte, bool) {
+	password, ok := u[user]
+	if !ok {
+		return [16]byte{}, false
+	}
+	var want []byte
+	switch c.Algorithm {
+	case CHAPMD5:
+		h := md5.New()
+		h.Write([]byte{c.Identifier})
+		h.Write([]byte(password))
+		h.Write(c.Value)
+		want = h.Sum(nil)
+	case MSCHAPv2:
+		want = mschap.GenerateNTResponse(c.Value, c.PeerChallenge, user, password)
+	default:
+		return [16]byte{}, false
+	}
+	if subtle.ConstantTimeCompare(want, response) != 1 {
+		return [16]byte{}, false
+	}
+	return mschap.NTPasswordHash(password), true
+}
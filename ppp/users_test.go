@@ -0,0 +1,31 @@
+package ppp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadUsersFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users")
+	contents := "# comment\nalice swordfish\n\n  bob\thunter2  \n"
+	if err := os.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := ReadUsersFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Users{"alice": "swordfish", "bob": "hunter2"}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("ReadUsersFile = %+v, want %+v", users, want)
+	}
+
+	if err := os.WriteFile(filename, []byte("alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadUsersFile(filename); err == nil {
+		t.Errorf("ReadUsersFile succeeded with malformed line")
+	}
+}
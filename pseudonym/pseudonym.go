@@ -0,0 +1,128 @@
+// Package pseudonym implements short, stable pseudonyms for client addresses,
+// so that servers can write logs without recording the real addresses of the
+// players connecting to them.
+package pseudonym
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+const (
+	// keyLength is the length in bytes of the randomly generated HMAC
+	// key.
+	keyLength = 32
+
+	// maxRegistered is the number of registered pseudonyms that are
+	// remembered for Lookup. Once exceeded, the least recently
+	// registered are forgotten.
+	maxRegistered = 4096
+)
+
+// Map generates pseudonyms for addresses. Pseudonyms are derived from an HMAC
+// of the address, so the same address always maps to the same pseudonym, but
+// the address cannot be recovered from a pseudonym without access to the Map.
+// The Map remembers the pseudonyms of registered addresses (normally those of
+// accepted clients) so that they can later be reversed.
+//
+// A nil *Map is valid and performs no mapping; addresses are returned as-is.
+type Map struct {
+	key     []byte
+	mu      sync.Mutex
+	reverse map[string]*list.Element
+	order   *list.List
+}
+
+// registration is an entry in Map.order.
+type registration struct {
+	name, addr string
+}
+
+// New creates a new Map using the given HMAC key. If key is nil, a random key
+// is generated, in which case pseudonyms are only stable for the lifetime of
+// the Map.
+func New(key []byte) (*Map, error) {
+	if key == nil {
+		key = make([]byte, keyLength)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &Map{
+		key:     key,
+		reverse: map[string]*list.Element{},
+		order:   list.New(),
+	}, nil
+}
+
+// Name returns the pseudonym for the given address. The pseudonym is not
+// remembered, so it cannot be reversed with Lookup unless the address is
+// also registered.
+func (m *Map) Name(addr string) string {
+	if m == nil {
+		return addr
+	}
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(addr))
+	return "client-" + hex.EncodeToString(mac.Sum(nil)[:5])
+}
+
+// Register returns the pseudonym for the given address, like Name, and
+// remembers it so that it can be reversed with Lookup. Only the most
+// recently registered addresses are remembered.
+func (m *Map) Register(addr string) string {
+	name := m.Name(addr)
+	if m == nil {
+		return name
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.reverse[name]; ok {
+		m.order.MoveToBack(e)
+		return name
+	}
+	m.reverse[name] = m.order.PushBack(&registration{name, addr})
+	if m.order.Len() > maxRegistered {
+		oldest := m.order.Remove(m.order.Front()).(*registration)
+		delete(m.reverse, oldest.name)
+	}
+	return name
+}
+
+// lazyName is a fmt.Stringer that computes a pseudonym when formatted.
+type lazyName struct {
+	m    *Map
+	addr fmt.Stringer
+}
+
+func (n lazyName) String() string {
+	return n.m.Name(n.addr.String())
+}
+
+// Lazy returns a value that formats as the pseudonym for the given address.
+// The pseudonym is only computed if the value is formatted, so this is
+// suitable for log messages that are usually discarded.
+func (m *Map) Lazy(addr fmt.Stringer) fmt.Stringer {
+	return lazyName{m, addr}
+}
+
+// Lookup returns the address that the given pseudonym was generated from.
+// Only pseudonyms of registered addresses can be reversed. This should
+// only be exposed to server administrators.
+func (m *Map) Lookup(name string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.reverse[name]
+	if !ok {
+		return "", false
+	}
+	return e.Value.(*registration).addr, true
+}
@@ -0,0 +1,92 @@
+package pseudonym
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPseudonyms(t *testing.T) {
+	m, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr1, addr2 := "192.0.2.1:10000", "192.0.2.2:10000"
+	name1 := m.Register(addr1)
+	if name1 == addr1 {
+		t.Errorf("address not pseudonymized: %s", name1)
+	}
+	if got := m.Name(addr1); got != name1 {
+		t.Errorf("pseudonym not stable: first %s, then %s", name1, got)
+	}
+	name2 := m.Register(addr2)
+	if name2 == name1 {
+		t.Errorf("different addresses got same pseudonym %s", name1)
+	}
+	for name, want := range map[string]string{name1: addr1, name2: addr2} {
+		got, ok := m.Lookup(name)
+		if !ok || got != want {
+			t.Errorf("Lookup(%q) = %q, %v; want %q", name, got, ok, want)
+		}
+	}
+	if _, ok := m.Lookup("client-0000000000"); ok {
+		t.Errorf("Lookup of unknown pseudonym succeeded")
+	}
+	// Names that are not registered cannot be reversed.
+	if _, ok := m.Lookup(m.Name("192.0.2.3:10000")); ok {
+		t.Errorf("Lookup of unregistered pseudonym succeeded")
+	}
+
+	// Maps with the same key generate the same pseudonyms.
+	key := []byte("secret")
+	m1, _ := New(key)
+	m2, _ := New(key)
+	if m1.Name(addr1) != m2.Name(addr1) {
+		t.Errorf("pseudonyms differ between Maps with the same key")
+	}
+
+	// A nil Map does nothing.
+	var nilMap *Map
+	if got := nilMap.Register(addr1); got != addr1 {
+		t.Errorf("nil Map changed address: got %s", got)
+	}
+	if got := nilMap.Lazy(stringer(addr1)).String(); got != addr1 {
+		t.Errorf("nil Map changed address: got %s", got)
+	}
+}
+
+type stringer string
+
+func (s stringer) String() string {
+	return string(s)
+}
+
+func TestLazy(t *testing.T) {
+	m, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "192.0.2.1:10000"
+	if got, want := fmt.Sprintf("%s", m.Lazy(stringer(addr))), m.Name(addr); got != want {
+		t.Errorf("Lazy formatted as %q, want %q", got, want)
+	}
+	if _, ok := m.Lookup(m.Name(addr)); ok {
+		t.Errorf("Lazy registered pseudonym")
+	}
+}
+
+func TestRegisterLimit(t *testing.T) {
+	m, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := m.Register("192.0.2.1:0")
+	for i := 0; i < maxRegistered; i++ {
+		m.Register(fmt.Sprintf("198.51.100.1:%d", i))
+	}
+	if got := len(m.reverse); got != maxRegistered {
+		t.Errorf("want %d registered pseudonyms, got %d", maxRegistered, got)
+	}
+	if _, ok := m.Lookup(first); ok {
+		t.Errorf("oldest pseudonym not forgotten")
+	}
+}
@@ -3,33 +3,111 @@
 package qproxy
 
 import (
+	"bytes"
 	"context"
-	"io"
+	"encoding/binary"
+	"fmt"
 	"log"
 	"net"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/udpproxy"
 )
 
 const (
-	garbageCollectPeriod = 10 * time.Second
-	quakeIPXSocket       = 26000
-	connectedIPXSocket   = 26001
-	quakeHeaderBytes     = 4
-	acceptHeaderMinLen   = 9
+	quakeIPXSocket     = 26000
+	connectedIPXSocket = 26001
+	quakeHeaderBytes   = 4
+	acceptHeaderMinLen = 9
 
 	// Packet response from server when accepting connection
 	ccRepAccept = 0x81
+
+	// Packet response from server to a server info query, as broadcast
+	// by clients when searching for servers.
+	ccRepServerInfo = 0x83
+)
+
+// Game identifies which variant of the Quake network protocol a server uses.
+type Game int
+
+const (
+	// Quake is the original Quake ("NetQuake") protocol, where IPX
+	// packets have a four byte header and the server assigns a separate
+	// port to each connected client. It is proxied using a udpproxy
+	// Handler that translates between the two.
+	Quake Game = iota
+
+	// Quake2 and QuakeWorld use a different protocol where all packets
+	// for a client are sent to and from the server's main port, and
+	// connectionless packets begin with 0xffffffff rather than having a
+	// separate header. The IPX packets are the same as the UDP packets,
+	// so these are relayed unchanged.
+	Quake2
+	QuakeWorld
 )
 
+type gameInfo struct {
+	name      string
+	ipxSocket uint16
+	udpPort   int
+}
+
+var games = map[Game]gameInfo{
+	Quake:      {"quake", quakeIPXSocket, 26000},
+	Quake2:     {"quake2", 27910, 27910},
+	QuakeWorld: {"quakeworld", 27500, 27500},
+}
+
+func (g Game) String() string {
+	if info, ok := games[g]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("Game(%d)", int(g))
+}
+
+// ParseServer parses a Quake server address of the form game://host:port,
+// where game is "quake", "quake2" or "quakeworld". If the game is omitted,
+// Quake is assumed; if the port is omitted, the game's default server port
+// is used. The game and an address suitable for Config.Address are returned.
+func ParseServer(s string) (Game, string, error) {
+	game := Quake
+	if i := strings.Index(s, "://"); i >= 0 {
+		found := false
+		for g, info := range games {
+			if s[:i] == info.name {
+				game, found = g, true
+				break
+			}
+		}
+		if !found {
+			return Quake, "", fmt.Errorf("unknown game %q in Quake server address %q", s[:i], s)
+		}
+		s = s[i+3:]
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(s, strconv.Itoa(games[game].udpPort))
+	}
+	return game, s, nil
+}
+
 type Config struct {
 	// Address of Quake server.
 	Address string
 
-	// IdleTimeout is the amount of time after which a connection is deleted.
+	// Game is the protocol variant used by the server. The default is
+	// the original Quake protocol.
+	Game Game
+
+	// IdleTimeout is the amount of time after which a connection is deleted
+	// if no packets have been sent or received on it. Each connection
+	// has its own UDP socket, which is opened when the first packet is
+	// received from an IPX client and closed when the connection is
+	// deleted. If zero, a default of one minute is used.
 	IdleTimeout time.Duration
 }
 
@@ -38,14 +116,20 @@ func debug(fmt string, args ...interface{}) {
 }
 
 type connection struct {
-	p             *Proxy
+	c             *udpproxy.Conn
 	rs            reliableSharder
-	ipxAddr       *ipx.HeaderAddr
-	conn          *net.UDPConn
-	lastRXTime    time.Time
 	connectedPort int
 	ipxSocket     uint16
-	closed        bool
+}
+
+func newConnection(c *udpproxy.Conn) udpproxy.Handler {
+	qc := &connection{
+		c:             c,
+		connectedPort: -1,
+		ipxSocket:     connectedIPXSocket,
+	}
+	qc.rs.init(qc.sendToUpstream, qc.sendToDownstream)
+	return qc
 }
 
 // handleAccept checks if a packet received from the main server port is a
@@ -82,27 +166,46 @@ func (c *connection) handleAccept(packet []byte, serverAddr *net.UDPAddr) {
 			IP:   serverAddr.IP,
 			Port: c.connectedPort,
 		}
-		if _, err := c.conn.WriteToUDP([]byte{}, destAddress); err != nil {
+		if err := c.c.WriteToServer([]byte{}, destAddress); err != nil {
 			log.Printf("error sending firewall traversal packet: %v", err)
 		}
 	}
 }
 
+// handleServerInfo checks if a packet received from the main server port is
+// a CCREP_SERVER_INFO packet, sent in reply to a client searching for
+// servers. The packet starts with the server's address as a string, which
+// Quake clients parse and use in place of the address the reply came from.
+// The UDP address is meaningless to an IPX client, so it is replaced with the
+// proxy's IPX address, in the format that Quake uses for IPX addresses.
+func (c *connection) handleServerInfo(packet []byte) []byte {
+	if len(packet) < 5 || packet[4] != ccRepServerInfo {
+		return packet
+	}
+	if binary.BigEndian.Uint16(packet[0:2])&flagCtl == 0 {
+		return packet
+	}
+	addrLen := bytes.IndexByte(packet[5:], 0)
+	if addrLen < 0 {
+		return packet
+	}
+	addr := c.c.LocalAddr()
+	ipxAddr := fmt.Sprintf("00000000:%02x%02x%02x%02x%02x%02x:%d",
+		addr[0], addr[1], addr[2], addr[3], addr[4], addr[5],
+		quakeIPXSocket)
+	result := append([]byte{}, packet[:5]...)
+	result = append(result, ipxAddr...)
+	result = append(result, packet[5+addrLen:]...)
+	// The length of the packet is in the lower half of the control word.
+	binary.BigEndian.PutUint16(result[2:4], uint16(len(result)))
+	return result
+}
+
 func (c *connection) sendToDownstreamSocket(payload []byte, socket uint16) error {
 	zeroBytes := [quakeHeaderBytes]byte{}
 	pktBytes := append([]byte{}, zeroBytes[:]...)
 	pktBytes = append(pktBytes, payload...)
-	return c.p.node.WritePacket(&ipx.Packet{
-		Header: ipx.Header{
-			Length: uint16(ipx.HeaderLength + len(pktBytes)),
-			Dest:   *c.ipxAddr,
-			Src: ipx.HeaderAddr{
-				Addr:   network.NodeAddress(c.p.node),
-				Socket: socket,
-			},
-		},
-		Payload: pktBytes,
-	})
+	return c.c.WriteToClient(pktBytes, socket)
 }
 
 // sendToDownstream forwards the given packet to the client, sending to the
@@ -116,193 +219,81 @@ func (c *connection) sendToUpstream(payload []byte) error {
 	if c.connectedPort < 0 {
 		return nil
 	}
-	_, err := c.conn.WriteToUDP(payload, &net.UDPAddr{
-		IP:   c.p.address.IP,
+	return c.c.WriteToServer(payload, &net.UDPAddr{
+		IP:   c.c.ServerAddr().IP,
 		Port: c.connectedPort,
 	})
-	return err
 }
 
-func (c *connection) receivePackets() {
-	var buf [9000]byte
-	for {
-		n, addr, err := c.conn.ReadFromUDP(buf[:])
-		switch {
-		case c.closed:
-			return
-		case err != nil:
-			log.Printf("error receiving UDP packets for connection to %v: %v", c.conn.RemoteAddr(), err)
-			return
-		}
-		// Sanity check: packet must come from server's IP address.
-		if !addr.IP.Equal(c.p.address.IP) {
-			continue
-		}
-		// Packet must come from either the server's main port or from
-		// the port assigned to this connection. Map this into the IPX
-		// socket number for the source address.
-		var socket uint16
-		switch addr.Port {
-		case c.p.address.Port:
-			socket = uint16(quakeIPXSocket)
-			c.handleAccept(buf[:n], &c.p.address)
-		case c.connectedPort:
-			socket = uint16(c.ipxSocket)
-			eaten, err := c.rs.receiveFromUpstream(buf[:n])
-			if err != nil || eaten {
-				// Processed by sharder.
-				continue
-			}
-		default:
-			continue
+// ServerPacket processes a packet received from the server.
+func (c *connection) ServerPacket(packet []byte, addr *net.UDPAddr) error {
+	// Packet must come from either the server's main port or from
+	// the port assigned to this connection. Map this into the IPX
+	// socket number for the source address.
+	var socket uint16
+	switch addr.Port {
+	case c.c.ServerAddr().Port:
+		socket = uint16(quakeIPXSocket)
+		c.handleAccept(packet, c.c.ServerAddr())
+		packet = c.handleServerInfo(packet)
+	case c.connectedPort:
+		socket = uint16(c.ipxSocket)
+		eaten, err := c.rs.receiveFromUpstream(packet)
+		if err != nil || eaten {
+			// Processed by sharder.
+			return nil
 		}
-		c.lastRXTime = time.Now()
-		if err := c.sendToDownstreamSocket(buf[:n], socket); err != nil {
-			// TODO: close connection?
-		}
-	}
-}
-
-type Proxy struct {
-	config  Config
-	node    network.Node
-	conns   map[ipx.HeaderAddr]*connection
-	mu      sync.Mutex
-	address net.UDPAddr
-}
-
-func (p *Proxy) newConnection(ipxAddr *ipx.HeaderAddr) (*connection, error) {
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
-	if err != nil {
-		return nil, err
-	}
-	c := &connection{
-		p:             p,
-		ipxAddr:       ipxAddr,
-		conn:          conn,
-		lastRXTime:    time.Now(),
-		connectedPort: -1,
-		ipxSocket:     connectedIPXSocket,
-	}
-	c.rs.init(c.sendToUpstream, c.sendToDownstream)
-	p.conns[*ipxAddr] = c
-	go c.receivePackets()
-	return c, nil
-}
-
-func (p *Proxy) closeConnection(addr *ipx.HeaderAddr) {
-	c, ok := p.conns[*addr]
-	if !ok {
-		return
-	}
-	c.closed = true
-	delete(p.conns, *addr)
-	c.conn.Close()
-}
-
-func (p *Proxy) resolveAddress() bool {
-	a, err := net.ResolveUDPAddr("udp", p.config.Address)
-	if err != nil {
-		log.Printf("failed to resolve server address: %v", err)
-		return false
-	}
-	p.address = *a
-	return true
-}
-
-func (p *Proxy) processPacket(packet *ipx.Packet) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	// First connection triggers the server address to be resolved. After
-	// all connections time out, we resolve again once a new connection is
-	// opened. This handles dynamic DNS addresses where the IP changes.
-	// But we don't block on DNS resolution while a game is in progress.
-	if len(p.conns) == 0 && !p.resolveAddress() {
-		return
-	}
-	c, ok := p.conns[packet.Header.Src]
-	if !ok {
-		var err error
-		c, err = p.newConnection(&packet.Header.Src)
-		if err != nil {
-			log.Printf("failed to create new connection to %v: %v", p.address, err)
-			return
-		}
-	}
-	c.lastRXTime = time.Now()
-	if _, err := c.conn.WriteToUDP(packet.Payload[quakeHeaderBytes:], &p.address); err != nil {
-		log.Printf("failed to forward IPX packet to UDP server: %v", err)
-		p.closeConnection(&packet.Header.Src)
+	default:
+		return nil
 	}
+	return c.sendToDownstreamSocket(packet, socket)
 }
 
-func (p *Proxy) processConnectedPacket(packet *ipx.Packet) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	c, ok := p.conns[packet.Header.Src]
-	if !ok {
-		return
+// ClientPacket processes a packet received from the IPX client, stripping
+// the Quake IPX header before forwarding it to the server.
+func (c *connection) ClientPacket(packet *ipx.Packet) error {
+	if len(packet.Payload) < quakeHeaderBytes {
+		return nil
 	}
-	c.lastRXTime = time.Now()
 	msg := packet.Payload[quakeHeaderBytes:]
+	if packet.Header.Dest.Socket == quakeIPXSocket {
+		return c.c.WriteToServer(msg, c.c.ServerAddr())
+	}
 	eaten, err := c.rs.receiveFromDownstream(msg)
 	if err != nil {
-		log.Printf("error processing packet from downstream: %v", err)
-		p.closeConnection(&packet.Header.Src)
+		return fmt.Errorf("error processing packet from downstream: %w", err)
 	}
 	if eaten {
 		// Handled by reliable sharder code.
-		return
-	}
-	if err := c.sendToUpstream(msg); err != nil {
-		log.Printf("failed to forward IPX packet to UDP server: %v", err)
-		p.closeConnection(&packet.Header.Src)
+		return nil
 	}
+	return c.sendToUpstream(msg)
 }
 
-func (p *Proxy) garbageCollect() {
-	for {
-		time.Sleep(garbageCollectPeriod)
-		p.mu.Lock()
-		now := time.Now()
-		expiredConns := []ipx.HeaderAddr{}
-		for addr, c := range p.conns {
-			if now.Sub(c.lastRXTime) > p.config.IdleTimeout {
-				debug("timeout for %s: idle %s", c.conn.RemoteAddr(), now.Sub(c.lastRXTime))
-				expiredConns = append(expiredConns, addr)
-			}
-		}
-		for _, addr := range expiredConns {
-			p.closeConnection(&addr)
-		}
-		p.mu.Unlock()
-	}
+// Proxy makes a Quake server available to IPX clients.
+type Proxy struct {
+	relay *udpproxy.Proxy
 }
 
+// Run processes packets received from IPX clients until the context is
+// cancelled or the node is closed. When it returns, all connections to the
+// server are closed.
 func (p *Proxy) Run(ctx context.Context) {
-	go p.garbageCollect()
-	for {
-		packet, err := p.node.ReadPacket(ctx)
-		switch {
-		case err == io.ErrClosedPipe:
-			return
-		case err != nil:
-			log.Printf("unexpected error reading from node: %v", err)
-			return
-		}
-
-		if packet.Header.Dest.Socket == quakeIPXSocket {
-			p.processPacket(packet)
-		} else if packet.Header.Dest.Socket == connectedIPXSocket {
-			p.processConnectedPacket(packet)
-		}
-	}
+	p.relay.Run(ctx)
 }
 
+// New creates a new proxy that makes the Quake server in the given Config
+// available to IPX clients. Run must be called to process packets from the
+// given node.
 func New(config *Config, node network.Node) *Proxy {
-	return &Proxy{
-		config: *config,
-		node:   node,
-		conns:  make(map[ipx.HeaderAddr]*connection),
+	relayConfig := &udpproxy.Config{
+		Address:     config.Address,
+		Socket:      games[config.Game].ipxSocket,
+		IdleTimeout: config.IdleTimeout,
+	}
+	if config.Game == Quake {
+		relayConfig.ConnectedSockets = []uint16{connectedIPXSocket}
+		relayConfig.NewHandler = newConnection
 	}
+	return &Proxy{relay: udpproxy.New(relayConfig, node)}
 }
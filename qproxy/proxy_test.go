@@ -0,0 +1,214 @@
+package qproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+)
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantGame Game
+		wantAddr string
+	}{
+		{"quake.example.com:26001", Quake, "quake.example.com:26001"},
+		{"quake.example.com", Quake, "quake.example.com:26000"},
+		{"quake://quake.example.com", Quake, "quake.example.com:26000"},
+		{"quake2://q2.example.com", Quake2, "q2.example.com:27910"},
+		{"quake2://q2.example.com:27911", Quake2, "q2.example.com:27911"},
+		{"quakeworld://192.168.0.1", QuakeWorld, "192.168.0.1:27500"},
+	}
+	for _, test := range tests {
+		game, addr, err := ParseServer(test.in)
+		if err != nil {
+			t.Errorf("ParseServer(%q) failed: %v", test.in, err)
+			continue
+		}
+		if game != test.wantGame || addr != test.wantAddr {
+			t.Errorf("ParseServer(%q) = %v, %q; want %v, %q", test.in, game, addr, test.wantGame, test.wantAddr)
+		}
+	}
+	if _, _, err := ParseServer("doom://example.com"); err == nil {
+		t.Errorf("ParseServer with unknown game succeeded")
+	}
+}
+
+func TestQuake2Proxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	n := addressable.Wrap(ipxswitch.New())
+	proxyNode, err := n.NewNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(&Config{
+		Address:     server.LocalAddr().String(),
+		Game:        Quake2,
+		IdleTimeout: time.Minute,
+	}, proxyNode)
+	go p.Run(ctx)
+	defer proxyNode.Close()
+
+	client, err := n.NewNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	clientAddr := ipx.HeaderAddr{Addr: network.NodeAddress(client), Socket: 27901}
+
+	// Connectionless packets are forwarded unchanged in both directions.
+	getinfo := "\xff\xff\xff\xffinfo 34"
+	client.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 27910},
+			Src:  clientAddr,
+		},
+		Payload: []byte(getinfo),
+	})
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [1500]byte
+	nbytes, proxyAddr, err := server.ReadFromUDP(buf[:])
+	if err != nil {
+		t.Fatalf("packet not forwarded to server: %v", err)
+	}
+	if got := string(buf[:nbytes]); got != getinfo {
+		t.Errorf("wrong packet forwarded to server: want %q, got %q", getinfo, got)
+	}
+
+	reply := "\xff\xff\xff\xffinfo\nq2dm1"
+	if _, err := server.WriteToUDP([]byte(reply), proxyAddr); err != nil {
+		t.Fatal(err)
+	}
+	packet, err := client.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("reply not forwarded to client: %v", err)
+	}
+	if packet.Header.Dest != clientAddr || packet.Header.Src.Socket != 27910 {
+		t.Errorf("wrong addresses on reply: %+v", packet.Header)
+	}
+	if got := string(packet.Payload); got != reply {
+		t.Errorf("wrong reply forwarded to client: want %q, got %q", reply, got)
+	}
+}
+
+// controlPacket builds a Quake control packet with the given contents.
+func controlPacket(contents ...interface{}) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0x80, 0, 0, 0})
+	for _, c := range contents {
+		switch c := c.(type) {
+		case byte:
+			buf.WriteByte(c)
+		case string:
+			buf.WriteString(c)
+			buf.WriteByte(0)
+		}
+	}
+	result := buf.Bytes()
+	binary.BigEndian.PutUint16(result[2:4], uint16(len(result)))
+	return result
+}
+
+// fakeQuakeServer answers every packet received with a CCREP_SERVER_INFO
+// packet for a server with the given hostname.
+func fakeQuakeServer(t *testing.T, hostname string) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var buf [1500]byte
+		for {
+			_, addr, err := conn.ReadFromUDP(buf[:])
+			if err != nil {
+				return
+			}
+			reply := controlPacket(byte(ccRepServerInfo), conn.LocalAddr().String(), hostname, "e1m1", byte(0), byte(8), byte(3))
+			conn.WriteToUDP(reply, addr)
+		}
+	}()
+	return conn
+}
+
+func TestServerDiscovery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n := addressable.Wrap(ipxswitch.New())
+
+	// hostname -> IPX address of the proxy for that server
+	want := map[string]ipx.Addr{}
+	for _, hostname := range []string{"server1", "server2"} {
+		server := fakeQuakeServer(t, hostname)
+		defer server.Close()
+		node, err := n.NewNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Close()
+		p := New(&Config{
+			Address:     server.LocalAddr().String(),
+			IdleTimeout: time.Minute,
+		}, node)
+		go p.Run(ctx)
+		want[hostname] = network.NodeAddress(node)
+	}
+
+	client, err := n.NewNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// CCREQ_SERVER_INFO, preceded by the IPX driver's header.
+	query := append([]byte{0, 0, 0, 0}, controlPacket(byte(0x02), "QUAKE", byte(3))...)
+	client.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: quakeIPXSocket},
+			Src:  ipx.HeaderAddr{Addr: network.NodeAddress(client), Socket: 0x4000},
+		},
+		Payload: query,
+	})
+
+	for len(want) > 0 {
+		packet, err := client.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("missing replies for %v: %v", want, err)
+		}
+		reply := packet.Payload[quakeHeaderBytes:]
+		if len(reply) < 5 || reply[4] != ccRepServerInfo {
+			t.Fatalf("unexpected reply: %x", reply)
+		}
+		if got := int(binary.BigEndian.Uint16(reply[2:4])); got != len(reply) {
+			t.Errorf("wrong length in reply: want %d, got %d", len(reply), got)
+		}
+		fields := bytes.Split(reply[5:], []byte{0})
+		addr, hostname := string(fields[0]), string(fields[1])
+		proxyAddr, ok := want[hostname]
+		if !ok {
+			t.Fatalf("unexpected or duplicate reply for %q", hostname)
+		}
+		delete(want, hostname)
+		if packet.Header.Src.Addr != proxyAddr || packet.Header.Src.Socket != quakeIPXSocket {
+			t.Errorf("reply for %q from wrong address: want %v, got %+v", hostname, proxyAddr, packet.Header.Src)
+		}
+		wantAddr := fmt.Sprintf("00000000:%x:26000", proxyAddr[:])
+		if addr != wantAddr {
+			t.Errorf("wrong address in reply for %q: want %q, got %q", hostname, wantAddr, addr)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Package selftest implements a smoke test that runs a server and two
+// clients in-process and checks that packets are delivered between them.
+// It is intended to prove that the core of ipxbox works on a user's machine
+// before they start troubleshooting their DOSBox setup.
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/fragglet/ipxbox/client/dosbox"
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	"github.com/fragglet/ipxbox/server"
+	dosboxserver "github.com/fragglet/ipxbox/server/dosbox"
+)
+
+// Timeout is the time allowed for each step of the self-test.
+var Timeout = 5 * time.Second
+
+// step runs a single step of the self-test, reporting the result to w.
+func step(w io.Writer, name string, f func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	if err := f(ctx); err != nil {
+		fmt.Fprintf(w, "%s: FAILED: %v\n", name, err)
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	fmt.Fprintf(w, "%s: ok\n", name)
+	return nil
+}
+
+// sendAndReceive sends a packet from one client to the given destination
+// address and checks that it is received by the other client.
+func sendAndReceive(ctx context.Context, from, to network.Node, dest ipx.Addr) error {
+	payload := []byte("ipxbox self-test")
+	err := from.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: dest, Socket: 0x869c},
+			Src:  ipx.HeaderAddr{Addr: network.NodeAddress(from), Socket: 0x869c},
+		},
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		packet, err := to.ReadPacket(ctx)
+		if err != nil {
+			return fmt.Errorf("packet not received: %w", err)
+		}
+		if bytes.Equal(packet.Payload, payload) {
+			return nil
+		}
+	}
+}
+
+// Run runs the self-test, writing the result of each step to w. An error
+// is returned if any step fails.
+func Run(w io.Writer) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var s *server.Server
+	err := step(w, "start server", func(context.Context) error {
+		var err error
+		s, err = server.New("127.0.0.1:0", &server.Config{
+			Protocols: []server.Protocol{
+				&dosboxserver.Protocol{
+					Network: addressable.Wrap(ipxswitch.New()),
+				},
+			},
+			ClientTimeout: time.Minute,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	go s.Run(ctx)
+
+	var clients [2]network.Node
+	for i := range clients {
+		name := fmt.Sprintf("connect client %d", i+1)
+		err := step(w, name, func(ctx context.Context) error {
+			var err error
+			clients[i], err = dosbox.Dial(ctx, s.Addr().String())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		defer clients[i].Close()
+	}
+
+	err = step(w, "broadcast from client 1 to client 2", func(ctx context.Context) error {
+		return sendAndReceive(ctx, clients[0], clients[1], ipx.AddrBroadcast)
+	})
+	if err != nil {
+		return err
+	}
+	return step(w, "unicast from client 2 to client 1", func(ctx context.Context) error {
+		return sendAndReceive(ctx, clients[1], clients[0], network.NodeAddress(clients[0]))
+	})
+}
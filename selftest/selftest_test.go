@@ -0,0 +1,17 @@
+package selftest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Run(&buf); err != nil {
+		t.Fatalf("self-test failed: %v\noutput:\n%s", err, buf.String())
+	}
+	if strings.Contains(buf.String(), "FAILED") {
+		t.Errorf("failure reported in output:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+const (
+	authTimestampLen  = 8
+	authNonceLen      = 16
+	authSignedLen     = authTimestampLen + authNonceLen
+	authRegPayloadLen = authSignedLen + sha256.Size
+
+	// AuthMaxClockSkew is the maximum difference between the timestamp
+	// in an authenticated registration packet and the server's clock.
+	AuthMaxClockSkew = 5 * time.Minute
+)
+
+func registrationMAC(secret []byte, signed []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signed)
+	return mac.Sum(nil)
+}
+
+// SignRegistration adds an authentication payload to the given registration
+// packet, using the given shared secret and time, so that it will be accepted
+// by a server with Config.SharedSecret set.
+//
+// An authenticated registration packet is a normal registration packet for
+// the protocol (for DOSBox, an IPX header addressed to 00:00:00:00:00:00
+// socket 2) followed by a 56 byte payload:
+//
+//	bytes 0-7:   current time, as seconds since the Unix epoch, as a
+//	             big endian 64-bit integer.
+//	bytes 8-23:  random nonce.
+//	bytes 24-55: HMAC-SHA256 of bytes 0-23, using the shared secret as key.
+//
+// The header length field covers the payload as normal (ie. 86 bytes). The
+// timestamp must be within AuthMaxClockSkew of the server's clock, and the
+// server remembers the nonces it has seen for that long, so a captured
+// registration packet cannot be replayed. The server removes the payload
+// before passing the packet to the protocol, so the protocol sees a normal
+// registration packet.
+//
+// Stock DOSBox cannot send authenticated registrations, so a server with a
+// shared secret only accepts clients that support this extension.
+func SignRegistration(packet *ipx.Packet, secret []byte, now time.Time) {
+	payload := make([]byte, authSignedLen, authRegPayloadLen)
+	binary.BigEndian.PutUint64(payload, uint64(now.Unix()))
+	if _, err := rand.Read(payload[authTimestampLen:]); err != nil {
+		panic(err)
+	}
+	packet.Payload = append(payload, registrationMAC(secret, payload)...)
+	packet.Header.Length = uint16(ipx.HeaderLength + len(packet.Payload))
+}
+
+// nonceCache records the nonces of authenticated registrations, so that each
+// registration is only accepted once. Nonces are forgotten once their
+// registration's timestamp is too old to be accepted anyway.
+type nonceCache struct {
+	mu        sync.Mutex
+	seen      map[[authNonceLen]byte]time.Time
+	nextSweep time.Time
+}
+
+// add records the given nonce, returning false if it has already been seen.
+// The nonce expires at the given time.
+func (c *nonceCache) add(nonce []byte, expiry, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = map[[authNonceLen]byte]time.Time{}
+	}
+	if now.After(c.nextSweep) {
+		for n, e := range c.seen {
+			if now.After(e) {
+				delete(c.seen, n)
+			}
+		}
+		c.nextSweep = now.Add(AuthMaxClockSkew)
+	}
+	var key [authNonceLen]byte
+	copy(key[:], nonce)
+	if e, ok := c.seen[key]; ok && !now.After(e) {
+		return false
+	}
+	c.seen[key] = expiry
+	return true
+}
+
+// verifyRegistration checks the authentication payload of a registration
+// packet, returning true if it is valid and its nonce has not been seen
+// before in the given cache. If so, the payload is removed.
+func verifyRegistration(packet *ipx.Packet, secret []byte, now time.Time, nonces *nonceCache) bool {
+	payload := packet.Payload
+	if len(payload) != authRegPayloadLen {
+		return false
+	}
+	timestamp := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	skew := now.Sub(timestamp)
+	if skew > AuthMaxClockSkew || skew < -AuthMaxClockSkew {
+		return false
+	}
+	want := registrationMAC(secret, payload[:authSignedLen])
+	if !hmac.Equal(payload[authSignedLen:], want) {
+		return false
+	}
+	if !nonces.add(payload[authTimestampLen:authSignedLen], timestamp.Add(AuthMaxClockSkew), now) {
+		return false
+	}
+	packet.Payload = nil
+	packet.Header.Length = uint16(ipx.HeaderLength)
+	return true
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+func TestVerifyRegistration(t *testing.T) {
+	secret := []byte("swordfish")
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		secret []byte
+		signed time.Time
+		want   bool
+	}{
+		{"valid", secret, now, true},
+		{"within clock skew", secret, now.Add(-AuthMaxClockSkew + time.Second), true},
+		{"too old", secret, now.Add(-AuthMaxClockSkew - time.Second), false},
+		{"in the future", secret, now.Add(AuthMaxClockSkew + time.Second), false},
+		{"wrong secret", []byte("password"), now, false},
+	}
+	for _, test := range tests {
+		packet := &ipx.Packet{}
+		SignRegistration(packet, test.secret, test.signed)
+		if packet.Header.Length != 86 {
+			t.Errorf("%s: want header length 86, got %d", test.name, packet.Header.Length)
+		}
+		got := verifyRegistration(packet, secret, now, &nonceCache{})
+		if got != test.want {
+			t.Errorf("%s: want %v, got %v", test.name, test.want, got)
+		}
+		if got && (len(packet.Payload) != 0 || packet.Header.Length != 30) {
+			t.Errorf("%s: authentication payload not removed: %+v", test.name, packet)
+		}
+	}
+
+	// Stock registration packets, without a payload, are rejected.
+	if verifyRegistration(&ipx.Packet{}, secret, now, &nonceCache{}) {
+		t.Errorf("registration without authentication payload accepted")
+	}
+}
+
+func TestRegistrationReplay(t *testing.T) {
+	secret := []byte("swordfish")
+	now := time.Unix(1700000000, 0)
+	nonces := &nonceCache{}
+	captured := &ipx.Packet{}
+	SignRegistration(captured, secret, now)
+	replay := func(at time.Time) bool {
+		packet := &ipx.Packet{Payload: append([]byte{}, captured.Payload...)}
+		return verifyRegistration(packet, secret, at, nonces)
+	}
+	if !replay(now) {
+		t.Fatalf("registration not accepted the first time")
+	}
+	// A replay is rejected as a duplicate while the timestamp is still
+	// valid, and for being too old afterwards.
+	for _, at := range []time.Time{
+		now.Add(time.Second),
+		now.Add(AuthMaxClockSkew),
+		now.Add(AuthMaxClockSkew + time.Second),
+	} {
+		if replay(at) {
+			t.Errorf("replayed registration accepted at %v", at.Sub(now))
+		}
+	}
+
+	// A fresh registration at the same time has a different nonce, so
+	// it is accepted.
+	fresh := &ipx.Packet{}
+	SignRegistration(fresh, secret, now)
+	if !verifyRegistration(fresh, secret, now.Add(time.Second), nonces) {
+		t.Errorf("fresh registration rejected")
+	}
+
+	// Changing the nonce invalidates the MAC.
+	tampered := &ipx.Packet{}
+	SignRegistration(tampered, secret, now)
+	tampered.Payload[authTimestampLen] ^= 1
+	if verifyRegistration(tampered, secret, now, nonces) {
+		t.Errorf("registration with tampered nonce accepted")
+	}
+}
+
+func TestNonceCacheExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := &nonceCache{}
+	for i := 0; i < 10; i++ {
+		c.add([]byte{byte(i)}, now.Add(AuthMaxClockSkew), now)
+	}
+	// Once the nonces have expired, they are swept from the cache.
+	c.add([]byte{0xff}, now.Add(3*AuthMaxClockSkew), now.Add(2*AuthMaxClockSkew))
+	if got := len(c.seen); got != 1 {
+		t.Errorf("want 1 nonce in cache after expiry, got %d", got)
+	}
+}
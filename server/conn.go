@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/pipe"
+)
+
+// ConnHandler runs clients that connect over a connection-oriented
+// transport, such as TCP or WebSocket, where each connection is a separate
+// client. The transport is responsible for accepting connections and for
+// framing packets; ConnHandler adds the clients to a Server's client table,
+// so that they are subject to the same checks, limits, accounting and
+// callbacks as UDP clients, and run with the same protocols.
+type ConnHandler struct {
+	s       *Server
+	mu      sync.Mutex
+	conns   map[ipx.ReadWriteCloser]bool
+	pending int
+}
+
+// NewConnHandler creates a new ConnHandler that adds clients to the given
+// server. The server's Run method must be running for idle clients to be
+// timed out.
+func NewConnHandler(s *Server) *ConnHandler {
+	return &ConnHandler{
+		s:     s,
+		conns: map[ipx.ReadWriteCloser]bool{},
+	}
+}
+
+// Budget returns the budget that transports should account packets against
+// while they are buffered; see Config.Budget.
+func (h *ConnHandler) Budget() *pipe.Budget {
+	return h.s.config.Budget
+}
+
+// addConn adds a new connection that has not yet registered, returning
+// false if too many connections are already waiting to register.
+func (h *ConnHandler) addConn(conn ipx.ReadWriteCloser) bool {
+	maxPending := h.s.config.MaxPendingConns
+	if maxPending == 0 {
+		maxPending = DefaultMaxPendingConns
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pending >= maxPending {
+		return false
+	}
+	h.conns[conn] = true
+	h.pending++
+	return true
+}
+
+// registered is called once a connection is no longer waiting to register,
+// whether or not it registered successfully.
+func (h *ConnHandler) registered() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending--
+}
+
+func (h *ConnHandler) removeConn(conn ipx.ReadWriteCloser) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns, conn)
+}
+
+// readRegistration reads the first packet from a new connection, which
+// must arrive within Config.RegistrationTimeout.
+func (h *ConnHandler) readRegistration(ctx context.Context, conn ipx.ReadWriteCloser) (*ipx.Packet, error) {
+	defer h.registered()
+	timeout := h.s.config.RegistrationTimeout
+	if timeout == 0 {
+		timeout = DefaultRegistrationTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return conn.ReadPacket(ctx)
+}
+
+// Serve runs a client on a new connection from the given address, returning
+// once the client has disconnected. The connection is always closed before
+// Serve returns.
+func (h *ConnHandler) Serve(ctx context.Context, conn ipx.ReadWriteCloser, addr *net.TCPAddr) {
+	defer conn.Close()
+	s := h.s
+	addrName := s.config.Pseudonyms.Lazy(addr)
+	if !s.allowedIP(addr.IP) {
+		s.config.Logger.Debugf("connection from %s refused: "+
+			"address not allowed", addrName)
+		return
+	}
+	if !h.addConn(conn) {
+		s.packetLog.Debugf("connection from %s refused: too many "+
+			"connections waiting to register", addrName)
+		return
+	}
+	defer h.removeConn(conn)
+
+	packet, err := h.readRegistration(ctx, conn)
+	if err != nil {
+		s.config.Logger.Debugf("connection from %s closed: no "+
+			"registration received: %v", addrName, err)
+		return
+	}
+	clientAddr := &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	size := packetSize(packet)
+	s.mu.Lock()
+	protocol, ok := s.acceptClient(packet, clientAddr, conn)
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	c := s.newClient(ctx, protocol, clientAddr, conn)
+	s.mu.Unlock()
+	defer c.Close()
+
+	s.receive(c, packet, size, true)
+	for {
+		packet, err := conn.ReadPacket(ctx)
+		if err != nil {
+			return
+		}
+		s.receive(c, packet, packetSize(packet), false)
+	}
+}
+
+// packetSize returns the encoded size of the given packet.
+func packetSize(packet *ipx.Packet) int {
+	return ipx.HeaderLength + len(packet.Payload)
+}
+
+// Close disconnects all clients.
+func (h *ConnHandler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for conn := range h.conns {
+		conn.Close()
+	}
+	return nil
+}
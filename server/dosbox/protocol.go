@@ -3,23 +3,28 @@ package dosbox
 
 import (
 	"context"
-	"log"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/logging"
+	"github.com/fragglet/ipxbox/metrics"
 	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/network/stats"
+	"github.com/fragglet/ipxbox/network/tappable"
+	"github.com/fragglet/ipxbox/pseudonym"
 	"github.com/fragglet/ipxbox/server"
+	"github.com/fragglet/ipxbox/webhook"
 )
 
 var (
 	_ = (server.Protocol)(&Protocol{})
 	_ = (ipx.ReadWriteCloser)(&client{})
 
-	// Server-initiated pings come from this address.
-	addrPingReply = [6]byte{0x02, 0xff, 0xff, 0xff, 0x00, 0x00}
+	// AddrPingReply is the address that server-initiated pings come
+	// from. It must never be assigned to a client.
+	AddrPingReply = ipx.Addr{0x02, 0xff, 0xff, 0xff, 0x00, 0x00}
 )
 
 // Protocol is an implementation of the server.Protocol interface that
@@ -36,15 +41,139 @@ type Protocol struct {
 	// This controls the time for keepalives.
 	KeepaliveTime time.Duration
 
+	// If non-zero, keepalives adapt to each client: if a keepalive ping
+	// goes unanswered, the client is probably behind a NAT that expires
+	// mappings sooner than KeepaliveTime, so the keepalive interval for
+	// that client is halved, down to this minimum.
+	MinKeepaliveTime time.Duration
+
 	// If not nil, log entries are written as clients connect and
 	// disconnect.
-	Logger *log.Logger
+	Logger *logging.Logger
+
+	// If not nil, client addresses are replaced with pseudonyms in
+	// log entries.
+	Pseudonyms *pseudonym.Map
+
+	// If not nil, a webhook is notified as clients join and leave.
+	Webhook *webhook.Notifier
+
+	// If not nil, round trip times for keepalive pings are recorded in
+	// this histogram.
+	RTT *metrics.Histogram
+
+	// A registration packet should consist only of an IPX header. If
+	// true, registration packets with trailing data are accepted and the
+	// extra data is ignored; otherwise they are rejected.
+	AcceptOversizedRegistration bool
+
+	// If non-zero, when a client disconnects (or times out), its IPX
+	// address is held for this long. If a new client connects from the
+	// same IP address within that time, it is assigned the same IPX
+	// address again, so that a player who drops out and rejoins appears
+	// to other players as the same machine.
+	AddressLeaseTime time.Duration
+
+	// If true, packets from clients that have a checksum (that is, whose
+	// checksum field is not ipx.NoChecksum) are dropped if the checksum
+	// is wrong.
+	VerifyChecksums bool
+
+	// If true, broadcast packets sent by a client are also delivered
+	// back to it, once the network has accepted them. Some applications
+	// expect to receive their own broadcasts.
+	ReflectBroadcasts bool
+
+	mu     sync.Mutex
+	leases map[string][]addressLease
+}
+
+// addressLease records the IPX address of a client that has disconnected.
+type addressLease struct {
+	addr   ipx.Addr
+	expiry time.Time
+}
+
+// leaseKey returns the key used to look up address leases for a client. Only
+// the IP address is used, since a client that reconnects will usually do so
+// from a different port.
+func leaseKey(remoteAddr net.Addr) string {
+	switch addr := remoteAddr.(type) {
+	case *net.UDPAddr:
+		return addr.IP.String()
+	case *net.TCPAddr:
+		return addr.IP.String()
+	default:
+		return remoteAddr.String()
+	}
+}
+
+// expireLeases removes all leases that have expired. p.mu must be held.
+func (p *Protocol) expireLeases(now time.Time) {
+	for key, leases := range p.leases {
+		var unexpired []addressLease
+		for _, l := range leases {
+			if now.Before(l.expiry) {
+				unexpired = append(unexpired, l)
+			}
+		}
+		if len(unexpired) == 0 {
+			delete(p.leases, key)
+		} else {
+			p.leases[key] = unexpired
+		}
+	}
+}
+
+// releaseAddress is called when a client disconnects, to hold its IPX address
+// for AddressLeaseTime.
+func (p *Protocol) releaseAddress(remoteAddr net.Addr, addr ipx.Addr) {
+	if p.AddressLeaseTime == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.expireLeases(now)
+	if p.leases == nil {
+		p.leases = map[string][]addressLease{}
+	}
+	key := leaseKey(remoteAddr)
+	p.leases[key] = append(p.leases[key], addressLease{
+		addr:   addr,
+		expiry: now.Add(p.AddressLeaseTime),
+	})
 }
 
-func (p *Protocol) log(format string, args ...interface{}) {
-	if p.Logger != nil {
-		p.Logger.Printf(format, args...)
+// claimAddress returns the IPX address most recently released by a client
+// connecting from the same IP address, removing its lease. If there is no
+// such address, false is returned. Several clients may share an IP address
+// (eg. behind a NAT gateway), so multiple leases may be held for one key.
+func (p *Protocol) claimAddress(remoteAddr net.Addr) (ipx.Addr, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expireLeases(time.Now())
+	key := leaseKey(remoteAddr)
+	leases := p.leases[key]
+	if len(leases) == 0 {
+		return ipx.AddrNull, false
 	}
+	l := leases[len(leases)-1]
+	if len(leases) == 1 {
+		delete(p.leases, key)
+	} else {
+		p.leases[key] = leases[:len(leases)-1]
+	}
+	return l.addr, true
+}
+
+// newNode creates a node for a new client, reassigning a leased address if
+// there is one for the client.
+func (p *Protocol) newNode(remoteAddr net.Addr) (network.Node, error) {
+	if addr, ok := p.claimAddress(remoteAddr); ok {
+		return network.NewNodeWithAddress(p.Network, addr)
+	}
+	return p.Network.NewNode()
 }
 
 func isRegistrationPacket(packet *ipx.Packet) bool {
@@ -53,55 +182,156 @@ func isRegistrationPacket(packet *ipx.Packet) bool {
 }
 
 // IsRegistrationPacket returns true if the given packet is a DOSbox protocol
-// registration packet.
+// registration packet. Unless AcceptOversizedRegistration is set, packets
+// that carry data after the header are not accepted.
 func (p *Protocol) IsRegistrationPacket(packet *ipx.Packet) bool {
+	if len(packet.Payload) > 0 && !p.AcceptOversizedRegistration {
+		return false
+	}
 	return isRegistrationPacket(packet)
 }
 
+// RefusalPacket implements server.RefusingProtocol. The reply assigns the
+// null address, which the ipxbox client reports as the server being full.
+// Stock DOSBox would instead accept the null address, so the server only
+// sends this to clients that signed their registration.
+func (p *Protocol) RefusalPacket() *ipx.Packet {
+	return registrationReply(ipx.AddrNull)
+}
+
 // StartClient is invoked as a new goroutine when a new client connects.
 func (p *Protocol) StartClient(ctx context.Context, inner ipx.ReadWriteCloser, remoteAddr net.Addr) error {
 	packet, err := inner.ReadPacket(ctx)
 	if err != nil {
 		return err
 	}
-	if !isRegistrationPacket(packet) {
+	if !p.IsRegistrationPacket(packet) {
 		return nil
 	}
-	node := p.Network.NewNode()
+	node, err := p.newNode(remoteAddr)
+	if err != nil {
+		return err
+	}
 	nodeAddr := network.NodeAddress(node)
+	if aa, ok := inner.(server.AddressAssigner); ok {
+		aa.AssignAddress(nodeAddr)
+	}
+	addrName := p.Pseudonyms.Register(remoteAddr.String())
+	fields := logging.Fields{
+		"ipx_address": nodeAddr.String(),
+		"udp_address": addrName,
+	}
 	defer func() {
 		node.Close()
+		p.releaseAddress(remoteAddr, nodeAddr)
+		p.Webhook.Notify(webhook.EventClientLeave, addrName, nodeAddr.String())
 		statsString := stats.Summary(node)
 		if statsString != "" {
-			p.log("%s (IPX address %s): final statistics: %s",
-				remoteAddr.String(), nodeAddr.String(), statsString)
+			p.Logger.InfoEventf(fields, "%s (IPX address %s): final statistics: %s",
+				addrName, nodeAddr.String(), statsString)
 		}
 	}()
 
-	p.log("%s: new connection, assigned IPX address %s",
-		remoteAddr.String(), network.NodeAddress(node))
+	p.Logger.InfoEventf(fields, "%s: new connection, assigned IPX address %s",
+		addrName, nodeAddr)
+	p.Webhook.Notify(webhook.EventClientJoin, addrName, nodeAddr.String())
 	c := &client{
-		inner:        inner,
-		nodeAddr:     &nodeAddr,
-		lastRecvTime: time.Now(),
+		inner:            inner,
+		node:             node,
+		nodeAddr:         &nodeAddr,
+		lastRecvTime:     time.Now(),
+		rtt:              p.RTT,
+		keepaliveTime:    p.KeepaliveTime,
+		minKeepaliveTime: p.MinKeepaliveTime,
+		verifyChecksums:  p.VerifyChecksums,
+		logger:           p.Logger,
+		addrName:         addrName,
 	}
 
 	c.sendRegistrationReply()
 
 	if p.KeepaliveTime > 0 {
-		go c.sendKeepalives(ctx, p.KeepaliveTime)
+		go c.sendKeepalives(ctx)
 	}
 
+	if p.ReflectBroadcasts {
+		return ipx.DuplexCopyPackets(ctx, c, &reflector{Node: node, c: c})
+	}
 	return ipx.DuplexCopyPackets(ctx, c, node)
 }
 
+// reflector wraps a client's node so that broadcast packets written to the
+// node are also delivered back to the client.
+type reflector struct {
+	network.Node
+	c *client
+}
+
+func (r *reflector) WritePacket(packet *ipx.Packet) error {
+	if err := r.Node.WritePacket(packet); err != nil {
+		return err
+	}
+	if packet.Header.Dest.Addr == ipx.AddrBroadcast {
+		return r.c.WritePacket(packet)
+	}
+	return nil
+}
+
 // client implements the dosbox protocol as a wrapper around an
 // inner ReadWriteCloser that is used to send and receive IPX frames.
 type client struct {
 	inner        ipx.ReadWriteCloser
+	node         network.Node
 	nodeAddr     *ipx.Addr
 	mu           sync.Mutex
 	lastRecvTime time.Time
+	rtt          *metrics.Histogram
+
+	// pingTime is the time that the last ping was sent, if no reply
+	// has yet been received.
+	pingTime time.Time
+
+	// lastKeepaliveTime is the time that the last keepalive ping was
+	// sent. Together with lastRecvTime, it determines when the next
+	// keepalive is due; packets sent to the client do not affect it.
+	lastKeepaliveTime time.Time
+
+	// keepaliveTime is the current keepalive interval for this client,
+	// which is never shortened below minKeepaliveTime. If
+	// minKeepaliveTime is zero, the interval is fixed.
+	keepaliveTime    time.Duration
+	minKeepaliveTime time.Duration
+
+	verifyChecksums bool
+	logger          *logging.Logger
+	addrName        string
+}
+
+// adaptKeepalive is called before each keepalive ping and shortens the
+// interval if the last ping went unanswered. The unanswered ping is then
+// forgotten, so that each lost ping only shortens the interval once. The new
+// interval is returned.
+func (p *client) adaptKeepalive() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.minKeepaliveTime > 0 && !p.pingTime.IsZero() {
+		p.keepaliveTime /= 2
+		if p.keepaliveTime < p.minKeepaliveTime {
+			p.keepaliveTime = p.minKeepaliveTime
+		}
+		p.pingTime = time.Time{}
+	}
+	return p.keepaliveTime
+}
+
+// pingReplied is called when a reply to a ping is received.
+func (p *client) pingReplied() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.pingTime.IsZero() {
+		p.rtt.Observe(time.Since(p.pingTime))
+		p.pingTime = time.Time{}
+	}
 }
 
 func (p *client) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
@@ -117,6 +347,15 @@ func (p *client) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
 			p.sendRegistrationReply()
 			continue
 		}
+		if packet.Header.Dest.Addr == AddrPingReply {
+			p.pingReplied()
+			continue
+		}
+		if p.verifyChecksums && !packet.Header.VerifyChecksum(packet.Payload) {
+			p.logger.Debugf("%s: dropped packet with bad checksum %#04x",
+				p.addrName, packet.Header.Checksum)
+			continue
+		}
 		return packet, nil
 	}
 }
@@ -129,18 +368,27 @@ func (p *client) Close() error {
 	return p.inner.Close()
 }
 
-// sendRegistrationReply sends a response to the client when a registration
-// packet is received. This usually happens only once on first connect,
-// unless the reply is lost in transit.
-func (p *client) sendRegistrationReply() {
-	p.inner.WritePacket(&ipx.Packet{
+// sendOriginated sends a packet generated by the server itself, rather than
+// forwarded from the network, to the client.
+func (p *client) sendOriginated(packet *ipx.Packet) {
+	if p.node != nil {
+		tappable.RecordOriginated(p.node, packet)
+	}
+	p.inner.WritePacket(packet)
+}
+
+// registrationReply returns a reply to a registration packet that assigns
+// the given address to the client. If the address is ipx.AddrNull, the
+// registration was refused.
+func registrationReply(addr ipx.Addr) *ipx.Packet {
+	return &ipx.Packet{
 		Header: ipx.Header{
 			Checksum:     0xffff,
 			Length:       30,
 			TransControl: 0,
 			Dest: ipx.HeaderAddr{
 				Network: [4]byte{0, 0, 0, 0},
-				Addr:    *p.nodeAddr,
+				Addr:    addr,
 				Socket:  2,
 			},
 			Src: ipx.HeaderAddr{
@@ -149,15 +397,28 @@ func (p *client) sendRegistrationReply() {
 				Socket:  2,
 			},
 		},
-	})
+	}
+}
+
+// sendRegistrationReply sends a response to the client when a registration
+// packet is received. This usually happens only once on first connect,
+// unless the reply is lost in transit.
+func (p *client) sendRegistrationReply() {
+	p.sendOriginated(registrationReply(*p.nodeAddr))
 }
 
 // sendPing transmits a ping packet to the given client. The DOSbox IPX client
 // code recognizes broadcast packets sent to socket=2 and will send a reply to
 // the source address that we provide.
 func (p *client) sendPing() {
-	p.inner.WritePacket(&ipx.Packet{
+	p.mu.Lock()
+	p.pingTime = time.Now()
+	p.lastKeepaliveTime = p.pingTime
+	p.mu.Unlock()
+	p.sendOriginated(&ipx.Packet{
 		Header: ipx.Header{
+			Checksum: ipx.NoChecksum,
+			Length:   uint16(ipx.HeaderLength),
 			Dest: ipx.HeaderAddr{
 				Addr:   ipx.AddrBroadcast,
 				Socket: 2,
@@ -166,7 +427,7 @@ func (p *client) sendPing() {
 			// because if we used ipx.AddrNull the reply would be
 			// indistinguishable from a registration packet.
 			Src: ipx.HeaderAddr{
-				Addr:   addrPingReply,
+				Addr:   AddrPingReply,
 				Socket: 0,
 			},
 		},
@@ -174,27 +435,34 @@ func (p *client) sendPing() {
 }
 
 // sendKeepalives runs as a background goroutine while a client is connected,
-// sending keepalive pings to keep the connection alive.
-func (p *client) sendKeepalives(ctx context.Context, checkPeriod time.Duration) {
+// sending keepalive pings to keep the connection alive. A ping is only sent
+// once a full keepalive interval has passed with nothing received from the
+// client and no other ping sent, so a chatty client is never pinged.
+func (p *client) sendKeepalives(ctx context.Context) {
 	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(checkPeriod):
-		}
-		now := time.Now()
 		p.mu.Lock()
-		lastRecvTime := p.lastRecvTime
+		lastActivity := p.lastRecvTime
+		if p.lastKeepaliveTime.After(lastActivity) {
+			lastActivity = p.lastKeepaliveTime
+		}
+		wait := time.Until(lastActivity.Add(p.keepaliveTime))
 		p.mu.Unlock()
-		// Nothing sent in a while? Send a keepalive. This is
+		// Nothing received in a while? Send a keepalive. This is
 		// important because some games use a client/server
 		// arrangement where the server does not broadcast
 		// anything but listens for broadcasts from clients. An
 		// example is Warcraft 2. If there is no activity
 		// between the client and server in a long time, some
 		// NAT gateways or firewalls can drop the association.
-		if now.After(lastRecvTime.Add(checkPeriod)) {
+		if wait <= 0 {
+			p.adaptKeepalive()
 			p.sendPing()
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
 		}
 	}
 }
@@ -0,0 +1,310 @@
+package dosbox
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	"github.com/fragglet/ipxbox/network/stats"
+	"github.com/fragglet/ipxbox/network/tappable"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+// simulateNAT simulates a client behind a NAT gateway that drops mappings
+// which are idle for longer than natTimeout. A keepalive ping only gets a
+// reply if it was sent within natTimeout of the previous one. The final
+// keepalive interval is returned.
+func simulateNAT(keepaliveTime, minKeepaliveTime, natTimeout time.Duration) time.Duration {
+	c := &client{
+		inner:            ipxtesting.MakeCallbackDest(func(*ipx.Packet) {}),
+		nodeAddr:         &ipx.Addr{},
+		keepaliveTime:    keepaliveTime,
+		minKeepaliveTime: minKeepaliveTime,
+	}
+	interval := keepaliveTime
+	for i := 0; i < 10; i++ {
+		c.sendPing()
+		if interval <= natTimeout {
+			c.pingReplied()
+		}
+		interval = c.adaptKeepalive()
+	}
+	return interval
+}
+
+func TestAdaptiveKeepalive(t *testing.T) {
+	tests := []struct {
+		name                  string
+		minKeepalive, natTime time.Duration
+		want                  time.Duration
+	}{
+		{"well behaved NAT", time.Second, time.Minute, 8 * time.Second},
+		{"aggressive NAT", time.Second, 3 * time.Second, 2 * time.Second},
+		{"bounded by minimum", 5 * time.Second, 3 * time.Second, 5 * time.Second},
+		{"not enabled", 0, 3 * time.Second, 8 * time.Second},
+	}
+	for _, test := range tests {
+		got := simulateNAT(8*time.Second, test.minKeepalive, test.natTime)
+		if got != test.want {
+			t.Errorf("%s: want keepalive interval %v, got %v",
+				test.name, test.want, got)
+		}
+	}
+}
+
+func TestKeepaliveActivity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	pings := 0
+	c := &client{
+		inner: ipxtesting.MakeCallbackDest(func(*ipx.Packet) {
+			mu.Lock()
+			pings++
+			mu.Unlock()
+		}),
+		nodeAddr:      &ipx.Addr{},
+		lastRecvTime:  time.Now(),
+		keepaliveTime: 50 * time.Millisecond,
+	}
+	go c.sendKeepalives(ctx)
+
+	// While the client keeps sending, it is never pinged.
+	for i := 0; i < 20; i++ {
+		time.Sleep(10 * time.Millisecond)
+		c.mu.Lock()
+		c.lastRecvTime = time.Now()
+		c.mu.Unlock()
+	}
+	mu.Lock()
+	if pings != 0 {
+		t.Errorf("active client was pinged %d times", pings)
+	}
+	mu.Unlock()
+
+	// Once idle, it is pinged once per keepalive interval.
+	time.Sleep(275 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if pings < 3 || pings > 6 {
+		t.Errorf("idle client: want about 5 pings, got %d", pings)
+	}
+}
+
+func TestOversizedRegistration(t *testing.T) {
+	registration := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrNull, Socket: 2},
+		},
+	}
+	oversized := &ipx.Packet{
+		Header:  registration.Header,
+		Payload: make([]byte, 1000),
+	}
+	p := &Protocol{}
+	if !p.IsRegistrationPacket(registration) {
+		t.Errorf("registration packet not recognized")
+	}
+	if p.IsRegistrationPacket(oversized) {
+		t.Errorf("oversized registration packet accepted")
+	}
+
+	// StartClient must also reject it. Network is nil, so trying to
+	// create a node for the client would panic.
+	end1, end2 := ipxtesting.MakeLoopbackPair("client", "server")
+	end1.WritePacket(oversized)
+	err := p.StartClient(context.Background(), end2, &net.UDPAddr{})
+	if err != nil {
+		t.Errorf("StartClient returned error: %v", err)
+	}
+
+	p.AcceptOversizedRegistration = true
+	if !p.IsRegistrationPacket(oversized) {
+		t.Errorf("oversized registration packet rejected with AcceptOversizedRegistration set")
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	clientEnd, serverEnd := ipxtesting.MakeLoopbackPair("client", "server")
+	c := &client{inner: serverEnd, verifyChecksums: true}
+
+	good := *ipxtesting.TestPackets[0]
+	good.Header.Checksum = good.Header.ComputeChecksum(good.Payload)
+	bad := good
+	bad.Header.Checksum++
+	none := *ipxtesting.TestPackets[1]
+	none.Header.Checksum = ipx.NoChecksum
+	for _, packet := range []*ipx.Packet{&bad, &good, &none} {
+		clientEnd.WritePacket(packet)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, want := range []*ipx.Packet{&good, &none} {
+		got, err := c.ReadPacket(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Header != want.Header {
+			t.Errorf("wrong packet received: want %+v, got %+v", want.Header, got.Header)
+		}
+	}
+}
+
+func TestTapDirections(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tn := tappable.Wrap(ipxswitch.New())
+	tap, err := tn.NewTapForDirections(tappable.Forwarded, tappable.ServerOriginated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := addressable.Wrap(tn)
+	p := &Protocol{Network: n}
+	clientEnd, serverEnd := ipxtesting.MakeLoopbackPair("client", "server")
+	go p.StartClient(ctx, serverEnd, &net.UDPAddr{})
+
+	clientEnd.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrNull, Socket: 2},
+		},
+	})
+	reply, err := clientEnd.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("no registration reply: %v", err)
+	}
+	clientAddr := reply.Header.Dest.Addr
+
+	// Another node on the network sends a packet to the client.
+	other := ipxtesting.MustNewNode(t, n)
+	otherAddr := ipx.Addr{}
+	other.GetProperty(&otherAddr)
+	forwarded := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: clientAddr, Socket: 0x869c},
+			Src:  ipx.HeaderAddr{Addr: otherAddr, Socket: 0x869c},
+		},
+	}
+	if err := other.WritePacket(forwarded); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientEnd.ReadPacket(ctx); err != nil {
+		t.Fatalf("forwarded packet not received: %v", err)
+	}
+
+	packet, d, err := tap.ReadTappedPacket(ctx)
+	if err != nil || packet.Header != reply.Header || d != tappable.ServerOriginated {
+		t.Errorf("want registration reply as server-originated, got %+v, %v, %v", packet, d, err)
+	}
+	packet, d, err = tap.ReadTappedPacket(ctx)
+	if err != nil || packet != forwarded || d != tappable.Forwarded {
+		t.Errorf("want forwarded packet, got %+v, %v, %v", packet, d, err)
+	}
+}
+
+func TestReflectBroadcasts(t *testing.T) {
+	for _, reflect := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		n := addressable.Wrap(ipxswitch.New())
+		p := &Protocol{Network: n, ReflectBroadcasts: reflect}
+		clientEnd, serverEnd := ipxtesting.MakeLoopbackPair("client", "server")
+		go p.StartClient(ctx, serverEnd, &net.UDPAddr{})
+		clientEnd.WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: ipx.AddrNull, Socket: 2},
+			},
+		})
+		reply, err := clientEnd.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("no registration reply: %v", err)
+		}
+		other := ipxtesting.MustNewNode(t, n)
+
+		broadcast := &ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: ipx.AddrBroadcast, Socket: 0x869c},
+				Src:  ipx.HeaderAddr{Addr: reply.Header.Dest.Addr, Socket: 0x869c},
+			},
+		}
+		clientEnd.WritePacket(broadcast)
+		if _, err := other.ReadPacket(ctx); err != nil {
+			t.Errorf("reflect=%v: other node did not receive broadcast: %v", reflect, err)
+		}
+		readCtx, readCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		packet, err := clientEnd.ReadPacket(readCtx)
+		readCancel()
+		switch {
+		case reflect && err != nil:
+			t.Errorf("client did not receive own broadcast: %v", err)
+		case reflect && packet.Header != broadcast.Header:
+			t.Errorf("client received wrong packet: want %+v, got %+v", broadcast, packet)
+		case !reflect && err == nil:
+			t.Errorf("client received own broadcast with reflection disabled: %+v", packet)
+		}
+		cancel()
+	}
+}
+
+// connectClient runs a client through StartClient from the given remote
+// address and returns its assigned IPX address. The client is disconnected
+// before returning.
+func connectClient(t *testing.T, p *Protocol, remoteAddr net.Addr) ipx.Addr {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clientEnd, serverEnd := ipxtesting.MakeLoopbackPair("client", "server")
+	done := make(chan struct{})
+	go func() {
+		p.StartClient(ctx, serverEnd, remoteAddr)
+		close(done)
+	}()
+	clientEnd.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrNull, Socket: 2},
+		},
+	})
+	reply, err := clientEnd.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("no registration reply: %v", err)
+	}
+	cancel()
+	<-done
+	return reply.Header.Dest.Addr
+}
+
+func TestAddressLease(t *testing.T) {
+	p := &Protocol{
+		Network:          stats.Wrap(addressable.Wrap(ipxswitch.New())),
+		AddressLeaseTime: time.Minute,
+	}
+	addr1 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	addr2 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2000}
+	otherAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+
+	first := connectClient(t, p, addr1)
+	if got := connectClient(t, p, otherAddr); got == first {
+		t.Errorf("client from another IP was assigned leased address %s", first)
+	}
+	if got := connectClient(t, p, addr2); got != first {
+		t.Errorf("reconnecting client: want address %s, got %s", first, got)
+	}
+
+	// Expired leases are not reassigned.
+	p.AddressLeaseTime = time.Nanosecond
+	first = connectClient(t, p, addr1)
+	time.Sleep(time.Millisecond)
+	if got := connectClient(t, p, addr2); got == first {
+		t.Errorf("address %s reassigned after lease expired", first)
+	}
+
+	// Without a lease time, addresses are not remembered.
+	p.AddressLeaseTime = 0
+	first = connectClient(t, p, addr1)
+	if got := connectClient(t, p, addr2); got == first {
+		t.Errorf("address %s reassigned with leases disabled", first)
+	}
+}
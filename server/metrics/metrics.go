@@ -0,0 +1,88 @@
+// Package metrics contains the metrics that are updated by an IPX server,
+// and a Collector that serves them over HTTP in the OpenMetrics text format,
+// so that they can be scraped by Prometheus. The Prometheus client library
+// is not a dependency of this module, so the format is written directly.
+package metrics
+
+import (
+	"net/http"
+
+	ipxmetrics "github.com/fragglet/ipxbox/metrics"
+)
+
+var _ = (http.Handler)(&Collector{})
+
+// Metrics contains the metrics that are updated by a server.
+type Metrics struct {
+	// Number of clients currently connected.
+	Clients *ipxmetrics.Gauge
+
+	// Number of new clients that have registered, and the number that
+	// were disconnected because nothing was received from them.
+	Registrations *ipxmetrics.Counter
+	Timeouts      *ipxmetrics.Counter
+
+	// Packets and bytes received from clients and passed to the
+	// protocol, and sent to clients.
+	ReceivedPackets, ReceivedBytes *ipxmetrics.Counter
+	SentPackets, SentBytes         *ipxmetrics.Counter
+
+	// Packets dropped because they were from a blocked address or over a
+	// client's rate limit.
+	DroppedPackets *ipxmetrics.Counter
+
+	// Packets from unknown addresses that were ignored, either because
+	// they were not a valid registration, or because a new client could
+	// not be accepted.
+	RefusedPackets *ipxmetrics.Counter
+
+	// Unicast packets sent to an address that no client is using. The
+	// server does not update this itself; it is intended to be passed
+	// to the network that the clients are connected to (see
+	// ipxswitch.Network.UnknownDestinations).
+	UnknownDestinations *ipxmetrics.Counter
+}
+
+// New creates a new set of server metrics.
+func New() *Metrics {
+	return &Metrics{
+		Clients:             ipxmetrics.NewGauge("ipxbox_clients", "Number of clients connected."),
+		Registrations:       ipxmetrics.NewCounter("ipxbox_client_registrations", "Number of new clients registered."),
+		Timeouts:            ipxmetrics.NewCounter("ipxbox_client_timeouts", "Number of clients that timed out."),
+		ReceivedPackets:     ipxmetrics.NewCounter("ipxbox_server_received_packets", "Packets received from clients."),
+		ReceivedBytes:       ipxmetrics.NewCounter("ipxbox_server_received_bytes", "Bytes received from clients."),
+		SentPackets:         ipxmetrics.NewCounter("ipxbox_server_sent_packets", "Packets sent to clients."),
+		SentBytes:           ipxmetrics.NewCounter("ipxbox_server_sent_bytes", "Bytes sent to clients."),
+		DroppedPackets:      ipxmetrics.NewCounter("ipxbox_server_dropped_packets", "Packets dropped from blocked or rate limited clients."),
+		RefusedPackets:      ipxmetrics.NewCounter("ipxbox_server_refused_packets", "Packets from unknown addresses that were ignored."),
+		UnknownDestinations: ipxmetrics.NewCounter("ipxbox_unknown_destination_packets", "Unicast packets sent to an unknown address."),
+	}
+}
+
+// All returns all the metrics, for passing to metrics.WriteOpenMetrics.
+func (m *Metrics) All() []ipxmetrics.Metric {
+	return []ipxmetrics.Metric{
+		m.Clients, m.Registrations, m.Timeouts,
+		m.ReceivedPackets, m.ReceivedBytes, m.SentPackets, m.SentBytes,
+		m.DroppedPackets, m.RefusedPackets, m.UnknownDestinations,
+	}
+}
+
+// Collector is an http.Handler that serves a set of server metrics, and any
+// other metrics, in the OpenMetrics text format.
+type Collector struct {
+	metrics []ipxmetrics.Metric
+}
+
+// NewCollector creates a Collector that serves the given server metrics,
+// followed by the given extra metrics.
+func NewCollector(m *Metrics, extra ...ipxmetrics.Metric) *Collector {
+	return &Collector{
+		metrics: append(m.All(), extra...),
+	}
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	ipxmetrics.WriteOpenMetrics(w, c.metrics...)
+}
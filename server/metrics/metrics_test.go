@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	ipxmetrics "github.com/fragglet/ipxbox/metrics"
+)
+
+// scrape fetches the metrics served by the given collector, and returns
+// the value of every sample by name.
+func scrape(t *testing.T, c *Collector) map[string]float64 {
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("wrong content type: %q", ct)
+	}
+	result := map[string]float64{}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Fatalf("malformed sample: %q", line)
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			t.Fatalf("malformed sample: %q: %v", line, err)
+		}
+		result[fields[0]] = value
+	}
+	return result
+}
+
+func TestCollector(t *testing.T) {
+	m := New()
+	extra := ipxmetrics.NewCounter("test_extra", "Extra counter.")
+	c := NewCollector(m, extra)
+
+	before := scrape(t, c)
+	m.Clients.Add(2)
+	m.Clients.Add(-1)
+	m.Registrations.Inc()
+	m.Timeouts.Inc()
+	m.ReceivedPackets.Add(3)
+	m.SentBytes.Add(100)
+	m.UnknownDestinations.Inc()
+	extra.Inc()
+	after := scrape(t, c)
+
+	for _, test := range []struct {
+		name string
+		diff float64
+	}{
+		{"ipxbox_clients", 1},
+		{"ipxbox_client_registrations_total", 1},
+		{"ipxbox_client_timeouts_total", 1},
+		{"ipxbox_server_received_packets_total", 3},
+		{"ipxbox_server_received_bytes_total", 0},
+		{"ipxbox_server_sent_bytes_total", 100},
+		{"ipxbox_unknown_destination_packets_total", 1},
+		{"test_extra_total", 1},
+	} {
+		b, ok1 := before[test.name]
+		a, ok2 := after[test.name]
+		if !ok1 || !ok2 {
+			t.Errorf("%s: metric not exported", test.name)
+			continue
+		}
+		if a-b != test.diff {
+			t.Errorf("%s: want increase of %v, got %v", test.name, test.diff, a-b)
+		}
+	}
+}
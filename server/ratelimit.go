@@ -0,0 +1,56 @@
+package server
+
+import (
+	"time"
+)
+
+// tokenBucket is a token bucket that is refilled at a fixed rate, up to a
+// burst size of one second's worth of tokens. Rather than using a separate
+// goroutine, it is refilled based on the time elapsed since it was last
+// used.
+type tokenBucket struct {
+	rate     float64
+	tokens   float64
+	lastTime time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b.lastTime.IsZero() {
+		b.tokens = b.rate
+	} else {
+		b.tokens += now.Sub(b.lastTime).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.lastTime = now
+}
+
+// rateLimiter limits the rate of packets received from a client, both in
+// packets per second and bytes per second. A zero rate means no limit.
+type rateLimiter struct {
+	packets, bytes tokenBucket
+}
+
+func newRateLimiter(packetRate, byteRate float64) *rateLimiter {
+	return &rateLimiter{
+		packets: tokenBucket{rate: packetRate},
+		bytes:   tokenBucket{rate: byteRate},
+	}
+}
+
+// allow returns true if a packet of the given size is within the rate limit.
+// If so, it is counted against the limit.
+func (l *rateLimiter) allow(now time.Time, size int) bool {
+	l.packets.refill(now)
+	l.bytes.refill(now)
+	if l.packets.rate > 0 && l.packets.tokens < 1 {
+		return false
+	}
+	if l.bytes.rate > 0 && l.bytes.tokens < float64(size) {
+		return false
+	}
+	l.packets.tokens--
+	l.bytes.tokens -= float64(size)
+	return true
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Now()
+	l := newRateLimiter(10, 0)
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if l.allow(start, 100) {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("burst: want 10 packets allowed, got %d", allowed)
+	}
+	// Half a second later, the bucket is half refilled.
+	allowed = 0
+	for i := 0; i < 100; i++ {
+		if l.allow(start.Add(500*time.Millisecond), 100) {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("after refill: want 5 packets allowed, got %d", allowed)
+	}
+
+	l = newRateLimiter(0, 1000)
+	if !l.allow(start, 600) {
+		t.Errorf("first packet within byte limit was dropped")
+	}
+	if l.allow(start, 600) {
+		t.Errorf("second packet over byte limit was allowed")
+	}
+	if !l.allow(start, 400) {
+		t.Errorf("smaller packet within remaining byte limit was dropped")
+	}
+}
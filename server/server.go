@@ -5,14 +5,17 @@ package server
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/logging"
 	"github.com/fragglet/ipxbox/network/pipe"
+	"github.com/fragglet/ipxbox/pseudonym"
+	"github.com/fragglet/ipxbox/server/metrics"
 )
 
 var (
@@ -26,14 +29,142 @@ type Config struct {
 	// logic.
 	Protocols []Protocol
 
+	// Network to listen on: "udp4", "udp6", or "udp" to accept both
+	// IPv4 and IPv6 clients. If empty, "udp4" is used.
+	Network string
+
 	// Clients time out if nothing is received for this amount of time.
 	ClientTimeout time.Duration
 
+	// If non-zero, the maximum number of clients that can be connected
+	// at once. Registrations from new clients are ignored once this many
+	// are connected, unless their IP address matches TrustedClients.
+	MaxClients int
+
+	// If non-zero, the maximum rate at which packets are accepted from
+	// each client, in packets per second and bytes per second. Bursts of
+	// up to one second's worth are allowed. Packets over the limit are
+	// dropped; trusted clients are exempt.
+	MaxPacketRate float64
+	MaxByteRate   float64
+
+	// If not empty, packets are only accepted from IP addresses in these
+	// networks (in CIDR notation, eg. 192.168.0.0/16, or single IP
+	// addresses). Packets from anywhere else are dropped.
+	AllowedCIDRs []string
+
+	// Packets from IP addresses in these networks are always dropped,
+	// even if they are also in AllowedCIDRs.
+	BlockedCIDRs []string
+
+	// If not nil, clients connecting from IP addresses in this list are
+	// trusted. Trusted clients are exempt from limits applied to other
+	// clients, and time out after TrustedClientTimeout instead of
+	// ClientTimeout.
+	TrustedClients *TrustList
+
+	// Trusted clients time out if nothing is received for this amount
+	// of time. If zero, ClientTimeout is used.
+	TrustedClientTimeout time.Duration
+
+	// If not empty, new clients must authenticate using this shared
+	// secret: registration packets without a valid authentication
+	// payload are silently ignored. See SignRegistration for the wire
+	// format. If empty, clients are accepted without authentication, as
+	// with stock DOSBox.
+	SharedSecret []byte
+
+	// If true, packets are dropped if the Length field of their IPX
+	// header does not match the size of the UDP datagram, so that
+	// truncated or oversized packets are not forwarded. Older versions
+	// of the ipxbox client leave the field as zero in some packets.
+	CheckPacketLength bool
+
+	// If not nil, these are invoked when a new client connects, and when
+	// a client is disconnected (either because it timed out, or because
+	// the protocol closed the connection). They are called without the
+	// server's lock held, but from the server's main goroutine or a
+	// client's goroutine, so they should return quickly. The IPX address
+	// passed to OnConnect is the source address of the client's first
+	// packet; for protocols that assign addresses during registration
+	// (such as DOSBox), this is ipx.AddrNull. The IPX address passed to
+	// OnDisconnect is the one the client was using, as in
+	// ClientInfo.IPXAddr.
+	OnConnect    func(ipx.Addr, *net.UDPAddr)
+	OnDisconnect func(ipx.Addr, *net.UDPAddr)
+
 	// If not nil, log entries are written as clients connect and
 	// disconnect.
-	Logger *log.Logger
+	Logger *logging.Logger
+
+	// If not nil, packets queued for clients are accounted against this
+	// budget, and new clients are refused while it is exceeded.
+	Budget *pipe.Budget
+
+	// If not nil, client addresses are replaced with pseudonyms in
+	// log entries.
+	Pseudonyms *pseudonym.Map
+
+	// If greater than one, only one in this many debug messages about
+	// individual packets is logged, so that debug logging can be used
+	// on a busy server.
+	PacketLogSampleRate int
+
+	// Maximum size of a UDP datagram that can be received. Larger
+	// datagrams are dropped, since they would otherwise be truncated.
+	// If zero, DefaultReadBufferSize is used; otherwise it must be at
+	// least ipx.HeaderLength.
+	ReadBufferSize int
+
+	// Metrics updated by the server. If nil, a new set is created.
+	Metrics *metrics.Metrics
+
+	// If not nil, Identify is called on packets received from each
+	// client until it returns true, to label the client with the name
+	// of the game that it is playing (see gamefilter.Identify and
+	// ClientInfo.Game).
+	Identify func(*ipx.Packet) (string, bool)
+
+	// When a packet arrives from a new UDP port with the source address
+	// that the server assigned to an existing client on the same IP,
+	// the client is moved to the new port (eg. after NAT rebinding),
+	// but only once nothing has been received from the old port for
+	// this long. This stops another user behind the same IP from taking
+	// over a client that is still active. If zero,
+	// DefaultMigrationQuietTime is used.
+	MigrationQuietTime time.Duration
+
+	// Connections over stream transports (see ConnHandler) are closed
+	// if no valid registration is received within this time. If zero,
+	// DefaultRegistrationTimeout is used.
+	RegistrationTimeout time.Duration
+
+	// Maximum number of stream connections that can be waiting to
+	// register at once, for each ConnHandler. Further connections are
+	// closed immediately. If zero, DefaultMaxPendingConns is used.
+	MaxPendingConns int
 }
 
+// DefaultReadBufferSize is the default value of Config.ReadBufferSize,
+// large enough for an IPX packet in a standard Ethernet frame.
+const DefaultReadBufferSize = 1500
+
+// DefaultMigrationQuietTime is the default value of
+// Config.MigrationQuietTime. It is longer than the DOSBox keepalive
+// interval, so a client that is still connected always answers a ping
+// within this time.
+const DefaultMigrationQuietTime = 15 * time.Second
+
+const (
+	// DefaultRegistrationTimeout is the default value of
+	// Config.RegistrationTimeout.
+	DefaultRegistrationTimeout = 10 * time.Second
+
+	// DefaultMaxPendingConns is the default value of
+	// Config.MaxPendingConns.
+	DefaultMaxPendingConns = 64
+)
+
 // Protocol implements the inner protocol logic of the server.
 type Protocol interface {
 	// StartClient is invoked each time the server receives packets from
@@ -49,13 +180,187 @@ type Protocol interface {
 	IsRegistrationPacket(*ipx.Packet) bool
 }
 
+// AuthenticatingProtocol is implemented by protocols that authenticate
+// clients themselves (for example, with a password). Such protocols are
+// exempt from Config.SharedSecret.
+type AuthenticatingProtocol interface {
+	Protocol
+
+	// AuthenticatesClients returns true if the protocol performs its
+	// own authentication of new clients.
+	AuthenticatesClients() bool
+}
+
+// AddressAssigner is implemented by the ipx.ReadWriteCloser passed to
+// Protocol.StartClient. Protocols that assign an IPX address to the client
+// during registration (such as DOSBox) should call AssignAddress, so that
+// the server can recognize the client if its UDP address changes. Source
+// addresses claimed by clients are never used for this, since any client
+// could claim another client's address.
+type AddressAssigner interface {
+	AssignAddress(ipx.Addr)
+}
+
+// RefusingProtocol is implemented by protocols that can tell a client that
+// its registration was refused because the server is full, so that it does
+// not have to wait for its registration to time out. The refusal is only
+// sent to clients whose registration was signed with Config.SharedSecret:
+// only ipxbox clients can sign registrations, and other clients (such as
+// stock DOSBox) may mistake the refusal for a successful registration.
+type RefusingProtocol interface {
+	Protocol
+
+	// RefusalPacket returns the packet to send in reply to a refused
+	// registration.
+	RefusalPacket() *ipx.Packet
+}
+
+func authenticatesClients(p Protocol) bool {
+	ap, ok := p.(AuthenticatingProtocol)
+	return ok && ap.AuthenticatesClients()
+}
+
 // client represents a client that is connected to an IPX server.
 type client struct {
 	s               *Server
 	closed          bool
 	rxpipe          ipx.ReadWriteCloser
 	addr            *net.UDPAddr
+	key             string
+	connectTime     time.Time
 	lastReceiveTime time.Time
+	lastSendTime    time.Time
+	rateLimiter     *rateLimiter
+	dropped         uint64
+
+	// Counts of packets and bytes received from and sent to the
+	// client, including protocol traffic such as keepalives.
+	rxPackets, rxBytes uint64
+	txPackets, txBytes uint64
+
+	// ipxAddr is the IPX address assigned to the client by its
+	// protocol, or otherwise the first source IPX address seen in a
+	// packet from it. Only assigned addresses are used to recognize
+	// the client if its UDP address changes.
+	ipxAddr  ipx.Addr
+	assigned bool
+
+	// game is the name of the game that the client appears to be
+	// playing, or empty if it has not been identified.
+	game string
+
+	// stream is the connection for clients that are connected over a
+	// stream transport (see ConnHandler), or nil for UDP clients.
+	stream ipx.ReadWriteCloser
+}
+
+// ClientInfo describes a client in a snapshot of the server's client table.
+type ClientInfo struct {
+	// Addr is the client's address. For clients connected over a stream
+	// transport, it holds the IP address and port of the connection.
+	Addr            *net.UDPAddr
+	ConnectTime     time.Time
+	LastReceiveTime time.Time
+
+	// LastSendTime is the time that a packet was last sent to the
+	// client, or the zero time if none has been sent.
+	LastSendTime time.Time
+
+	// IPXAddr is the source IPX address that the client is using, or
+	// ipx.AddrNull if it has not yet sent any packets.
+	IPXAddr ipx.Addr
+
+	// Trusted is true if the client matches Config.TrustedClients.
+	Trusted bool
+
+	// Game is the name of the game that the client appears to be
+	// playing (see Config.Identify), or empty if it is not known.
+	Game string
+
+	// Dropped is the number of packets from the client that were dropped
+	// for exceeding the rate limit.
+	Dropped uint64
+
+	// Number of packets and bytes received from and sent to the client.
+	// These count everything at the UDP level, including protocol
+	// traffic such as registration and keepalive packets, and packets
+	// that were dropped.
+	RxPackets, RxBytes uint64
+	TxPackets, TxBytes uint64
+}
+
+// Snapshot returns a description of every client currently in the server's
+// client table. This is intended for debugging and observability; for
+// example, to confirm that disconnected clients are being cleaned up, or to
+// build a status page. The result is a copy that shares nothing with the
+// server's internal state, and it is safe to call while the server is
+// running.
+func (s *Server) Snapshot() []ClientInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []ClientInfo{}
+	for _, c := range s.clients {
+		addr := *c.addr
+		addr.IP = append(net.IP{}, c.addr.IP...)
+		result = append(result, ClientInfo{
+			Addr:            &addr,
+			ConnectTime:     c.connectTime,
+			LastReceiveTime: c.lastReceiveTime,
+			LastSendTime:    c.lastSendTime,
+			IPXAddr:         c.ipxAddr,
+			Trusted:         s.trusted(c),
+			Game:            c.game,
+			Dropped:         c.dropped,
+			RxPackets:       c.rxPackets,
+			RxBytes:         c.rxBytes,
+			TxPackets:       c.txPackets,
+			TxBytes:         c.txBytes,
+		})
+	}
+	return result
+}
+
+// StaleClients returns the clients from the given snapshot that have either
+// been connected for longer than maxConnected, or from which nothing has
+// been received for longer than maxIdle. A zero duration disables the
+// corresponding check. Since the server times out idle clients, idle
+// clients found by this function may indicate an eviction bug.
+func StaleClients(snapshot []ClientInfo, now time.Time, maxConnected, maxIdle time.Duration) []ClientInfo {
+	result := []ClientInfo{}
+	for _, ci := range snapshot {
+		switch {
+		case maxConnected > 0 && now.Sub(ci.ConnectTime) > maxConnected:
+		case maxIdle > 0 && now.Sub(ci.LastReceiveTime) > maxIdle:
+		default:
+			continue
+		}
+		result = append(result, ci)
+	}
+	return result
+}
+
+// DiffSnapshots compares two snapshots of the client table, returning the
+// clients that appear only in after (added) and only in before (removed).
+func DiffSnapshots(before, after []ClientInfo) (added, removed []ClientInfo) {
+	index := func(snapshot []ClientInfo) map[string]bool {
+		result := map[string]bool{}
+		for _, ci := range snapshot {
+			result[ci.Addr.String()] = true
+		}
+		return result
+	}
+	beforeAddrs, afterAddrs := index(before), index(after)
+	for _, ci := range after {
+		if !beforeAddrs[ci.Addr.String()] {
+			added = append(added, ci)
+		}
+	}
+	for _, ci := range before {
+		if !afterAddrs[ci.Addr.String()] {
+			removed = append(removed, ci)
+		}
+	}
+	return added, removed
 }
 
 func (c *client) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
@@ -67,18 +372,65 @@ func (c *client) WritePacket(packet *ipx.Packet) error {
 	if err != nil {
 		return err
 	}
-	_, err = c.s.socket.WriteToUDP(packetBytes, c.addr)
+	c.s.mu.Lock()
+	addr := c.addr
+	c.lastSendTime = time.Now()
+	c.txPackets++
+	c.txBytes += uint64(len(packetBytes))
+	c.s.mu.Unlock()
+	c.s.metrics.SentPackets.Inc()
+	c.s.metrics.SentBytes.Add(uint64(len(packetBytes)))
+	if c.stream != nil {
+		return c.stream.WritePacket(packet)
+	}
+	_, err = c.s.socket.WriteToUDP(packetBytes, addr)
 	return err
 }
 
-func (c *client) Close() error {
+// AssignAddress implements AddressAssigner.
+func (c *client) AssignAddress(addr ipx.Addr) {
 	c.s.mu.Lock()
 	defer c.s.mu.Unlock()
-	if !c.closed {
-		delete(c.s.clients, c.addr.String())
+	if c.closed || c.assigned {
+		return
+	}
+	if c.s.clientsByIPX[c.ipxAddr] == c {
+		delete(c.s.clientsByIPX, c.ipxAddr)
+	}
+	c.ipxAddr = addr
+	c.assigned = true
+	c.s.clientsByIPX[addr] = c
+}
+
+func (c *client) Close() error {
+	c.close()
+	return nil
+}
+
+// close disconnects the client, returning false if it was already closed.
+func (c *client) close() bool {
+	c.s.mu.Lock()
+	wasOpen := !c.closed
+	if wasOpen {
+		delete(c.s.clients, c.key)
+		if c.s.clientsByIPX[c.ipxAddr] == c {
+			delete(c.s.clientsByIPX, c.ipxAddr)
+		}
 		c.closed = true
 	}
-	return c.rxpipe.Close()
+	ipxAddr, addr := c.ipxAddr, c.addr
+	c.s.mu.Unlock()
+	if wasOpen {
+		c.s.metrics.Clients.Add(-1)
+	}
+	if wasOpen && c.s.config.OnDisconnect != nil {
+		c.s.config.OnDisconnect(ipxAddr, addr)
+	}
+	if c.stream != nil {
+		c.stream.Close()
+	}
+	c.rxpipe.Close()
+	return wasOpen
 }
 
 // Server is the top-level struct representing an IPX server that listens
@@ -86,40 +438,77 @@ func (c *client) Close() error {
 type Server struct {
 	mu               sync.Mutex
 	config           *Config
+	ipFilter         *ipFilter
+	metrics          *metrics.Metrics
 	socket           *net.UDPConn
 	clients          map[string]*client
+	clientsByIPX     map[ipx.Addr]*client
 	timeoutCheckTime time.Time
+	overBudget       bool
+	nonces           nonceCache
+	packetLog        *logging.Sampler
+	readBuf          []byte
+	warnedTruncated  bool
 }
 
 // New creates a new Server, listening on the given address.
 func New(addr string, c *Config) (*Server, error) {
-	udp4Addr, err := net.ResolveUDPAddr("udp4", addr)
+	if c.ReadBufferSize != 0 && c.ReadBufferSize < ipx.HeaderLength {
+		return nil, fmt.Errorf("read buffer size %d is too small: must be at least %d bytes", c.ReadBufferSize, ipx.HeaderLength)
+	}
+	ipFilter, err := newIPFilter(c)
 	if err != nil {
 		return nil, err
 	}
-	socket, err := net.ListenUDP("udp", udp4Addr)
+	network := c.Network
+	if network == "" {
+		network = "udp4"
+	}
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
 	if err != nil {
 		return nil, err
 	}
+	socket, err := net.ListenUDP(network, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	m := c.Metrics
+	if m == nil {
+		m = metrics.New()
+	}
+	bufSize := c.ReadBufferSize
+	if bufSize == 0 {
+		bufSize = DefaultReadBufferSize
+	}
 	return &Server{
 		config:           c,
+		ipFilter:         ipFilter,
+		metrics:          m,
 		socket:           socket,
 		clients:          map[string]*client{},
+		clientsByIPX:     map[ipx.Addr]*client{},
 		timeoutCheckTime: time.Now().Add(10 * time.Second),
+		packetLog:        logging.NewSampler(c.Logger, c.PacketLogSampleRate),
+		// One byte larger than the maximum, so that we can tell when
+		// a datagram has been truncated.
+		readBuf: make([]byte, bufSize+1),
 	}, nil
 }
 
-func (s *Server) log(format string, args ...interface{}) {
-	if s.config.Logger != nil {
-		s.config.Logger.Printf(format, args...)
-	}
+// Metrics returns the metrics recorded by the server.
+func (s *Server) Metrics() *metrics.Metrics {
+	return s.metrics
 }
 
 // findProtocol checks the protocols supported by the server and returns
 // a Protocol that matches the given packet. If no valid protocols are
 // found then nil, false is returned.
 func (s *Server) findProtocol(packet *ipx.Packet) (Protocol, bool) {
-	for _, proto := range s.config.Protocols {
+	return findProtocol(s.config.Protocols, packet)
+}
+
+func findProtocol(protocols []Protocol, packet *ipx.Packet) (Protocol, bool) {
+	for _, proto := range protocols {
 		if proto.IsRegistrationPacket(packet) {
 			return proto, true
 		}
@@ -129,17 +518,33 @@ func (s *Server) findProtocol(packet *ipx.Packet) (Protocol, bool) {
 
 // newClient is invoked when a new client should be started. When called, a
 // packet has been received from the given address but no client matches the
-// address.
-func (s *Server) newClient(ctx context.Context, protocol Protocol, addr *net.UDPAddr) *client {
+// address. For clients connected over a stream transport, stream is the
+// connection; otherwise it is nil. s.mu must be held when calling.
+func (s *Server) newClient(ctx context.Context, protocol Protocol, addr *net.UDPAddr, stream ipx.ReadWriteCloser) *client {
 	addrStr := addr.String()
 	now := time.Now()
 	c := &client{
 		s:               s,
-		rxpipe:          pipe.New(),
+		rxpipe:          pipe.NewWithBudget(s.config.Budget),
 		addr:            addr,
+		key:             addrStr,
+		connectTime:     now,
 		lastReceiveTime: now,
+		rateLimiter:     newRateLimiter(s.config.MaxPacketRate, s.config.MaxByteRate),
+		stream:          stream,
+	}
+	if stream != nil {
+		// Stream clients are never looked up by address, but must
+		// not collide with a UDP client from the same address.
+		c.key = "stream/" + addrStr
 	}
-	s.clients[addrStr] = c
+	s.clients[c.key] = c
+	// The client has been accepted, so its pseudonym can be reversed.
+	s.config.Pseudonyms.Register(addrStr)
+	// The client is counted before its goroutine starts, since it
+	// could be closed (and uncounted) as soon as it does.
+	s.metrics.Registrations.Inc()
+	s.metrics.Clients.Add(1)
 
 	go func() {
 		subctx, cancel := context.WithCancel(ctx)
@@ -150,7 +555,8 @@ func (s *Server) newClient(ctx context.Context, protocol Protocol, addr *net.UDP
 			err = nil
 		}
 		if err != nil {
-			s.log("client %s terminated abnormally: %v", addrStr, err)
+			s.config.Logger.Errorf("client %s terminated abnormally: %v",
+				s.config.Pseudonyms.Name(addrStr), err)
 		}
 		cancel()
 		c.Close()
@@ -158,32 +564,261 @@ func (s *Server) newClient(ctx context.Context, protocol Protocol, addr *net.UDP
 	return c
 }
 
+// checkBudget returns true if there is enough memory available to accept a
+// new client. s.mu must be held when calling.
+func (s *Server) checkBudget() bool {
+	if s.config.Budget == nil {
+		return true
+	}
+	exceeded := s.config.Budget.Exceeded()
+	if exceeded && !s.overBudget {
+		s.config.Logger.Warnf("packet buffer memory limit exceeded (%d bytes in use); "+
+			"refusing new clients", s.config.Budget.Used())
+	} else if !exceeded && s.overBudget {
+		s.config.Logger.Infof("packet buffer memory back under limit; accepting new clients")
+	}
+	s.overBudget = exceeded
+	return !exceeded
+}
+
+// recordIPXAddr saves the source IPX address from a packet received from the
+// given client for reporting, if no address has been recorded or assigned.
+// The address is claimed by the client and is not trusted, so it is not used
+// for migration. s.mu must be held when calling.
+func (s *Server) recordIPXAddr(c *client, packet *ipx.Packet) {
+	src := packet.Header.Src.Addr
+	if c.ipxAddr != ipx.AddrNull || src == ipx.AddrNull || src == ipx.AddrBroadcast {
+		return
+	}
+	c.ipxAddr = src
+}
+
+// recordGame labels the given client with the game identified from a packet
+// received from it, if it has not already been identified. s.mu must be held
+// when calling.
+func (s *Server) recordGame(c *client, packet *ipx.Packet) {
+	if c.game != "" || s.config.Identify == nil {
+		return
+	}
+	if game, ok := s.config.Identify(packet); ok {
+		c.game = game
+	}
+}
+
+// migrationQuietTime returns how long a client's old UDP address must have
+// been quiet before it can be migrated; see Config.MigrationQuietTime.
+func (s *Server) migrationQuietTime() time.Duration {
+	if s.config.MigrationQuietTime > 0 {
+		return s.config.MigrationQuietTime
+	}
+	return DefaultMigrationQuietTime
+}
+
+// migrateClient is invoked when a packet is received from an unknown address.
+// If the client's UDP address has changed (eg. due to NAT rebinding), we
+// recognize it by the source IPX address in the packet, and move the existing
+// client to the new address, instead of treating it as a new connection.
+// Only addresses assigned by the server are recognized, the IP address must
+// be the same (only the port may change), and the old address must have gone
+// quiet, so that a client that is still active cannot be taken over. s.mu
+// must be held when calling.
+func (s *Server) migrateClient(packet *ipx.Packet, addr *net.UDPAddr, now time.Time) (*client, bool) {
+	src := packet.Header.Src.Addr
+	if src == ipx.AddrNull || src == ipx.AddrBroadcast {
+		return nil, false
+	}
+	c, ok := s.clientsByIPX[src]
+	if !ok || c.closed || c.stream != nil || !c.addr.IP.Equal(addr.IP) {
+		return nil, false
+	}
+	if now.Sub(c.lastReceiveTime) < s.migrationQuietTime() {
+		s.packetLog.Debugf("packet from %s not migrated to client %s: "+
+			"old address is still active",
+			s.config.Pseudonyms.Lazy(addr),
+			s.config.Pseudonyms.Lazy(c.addr))
+		return nil, false
+	}
+	s.config.Logger.Infof("client %s (IPX address %s) migrated to new address %s",
+		s.config.Pseudonyms.Name(c.addr.String()), src.String(),
+		s.config.Pseudonyms.Register(addr.String()))
+	delete(s.clients, c.key)
+	c.addr = addr
+	c.key = addr.String()
+	s.clients[c.key] = c
+	return c, true
+}
+
 // processPacket decodes a received UDP packet, delivering it to the appropriate
 // client based on address. A new client is started if none matches the address.
 func (s *Server) processPacket(ctx context.Context, packetBytes []byte, addr *net.UDPAddr) {
+	if !s.allowedIP(addr.IP) {
+		s.metrics.DroppedPackets.Inc()
+		s.packetLog.Debugf("packet from %s dropped: address not allowed",
+			s.config.Pseudonyms.Lazy(addr))
+		return
+	}
 	packet := &ipx.Packet{}
 	if err := packet.UnmarshalBinary(packetBytes); err != nil {
 		return
 	}
+	if s.config.CheckPacketLength {
+		if err := packet.Header.CheckLength(len(packetBytes)); err != nil {
+			s.metrics.DroppedPackets.Inc()
+			s.packetLog.Debugf("packet from %s dropped: %v",
+				s.config.Pseudonyms.Lazy(addr), err)
+			return
+		}
+	}
 
 	// Find which client sent it, and forward to receive queue.
 	// If we don't find a client matching this address, start a new one.
 	s.mu.Lock()
+	isNew := false
 	srcClient, ok := s.clients[addr.String()]
 	if !ok {
-		// Is this a supported protocol?
-		protocol, ok := s.findProtocol(packet)
+		srcClient, ok = s.migrateClient(packet, addr, time.Now())
+	}
+	if !ok {
+		protocol, ok := s.acceptClient(packet, addr, nil)
 		if !ok {
 			s.mu.Unlock()
 			return
 		}
+		srcClient = s.newClient(ctx, protocol, addr, nil)
+		isNew = true
+	}
+	s.mu.Unlock()
+	s.receive(srcClient, packet, len(packetBytes), isNew)
+}
+
+// acceptClient is invoked when a packet is received from an address with no
+// client, and decides whether a new client should be started. It returns the
+// protocol to run the client with, or false if the packet is not a valid
+// registration or the server cannot accept a new client. A client with a
+// signed registration that is refused because the server is full is sent
+// the protocol's refusal packet, over stream if it is not nil or otherwise
+// over UDP. s.mu must be held
+// when calling.
+func (s *Server) acceptClient(packet *ipx.Packet, addr *net.UDPAddr, stream ipx.ReadWriteCloser) (Protocol, bool) {
+	// If authentication is required, this strips the authentication
+	// payload so the protocol sees a normal registration packet.
+	signed := len(s.config.SharedSecret) > 0 &&
+		verifyRegistration(packet, s.config.SharedSecret, time.Now(), &s.nonces)
+	authenticated := len(s.config.SharedSecret) == 0 || signed
+	// Is this a supported protocol?
+	protocol, ok := s.findProtocol(packet)
+	if !ok {
+		s.metrics.RefusedPackets.Inc()
+		s.packetLog.Debugf("packet from unknown address %s "+
+			"is not a registration packet; ignored",
+			s.config.Pseudonyms.Lazy(addr))
+		return nil, false
+	}
+	if !authenticated && !authenticatesClients(protocol) {
+		s.metrics.RefusedPackets.Inc()
+		s.packetLog.Debugf("registration from %s ignored: "+
+			"not authenticated",
+			s.config.Pseudonyms.Lazy(addr))
+		return nil, false
+	}
+	if s.config.MaxClients > 0 && len(s.clients) >= s.config.MaxClients &&
+		!s.config.TrustedClients.Match(addr.IP) {
+		s.metrics.RefusedPackets.Inc()
+		s.packetLog.Debugf("new client %s refused: "+
+			"server is full (%d clients)",
+			s.config.Pseudonyms.Lazy(addr),
+			s.config.MaxClients)
+		if signed {
+			s.sendRefusal(protocol, addr, stream)
+		}
+		return nil, false
+	}
+	if !s.checkBudget() {
+		s.metrics.RefusedPackets.Inc()
+		s.packetLog.Debugf("new client %s refused: "+
+			"over memory budget",
+			s.config.Pseudonyms.Lazy(addr))
+		if signed {
+			s.sendRefusal(protocol, addr, stream)
+		}
+		return nil, false
+	}
+	return protocol, true
+}
 
-		srcClient = s.newClient(ctx, protocol, addr)
+// sendRefusal sends the given protocol's refusal packet to a client, if the
+// protocol has one.
+func (s *Server) sendRefusal(protocol Protocol, addr *net.UDPAddr, stream ipx.ReadWriteCloser) {
+	rp, ok := protocol.(RefusingProtocol)
+	if !ok {
+		return
+	}
+	packet := rp.RefusalPacket()
+	if stream != nil {
+		stream.WritePacket(packet)
+		return
+	}
+	packetBytes, err := packet.MarshalBinary()
+	if err != nil {
+		return
+	}
+	s.socket.WriteToUDP(packetBytes, addr)
+}
+
+// receive is invoked for every packet received from a client, over any
+// transport. The packet is counted and then queued for the client's
+// protocol, unless it is over the client's rate limit. size is the size of
+// the packet as received. If isNew is true, the packet started the client,
+// and Config.OnConnect is invoked.
+func (s *Server) receive(c *client, packet *ipx.Packet, size int, isNew bool) {
+	s.mu.Lock()
+	now := time.Now()
+	c.lastReceiveTime = now
+	c.rxPackets++
+	c.rxBytes += uint64(size)
+	s.recordIPXAddr(c, packet)
+	s.recordGame(c, packet)
+	ipxAddr, addr := c.ipxAddr, c.addr
+	allowed := s.trusted(c) || c.rateLimiter.allow(now, size)
+	if !allowed {
+		c.dropped++
 	}
 	s.mu.Unlock()
 
-	srcClient.lastReceiveTime = time.Now()
-	srcClient.rxpipe.WritePacket(packet)
+	if isNew && s.config.OnConnect != nil {
+		s.config.OnConnect(ipxAddr, addr)
+	}
+	if !allowed {
+		s.metrics.DroppedPackets.Inc()
+		s.packetLog.Debugf("packet from %s dropped: over rate limit",
+			s.config.Pseudonyms.Lazy(addr))
+		return
+	}
+
+	s.metrics.ReceivedPackets.Inc()
+	s.metrics.ReceivedBytes.Add(uint64(size))
+	c.rxpipe.WritePacket(packet)
+}
+
+// allowedIP returns true if packets may be accepted from the given IP
+// address, according to Config.AllowedCIDRs and Config.BlockedCIDRs.
+func (s *Server) allowedIP(ip net.IP) bool {
+	return s.ipFilter.allows(ip)
+}
+
+// trusted returns true if the given client connects from a trusted IP
+// address. s.mu must be held when calling.
+func (s *Server) trusted(c *client) bool {
+	return s.config.TrustedClients.Match(c.addr.IP)
+}
+
+// clientTimeout returns the time after which the given client times out if
+// nothing is received from it. s.mu must be held when calling.
+func (s *Server) clientTimeout(c *client) time.Duration {
+	if s.config.TrustedClientTimeout > 0 && s.trusted(c) {
+		return s.config.TrustedClientTimeout
+	}
+	return s.config.ClientTimeout
 }
 
 func (s *Server) allClients() []*client {
@@ -209,12 +844,18 @@ func (s *Server) checkClientTimeouts() time.Time {
 
 	for _, c := range s.allClients() {
 		// Nothing received in a long time? Time out the connection.
-		timeoutTime := c.lastReceiveTime.Add(s.config.ClientTimeout)
-		if now.After(timeoutTime) {
-			s.log(("client %s timed out: nothing received " +
+		s.mu.Lock()
+		lastReceiveTime := c.lastReceiveTime
+		timeoutTime := lastReceiveTime.Add(s.clientTimeout(c))
+		s.mu.Unlock()
+		// The client may have been closed since allClients was
+		// called, in which case it does not count as a timeout.
+		if now.After(timeoutTime) && c.close() {
+			s.config.Logger.Infof(("client %s timed out: nothing received " +
 				"since %s."),
-				c.addr.String(), c.lastReceiveTime)
-			c.Close()
+				s.config.Pseudonyms.Name(c.addr.String()),
+				lastReceiveTime)
+			s.metrics.Timeouts.Inc()
 		}
 
 		if timeoutTime.Before(nextCheckTime) {
@@ -225,16 +866,39 @@ func (s *Server) checkClientTimeouts() time.Time {
 	return nextCheckTime
 }
 
+// dropTruncated is called when a datagram too large for the read buffer is
+// received. The first is logged as a warning, since it probably means that
+// Config.ReadBufferSize needs to be increased.
+func (s *Server) dropTruncated(addr *net.UDPAddr) {
+	s.metrics.DroppedPackets.Inc()
+	maxSize := len(s.readBuf) - 1
+	name := s.config.Pseudonyms.Lazy(addr)
+	if !s.warnedTruncated {
+		s.warnedTruncated = true
+		s.config.Logger.Warnf("packet from %s dropped: larger than "+
+			"maximum of %d bytes; further oversized packets "+
+			"will only be logged at debug level", name, maxSize)
+		return
+	}
+	s.packetLog.Debugf("packet from %s dropped: larger than maximum "+
+		"of %d bytes", name, maxSize)
+}
+
 // poll listens for new packets, blocking until one is received, or until
 // a timeout is reached.
 func (s *Server) poll(ctx context.Context) error {
-	var buf [1500]byte
-
 	s.socket.SetReadDeadline(s.timeoutCheckTime)
-	packetLen, addr, err := s.socket.ReadFromUDP(buf[:])
+	// Run sets the deadline to wake us up when the context is cancelled;
+	// if that happened before we set it above, we must not block.
+	if ctx.Err() != nil {
+		return nil
+	}
+	packetLen, addr, err := s.socket.ReadFromUDP(s.readBuf)
 
-	if err == nil {
-		s.processPacket(ctx, buf[0:packetLen], addr)
+	if err == nil && packetLen >= len(s.readBuf) {
+		s.dropTruncated(addr)
+	} else if err == nil {
+		s.processPacket(ctx, s.readBuf[0:packetLen], addr)
 	} else if nerr, ok := err.(net.Error); ok && !nerr.Timeout() {
 		return err
 	}
@@ -248,13 +912,35 @@ func (s *Server) poll(ctx context.Context) error {
 	return nil
 }
 
-// Run runs the server, blocking until the socket is closed or an error occurs.
-func (s *Server) Run(ctx context.Context) {
-	for {
-		if err := s.poll(ctx); err != nil {
-			return
+// Run runs the server, blocking until the context is cancelled, the server is
+// shut down by calling Close, or an error occurs. In the first two cases nil
+// is returned. Cancelling the context does not close the socket, so Close
+// should still be called once Run has returned.
+func (s *Server) Run(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Interrupt the read that poll() is blocked on.
+			s.socket.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	for ctx.Err() == nil {
+		err := s.poll(ctx)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// Addr returns the local address that the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.socket.LocalAddr()
 }
 
 // Close closes the socket associated with the server to shut it down.
@@ -0,0 +1,1166 @@
+package server
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/pipe"
+	"github.com/fragglet/ipxbox/pseudonym"
+)
+
+func makeClientInfo(port int, connected, idle time.Duration, now time.Time) ClientInfo {
+	return ClientInfo{
+		Addr:            &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+		ConnectTime:     now.Add(-connected),
+		LastReceiveTime: now.Add(-idle),
+	}
+}
+
+func TestStaleClients(t *testing.T) {
+	now := time.Now()
+	active := makeClientInfo(1000, time.Minute, time.Second, now)
+	longConnected := makeClientInfo(1001, 48*time.Hour, time.Second, now)
+	idle := makeClientInfo(1002, time.Hour, 20*time.Minute, now)
+	snapshot := []ClientInfo{active, longConnected, idle}
+
+	got := StaleClients(snapshot, now, 24*time.Hour, 10*time.Minute)
+	want := []ClientInfo{longConnected, idle}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong stale clients: want %+v, got %+v", want, got)
+	}
+
+	got = StaleClients(snapshot, now, 0, 10*time.Minute)
+	want = []ClientInfo{idle}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong stale clients with connect check disabled: want %+v, got %+v", want, got)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	now := time.Now()
+	x := makeClientInfo(1000, time.Minute, time.Second, now)
+	y := makeClientInfo(1001, time.Minute, time.Second, now)
+	z := makeClientInfo(1002, time.Minute, time.Second, now)
+
+	added, removed := DiffSnapshots([]ClientInfo{x, y}, []ClientInfo{y, z})
+	if !reflect.DeepEqual(added, []ClientInfo{z}) {
+		t.Errorf("wrong added clients: %+v", added)
+	}
+	if !reflect.DeepEqual(removed, []ClientInfo{x}) {
+		t.Errorf("wrong removed clients: %+v", removed)
+	}
+}
+
+// echoProtocol is a trivial protocol that sends back every packet it
+// receives. Any packet with a null source address is a registration.
+type echoProtocol struct{}
+
+func (echoProtocol) StartClient(ctx context.Context, conn ipx.ReadWriteCloser, addr net.Addr) error {
+	for {
+		packet, err := conn.ReadPacket(ctx)
+		if err != nil {
+			return err
+		}
+		if err := conn.WritePacket(packet); err != nil {
+			return err
+		}
+	}
+}
+
+func (echoProtocol) IsRegistrationPacket(packet *ipx.Packet) bool {
+	return packet.Header.Src.Addr == ipx.AddrNull
+}
+
+func sendTestPacket(t *testing.T, conn *net.UDPConn, dest net.Addr, src ipx.Addr) {
+	packet := &ipx.Packet{
+		Header: ipx.Header{
+			Src: ipx.HeaderAddr{Addr: src},
+		},
+		Payload: []byte("hello"),
+	}
+	packetBytes, err := packet.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(packetBytes, dest); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectTestPacket(t *testing.T, conn *net.UDPConn) {
+	var buf [1500]byte
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadFrom(buf[:]); err != nil {
+		t.Fatalf("no packet received: %v", err)
+	}
+}
+
+// assigningProtocol is like echoProtocol, but assigns the given IPX
+// address to each new client, as the DOSBox protocol does.
+type assigningProtocol struct {
+	echoProtocol
+	addr ipx.Addr
+}
+
+func (p assigningProtocol) StartClient(ctx context.Context, conn ipx.ReadWriteCloser, addr net.Addr) error {
+	conn.(AddressAssigner).AssignAddress(p.addr)
+	return p.echoProtocol.StartClient(ctx, conn, addr)
+}
+
+// startMigrationTest starts a server for the client migration tests and
+// returns it along with two sockets on the given IP addresses.
+func startMigrationTest(t *testing.T, ctx context.Context, protocol Protocol, ips [2]net.IP) (*Server, [2]*net.UDPConn) {
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:          []Protocol{protocol},
+		ClientTimeout:      time.Minute,
+		MigrationQuietTime: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	go s.Run(ctx)
+
+	var conns [2]*net.UDPConn
+	for i := range conns {
+		conns[i], err = net.ListenUDP("udp", &net.UDPAddr{IP: ips[i]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := conns[i]
+		t.Cleanup(func() { conn.Close() })
+	}
+	return s, conns
+}
+
+func expectClientAddr(t *testing.T, s *Server, conn *net.UDPConn) {
+	t.Helper()
+	snapshot := s.Snapshot()
+	if len(snapshot) != 1 {
+		t.Fatalf("want one client, got %+v", snapshot)
+	}
+	wantAddr := conn.LocalAddr().String()
+	if got := snapshot[0].Addr.String(); got != wantAddr {
+		t.Errorf("wrong client address: want %s, got %s", wantAddr, got)
+	}
+}
+
+func TestClientMigration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientAddr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	localhost := net.IPv4(127, 0, 0, 1)
+	s, conns := startMigrationTest(t, ctx,
+		assigningProtocol{addr: clientAddr}, [2]net.IP{localhost, localhost})
+	serverAddr := s.socket.LocalAddr()
+
+	// Client registers and sends data from its first address.
+	sendTestPacket(t, conns[0], serverAddr, ipx.AddrNull)
+	expectTestPacket(t, conns[0])
+	sendTestPacket(t, conns[0], serverAddr, clientAddr)
+	expectTestPacket(t, conns[0])
+
+	// NAT rebinding: once the old address has gone quiet, the same
+	// client sends from a different port.
+	time.Sleep(300 * time.Millisecond)
+	sendTestPacket(t, conns[1], serverAddr, clientAddr)
+	expectTestPacket(t, conns[1])
+	expectClientAddr(t, s, conns[1])
+
+	// A packet from the same IPX address but a different IP must not
+	// be treated as the same client; it is not a registration either,
+	// so it is ignored.
+	s.mu.Lock()
+	_, ok := s.migrateClient(&ipx.Packet{
+		Header: ipx.Header{Src: ipx.HeaderAddr{Addr: clientAddr}},
+	}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1234}, time.Now().Add(time.Minute))
+	s.mu.Unlock()
+	if ok {
+		t.Errorf("client migrated to a different IP address")
+	}
+}
+
+func TestClientMigrationHijack(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	victimAddr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	localhost := net.IPv4(127, 0, 0, 1)
+	s, conns := startMigrationTest(t, ctx,
+		assigningProtocol{addr: victimAddr}, [2]net.IP{localhost, localhost})
+	serverAddr := s.socket.LocalAddr()
+	victim, attacker := conns[0], conns[1]
+
+	sendTestPacket(t, victim, serverAddr, ipx.AddrNull)
+	expectTestPacket(t, victim)
+
+	// The victim stays active while another user behind the same IP
+	// sends packets claiming the victim's IPX address.
+	for i := 0; i < 5; i++ {
+		sendTestPacket(t, victim, serverAddr, victimAddr)
+		expectTestPacket(t, victim)
+		sendTestPacket(t, attacker, serverAddr, victimAddr)
+		time.Sleep(100 * time.Millisecond)
+	}
+	expectClientAddr(t, s, victim)
+	if got := s.Metrics().RefusedPackets.Value(); got != 5 {
+		t.Errorf("want 5 refused packets from attacker, got %d", got)
+	}
+}
+
+func TestClientMigrationClaimedAddress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientAddr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	localhost := net.IPv4(127, 0, 0, 1)
+	s, conns := startMigrationTest(t, ctx, echoProtocol{},
+		[2]net.IP{localhost, localhost})
+	serverAddr := s.socket.LocalAddr()
+
+	// The protocol does not assign addresses, so the address the client
+	// claims is not trusted to identify it, even after it goes quiet.
+	sendTestPacket(t, conns[0], serverAddr, ipx.AddrNull)
+	expectTestPacket(t, conns[0])
+	sendTestPacket(t, conns[0], serverAddr, clientAddr)
+	expectTestPacket(t, conns[0])
+	time.Sleep(300 * time.Millisecond)
+	sendTestPacket(t, conns[1], serverAddr, clientAddr)
+	time.Sleep(100 * time.Millisecond)
+	expectClientAddr(t, s, conns[0])
+}
+
+func TestSnapshotAllocations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	want := map[string]ipx.Addr{}
+	for i := 1; i <= 2; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		addr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, byte(i)}
+		sendTestPacket(t, conn, serverAddr, ipx.AddrNull)
+		expectTestPacket(t, conn)
+		sendTestPacket(t, conn, serverAddr, addr)
+		expectTestPacket(t, conn)
+		want[conn.LocalAddr().String()] = addr
+	}
+
+	snapshot := s.Snapshot()
+	if len(snapshot) != len(want) {
+		t.Fatalf("want %d clients, got %+v", len(want), snapshot)
+	}
+	for _, ci := range snapshot {
+		if got := ci.IPXAddr; got != want[ci.Addr.String()] {
+			t.Errorf("client %s: want IPX address %s, got %s",
+				ci.Addr, want[ci.Addr.String()], got)
+		}
+		if ci.LastSendTime.IsZero() {
+			t.Errorf("client %s: no send time recorded", ci.Addr)
+		}
+		// Two packets of 35 bytes each were sent and echoed back.
+		if ci.RxPackets != 2 || ci.RxBytes != 70 || ci.TxPackets != 2 || ci.TxBytes != 70 {
+			t.Errorf("client %s: want 2 packets, 70 bytes each way, got rx %d/%d, tx %d/%d",
+				ci.Addr, ci.RxPackets, ci.RxBytes, ci.TxPackets, ci.TxBytes)
+		}
+		// Modifying the snapshot must not affect the server.
+		ci.Addr.Port = 1
+		ci.Addr.IP[len(ci.Addr.IP)-1] = 0
+	}
+	for _, ci := range s.Snapshot() {
+		if _, ok := want[ci.Addr.String()]; !ok {
+			t.Errorf("client address changed by modifying snapshot: %s", ci.Addr)
+		}
+	}
+}
+
+func TestSnapshotGame(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	identified := 0
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+		Identify: func(packet *ipx.Packet) (string, bool) {
+			identified++
+			if packet.Header.Src.Addr == ipx.AddrNull {
+				return "", false
+			}
+			return "Test Game", true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sendTestPacket(t, conn, serverAddr, ipx.AddrNull)
+	expectTestPacket(t, conn)
+	if snapshot := s.Snapshot(); len(snapshot) != 1 || snapshot[0].Game != "" {
+		t.Errorf("want one client with no game, got %+v", snapshot)
+	}
+	addr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	for i := 0; i < 2; i++ {
+		sendTestPacket(t, conn, serverAddr, addr)
+		expectTestPacket(t, conn)
+	}
+	if snapshot := s.Snapshot(); len(snapshot) != 1 || snapshot[0].Game != "Test Game" {
+		t.Errorf("want one client playing Test Game, got %+v", snapshot)
+	}
+	// Once a client is identified, later packets are not examined.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if identified != 2 {
+		t.Errorf("want Identify called twice, got %d calls", identified)
+	}
+}
+
+func TestTrustedClientTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	trustedAddr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	trusted, err := ParseTrustList("127.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:            []Protocol{echoProtocol{}},
+		ClientTimeout:        time.Minute,
+		TrustedClients:       trusted,
+		TrustedClientTimeout: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	clients := []struct {
+		ip      net.IP
+		ipxAddr ipx.Addr
+	}{
+		{net.IPv4(127, 0, 0, 2), trustedAddr},
+		{net.IPv4(127, 0, 0, 1), ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}},
+	}
+	for _, c := range clients {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: c.ip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		sendTestPacket(t, conn, serverAddr, ipx.AddrNull)
+		expectTestPacket(t, conn)
+		sendTestPacket(t, conn, serverAddr, c.ipxAddr)
+		expectTestPacket(t, conn)
+	}
+
+	// Pretend that nothing has been received from either client for
+	// longer than the normal timeout.
+	s.mu.Lock()
+	for _, c := range s.clients {
+		c.lastReceiveTime = time.Now().Add(-2 * time.Minute)
+	}
+	s.mu.Unlock()
+	s.checkClientTimeouts()
+
+	snapshot := s.Snapshot()
+	if len(snapshot) != 1 || snapshot[0].IPXAddr != trustedAddr || !snapshot[0].Trusted {
+		t.Errorf("want only trusted client %s after timeout, got %+v", trustedAddr, snapshot)
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := New(":0", &Config{
+		Network:       "udp",
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	port := s.Addr().(*net.UDPAddr).Port
+
+	conn6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	defer conn6.Close()
+	conn4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn4.Close()
+
+	for i, conn := range []*net.UDPConn{conn4, conn6} {
+		ip := net.IPv4(127, 0, 0, 1)
+		if conn == conn6 {
+			ip = net.IPv6loopback
+		}
+		serverAddr := &net.UDPAddr{IP: ip, Port: port}
+		sendTestPacket(t, conn, serverAddr, ipx.AddrNull)
+		expectTestPacket(t, conn)
+		sendTestPacket(t, conn, serverAddr, ipx.Addr{0x02, 0, 0, 0, 0, byte(i + 1)})
+		expectTestPacket(t, conn)
+	}
+	if snapshot := s.Snapshot(); len(snapshot) != 2 {
+		t.Errorf("want IPv4 and IPv6 clients, got %+v", snapshot)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Run returned error after cancel: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run did not return after context was cancelled")
+	}
+}
+
+func TestRunClose(t *testing.T) {
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Run returned error after Close: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run did not return after Close")
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const maxClients = 3
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+		MaxClients:    maxClients,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	conns := []*net.UDPConn{}
+	for i := 0; i <= maxClients; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns[:maxClients] {
+		sendTestPacket(t, conn, serverAddr, ipx.AddrNull)
+		expectTestPacket(t, conn)
+	}
+
+	// The server is full, so the next registration is ignored.
+	extra := conns[maxClients]
+	sendTestPacket(t, extra, serverAddr, ipx.AddrNull)
+	var buf [1500]byte
+	extra.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := extra.ReadFrom(buf[:]); err == nil {
+		t.Errorf("client registered beyond limit of %d clients", maxClients)
+	}
+	if got := len(s.Snapshot()); got != maxClients {
+		t.Errorf("want %d clients, got %d", maxClients, got)
+	}
+
+	// Existing clients can still register again.
+	sendTestPacket(t, conns[0], serverAddr, ipx.AddrNull)
+	expectTestPacket(t, conns[0])
+}
+
+func TestBudgetRefusesClients(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	budget := pipe.NewBudget(100)
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+		Budget:        budget,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	// Use up most of the budget with a packet queued in another pipe,
+	// so that the next packet does not fit.
+	p := pipe.NewWithBudget(budget)
+	if err := p.WritePacket(&ipx.Packet{Payload: make([]byte, 80-ipx.HeaderLength)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WritePacket(&ipx.Packet{Payload: make([]byte, 40-ipx.HeaderLength)}); err != pipe.BudgetExceededError {
+		t.Fatalf("want error %v, got %v", pipe.BudgetExceededError, err)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sendTestPacket(t, conn, serverAddr, ipx.AddrNull)
+	var buf [1500]byte
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := conn.ReadFrom(buf[:]); err == nil {
+		t.Errorf("client registered while over memory budget")
+	}
+	if got := len(s.Snapshot()); got != 0 {
+		t.Errorf("want no clients while over budget, got %d", got)
+	}
+	if got := s.Metrics().RefusedPackets.Value(); got != 1 {
+		t.Errorf("want 1 refused packet, got %d", got)
+	}
+
+	// Once the queued packet is read, the budget is released and the
+	// client can register.
+	if _, err := p.ReadPacket(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sendTestPacket(t, conn, serverAddr, ipx.AddrNull)
+	expectTestPacket(t, conn)
+}
+
+func TestMaxClientsTrusted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	trusted, err := ParseTrustList("127.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:      []Protocol{echoProtocol{}},
+		ClientTimeout:  time.Minute,
+		MaxClients:     1,
+		TrustedClients: trusted,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	var conns []*net.UDPConn
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)} {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	sendTestPacket(t, conns[0], serverAddr, ipx.AddrNull)
+	expectTestPacket(t, conns[0])
+
+	// A client from another IP address is refused.
+	sendTestPacket(t, conns[1], serverAddr, ipx.AddrNull)
+	var buf [1500]byte
+	conns[1].SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := conns[1].ReadFrom(buf[:]); err == nil {
+		t.Errorf("untrusted client registered beyond limit")
+	}
+
+	// A client from a trusted IP address can still connect.
+	sendTestPacket(t, conns[2], serverAddr, ipx.AddrNull)
+	expectTestPacket(t, conns[2])
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	limitedAddr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	trusted, err := ParseTrustList("127.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const rate = 5
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:      []Protocol{echoProtocol{}},
+		ClientTimeout:  time.Minute,
+		MaxPacketRate:  rate,
+		TrustedClients: trusted,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	const numPackets = 10
+	clients := []struct {
+		ip      net.IP
+		ipxAddr ipx.Addr
+	}{
+		{net.IPv4(127, 0, 0, 2), ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}},
+		{net.IPv4(127, 0, 0, 1), limitedAddr},
+	}
+	var received [2]int
+	for i, c := range clients {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: c.ip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// The first packet registers the client and also counts
+		// against the limit.
+		sendTestPacket(t, conn, serverAddr, ipx.AddrNull)
+		expectTestPacket(t, conn)
+		for j := 0; j < numPackets; j++ {
+			sendTestPacket(t, conn, serverAddr, c.ipxAddr)
+		}
+		var buf [1500]byte
+		for {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, _, err := conn.ReadFrom(buf[:]); err != nil {
+				break
+			}
+			received[i]++
+		}
+	}
+
+	if got := received[0]; got != numPackets {
+		t.Errorf("trusted client: want all %d packets, got %d", numPackets, got)
+	}
+	// The rate limited client can exceed the limit slightly because
+	// tokens are refilled while the packets are being sent.
+	if got := received[1]; got < rate-1 || got > rate+1 {
+		t.Errorf("rate limited client: want about %d packets, got %d", rate-1, got)
+	}
+	for _, ci := range s.Snapshot() {
+		if ci.IPXAddr == limitedAddr && ci.Dropped == 0 {
+			t.Errorf("no dropped packets counted for rate limited client")
+		}
+	}
+}
+
+func TestSharedSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	secret := []byte("swordfish")
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+		SharedSecret:  secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// An unauthenticated registration is silently ignored.
+	sendTestPacket(t, conn, serverAddr, ipx.AddrNull)
+	var buf [1500]byte
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := conn.ReadFrom(buf[:]); err == nil {
+		t.Errorf("unauthenticated client was accepted")
+	}
+	if got := len(s.Snapshot()); got != 0 {
+		t.Errorf("want no clients, got %d", got)
+	}
+
+	// The protocol sees an authenticated registration without the
+	// authentication payload.
+	packet := &ipx.Packet{}
+	SignRegistration(packet, secret, time.Now())
+	packetBytes, err := packet.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(packetBytes, serverAddr); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatalf("authenticated client not accepted: %v", err)
+	}
+	if n != ipx.HeaderLength {
+		t.Errorf("want %d byte registration echoed back, got %d bytes", ipx.HeaderLength, n)
+	}
+}
+
+func TestRegistrationReplayRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	secret := []byte("swordfish")
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+		SharedSecret:  secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	// A DOSBox registration packet, as sent by the ipxbox client.
+	packet := &ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrNull, Socket: 2},
+			Src:  ipx.HeaderAddr{Addr: ipx.AddrNull, Socket: 2},
+		},
+	}
+	SignRegistration(packet, secret, time.Now())
+	captured, err := packet.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first copy is accepted. An attacker who captures it and sends
+	// it again, from another address, is ignored.
+	var buf [1500]byte
+	for i, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)} {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.WriteTo(captured, serverAddr); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err = conn.ReadFrom(buf[:])
+		switch {
+		case i == 0 && err != nil:
+			t.Fatalf("registration not accepted: %v", err)
+		case i > 0 && err == nil:
+			t.Errorf("replayed registration %d from %s accepted", i, conn.LocalAddr())
+		}
+	}
+	if got := len(s.Snapshot()); got != 1 {
+		t.Errorf("want 1 client, got %d", got)
+	}
+}
+
+func TestPseudonymsOnlyRegisteredForClients(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pseudonyms, err := pseudonym.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+		Pseudonyms:    pseudonyms,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	// A packet that is not a registration does not start a client, so
+	// its pseudonym cannot be reversed.
+	refused, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	sendTestPacket(t, refused, serverAddr, ipx.Addr{1, 2, 3, 4, 5, 6})
+
+	accepted, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	sendTestPacket(t, accepted, serverAddr, ipx.AddrNull)
+	expectTestPacket(t, accepted)
+
+	if _, ok := pseudonyms.Lookup(pseudonyms.Name(refused.LocalAddr().String())); ok {
+		t.Errorf("pseudonym registered for refused packet")
+	}
+	if _, ok := pseudonyms.Lookup(pseudonyms.Name(accepted.LocalAddr().String())); !ok {
+		t.Errorf("pseudonym not registered for accepted client")
+	}
+}
+
+func TestCheckPacketLength(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:         []Protocol{echoProtocol{}},
+		ClientTimeout:     time.Minute,
+		CheckPacketLength: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	payload := []byte("hello")
+	actualLen := ipx.HeaderLength + len(payload)
+	for _, test := range []struct {
+		name   string
+		length int
+		want   bool
+	}{
+		{"truncated", actualLen + 1, false},
+		{"oversized", actualLen - 1, false},
+		{"correct length", actualLen, true},
+	} {
+		packet := &ipx.Packet{
+			Header:  ipx.Header{Length: uint16(test.length)},
+			Payload: payload,
+		}
+		packetBytes, err := packet.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteTo(packetBytes, serverAddr); err != nil {
+			t.Fatal(err)
+		}
+		var buf [1500]byte
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err = conn.ReadFrom(buf[:])
+		if got := err == nil; got != test.want {
+			t.Errorf("%s packet: want accepted=%v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestReadBufferSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:      []Protocol{echoProtocol{}},
+		ClientTimeout:  time.Minute,
+		ReadBufferSize: 600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, test := range []struct {
+		size int
+		want bool
+	}{
+		{601, false},
+		{600, true},
+		{2000, false},
+	} {
+		packet := &ipx.Packet{
+			Payload: make([]byte, test.size-ipx.HeaderLength),
+		}
+		packetBytes, err := packet.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteTo(packetBytes, serverAddr); err != nil {
+			t.Fatal(err)
+		}
+		var buf [3000]byte
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf[:])
+		if got := err == nil; got != test.want {
+			t.Errorf("%d byte packet: want accepted=%v, got %v", test.size, test.want, got)
+		} else if got && n != test.size {
+			t.Errorf("%d byte packet: echoed packet has length %d", test.size, n)
+		}
+	}
+	if got := s.Metrics().DroppedPackets.Value(); got != 2 {
+		t.Errorf("want 2 dropped packets, got %v", got)
+	}
+}
+
+func TestReadBufferSizeTooSmall(t *testing.T) {
+	for _, size := range []int{-1, ipx.HeaderLength - 1} {
+		s, err := New("127.0.0.1:0", &Config{
+			Protocols:      []Protocol{echoProtocol{}},
+			ReadBufferSize: size,
+		})
+		if err == nil {
+			s.Close()
+			t.Errorf("New succeeded with read buffer size %d", size)
+		}
+	}
+}
+
+func TestAllowedIP(t *testing.T) {
+	tests := []struct {
+		allowed, blocked []string
+		ip               net.IP
+		want             bool
+	}{
+		{nil, nil, net.IPv4(1, 2, 3, 4), true},
+		{[]string{"10.0.0.0/8"}, nil, net.IPv4(10, 1, 2, 3), true},
+		{[]string{"10.0.0.0/8"}, nil, net.IPv4(11, 1, 2, 3), false},
+		{[]string{"10.0.0.0/8", "192.168.0.1"}, nil, net.IPv4(192, 168, 0, 1), true},
+		{nil, []string{"10.0.0.0/8"}, net.IPv4(10, 1, 2, 3), false},
+		{nil, []string{"10.0.0.0/8"}, net.IPv4(11, 1, 2, 3), true},
+		{[]string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, net.IPv4(10, 1, 2, 3), false},
+		{[]string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, net.IPv4(10, 2, 2, 3), true},
+		{[]string{"2001:db8::/32"}, nil, net.ParseIP("2001:db8::1"), true},
+		{[]string{"2001:db8::/32"}, nil, net.IPv4(10, 1, 2, 3), false},
+	}
+	for _, test := range tests {
+		s, err := New("127.0.0.1:0", &Config{
+			AllowedCIDRs: test.allowed,
+			BlockedCIDRs: test.blocked,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+		if got := s.allowedIP(test.ip); got != test.want {
+			t.Errorf("allowed=%v, blocked=%v: allowedIP(%v) = %v, want %v",
+				test.allowed, test.blocked, test.ip, got, test.want)
+		}
+	}
+
+	if _, err := New("127.0.0.1:0", &Config{BlockedCIDRs: []string{"10.0.0.0/33"}}); err == nil {
+		t.Errorf("invalid network accepted")
+	}
+}
+
+func TestBlockedClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+		BlockedCIDRs:  []string{"127.0.0.2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	blocked, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skipf("cannot listen on 127.0.0.2: %v", err)
+	}
+	defer blocked.Close()
+	sendTestPacket(t, blocked, serverAddr, ipx.AddrNull)
+	var buf [1500]byte
+	blocked.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := blocked.ReadFrom(buf[:]); err == nil {
+		t.Errorf("client from blocked address was accepted")
+	}
+
+	allowed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close()
+	sendTestPacket(t, allowed, serverAddr, ipx.AddrNull)
+	expectTestPacket(t, allowed)
+
+	if got := len(s.Snapshot()); got != 1 {
+		t.Errorf("want 1 client, got %d", got)
+	}
+}
+
+// oneShotProtocol accepts any packet as a registration, and disconnects the
+// client after it has read one packet.
+type oneShotProtocol struct{}
+
+func (oneShotProtocol) StartClient(ctx context.Context, conn ipx.ReadWriteCloser, addr net.Addr) error {
+	_, err := conn.ReadPacket(ctx)
+	return err
+}
+
+func (oneShotProtocol) IsRegistrationPacket(packet *ipx.Packet) bool {
+	return true
+}
+
+func TestConnectCallbacks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type event struct {
+		ipxAddr ipx.Addr
+		addr    string
+	}
+	connects := make(chan event, 10)
+	disconnects := make(chan event, 10)
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{oneShotProtocol{}},
+		ClientTimeout: time.Minute,
+		OnConnect: func(ipxAddr ipx.Addr, addr *net.UDPAddr) {
+			connects <- event{ipxAddr, addr.String()}
+		},
+		OnDisconnect: func(ipxAddr ipx.Addr, addr *net.UDPAddr) {
+			disconnects <- event{ipxAddr, addr.String()}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ipxAddr := ipx.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	sendTestPacket(t, conn, s.socket.LocalAddr(), ipxAddr)
+	want := event{ipxAddr, conn.LocalAddr().String()}
+
+	for _, ch := range []chan event{connects, disconnects} {
+		select {
+		case got := <-ch:
+			if got != want {
+				t.Errorf("want callback for %+v, got %+v", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("callback not invoked")
+		}
+	}
+	select {
+	case got := <-disconnects:
+		t.Errorf("OnDisconnect invoked twice, second time for %+v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := New("127.0.0.1:0", &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run(ctx)
+	serverAddr := s.socket.LocalAddr()
+
+	conns := []*net.UDPConn{}
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	sendTestPacket(t, conns[0], serverAddr, ipx.AddrNull)
+	expectTestPacket(t, conns[0])
+	sendTestPacket(t, conns[0], serverAddr, ipx.AddrNull)
+	expectTestPacket(t, conns[0])
+
+	// Not a registration packet, so it is refused.
+	sendTestPacket(t, conns[1], serverAddr, ipx.Addr{0x02, 0, 0, 0, 0, 1})
+	// Wait for the server to process the packet.
+	sendTestPacket(t, conns[0], serverAddr, ipx.AddrNull)
+	expectTestPacket(t, conns[0])
+
+	m := s.Metrics()
+	for _, test := range []struct {
+		name      string
+		got, want int64
+	}{
+		{"clients", m.Clients.Value(), 1},
+		{"registrations", int64(m.Registrations.Value()), 1},
+		{"received packets", int64(m.ReceivedPackets.Value()), 3},
+		{"received bytes", int64(m.ReceivedBytes.Value()), 105},
+		{"sent packets", int64(m.SentPackets.Value()), 3},
+		{"sent bytes", int64(m.SentBytes.Value()), 105},
+		{"refused packets", int64(m.RefusedPackets.Value()), 1},
+		{"dropped packets", int64(m.DroppedPackets.Value()), 0},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s: want %d, got %d", test.name, test.want, test.got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/pipe"
+)
+
+var (
+	_ = (ipx.ReadWriteCloser)(&StreamConn{})
+	_ = (io.Closer)(&TCPServer{})
+)
+
+// StreamConn sends and receives IPX packets over a stream connection, such
+// as a TCP connection. Each packet is sent as a two byte, big endian length
+// followed by the packet itself (IPX header and payload).
+type StreamConn struct {
+	conn   net.Conn
+	rxpipe ipx.ReadWriteCloser
+	mu     sync.Mutex
+}
+
+// NewStreamConn creates a StreamConn that sends and receives packets over the
+// given connection.
+func NewStreamConn(conn net.Conn) *StreamConn {
+	return NewStreamConnWithBudget(conn, nil)
+}
+
+// NewStreamConnWithBudget is like NewStreamConn, but received packets are
+// accounted against the given budget until they are read.
+func NewStreamConnWithBudget(conn net.Conn, budget *pipe.Budget) *StreamConn {
+	c := &StreamConn{
+		conn:   conn,
+		rxpipe: pipe.NewWithBudget(budget),
+	}
+	go c.recvLoop()
+	return c
+}
+
+func (c *StreamConn) recvLoop() {
+	defer c.rxpipe.Close()
+	r := bufio.NewReader(c.conn)
+	var lenBuf [2]byte
+	for {
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return
+		}
+		p := &ipx.Packet{}
+		if err := p.UnmarshalBinary(buf); err != nil {
+			// The framing is still intact, so we can skip over
+			// a bad packet.
+			continue
+		}
+		c.rxpipe.WritePacket(p)
+	}
+}
+
+func (c *StreamConn) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	return c.rxpipe.ReadPacket(ctx)
+}
+
+func (c *StreamConn) WritePacket(packet *ipx.Packet) error {
+	packetBytes, err := packet.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if len(packetBytes) > 0xffff {
+		return fmt.Errorf("packet too long to send: %d bytes", len(packetBytes))
+	}
+	frame := make([]byte, 2+len(packetBytes))
+	binary.BigEndian.PutUint16(frame, uint16(len(packetBytes)))
+	copy(frame[2:], packetBytes)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.conn.Write(frame)
+	return err
+}
+
+func (c *StreamConn) Close() error {
+	c.rxpipe.Close()
+	return c.conn.Close()
+}
+
+// TCPServer is an IPX server that accepts clients over TCP instead of UDP,
+// for networks that block or interfere with UDP traffic. Packets are framed
+// as for StreamConn, and each connection is a separate client. Otherwise the
+// same protocols are used as for a UDP server.
+type TCPServer struct {
+	handler  *ConnHandler
+	listener *net.TCPListener
+}
+
+// NewTCP creates a new TCPServer, listening on the given address. Clients
+// are added to the given UDP server, as for NewConnHandler, and it is
+// listened on using the same network type.
+func NewTCP(addr string, s *Server) (*TCPServer, error) {
+	network := "tcp4"
+	if s.config.Network != "" {
+		network = strings.Replace(s.config.Network, "udp", "tcp", 1)
+	}
+	tcpAddr, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenTCP(network, tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPServer{
+		handler:  NewConnHandler(s),
+		listener: listener,
+	}, nil
+}
+
+// Addr returns the address that the server is listening on.
+func (s *TCPServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Run accepts new connections until the context is cancelled, the server is
+// shut down by calling Close, or an error occurs. In the first two cases nil
+// is returned. As with Server.Run, Close should still be called once Run has
+// returned.
+func (s *TCPServer) Run(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Interrupt the blocked call to Accept.
+			s.listener.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	for {
+		conn, err := s.listener.AcceptTCP()
+		if err == nil {
+			addr := conn.RemoteAddr().(*net.TCPAddr)
+			sc := NewStreamConnWithBudget(conn, s.handler.Budget())
+			go s.handler.Serve(ctx, sc, addr)
+			continue
+		}
+		if errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+}
+
+// Close stops the server listening for new connections and disconnects all
+// clients.
+func (s *TCPServer) Close() error {
+	err := s.listener.Close()
+	s.handler.Close()
+	return err
+}
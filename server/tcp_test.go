@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+func dialTCPServer(t *testing.T, s *TCPServer) *StreamConn {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStreamConn(conn)
+}
+
+// startTCPServer starts a UDP server with the given configuration, and a
+// TCPServer that adds clients to it.
+func startTCPServer(t *testing.T, ctx context.Context, c *Config) (*Server, *TCPServer) {
+	us, err := New("127.0.0.1:0", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { us.Close() })
+	go us.Run(ctx)
+	s, err := NewTCP("127.0.0.1:0", us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	go s.Run(ctx)
+	return us, s
+}
+
+func TestTCPServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, s := startTCPServer(t, ctx, &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+		MaxClients:    1,
+	})
+
+	c := dialTCPServer(t, s)
+	defer c.Close()
+	for _, src := range []ipx.Addr{ipx.AddrNull, {0x02, 0, 0, 0, 0, 1}} {
+		packet := &ipx.Packet{
+			Header:  ipx.Header{Src: ipx.HeaderAddr{Addr: src}},
+			Payload: []byte("hello"),
+		}
+		if err := c.WritePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("no packet received: %v", err)
+		}
+		if got.Header != packet.Header || string(got.Payload) != "hello" {
+			t.Errorf("wrong packet echoed: want %+v, got %+v", packet, got)
+		}
+	}
+
+	// The server is full, so a second client is disconnected.
+	c2 := dialTCPServer(t, s)
+	defer c2.Close()
+	c2.WritePacket(&ipx.Packet{})
+	if _, err := c2.ReadPacket(ctx); err == nil {
+		t.Errorf("client connected beyond limit")
+	}
+}
+
+func TestTCPServerRejectsNonRegistration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, s := startTCPServer(t, ctx, &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+	})
+
+	c := dialTCPServer(t, s)
+	defer c.Close()
+	c.WritePacket(&ipx.Packet{
+		Header: ipx.Header{Src: ipx.HeaderAddr{Addr: ipx.Addr{0x02, 0, 0, 0, 0, 1}}},
+	})
+	if _, err := c.ReadPacket(ctx); err == nil {
+		t.Errorf("connection not closed after non-registration packet")
+	}
+}
+
+func TestTCPServerRegistrationTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, s := startTCPServer(t, ctx, &Config{
+		Protocols:           []Protocol{echoProtocol{}},
+		ClientTimeout:       time.Minute,
+		RegistrationTimeout: 100 * time.Millisecond,
+	})
+
+	// The client never registers, so it is disconnected.
+	c := dialTCPServer(t, s)
+	defer c.Close()
+	if _, err := c.ReadPacket(ctx); err == nil || ctx.Err() != nil {
+		t.Errorf("connection not closed after registration timeout")
+	}
+}
+
+func TestTCPServerMaxPendingConns(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, s := startTCPServer(t, ctx, &Config{
+		Protocols:       []Protocol{echoProtocol{}},
+		ClientTimeout:   time.Minute,
+		MaxPendingConns: 1,
+	})
+
+	// The first connection has not yet registered, so the second is
+	// refused.
+	c := dialTCPServer(t, s)
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond)
+	c2 := dialTCPServer(t, s)
+	defer c2.Close()
+	c2.WritePacket(&ipx.Packet{})
+	if _, err := c2.ReadPacket(ctx); err == nil || ctx.Err() != nil {
+		t.Errorf("connection accepted beyond pending limit")
+	}
+
+	// Once the first registers, it is no longer pending.
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			c = dialTCPServer(t, s)
+			defer c.Close()
+		}
+		c.WritePacket(&ipx.Packet{})
+		if _, err := c.ReadPacket(ctx); err != nil {
+			t.Fatalf("no packet received: %v", err)
+		}
+	}
+}
+
+func TestTCPServerRunCancel(t *testing.T) {
+	us, err := New("127.0.0.1:0", &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer us.Close()
+	s, err := NewTCP("127.0.0.1:0", us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- s.Run(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Run returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after context was cancelled")
+	}
+}
+
+func TestTCPServerSharesClientTable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	connected, disconnected := 0, 0
+	us, s := startTCPServer(t, ctx, &Config{
+		Protocols:     []Protocol{echoProtocol{}},
+		ClientTimeout: time.Minute,
+		MaxClients:    2,
+		MaxPacketRate: 1,
+		OnConnect: func(ipx.Addr, *net.UDPAddr) {
+			mu.Lock()
+			connected++
+			mu.Unlock()
+		},
+		OnDisconnect: func(ipx.Addr, *net.UDPAddr) {
+			mu.Lock()
+			disconnected++
+			mu.Unlock()
+		},
+	})
+
+	// One client connects over UDP and one over TCP.
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	sendTestPacket(t, udpConn, us.Addr(), ipx.AddrNull)
+	expectTestPacket(t, udpConn)
+
+	c := dialTCPServer(t, s)
+	for i := 0; i < 5; i++ {
+		c.WritePacket(&ipx.Packet{Payload: []byte("hello")})
+	}
+	if _, err := c.ReadPacket(ctx); err != nil {
+		t.Fatalf("no packet received: %v", err)
+	}
+
+	// Both count towards MaxClients.
+	c2 := dialTCPServer(t, s)
+	defer c2.Close()
+	c2.WritePacket(&ipx.Packet{})
+	if _, err := c2.ReadPacket(ctx); err == nil {
+		t.Errorf("TCP client connected beyond limit")
+	}
+
+	// Give the server time to process the rest of the packets.
+	time.Sleep(100 * time.Millisecond)
+	snapshot := us.Snapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("want two clients in snapshot, got %+v", snapshot)
+	}
+	m := us.Metrics()
+	if got := m.Clients.Value(); got != 2 {
+		t.Errorf("want 2 clients in metrics, got %d", got)
+	}
+	// The TCP client is rate limited like a UDP client.
+	for _, ci := range snapshot {
+		if ci.Addr.String() == c.conn.LocalAddr().String() && ci.Dropped == 0 {
+			t.Errorf("no packets dropped from TCP client: %+v", ci)
+		}
+	}
+
+	c.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(us.Snapshot()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := m.Clients.Value(); got != 1 {
+		t.Errorf("want 1 client in metrics after disconnect, got %d", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if connected != 2 || disconnected != 1 {
+		t.Errorf("want 2 connects and 1 disconnect, got %d and %d",
+			connected, disconnected)
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/fragglet/ipxbox/ipx"
+)
+
+// TrustList identifies trusted clients, such as the machine hosting a game,
+// that are exempt from limits applied to other clients. Clients are matched
+// by the IP address they connect from. IPX addresses cannot be trusted,
+// since they are chosen by the clients themselves.
+type TrustList struct {
+	networks []*net.IPNet
+}
+
+// ParseTrustList parses a comma-separated list of trusted clients. Each
+// entry is either an IP address (eg. 192.168.0.10) or a network in CIDR
+// notation (eg. 192.168.0.0/24).
+func ParseTrustList(s string) (*TrustList, error) {
+	result := &TrustList{}
+	if s == "" {
+		return result, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		ipnet, ok := parseIPNet(entry)
+		if ok {
+			result.networks = append(result.networks, ipnet)
+			continue
+		}
+		if _, err := ipx.ParseAddr(entry); err == nil {
+			return nil, fmt.Errorf("invalid trusted client %q: IPX addresses cannot be trusted since clients can claim any address; use an IP address instead", entry)
+		}
+		return nil, fmt.Errorf("invalid trusted client %q: not an IP address or network", entry)
+	}
+	return result, nil
+}
+
+// parseIPNet parses either a network in CIDR notation or a single IP
+// address, which is treated as a network containing only that address.
+func parseIPNet(s string) (*net.IPNet, bool) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true
+	}
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet, true
+	}
+	return nil, false
+}
+
+// parseIPNets parses a list of networks, as for parseIPNet.
+func parseIPNets(list []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, s := range list {
+		ipnet, ok := parseIPNet(strings.TrimSpace(s))
+		if !ok {
+			return nil, fmt.Errorf("invalid network %q: not an IP address or CIDR network", s)
+		}
+		result = append(result, ipnet)
+	}
+	return result, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range networks {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if clients connecting from the given IP address are
+// trusted. It is safe to call on a nil TrustList, which matches nothing.
+func (l *TrustList) Match(ip net.IP) bool {
+	return l != nil && containsIP(l.networks, ip)
+}
+
+// ipFilter decides which IP addresses packets are accepted from, according
+// to Config.AllowedCIDRs and Config.BlockedCIDRs.
+type ipFilter struct {
+	allowed, blocked []*net.IPNet
+}
+
+func newIPFilter(c *Config) (*ipFilter, error) {
+	allowed, err := parseIPNets(c.AllowedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	blocked, err := parseIPNets(c.BlockedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return &ipFilter{allowed: allowed, blocked: blocked}, nil
+}
+
+func (f *ipFilter) allows(ip net.IP) bool {
+	if containsIP(f.blocked, ip) {
+		return false
+	}
+	return len(f.allowed) == 0 || containsIP(f.allowed, ip)
+}
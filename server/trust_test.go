@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTrustList(t *testing.T) {
+	l, err := ParseTrustList("192.168.0.10, 10.1.0.0/16,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   net.IP
+		want bool
+	}{
+		{net.IPv4(192, 168, 0, 10), true},
+		{net.IPv4(192, 168, 0, 11), false},
+		{net.IPv4(10, 1, 200, 3), true},
+		{net.IPv4(10, 2, 0, 1), false},
+		{net.IPv6loopback, true},
+	}
+	for _, test := range tests {
+		if got := l.Match(test.ip); got != test.want {
+			t.Errorf("Match(%s): want %v, got %v", test.ip, test.want, got)
+		}
+	}
+
+	var nilList *TrustList
+	if nilList.Match(net.IPv4(192, 168, 0, 10)) {
+		t.Errorf("nil TrustList matched client")
+	}
+	// IPX addresses are chosen by clients, so they cannot be trusted.
+	for _, bad := range []string{"example.com", "10.0.0.0/33", "02:00:00:00:00:01"} {
+		if _, err := ParseTrustList(bad); err == nil {
+			t.Errorf("invalid trust list %q parsed without error", bad)
+		}
+	}
+}
@@ -11,20 +11,23 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/logging"
 	"github.com/fragglet/ipxbox/network"
 	"github.com/fragglet/ipxbox/network/stats"
+	"github.com/fragglet/ipxbox/pseudonym"
 	"github.com/fragglet/ipxbox/server"
 )
 
 var (
 	_ = (ipx.ReadWriteCloser)(&client{})
 	_ = (server.Protocol)(&Protocol{})
+	_ = (server.AuthenticatingProtocol)(&Protocol{})
 
 	// Address is a special IPX address used to identify control packets;
 	// control packets have this destination address.
@@ -107,7 +110,7 @@ type Protocol struct {
 
 	// If not nil, log entries are written as clients connect and
 	// disconnect.
-	Logger *log.Logger
+	Logger *logging.Logger
 
 	// Clients *must* supply a password. Uplink is always authenticated.
 	Password string
@@ -118,12 +121,21 @@ type Protocol struct {
 	// packets on particular ports if nothing is received for a while.
 	// This controls the time for keepalives.
 	KeepaliveTime time.Duration
-}
 
-func (p *Protocol) log(format string, args ...interface{}) {
-	if p.Logger != nil {
-		p.Logger.Printf(format, args...)
-	}
+	// If not nil, client addresses are replaced with pseudonyms in
+	// log entries.
+	Pseudonyms *pseudonym.Map
+
+	// If not nil, challenge nonces are generated using this source of
+	// random data instead of crypto/rand. This is intended for testing.
+	Rand io.Reader
+
+	// If non-zero, the client must submit its solution within this time
+	// of the connection starting, otherwise it is rejected. Since each
+	// connection gets a fresh challenge, a solution captured from one
+	// connection cannot be replayed on another; this additionally limits
+	// the window in which a connection's own challenge can be attacked.
+	ChallengeTimeout time.Duration
 }
 
 // IsRegistrationPacket returns true if this is an uplink packet of type
@@ -140,6 +152,12 @@ func (p *Protocol) IsRegistrationPacket(packet *ipx.Packet) bool {
 	return msg.Type == MessageTypeGetChallengeRequest
 }
 
+// AuthenticatesClients implements server.AuthenticatingProtocol; uplink
+// clients must always authenticate using the password.
+func (p *Protocol) AuthenticatesClients() bool {
+	return true
+}
+
 // StartClient is invoked as a new goroutine when a new client connects.
 func (p *Protocol) StartClient(ctx context.Context, inner ipx.ReadWriteCloser, remoteAddr net.Addr) error {
 	c := &client{
@@ -147,21 +165,29 @@ func (p *Protocol) StartClient(ctx context.Context, inner ipx.ReadWriteCloser, r
 		inner:         inner,
 		authenticated: false,
 		challenge:     make([]byte, MinChallengeLength),
-		addr:          remoteAddr,
+		challengeTime: time.Now(),
+		addrName:      p.Pseudonyms.Register(remoteAddr.String()),
 	}
-	p.log("new uplink client from %s", remoteAddr)
-	if _, err := rand.Read(c.challenge); err != nil {
+	p.Logger.Infof("new uplink client from %s", c.addrName)
+	random := p.Rand
+	if random == nil {
+		random = rand.Reader
+	}
+	if _, err := io.ReadFull(random, c.challenge); err != nil {
 		return err
 	}
 	go c.sendKeepalives(ctx)
 
-	node := p.Network.NewNode()
+	node, err := p.Network.NewNode()
+	if err != nil {
+		return err
+	}
 	defer func() {
 		node.Close()
 		statsString := stats.Summary(node)
 		if statsString != "" {
-			p.log("uplink client %s: final statistics: %s",
-				remoteAddr.String(), statsString)
+			p.Logger.Infof("uplink client %s: final statistics: %s",
+				c.addrName, statsString)
 		}
 	}()
 	return ipx.DuplexCopyPackets(ctx, c, node)
@@ -174,8 +200,9 @@ type client struct {
 	inner         ipx.ReadWriteCloser
 	authenticated bool
 	challenge     []byte
+	challengeTime time.Time
 	mu            sync.Mutex
-	addr          net.Addr
+	addrName      string
 	lastSendTime  time.Time
 }
 
@@ -227,8 +254,13 @@ func (c *client) authenticate(msg *Message) error {
 		return fmt.Errorf("client challenge too short: want minimum %d bytes, got %d", MinChallengeLength, len(msg.Challenge))
 	}
 	solution := SolveChallenge("client", c.p.Password, c.challenge)
-	if !bytes.Equal(msg.Solution, solution) {
-		c.p.log("uplink client %s authentication rejected", c.addr)
+	timeout := c.p.ChallengeTimeout
+	stale := timeout > 0 && !c.isAuthenticated() && time.Since(c.challengeTime) > timeout
+	if stale {
+		c.p.Logger.Warnf("uplink client %s challenge expired", c.addrName)
+	}
+	if stale || !bytes.Equal(msg.Solution, solution) {
+		c.p.Logger.Warnf("uplink client %s authentication rejected", c.addrName)
 		c.Close()
 		return c.sendUplinkMessage(&Message{
 			Type: MessageTypeSubmitSolutionRejected,
@@ -236,7 +268,7 @@ func (c *client) authenticate(msg *Message) error {
 	}
 	c.mu.Lock()
 	if !c.authenticated {
-		c.p.log("uplink from %s authenticated successfully", c.addr)
+		c.p.Logger.Infof("uplink from %s authenticated successfully", c.addrName)
 		c.authenticated = true
 		// Don't send a keepalive immediately.
 		c.lastSendTime = time.Now()
@@ -262,7 +294,7 @@ func (c *client) handleUplinkPacket(packet *ipx.Packet) error {
 	case MessageTypeSubmitSolution:
 		return c.authenticate(&msg)
 	case MessageTypeClose:
-		c.p.log("uplink client %s closed connection", c.addr)
+		c.p.Logger.Infof("uplink client %s closed connection", c.addrName)
 		c.Close()
 	}
 	return nil
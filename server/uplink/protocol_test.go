@@ -0,0 +1,62 @@
+package uplink
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	ipxtesting "github.com/fragglet/ipxbox/testing"
+)
+
+func makeTestClient(p *Protocol, challenge []byte, challengeTime time.Time) *client {
+	inner, _ := ipxtesting.MakeLoopbackPair("server", "client")
+	return &client{
+		p:             p,
+		inner:         inner,
+		challenge:     challenge,
+		challengeTime: challengeTime,
+	}
+}
+
+func TestReplayRejected(t *testing.T) {
+	p := &Protocol{
+		Password:         "secret",
+		ChallengeTimeout: time.Minute,
+	}
+	challenge1 := bytes.Repeat([]byte{1}, MinChallengeLength)
+	challenge2 := bytes.Repeat([]byte{2}, MinChallengeLength)
+	msg := &Message{
+		Type:      MessageTypeSubmitSolution,
+		Challenge: bytes.Repeat([]byte{3}, MinChallengeLength),
+		Solution:  SolveChallenge("client", p.Password, challenge1),
+	}
+	payload, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	captured := &ipx.Packet{
+		Header:  ipx.Header{Dest: ipx.HeaderAddr{Addr: Address}},
+		Payload: payload,
+	}
+
+	c := makeTestClient(p, challenge1, time.Now())
+	c.handleUplinkPacket(captured)
+	if !c.isAuthenticated() {
+		t.Fatalf("valid solution was not accepted")
+	}
+
+	// Replayed on a different connection, with a different challenge.
+	c = makeTestClient(p, challenge2, time.Now())
+	c.handleUplinkPacket(captured)
+	if c.isAuthenticated() {
+		t.Errorf("solution replayed on another connection was accepted")
+	}
+
+	// Submitted after the challenge has expired.
+	c = makeTestClient(p, challenge1, time.Now().Add(-2*time.Minute))
+	c.handleUplinkPacket(captured)
+	if c.isAuthenticated() {
+		t.Errorf("solution to expired challenge was accepted")
+	}
+}
@@ -0,0 +1,153 @@
+// Package ws implements a WebSocket transport for an IPX server, so that
+// DOSBox running in a web browser (eg. js-dos), which cannot use UDP, can
+// connect. Each binary WebSocket message contains one IPX packet, header and
+// payload.
+package ws
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/pipe"
+	"github.com/fragglet/ipxbox/server"
+)
+
+var (
+	_ = (http.Handler)(&Server{})
+	_ = (ipx.ReadWriteCloser)(&conn{})
+)
+
+// Config contains optional configuration for a Server.
+type Config struct {
+	// Origins (eg. "https://games.example.com") of the web pages that
+	// may open connections, in addition to pages served from the same
+	// host as the server. The entry "*" allows any origin. Connections
+	// without an Origin header are always allowed, since they do not
+	// come from a web browser.
+	AllowedOrigins []string
+}
+
+// Server is an http.Handler that accepts WebSocket connections from clients.
+// Each connection is a separate client, and is added to a UDP server's
+// client table, as for server.NewConnHandler.
+type Server struct {
+	handler *server.ConnHandler
+	config  Config
+	ws      websocket.Server
+}
+
+// New creates a new Server, where clients are added to the given UDP server.
+// Only web pages served from the same host as the server can connect.
+func New(us *server.Server) *Server {
+	return NewWithConfig(us, &Config{})
+}
+
+// NewWithConfig creates a new Server, where clients are added to the given
+// UDP server.
+func NewWithConfig(us *server.Server, config *Config) *Server {
+	s := &Server{
+		handler: server.NewConnHandler(us),
+		config:  *config,
+	}
+	s.ws = websocket.Server{Handler: s.serve, Handshake: s.checkOrigin}
+	return s
+}
+
+// checkOrigin refuses connections from web pages whose origin is not
+// allowed. Otherwise, any web site could have its visitors' browsers join
+// the IPX network.
+func (s *Server) checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil || strings.EqualFold(origin.Host, r.Host) {
+		return nil
+	}
+	o := origin.Scheme + "://" + origin.Host
+	for _, allowed := range s.config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, o) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s not allowed", o)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.ws.ServeHTTP(w, r)
+}
+
+func (s *Server) serve(wsConn *websocket.Conn) {
+	addr, err := net.ResolveTCPAddr("tcp", wsConn.Request().RemoteAddr)
+	if err != nil {
+		wsConn.Close()
+		return
+	}
+	c := newConn(wsConn, s.handler.Budget())
+	s.handler.Serve(wsConn.Request().Context(), c, addr)
+}
+
+// Close disconnects all clients.
+func (s *Server) Close() error {
+	return s.handler.Close()
+}
+
+// conn sends and receives IPX packets over a WebSocket connection.
+type conn struct {
+	ws     *websocket.Conn
+	rxpipe ipx.ReadWriteCloser
+	mu     sync.Mutex
+}
+
+// newConn creates a new conn. Received packets are accounted against the
+// given budget until they are read; it may be nil.
+func newConn(ws *websocket.Conn, budget *pipe.Budget) *conn {
+	ws.MaxPayloadBytes = 0xffff
+	c := &conn{
+		ws:     ws,
+		rxpipe: pipe.NewWithBudget(budget),
+	}
+	go c.recvLoop()
+	return c
+}
+
+func (c *conn) recvLoop() {
+	defer c.rxpipe.Close()
+	for {
+		var buf []byte
+		if err := websocket.Message.Receive(c.ws, &buf); err != nil {
+			return
+		}
+		p := &ipx.Packet{}
+		if err := p.UnmarshalBinary(buf); err != nil {
+			continue
+		}
+		c.rxpipe.WritePacket(p)
+	}
+}
+
+func (c *conn) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
+	return c.rxpipe.ReadPacket(ctx)
+}
+
+func (c *conn) WritePacket(packet *ipx.Packet) error {
+	packetBytes, err := packet.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return websocket.Message.Send(c.ws, packetBytes)
+}
+
+func (c *conn) Close() error {
+	c.rxpipe.Close()
+	return c.ws.Close()
+}
@@ -0,0 +1,94 @@
+package ws
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+	"github.com/fragglet/ipxbox/server"
+	"github.com/fragglet/ipxbox/server/dosbox"
+)
+
+func TestWebSocketClient(t *testing.T) {
+	us, err := server.New("127.0.0.1:0", &server.Config{
+		Protocols: []server.Protocol{
+			&dosbox.Protocol{Network: addressable.Wrap(ipxswitch.New())},
+		},
+		ClientTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer us.Close()
+	s := New(us)
+	defer s.Close()
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	url := "ws" + strings.TrimPrefix(hs.URL, "http")
+	wsConn, err := websocket.Dial(url, "", hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConn(wsConn, nil)
+	defer c.Close()
+
+	c.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Dest: ipx.HeaderAddr{Addr: ipx.AddrNull, Socket: 2},
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := c.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("no registration reply: %v", err)
+	}
+	if reply.Header.Dest.Socket != 2 || reply.Header.Dest.Addr == ipx.AddrNull {
+		t.Errorf("wrong registration reply: %+v", reply.Header)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	us, err := server.New("127.0.0.1:0", &server.Config{
+		Protocols: []server.Protocol{
+			&dosbox.Protocol{Network: addressable.Wrap(ipxswitch.New())},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer us.Close()
+	s := NewWithConfig(us, &Config{
+		AllowedOrigins: []string{"https://games.example.com"},
+	})
+	defer s.Close()
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	url := "ws" + strings.TrimPrefix(hs.URL, "http")
+	for _, tc := range []struct {
+		origin string
+		ok     bool
+	}{
+		{hs.URL, true},
+		{"https://games.example.com", true},
+		{"https://evil.example.com", false},
+		{"http://games.example.com", false},
+	} {
+		wsConn, err := websocket.Dial(url, "", tc.origin)
+		if err == nil {
+			wsConn.Close()
+		}
+		if got := err == nil; got != tc.ok {
+			t.Errorf("connection from origin %s: want success=%v, got error %v", tc.origin, tc.ok, err)
+		}
+	}
+}
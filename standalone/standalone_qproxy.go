@@ -15,7 +15,7 @@ import (
 
 var (
 	dosboxServer = flag.String("dosbox_server", "", "Address of DOSbox IPX server.")
-	quakeServer  = flag.String("quake_server", "", "Address of Quake server.")
+	quakeServer  = flag.String("quake_server", "", "Address of Quake server, optionally prefixed with quake2:// or quakeworld://.")
 )
 
 func main() {
@@ -27,8 +27,13 @@ func main() {
 		log.Fatalf("failed to connect to server: %v", err)
 	}
 
+	game, addr, err := qproxy.ParseServer(*quakeServer)
+	if err != nil {
+		log.Fatal(err)
+	}
 	config := &qproxy.Config{
-		Address:     *quakeServer,
+		Address:     addr,
+		Game:        game,
 		IdleTimeout: 60 * time.Second,
 	}
 
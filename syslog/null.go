@@ -9,3 +9,7 @@ import (
 func NewLogger(p Priority, logFlag int) (*log.Logger, error) {
 	return nil, ErrNotImplemented
 }
+
+func NewLoggerWithFormat(f Format, p Priority, logFlag int) (*log.Logger, error) {
+	return nil, ErrNotImplemented
+}
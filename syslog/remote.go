@@ -0,0 +1,223 @@
+package syslog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fragglet/ipxbox/logging"
+)
+
+// sdID is the SD-ID used for structured data elements. 32473 is the
+// enterprise number reserved for documentation by RFC 5612.
+const sdID = "ipxbox@32473"
+
+// queueSize is the number of messages that can be waiting to be sent to
+// the syslog server before further messages are dropped.
+const queueSize = 1024
+
+var (
+	_ = (io.Writer)(&remoteWriter{})
+	_ = (logging.StructuredWriter)(&remoteWriter{})
+	_ = (logging.LeveledWriter)(&remoteWriter{})
+
+	// errQueueFull is returned when a message is dropped because too
+	// many messages are already waiting to be sent.
+	errQueueFull = errors.New("syslog queue full; message dropped")
+)
+
+// severities maps logging levels to syslog severities.
+var severities = map[logging.Level]Priority{
+	logging.LevelError: LOG_ERR,
+	logging.LevelWarn:  LOG_WARNING,
+	logging.LevelInfo:  LOG_INFO,
+	logging.LevelDebug: LOG_DEBUG,
+}
+
+// Format is the format of messages sent to a syslog server.
+type Format int
+
+const (
+	// RFC3164 is the traditional BSD syslog format.
+	RFC3164 Format = iota
+	// RFC5424 is the newer syslog format, which supports structured data.
+	RFC5424
+)
+
+func (f Format) String() string {
+	if f == RFC5424 {
+		return "rfc5424"
+	}
+	return "rfc3164"
+}
+
+// ParseFormat returns the Format with the given name, either "rfc3164" or
+// "rfc5424".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "rfc3164":
+		return RFC3164, nil
+	case "rfc5424":
+		return RFC5424, nil
+	}
+	return RFC3164, fmt.Errorf("unknown syslog format %q", name)
+}
+
+// remoteWriter sends each call to Write as a message to a syslog server, in
+// either RFC 3164 or RFC 5424 format. Over TCP, messages are framed using
+// octet counting (RFC 6587). Messages are queued and sent by a background
+// goroutine (see run), so that logging never blocks on the network; if the
+// queue is full, messages are dropped.
+type remoteWriter struct {
+	network, addr string
+	fmt           Format
+	priority      Priority
+	hostname, tag string
+	queue         chan []byte
+
+	// conn is only used by the goroutine running run, after the
+	// initial connection is made.
+	conn net.Conn
+}
+
+func (w *remoteWriter) connect() error {
+	conn, err := net.DialTimeout(w.network, w.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// structuredData formats fields as an RFC 5424 STRUCTURED-DATA element.
+func structuredData(fields logging.Fields) string {
+	if len(fields) == 0 {
+		return "-"
+	}
+	keys := []string{}
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("[" + sdID)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=\"%s\"", k, sdEscaper.Replace(fields[k]))
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+func (w *remoteWriter) format(p Priority, fields logging.Fields, msg string, now time.Time) []byte {
+	msg = strings.TrimSuffix(msg, "\n")
+	var result string
+	if w.fmt == RFC5424 {
+		result = fmt.Sprintf("<%d>1 %s %s %s %d - %s %s", p,
+			now.Format(time.RFC3339Nano), w.hostname, w.tag, os.Getpid(),
+			structuredData(fields), msg)
+	} else {
+		result = fmt.Sprintf("<%d>%s %s %s[%d]: %s", p,
+			now.Format(time.Stamp), w.hostname, w.tag, os.Getpid(), msg)
+	}
+	if strings.HasPrefix(w.network, "tcp") {
+		result = fmt.Sprintf("%d %s", len(result), result)
+	}
+	return []byte(result)
+}
+
+// Write queues a message to be sent with the configured priority.
+func (w *remoteWriter) Write(p []byte) (int, error) {
+	return w.send(w.priority, nil, p)
+}
+
+// WriteStructured queues a message to be sent along with fields, which are
+// included as structured data if the format is RFC 5424 and are otherwise
+// discarded.
+func (w *remoteWriter) WriteStructured(fields logging.Fields, p []byte) (int, error) {
+	return w.send(w.priority, fields, p)
+}
+
+// WriteLeveled is like WriteStructured, but the severity of the message is
+// set from the given level instead of the configured priority. The
+// configured facility is still used.
+func (w *remoteWriter) WriteLeveled(level logging.Level, fields logging.Fields, p []byte) (int, error) {
+	priority := w.priority
+	if severity, ok := severities[level]; ok {
+		priority = priority&^severityMask | severity
+	}
+	return w.send(priority, fields, p)
+}
+
+func (w *remoteWriter) send(priority Priority, fields logging.Fields, p []byte) (int, error) {
+	select {
+	case w.queue <- w.format(priority, fields, string(p), time.Now()):
+		return len(p), nil
+	default:
+		return 0, errQueueFull
+	}
+}
+
+// run sends queued messages to the server. If the connection to the server
+// has been lost, a new one is made; messages that cannot be sent are
+// dropped.
+func (w *remoteWriter) run() {
+	for msg := range w.queue {
+		for attempt := 0; attempt < 2; attempt++ {
+			if w.conn == nil {
+				if err := w.connect(); err != nil {
+					break
+				}
+			}
+			if _, err := w.conn.Write(msg); err != nil {
+				w.conn.Close()
+				w.conn = nil
+				continue
+			}
+			break
+		}
+	}
+}
+
+// NewRemoteLogger creates a log.Logger whose output is sent to the syslog
+// server at the given address, with the specified priority, in RFC 5424
+// format. The network is "udp" or "tcp" (or a variant such as "tcp4"), and
+// the logFlag argument is passed through to log.New. If a TCP connection is
+// lost, a new one is made when the next message is sent. Messages are sent
+// in the background and are dropped if the server cannot keep up. Unlike
+// NewLogger, this is available on all platforms.
+func NewRemoteLogger(network, addr string, p Priority, logFlag int) (*log.Logger, error) {
+	return NewRemoteLoggerWithFormat(network, addr, RFC5424, p, logFlag)
+}
+
+// NewRemoteLoggerWithFormat is like NewRemoteLogger but sends messages in
+// the given format. The writer of the returned logger implements
+// logging.StructuredWriter.
+func NewRemoteLoggerWithFormat(network, addr string, f Format, p Priority, logFlag int) (*log.Logger, error) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	w := &remoteWriter{
+		network:  network,
+		addr:     addr,
+		fmt:      f,
+		priority: p,
+		hostname: hostname,
+		tag:      filepath.Base(os.Args[0]),
+		queue:    make(chan []byte, queueSize),
+	}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return log.New(w, "", logFlag), nil
+}
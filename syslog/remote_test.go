@@ -0,0 +1,182 @@
+package syslog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/logging"
+)
+
+var messageRE = regexp.MustCompile(`^<29>1 \S+ \S+ \S+ \d+ - - hello world$`)
+
+func TestRemoteLoggerUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	logger, err := NewRemoteLogger("udp", conn.LocalAddr().String(), LOG_NOTICE|LOG_DAEMON, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Printf("hello %s", "world")
+
+	var buf [1500]byte
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); !messageRE.MatchString(msg) {
+		t.Errorf("wrong message format: %q", msg)
+	}
+}
+
+// readFramed reads one octet-counted message from a TCP connection.
+func readFramed(r *bufio.Reader) (string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+func TestRemoteLoggerTCPReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	logger, err := NewRemoteLogger("tcp", listener.Addr().String(), LOG_NOTICE|LOG_DAEMON, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	logger.Print("hello world")
+	msg, err := readFramed(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !messageRE.MatchString(msg) {
+		t.Errorf("wrong message format: %q", msg)
+	}
+
+	// The collector drops the connection. The first write after this
+	// may appear to succeed, since the reset has not arrived yet, but
+	// later messages are sent over a new connection.
+	conn.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	timeout := time.After(5 * time.Second)
+	for {
+		logger.Print("hello world")
+		select {
+		case conn := <-accepted:
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			msg, err := readFramed(bufio.NewReader(conn))
+			if err != nil {
+				t.Fatalf("after reconnect: %v", err)
+			}
+			if !messageRE.MatchString(msg) {
+				t.Errorf("after reconnect: wrong message format: %q", msg)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("logger did not reconnect")
+		}
+	}
+}
+
+func TestFormats(t *testing.T) {
+	now := time.Date(2024, 3, 5, 6, 7, 8, 0, time.UTC)
+	fields := logging.Fields{
+		"udp_address": "192.0.2.1:213",
+		"ipx_address": "02:00:00:00:00:01",
+		"note":        `a "quoted" \ value]`,
+	}
+	tests := []struct {
+		format Format
+		fields logging.Fields
+		want   *regexp.Regexp
+	}{
+		{RFC5424, nil, regexp.MustCompile(`^<29>1 2024-03-05T06:07:08Z host tag \d+ - - hello$`)},
+		{RFC5424, fields, regexp.MustCompile(`^<29>1 \S+ host tag \d+ - ` +
+			regexp.QuoteMeta(`[ipxbox@32473 ipx_address="02:00:00:00:00:01" note="a \"quoted\" \\ value\]" udp_address="192.0.2.1:213"] hello`) + `$`)},
+		{RFC3164, fields, regexp.MustCompile(`^<29>Mar  5 06:07:08 host tag\[\d+\]: hello$`)},
+	}
+	for _, tt := range tests {
+		w := &remoteWriter{
+			network:  "udp",
+			fmt:      tt.format,
+			priority: LOG_NOTICE | LOG_DAEMON,
+			hostname: "host",
+			tag:      "tag",
+		}
+		if got := string(w.format(w.priority, tt.fields, "hello\n", now)); !tt.want.MatchString(got) {
+			t.Errorf("%v format: got %q, want match for %v", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestLeveledPriority(t *testing.T) {
+	w := &remoteWriter{
+		network:  "udp",
+		fmt:      RFC5424,
+		priority: LOG_NOTICE | LOG_DAEMON,
+		queue:    make(chan []byte, 5),
+	}
+	w.Write([]byte("plain"))
+	for _, level := range []logging.Level{logging.LevelError, logging.LevelWarn, logging.LevelInfo, logging.LevelDebug} {
+		w.WriteLeveled(level, nil, []byte(level.String()))
+	}
+	for _, want := range []string{"<29>", "<27>", "<28>", "<30>", "<31>"} {
+		if got := string(<-w.queue); !strings.HasPrefix(got, want) {
+			t.Errorf("wrong priority: want %s, got %q", want, got)
+		}
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	// Nothing reads from the queue, as if the server were unreachable;
+	// messages are dropped rather than blocking the caller.
+	w := &remoteWriter{
+		network: "udp",
+		queue:   make(chan []byte, 1),
+	}
+	if _, err := w.Write([]byte("queued")); err != nil {
+		t.Errorf("first write failed: %v", err)
+	}
+	if _, err := w.Write([]byte("dropped")); err != errQueueFull {
+		t.Errorf("write to full queue: want %v, got %v", errQueueFull, err)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, f := range []Format{RFC3164, RFC5424} {
+		if got, err := ParseFormat(f.String()); err != nil || got != f {
+			t.Errorf("ParseFormat(%q) = %v, %v", f.String(), got, err)
+		}
+	}
+	if _, err := ParseFormat("json"); err == nil {
+		t.Errorf("ParseFormat of unknown format succeeded")
+	}
+}
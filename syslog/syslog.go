@@ -1,5 +1,6 @@
 // Package syslog provides a minimal portability wrapper around the Go
-// log/syslog package.
+// log/syslog package, along with a portable client for remote syslog
+// servers.
 package syslog
 
 import (
@@ -27,6 +28,9 @@ const (
 	LOG_DEBUG
 )
 
+// severityMask selects the severity part of a Priority.
+const severityMask Priority = 0x07
+
 const (
 	// Facility.
 
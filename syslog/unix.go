@@ -5,14 +5,65 @@ package syslog
 import (
 	"log"
 	"log/syslog"
+
+	"github.com/fragglet/ipxbox/logging"
 )
 
+var _ = (logging.LeveledWriter)(&localWriter{})
+
+// localWriter writes to the system log service, setting the severity of
+// each message from its logging level.
+type localWriter struct {
+	*syslog.Writer
+}
+
+func (w *localWriter) WriteLeveled(level logging.Level, fields logging.Fields, p []byte) (int, error) {
+	var err error
+	switch level {
+	case logging.LevelError:
+		err = w.Err(string(p))
+	case logging.LevelWarn:
+		err = w.Warning(string(p))
+	case logging.LevelInfo:
+		err = w.Info(string(p))
+	case logging.LevelDebug:
+		err = w.Debug(string(p))
+	default:
+		return w.Write(p)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 // NewLogger creates a log.Logger whose output is written to the
 // system log service with the specified priority, a combination of
 // the syslog facility and severity. The logFlag argument is the flag
-// set passed through to log.New to create the Logger.
+// set passed through to log.New to create the Logger. Messages logged
+// through a logging.Logger have their severity set from their level.
 // If syslog is not available on this platform then ErrNotImplemented
 // is returned.
 func NewLogger(p Priority, logFlag int) (*log.Logger, error) {
-	return syslog.NewLogger(syslog.Priority(p), logFlag)
+	w, err := syslog.New(syslog.Priority(p), "")
+	if err != nil {
+		return nil, err
+	}
+	return log.New(&localWriter{w}, "", logFlag), nil
+}
+
+// NewLoggerWithFormat is like NewLogger but writes messages to the local
+// syslog socket in the given format, which must be supported by the system
+// log service. The writer of the returned logger implements
+// logging.StructuredWriter.
+func NewLoggerWithFormat(f Format, p Priority, logFlag int) (*log.Logger, error) {
+	var err error
+	for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+		var l *log.Logger
+		l, err = NewRemoteLoggerWithFormat("unixgram", path, f, p, logFlag)
+		if err == nil {
+			return l, nil
+		}
+	}
+	return nil, err
 }
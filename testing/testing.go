@@ -3,6 +3,7 @@ package testing
 import (
 	"context"
 	"log"
+	gotesting "testing"
 
 	"github.com/fragglet/ipxbox/ipx"
 	"github.com/fragglet/ipxbox/network"
@@ -172,8 +173,19 @@ type FakeNetwork struct {
 	Address ipx.Addr
 }
 
-func (n *FakeNetwork) NewNode() network.Node {
-	return n
+func (n *FakeNetwork) NewNode() (network.Node, error) {
+	return n, nil
+}
+
+// MustNewNode creates a new node on the given network, failing the test if
+// the node cannot be created.
+func MustNewNode(t gotesting.TB, n network.Network) network.Node {
+	t.Helper()
+	node, err := n.NewNode()
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	return node
 }
 
 func (n *FakeNetwork) ReadPacket(ctx context.Context) (*ipx.Packet, error) {
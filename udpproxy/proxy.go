@@ -0,0 +1,316 @@
+// Package udpproxy implements a proxy that makes a UDP server available on
+// an IPX network, for games that support both. Packets sent by IPX clients
+// to a particular socket are relayed to the server, and the server's replies
+// are relayed back. Each client gets its own UDP socket, so the server sees
+// each client as a separate peer.
+package udpproxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+)
+
+const (
+	garbageCollectPeriod = 10 * time.Second
+	defaultIdleTimeout   = 60 * time.Second
+)
+
+type Config struct {
+	// Address of the UDP server.
+	Address string
+
+	// Socket is the IPX socket number that the server is made available
+	// on. Packets sent by clients to this socket are forwarded to the
+	// server, and packets from the server are sent from this socket.
+	Socket uint16
+
+	// IdleTimeout is the amount of time after which a connection is deleted
+	// if no packets have been sent or received on it. Each connection
+	// has its own UDP socket, which is opened when the first packet is
+	// received from an IPX client and closed when the connection is
+	// deleted. If zero, a default of one minute is used.
+	IdleTimeout time.Duration
+
+	// ConnectedSockets lists additional IPX sockets on which packets are
+	// accepted from clients that already have a connection. Packets sent
+	// to these sockets never open a new connection.
+	ConnectedSockets []uint16
+
+	// NewHandler is called to create the Handler for each new connection.
+	// If nil, payloads are relayed unchanged between Socket and the
+	// server.
+	NewHandler func(c *Conn) Handler
+}
+
+// Handler implements a game-specific protocol on top of the proxy. Its
+// methods are called with the proxy's lock held. If a method returns an
+// error, the connection is closed.
+type Handler interface {
+	// ClientPacket is called for each packet received from the IPX client.
+	ClientPacket(packet *ipx.Packet) error
+
+	// ServerPacket is called for each packet received from the server's
+	// IP address, on any port.
+	ServerPacket(payload []byte, addr *net.UDPAddr) error
+}
+
+// relay is the default Handler, which relays payloads unchanged.
+type relay struct {
+	c *Conn
+}
+
+func (r relay) ClientPacket(packet *ipx.Packet) error {
+	return r.c.WriteToServer(packet.Payload, r.c.ServerAddr())
+}
+
+func (r relay) ServerPacket(payload []byte, addr *net.UDPAddr) error {
+	if addr.Port != r.c.ServerAddr().Port {
+		return nil
+	}
+	return r.c.WriteToClient(payload, r.c.p.config.Socket)
+}
+
+// Conn is a connection between an IPX client and the server, with its own
+// UDP socket.
+type Conn struct {
+	p          *Proxy
+	handler    Handler
+	ipxAddr    ipx.HeaderAddr
+	conn       *net.UDPConn
+	lastRXTime time.Time
+	closed     bool
+}
+
+// ServerAddr returns the resolved address of the server.
+func (c *Conn) ServerAddr() *net.UDPAddr {
+	return &c.p.address
+}
+
+// LocalAddr returns the IPX address of the proxy's node.
+func (c *Conn) LocalAddr() ipx.Addr {
+	return network.NodeAddress(c.p.node)
+}
+
+// WriteToServer sends a UDP packet from the connection's socket to the given
+// address, which is normally on the server.
+func (c *Conn) WriteToServer(payload []byte, addr *net.UDPAddr) error {
+	_, err := c.conn.WriteToUDP(payload, addr)
+	return err
+}
+
+// WriteToClient sends an IPX packet to the client from the given socket.
+func (c *Conn) WriteToClient(payload []byte, socket uint16) error {
+	return c.p.node.WritePacket(&ipx.Packet{
+		Header: ipx.Header{
+			Length: uint16(ipx.HeaderLength + len(payload)),
+			Dest:   c.ipxAddr,
+			Src: ipx.HeaderAddr{
+				Addr:   network.NodeAddress(c.p.node),
+				Socket: socket,
+			},
+		},
+		Payload: append([]byte{}, payload...),
+	})
+}
+
+func (c *Conn) receivePackets() {
+	var buf [9000]byte
+	for {
+		n, addr, err := c.conn.ReadFromUDP(buf[:])
+		c.p.mu.Lock()
+		switch {
+		case c.closed:
+			c.p.mu.Unlock()
+			return
+		case err != nil:
+			c.p.mu.Unlock()
+			log.Printf("error receiving UDP packets for connection to %v: %v", &c.p.address, err)
+			return
+		}
+		// Sanity check: packet must come from the server's IP address.
+		if addr.IP.Equal(c.p.address.IP) {
+			c.lastRXTime = time.Now()
+			if err := c.handler.ServerPacket(buf[:n], addr); err != nil {
+				log.Printf("failed to forward UDP packet to IPX client: %v", err)
+				c.p.closeConnection(&c.ipxAddr)
+			}
+		}
+		c.p.mu.Unlock()
+	}
+}
+
+type Proxy struct {
+	config  Config
+	node    network.Node
+	conns   map[ipx.HeaderAddr]*Conn
+	mu      sync.Mutex
+	address net.UDPAddr
+}
+
+func (p *Proxy) newConnection(ipxAddr *ipx.HeaderAddr) (*Conn, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		p:          p,
+		ipxAddr:    *ipxAddr,
+		conn:       conn,
+		lastRXTime: time.Now(),
+	}
+	if p.config.NewHandler != nil {
+		c.handler = p.config.NewHandler(c)
+	} else {
+		c.handler = relay{c}
+	}
+	p.conns[*ipxAddr] = c
+	go c.receivePackets()
+	return c, nil
+}
+
+func (p *Proxy) closeConnection(addr *ipx.HeaderAddr) {
+	c, ok := p.conns[*addr]
+	if !ok {
+		return
+	}
+	c.closed = true
+	delete(p.conns, *addr)
+	c.conn.Close()
+}
+
+func (p *Proxy) resolveAddress() bool {
+	a, err := net.ResolveUDPAddr("udp", p.config.Address)
+	if err != nil {
+		log.Printf("failed to resolve server address: %v", err)
+		return false
+	}
+	p.address = *a
+	return true
+}
+
+func (p *Proxy) processPacket(packet *ipx.Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.conns[packet.Header.Src]
+	if !ok && packet.Header.Dest.Socket != p.config.Socket {
+		return
+	}
+	// First connection triggers the server address to be resolved. After
+	// all connections time out, we resolve again once a new connection is
+	// opened. This handles dynamic DNS addresses where the IP changes.
+	// But we don't block on DNS resolution while a game is in progress.
+	if len(p.conns) == 0 && !p.resolveAddress() {
+		return
+	}
+	if !ok {
+		var err error
+		c, err = p.newConnection(&packet.Header.Src)
+		if err != nil {
+			log.Printf("failed to create new connection to %v: %v", &p.address, err)
+			return
+		}
+	}
+	c.lastRXTime = time.Now()
+	if err := c.handler.ClientPacket(packet); err != nil {
+		log.Printf("failed to forward IPX packet to UDP server: %v", err)
+		p.closeConnection(&packet.Header.Src)
+	}
+}
+
+func (p *Proxy) idleTimeout() time.Duration {
+	if p.config.IdleTimeout > 0 {
+		return p.config.IdleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+// garbageCollect periodically deletes idle connections until the context is
+// cancelled. It checks at least twice per idle timeout period so that idle
+// sockets are not kept open for much longer than the timeout.
+func (p *Proxy) garbageCollect(ctx context.Context) {
+	period := garbageCollectPeriod
+	if p.idleTimeout()/2 < period {
+		period = p.idleTimeout() / 2
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		now := time.Now()
+		for addr, c := range p.conns {
+			if now.Sub(c.lastRXTime) > p.idleTimeout() {
+				p.closeConnection(&addr)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// closeAll deletes all connections.
+func (p *Proxy) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr := range p.conns {
+		p.closeConnection(&addr)
+	}
+}
+
+// acceptsSocket returns true if packets sent to the given IPX socket are
+// processed by the proxy.
+func (p *Proxy) acceptsSocket(socket uint16) bool {
+	if socket == p.config.Socket {
+		return true
+	}
+	for _, s := range p.config.ConnectedSockets {
+		if socket == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Run processes packets received from IPX clients until the context is
+// cancelled or the node is closed. When it returns, all connections to the
+// server are closed.
+func (p *Proxy) Run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer p.closeAll()
+	go p.garbageCollect(ctx)
+	for {
+		packet, err := p.node.ReadPacket(ctx)
+		switch {
+		case err == io.ErrClosedPipe || ctx.Err() != nil:
+			return
+		case err != nil:
+			log.Printf("unexpected error reading from node: %v", err)
+			return
+		}
+		if p.acceptsSocket(packet.Header.Dest.Socket) {
+			p.processPacket(packet)
+		}
+	}
+}
+
+// New creates a new proxy that makes the UDP server in the given Config
+// available to IPX clients. Run must be called to process packets from the
+// given node.
+func New(config *Config, node network.Node) *Proxy {
+	return &Proxy{
+		config: *config,
+		node:   node,
+		conns:  make(map[ipx.HeaderAddr]*Conn),
+	}
+}
@@ -0,0 +1,231 @@
+package udpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fragglet/ipxbox/ipx"
+	"github.com/fragglet/ipxbox/network"
+	"github.com/fragglet/ipxbox/network/addressable"
+	"github.com/fragglet/ipxbox/network/ipxswitch"
+)
+
+func TestProxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n := addressable.Wrap(ipxswitch.New())
+	proxyNode, err := n.NewNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyNode.Close()
+	go New(&Config{
+		Address: server.LocalAddr().String(),
+		Socket:  0x869c,
+	}, proxyNode).Run(ctx)
+
+	var clients []network.Node
+	var peers []*net.UDPAddr
+	for i, payload := range []string{"hello", "world"} {
+		client, err := n.NewNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+		client.WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: network.NodeAddress(proxyNode), Socket: 0x869c},
+				Src:  ipx.HeaderAddr{Addr: network.NodeAddress(client), Socket: 0x869c},
+			},
+			Payload: []byte(payload),
+		})
+		var buf [1500]byte
+		nbytes, addr, err := server.ReadFromUDP(buf[:])
+		if err != nil {
+			t.Fatalf("packet %d not forwarded to server: %v", i, err)
+		}
+		if got := string(buf[:nbytes]); got != payload {
+			t.Errorf("packet %d: want %q, got %q", i, payload, got)
+		}
+		peers = append(peers, addr)
+	}
+	if peers[0].String() == peers[1].String() {
+		t.Errorf("both clients forwarded from the same socket %v", peers[0])
+	}
+
+	// Replies go back to the right client, from the proxy's socket.
+	for i, client := range clients {
+		if _, err := server.WriteToUDP([]byte{byte(i)}, peers[i]); err != nil {
+			t.Fatal(err)
+		}
+		packet, err := client.ReadPacket(ctx)
+		if err != nil {
+			t.Fatalf("reply %d not received: %v", i, err)
+		}
+		wantSrc := ipx.HeaderAddr{Addr: network.NodeAddress(proxyNode), Socket: 0x869c}
+		if packet.Header.Src != wantSrc || len(packet.Payload) != 1 || packet.Payload[0] != byte(i) {
+			t.Errorf("wrong reply %d: %+v", i, packet)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n := addressable.Wrap(ipxswitch.New())
+	proxyNode, err := n.NewNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(&Config{
+		Address:     server.LocalAddr().String(),
+		Socket:      0x869c,
+		IdleTimeout: 100 * time.Millisecond,
+	}, proxyNode)
+	runDone := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(runDone)
+	}()
+	client, err := n.NewNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	numConns := func() int {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.conns)
+	}
+	waitForConns := func(want int) {
+		t.Helper()
+		for numConns() != want {
+			if ctx.Err() != nil {
+				t.Fatalf("want %d connections, got %d", want, numConns())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// send sends a packet from the client and checks it is forwarded to
+	// the server.
+	send := func() {
+		t.Helper()
+		client.WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: network.NodeAddress(proxyNode), Socket: 0x869c},
+				Src:  ipx.HeaderAddr{Addr: network.NodeAddress(client), Socket: 0x869c},
+			},
+			Payload: []byte("hello"),
+		})
+		var buf [1500]byte
+		if _, _, err := server.ReadFromUDP(buf[:]); err != nil {
+			t.Fatalf("packet not forwarded to server: %v", err)
+		}
+	}
+
+	// No socket is opened until a client sends something.
+	if got := numConns(); got != 0 {
+		t.Errorf("want no connections before any packets, got %d", got)
+	}
+	send()
+	p.mu.Lock()
+	var conn *net.UDPConn
+	for _, c := range p.conns {
+		conn = c.conn
+	}
+	p.mu.Unlock()
+	if conn == nil {
+		t.Fatalf("no connection after first packet")
+	}
+	waitForConns(0)
+	if _, err := conn.WriteToUDP(nil, server.LocalAddr().(*net.UDPAddr)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("socket not closed after idle timeout: write returned %v", err)
+	}
+
+	// A new socket is opened on demand.
+	send()
+	waitForConns(1)
+
+	// Closing the node closes all sockets.
+	proxyNode.Close()
+	select {
+	case <-runDone:
+	case <-ctx.Done():
+		t.Fatalf("Run did not return after node was closed")
+	}
+	if got := numConns(); got != 0 {
+		t.Errorf("want no connections after Run returned, got %d", got)
+	}
+}
+
+func TestConnectedSockets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n := addressable.Wrap(ipxswitch.New())
+	proxyNode, err := n.NewNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyNode.Close()
+	go New(&Config{
+		Address:          server.LocalAddr().String(),
+		Socket:           0x869c,
+		ConnectedSockets: []uint16{0x869d},
+	}, proxyNode).Run(ctx)
+	client, err := n.NewNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	send := func(socket uint16, payload string) {
+		client.WritePacket(&ipx.Packet{
+			Header: ipx.Header{
+				Dest: ipx.HeaderAddr{Addr: network.NodeAddress(proxyNode), Socket: socket},
+				Src:  ipx.HeaderAddr{Addr: network.NodeAddress(client), Socket: 0x869c},
+			},
+			Payload: []byte(payload),
+		})
+	}
+
+	// A packet to a connected socket does not open a connection, so only
+	// the second and third packets reach the server.
+	send(0x869d, "dropped")
+	send(0x869c, "hello")
+	send(0x869d, "world")
+	for _, want := range []string{"hello", "world"} {
+		var buf [1500]byte
+		nbytes, _, err := server.ReadFromUDP(buf[:])
+		if err != nil {
+			t.Fatalf("packet %q not forwarded to server: %v", want, err)
+		}
+		if got := string(buf[:nbytes]); got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Package webhook implements notifications to an external service (eg. a
+// matchmaking or server listing site) when clients join or leave the server.
+// Events are delivered as JSON in HTTP POST requests.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/fragglet/ipxbox/logging"
+)
+
+const (
+	// EventClientJoin is sent when a client connects to the server.
+	EventClientJoin = "client-join"
+
+	// EventClientLeave is sent when a client disconnects.
+	EventClientLeave = "client-leave"
+
+	// queueSize is the number of events that can be waiting to be
+	// delivered before new events start being dropped.
+	queueSize = 64
+)
+
+// Event is the JSON payload sent to the webhook URL.
+type Event struct {
+	Type       string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client,omitempty"`
+	IPXAddress string    `json:"ipx_address,omitempty"`
+}
+
+// Config contains configuration parameters for a Notifier.
+type Config struct {
+	// URL to POST events to.
+	URL string
+
+	// Timeout for each HTTP request.
+	Timeout time.Duration
+
+	// Number of times to retry delivery of an event before giving up.
+	Retries int
+
+	// Delay before the first retry; the delay doubles for each
+	// subsequent retry.
+	Backoff time.Duration
+
+	// If not nil, delivery failures are logged.
+	Logger *logging.Logger
+}
+
+// Notifier delivers events to a webhook. Events are queued and delivered in
+// the background so that a slow or unresponsive webhook never blocks the
+// server. A nil *Notifier is valid and discards all events.
+type Notifier struct {
+	config Config
+	client *http.Client
+	queue  chan *Event
+}
+
+// New creates a new Notifier; Run must be called to deliver events.
+func New(config *Config) *Notifier {
+	return &Notifier{
+		config: *config,
+		client: &http.Client{Timeout: config.Timeout},
+		queue:  make(chan *Event, queueSize),
+	}
+}
+
+// Notify queues an event of the given type for delivery. It never blocks; if
+// the queue is full, the event is dropped.
+func (n *Notifier) Notify(eventType, client, ipxAddress string) {
+	if n == nil {
+		return
+	}
+	ev := &Event{
+		Type:       eventType,
+		Time:       time.Now(),
+		Client:     client,
+		IPXAddress: ipxAddress,
+	}
+	select {
+	case n.queue <- ev:
+	default:
+		n.config.Logger.Warnf("webhook queue full; dropped %s event", eventType)
+	}
+}
+
+func (n *Notifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", n.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) deliver(ctx context.Context, ev *Event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	backoff := n.config.Backoff
+	for i := 0; ; i++ {
+		err = n.post(ctx, body)
+		if err == nil {
+			return
+		}
+		if i >= n.config.Retries {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	n.config.Logger.Warnf("failed to deliver %s event to webhook: %v", ev.Type, err)
+}
+
+// Run delivers queued events until the context is cancelled.
+func (n *Notifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-n.queue:
+			n.deliver(ctx, ev)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	events := make(chan *Event, 1)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// First attempt fails, to exercise the retry logic.
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var ev Event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("failed to decode payload: %v", err)
+		}
+		events <- &ev
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := New(&Config{
+		URL:     srv.URL,
+		Timeout: time.Second,
+		Retries: 2,
+		Backoff: time.Millisecond,
+	})
+	go n.Run(ctx)
+	n.Notify(EventClientJoin, "192.0.2.1:10000", "02:00:00:00:00:01")
+
+	select {
+	case ev := <-events:
+		if ev.Type != EventClientJoin || ev.Client != "192.0.2.1:10000" || ev.IPXAddress != "02:00:00:00:00:01" {
+			t.Errorf("wrong event payload: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("event not delivered")
+	}
+
+	// A nil Notifier discards events.
+	var nilNotifier *Notifier
+	nilNotifier.Notify(EventClientLeave, "", "")
+}